@@ -3,8 +3,11 @@ package main
 import (
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/initwirepod"
 	stt "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/stt/houndify"
+
+	// remote engines can be switched to from the web interface in any build
+	_ "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/stt/whisper"
 )
 
 func main() {
-	initwirepod.StartFromProgramInit(stt.Init, stt.STT, stt.Name)
+	initwirepod.StartFromProgramInit(stt.Name)
 }
@@ -0,0 +1,85 @@
+package audio
+
+import (
+	"math"
+	"testing"
+)
+
+func sine(freq float64, rate int, seconds float64, amplitude float64) []int16 {
+	samples := make([]int16, int(float64(rate)*seconds))
+	for i := range samples {
+		samples[i] = Clip(amplitude * 32767 * math.Sin(2*math.Pi*freq*float64(i)/float64(rate)))
+	}
+	return samples
+}
+
+// level is the RMS of the middle of the samples relative to full scale in dB, away from the edges
+// where filters settle
+func level(samples []int16) float64 {
+	middle := samples[len(samples)/4 : len(samples)*3/4]
+	return 20 * math.Log10(RMS(middle)/32767)
+}
+
+func near(t *testing.T, what string, got, want, tolerance float64) {
+	t.Helper()
+	if math.Abs(got-want) > tolerance {
+		t.Errorf("%s = %.3f, want %.3f ± %.3f", what, got, want, tolerance)
+	}
+}
+
+func TestBytes(t *testing.T) {
+	samples := []int16{0, 1, -1, math.MaxInt16, math.MinInt16, 12345}
+	pcm := Bytes(samples)
+	if len(pcm) != len(samples)*2 || pcm[2] != 1 || pcm[3] != 0 || pcm[4] != 0xff {
+		t.Fatalf("Bytes = %v", pcm)
+	}
+	back := Int16s(append(pcm, 7))
+	if len(back) != len(samples) {
+		t.Fatalf("Int16s gave %d samples, want %d", len(back), len(samples))
+	}
+	for i := range samples {
+		if back[i] != samples[i] {
+			t.Errorf("sample %d = %d, want %d", i, back[i], samples[i])
+		}
+	}
+}
+
+func TestFloat32s(t *testing.T) {
+	got := Float32s([]int16{0, 16384, math.MinInt16})
+	if got[0] != 0 || got[1] != 0.5 || got[2] != -1 {
+		t.Errorf("Float32s = %v", got)
+	}
+}
+
+func TestClip(t *testing.T) {
+	for v, want := range map[float64]int16{0.4: 0, 0.5: 1, -0.5: -1, -1.4: -1, 40000: math.MaxInt16, -40000: math.MinInt16} {
+		if got := Clip(v); got != want {
+			t.Errorf("Clip(%v) = %d, want %d", v, got, want)
+		}
+	}
+}
+
+func TestMono(t *testing.T) {
+	got := Mono([]int16{100, 300, -50, 50, 7, 8}, 2)
+	want := []int16{200, 0, 7}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("Mono = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestGain(t *testing.T) {
+	got := Gain([]int16{1000, -1000, 20000}, Decibels(6.0206))
+	if got[0] != 2000 || got[1] != -2000 || got[2] != math.MaxInt16 {
+		t.Errorf("Gain = %v", got)
+	}
+}
+
+func BenchmarkInt16s(b *testing.B) {
+	pcm := Bytes(sine(440, 16000, 1, 0.5))
+	b.SetBytes(int64(len(pcm)))
+	for i := 0; i < b.N; i++ {
+		Int16s(pcm)
+	}
+}
@@ -0,0 +1,91 @@
+package audio
+
+import "math"
+
+// Butterworth is the Q of a second order filter with a flat passband
+const Butterworth = math.Sqrt2 / 2
+
+// Biquad is a second order IIR filter, with coefficients from the Audio EQ Cookbook. it keeps its
+// state, so a stream can be filtered in pieces
+type Biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+func newBiquad(b0, b1, b2, a0, a1, a2 float64) *Biquad {
+	return &Biquad{b0: b0 / a0, b1: b1 / a0, b2: b2 / a0, a1: a1 / a0, a2: a2 / a0}
+}
+
+func coefficients(rate int, freq, q float64) (cos, alpha float64) {
+	w := 2 * math.Pi * freq / float64(rate)
+	return math.Cos(w), math.Sin(w) / (2 * q)
+}
+
+func LowPass(rate int, freq, q float64) *Biquad {
+	cos, alpha := coefficients(rate, freq, q)
+	return newBiquad((1-cos)/2, 1-cos, (1-cos)/2, 1+alpha, -2*cos, 1-alpha)
+}
+
+func HighPass(rate int, freq, q float64) *Biquad {
+	cos, alpha := coefficients(rate, freq, q)
+	return newBiquad((1+cos)/2, -(1 + cos), (1+cos)/2, 1+alpha, -2*cos, 1-alpha)
+}
+
+// BandPass passes freq at unity gain. a higher q is a narrower band
+func BandPass(rate int, freq, q float64) *Biquad {
+	cos, alpha := coefficients(rate, freq, q)
+	return newBiquad(alpha, 0, -alpha, 1+alpha, -2*cos, 1-alpha)
+}
+
+// HighShelf changes everything above freq by gain dB
+func HighShelf(rate int, freq, q, gain float64) *Biquad {
+	cos, alpha := coefficients(rate, freq, q)
+	a := math.Pow(10, gain/40)
+	sq := 2 * math.Sqrt(a) * alpha
+	return newBiquad(
+		a*((a+1)+(a-1)*cos+sq),
+		-2*a*((a-1)+(a+1)*cos),
+		a*((a+1)+(a-1)*cos-sq),
+		(a+1)-(a-1)*cos+sq,
+		2*((a-1)-(a+1)*cos),
+		(a+1)-(a-1)*cos-sq,
+	)
+}
+
+// Next filters one sample
+func (f *Biquad) Next(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
+
+// Process filters samples in place
+func (f *Biquad) Process(samples []int16) []int16 {
+	for i, s := range samples {
+		samples[i] = Clip(f.Next(float64(s)))
+	}
+	return samples
+}
+
+// Chain is filters one after another
+type Chain []*Biquad
+
+// Band passes low to high Hz, with Butterworth slopes either side
+func Band(rate int, low, high float64) Chain {
+	return Chain{HighPass(rate, low, Butterworth), LowPass(rate, high, Butterworth)}
+}
+
+func (c Chain) Next(x float64) float64 {
+	for _, f := range c {
+		x = f.Next(x)
+	}
+	return x
+}
+
+func (c Chain) Process(samples []int16) []int16 {
+	for i, s := range samples {
+		samples[i] = Clip(c.Next(float64(s)))
+	}
+	return samples
+}
@@ -0,0 +1,63 @@
+package audio
+
+import "testing"
+
+func TestFilters(t *testing.T) {
+	const rate = 16000
+	tests := []struct {
+		name   string
+		filter func() interface{ Process([]int16) []int16 }
+		freq   float64
+		// dB
+		want float64
+	}{
+		{"high pass, above", func() interface{ Process([]int16) []int16 } { return HighPass(rate, 300, Butterworth) }, 3000, 0},
+		{"high pass, at the cutoff", func() interface{ Process([]int16) []int16 } { return HighPass(rate, 300, Butterworth) }, 300, -3},
+		{"high pass, below", func() interface{ Process([]int16) []int16 } { return HighPass(rate, 300, Butterworth) }, 50, -31},
+		{"low pass, below", func() interface{ Process([]int16) []int16 } { return LowPass(rate, 4000, Butterworth) }, 500, 0},
+		{"low pass, at the cutoff", func() interface{ Process([]int16) []int16 } { return LowPass(rate, 4000, Butterworth) }, 4000, -3},
+		{"band pass, centre", func() interface{ Process([]int16) []int16 } { return BandPass(rate, 1000, 2) }, 1000, 0},
+		{"band, inside", func() interface{ Process([]int16) []int16 } { return Band(rate, 300, 3400) }, 1000, 0},
+		{"band, outside", func() interface{ Process([]int16) []int16 } { return Band(rate, 300, 3400) }, 7000, -25},
+		{"high shelf, above", func() interface{ Process([]int16) []int16 } { return HighShelf(rate, 1000, Butterworth, 6) }, 6000, 6},
+		{"high shelf, below", func() interface{ Process([]int16) []int16 } { return HighShelf(rate, 1000, Butterworth, 6) }, 50, 0},
+	}
+	for _, test := range tests {
+		in := sine(test.freq, rate, 1, 0.25)
+		out := test.filter().Process(append([]int16(nil), in...))
+		gain := level(out) - level(in)
+		tolerance := 0.5
+		if test.want < -10 {
+			// only needs to be at least this quiet
+			if gain > test.want {
+				t.Errorf("%s: %.1f dB, want below %.1f", test.name, gain, test.want)
+			}
+			continue
+		}
+		near(t, test.name, gain, test.want, tolerance)
+	}
+}
+
+func TestBiquadStreams(t *testing.T) {
+	in := sine(200, 16000, 0.5, 0.5)
+	whole := HighPass(16000, 300, Butterworth).Process(append([]int16(nil), in...))
+	f := HighPass(16000, 300, Butterworth)
+	pieces := append([]int16(nil), in...)
+	for i := 0; i < len(pieces); i += 160 {
+		f.Process(pieces[i : i+160])
+	}
+	for i := range whole {
+		if pieces[i] != whole[i] {
+			t.Fatalf("sample %d filtered in pieces = %d, all at once = %d", i, pieces[i], whole[i])
+		}
+	}
+}
+
+func BenchmarkBiquad(b *testing.B) {
+	in := sine(440, 16000, 1, 0.5)
+	f := HighPass(16000, 300, Butterworth)
+	b.SetBytes(int64(len(in) * 2))
+	for i := 0; i < b.N; i++ {
+		f.Process(in)
+	}
+}
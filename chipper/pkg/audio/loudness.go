@@ -0,0 +1,206 @@
+package audio
+
+import "math"
+
+const (
+	// blocks quieter than this are silence, and don't count (ITU-R BS.1770)
+	absoluteGate = -70.0
+	// nor do blocks this far below the loudness of the rest
+	relativeGate = -10.0
+	// the most Normalize and Leveler change the level by, so near-silence isn't brought up to
+	// speech level
+	maxGain = 24.0
+)
+
+// Loudness is the integrated loudness of mono samples in LUFS, as ITU-R BS.1770 measures it:
+// K-weighted, in 400ms blocks overlapping by 75%, gated. it's -Inf for silence
+func Loudness(samples []int16, rate int) float64 {
+	m := newMeter(rate)
+	m.add(samples)
+	return m.loudness()
+}
+
+// Normalize brings mono samples to target LUFS, in place. the gain is limited so peaks don't clip
+func Normalize(samples []int16, rate int, target float64) []int16 {
+	loudness := Loudness(samples, rate)
+	if math.IsInf(loudness, -1) {
+		return samples
+	}
+	gain := Decibels(limitGain(target - loudness))
+	if peak := Peak(samples); peak > 0 && peak*gain > math.MaxInt16 {
+		gain = math.MaxInt16 / peak
+	}
+	return Gain(samples, gain)
+}
+
+func limitGain(db float64) float64 {
+	return math.Max(-maxGain, math.Min(maxGain, db))
+}
+
+// Leveler brings a mono stream to a loudness target as it's played. it holds back the start of
+// the stream until it has heard enough to set the gain, then follows the loudness of everything
+// so far, changing the gain smoothly
+type Leveler struct {
+	target float64
+	meter  *meter
+	gain   float64
+	// how much of the way to the wanted gain each sample goes
+	smoothing float64
+	held      []int16
+	holdMax   int
+	started   bool
+}
+
+// NewLeveler makes a Leveler. it holds back up to a second of audio at the start
+func NewLeveler(rate int, target float64) *Leveler {
+	return &Leveler{
+		target:    target,
+		meter:     newMeter(rate),
+		gain:      1,
+		smoothing: 1 / (0.5 * float64(rate)),
+		holdMax:   rate,
+	}
+}
+
+// Process takes the next samples of the stream and returns what's ready to play
+func (l *Leveler) Process(samples []int16) []int16 {
+	l.meter.add(samples)
+	if l.started {
+		return l.apply(samples)
+	}
+	l.held = append(l.held, samples...)
+	if !l.meter.heard() && len(l.held) < l.holdMax {
+		return nil
+	}
+	return l.Flush()
+}
+
+// Flush returns what's being held back
+func (l *Leveler) Flush() []int16 {
+	if l.started {
+		return nil
+	}
+	l.started = true
+	l.gain = l.wanted()
+	held := l.held
+	l.held = nil
+	return l.apply(held)
+}
+
+func (l *Leveler) wanted() float64 {
+	loudness := l.meter.loudness()
+	if math.IsInf(loudness, -1) {
+		return l.gain
+	}
+	return Decibels(limitGain(l.target - loudness))
+}
+
+func (l *Leveler) apply(samples []int16) []int16 {
+	wanted := l.wanted()
+	for i, s := range samples {
+		l.gain += (wanted - l.gain) * l.smoothing
+		samples[i] = Clip(float64(s) * l.gain)
+	}
+	return samples
+}
+
+// meter measures BS.1770 loudness as samples come in
+type meter struct {
+	weighting Chain
+	// 100ms, a quarter of a block
+	hop int
+	n   int
+	sum float64
+	// mean squares of the last four hops, which make a block
+	hops  [4]float64
+	nHops int
+	// mean squares of the blocks
+	blocks []float64
+	// for audio shorter than a block
+	total float64
+	count int
+}
+
+func newMeter(rate int) *meter {
+	return &meter{weighting: kWeighting(rate), hop: rate / 10}
+}
+
+// kWeighting is a shelf for the head and a high pass for the ear. the standard gives coefficients
+// for 48kHz; these are the analog filters they come from (as libebur128 has them), so they work at
+// any rate
+func kWeighting(rate int) Chain {
+	k := math.Tan(math.Pi * 1681.974450955533 / float64(rate))
+	q := 0.7071752369554196
+	vh := math.Pow(10, 3.999843853973347/20)
+	vb := math.Pow(vh, 0.4996667741545416)
+	shelf := newBiquad(vh+vb*k/q+k*k, 2*(k*k-vh), vh-vb*k/q+k*k, 1+k/q+k*k, 2*(k*k-1), 1-k/q+k*k)
+	k = math.Tan(math.Pi * 38.13547087602444 / float64(rate))
+	q = 0.5003270373238773
+	highPass := newBiquad(1, -2, 1, 1+k/q+k*k, 2*(k*k-1), 1-k/q+k*k)
+	return Chain{shelf, highPass}
+}
+
+func (m *meter) add(samples []int16) {
+	for _, s := range samples {
+		y := m.weighting.Next(float64(s) / 32768)
+		m.sum += y * y
+		m.n++
+		if m.n < m.hop {
+			continue
+		}
+		m.hops[m.nHops%4] = m.sum / float64(m.n)
+		m.nHops++
+		m.total += m.sum
+		m.count += m.n
+		m.sum, m.n = 0, 0
+		if m.nHops >= 4 {
+			m.blocks = append(m.blocks, (m.hops[0]+m.hops[1]+m.hops[2]+m.hops[3])/4)
+		}
+	}
+}
+
+// heard is whether a block above the absolute gate has come in
+func (m *meter) heard() bool {
+	for _, power := range m.blocks {
+		if blockLoudness(power) > absoluteGate {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *meter) loudness() float64 {
+	if len(m.blocks) == 0 {
+		total, count := m.total+m.sum, m.count+m.n
+		if count == 0 {
+			return math.Inf(-1)
+		}
+		if loudness := blockLoudness(total / float64(count)); loudness > absoluteGate {
+			return loudness
+		}
+		return math.Inf(-1)
+	}
+	gated := func(threshold float64) float64 {
+		var sum float64
+		var n int
+		for _, power := range m.blocks {
+			if loudness := blockLoudness(power); loudness > absoluteGate && loudness > threshold {
+				sum += power
+				n++
+			}
+		}
+		if n == 0 {
+			return math.Inf(-1)
+		}
+		return blockLoudness(sum / float64(n))
+	}
+	ungated := gated(absoluteGate)
+	if math.IsInf(ungated, -1) {
+		return ungated
+	}
+	return gated(ungated + relativeGate)
+}
+
+func blockLoudness(power float64) float64 {
+	return -0.691 + 10*math.Log10(power)
+}
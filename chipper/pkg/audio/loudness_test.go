@@ -0,0 +1,89 @@
+package audio
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLoudness(t *testing.T) {
+	// BS.1770 is defined so a 997Hz sine at full scale is -3.01 LUFS
+	near(t, "full scale 997Hz at 48kHz", Loudness(sine(997, 48000, 5, 1), 48000), -3.01, 0.05)
+	near(t, "-20dBFS 997Hz at 48kHz", Loudness(sine(997, 48000, 5, 0.1), 48000), -23.01, 0.05)
+	near(t, "-20dBFS 997Hz at 16kHz", Loudness(sine(997, 16000, 5, 0.1), 16000), -23.01, 0.2)
+	// the K-weighting shelf makes high frequencies count for about 3.3dB more than 1kHz
+	near(t, "-20dBFS 4kHz at 48kHz", Loudness(sine(4000, 48000, 5, 0.1), 48000), -19.7, 0.15)
+	if l := Loudness(make([]int16, 48000), 48000); !math.IsInf(l, -1) {
+		t.Errorf("silence is %.1f LUFS, want -Inf", l)
+	}
+}
+
+func TestLoudnessGating(t *testing.T) {
+	// a long quiet stretch after the tone is gated out, so it hardly pulls the loudness down. only
+	// the blocks overlapping the end of the tone count
+	tone := sine(997, 16000, 3, 0.1)
+	quiet := sine(997, 16000, 10, 0.001)
+	near(t, "tone then near silence", Loudness(append(tone, quiet...), 16000), Loudness(tone, 16000), 0.3)
+	// but a quieter stretch above the gates counts: 3s at -23 and 10s at -33.5 average to -28.3
+	near(t, "tone then quieter", Loudness(append(tone, sine(997, 16000, 10, 0.03)...), 16000), -28.3, 0.3)
+}
+
+func TestLoudnessShort(t *testing.T) {
+	// shorter than a block, but still measured
+	near(t, "200ms", Loudness(sine(997, 16000, 0.2, 0.1), 16000), -23.01, 0.5)
+}
+
+func TestNormalize(t *testing.T) {
+	samples := Normalize(sine(997, 16000, 3, 0.05), 16000, -16)
+	near(t, "normalized", Loudness(samples, 16000), -16, 0.2)
+	// would need to clip, so it stops at full scale
+	loud := Normalize(sine(997, 16000, 3, 0.5), 16000, 0)
+	if peak := Peak(loud); peak < 32000 || peak > math.MaxInt16 {
+		t.Errorf("peak is %.0f, want just under full scale", peak)
+	}
+}
+
+func TestLeveler(t *testing.T) {
+	in := sine(997, 16000, 4, 0.03)
+	l := NewLeveler(16000, -16)
+	var out []int16
+	for i := 0; i < len(in); i += 1000 {
+		end := i + 1000
+		if end > len(in) {
+			end = len(in)
+		}
+		out = append(out, l.Process(append([]int16(nil), in[i:end]...))...)
+	}
+	out = append(out, l.Flush()...)
+	if len(out) != len(in) {
+		t.Fatalf("leveled %d samples, want %d", len(out), len(in))
+	}
+	near(t, "leveled", Loudness(out, 16000), -16, 0.5)
+	// and it doesn't wait for long
+	if held := NewLeveler(16000, -16).Process(sine(997, 16000, 0.5, 0.03)); len(held) == 0 {
+		t.Error("still holding back after half a second of audio")
+	}
+}
+
+func BenchmarkLoudness(b *testing.B) {
+	in := sine(997, 16000, 5, 0.1)
+	b.SetBytes(int64(len(in) * 2))
+	for i := 0; i < b.N; i++ {
+		Loudness(in, 16000)
+	}
+}
+
+func BenchmarkLeveler(b *testing.B) {
+	in := sine(997, 16000, 5, 0.1)
+	b.SetBytes(int64(len(in) * 2))
+	for i := 0; i < b.N; i++ {
+		l := NewLeveler(16000, -16)
+		for j := 0; j < len(in); j += 2048 {
+			end := j + 2048
+			if end > len(in) {
+				end = len(in)
+			}
+			l.Process(in[j:end])
+		}
+		l.Flush()
+	}
+}
@@ -0,0 +1,147 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+// just enough of Ogg (RFC 3533) for Opus files: one logical stream
+
+const (
+	oggContinued = 1 << iota
+	oggFirst
+	oggLast
+)
+
+var oggCRC [256]uint32
+
+func init() {
+	for i := range oggCRC {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		oggCRC[i] = crc
+	}
+}
+
+func oggChecksum(page []byte) uint32 {
+	var crc uint32
+	for _, b := range page {
+		crc = crc<<8 ^ oggCRC[byte(crc>>24)^b]
+	}
+	return crc
+}
+
+// oggWriter puts packets on pages, as many as fit on one page
+type oggWriter struct {
+	out      bytes.Buffer
+	serial   uint32
+	sequence uint32
+	lacing   []byte
+	body     []byte
+	granule  int64
+	flags    byte
+}
+
+// add puts a packet on the current page. granule is the position at the end of it
+func (w *oggWriter) add(packet []byte, granule int64) {
+	segments := len(packet)/255 + 1
+	if len(w.lacing)+segments > 255 {
+		w.flush()
+	}
+	for i := 0; i < segments-1; i++ {
+		w.lacing = append(w.lacing, 255)
+	}
+	w.lacing = append(w.lacing, byte(len(packet)%255))
+	w.body = append(w.body, packet...)
+	w.granule = granule
+}
+
+// flush writes the current page
+func (w *oggWriter) flush() {
+	if len(w.lacing) == 0 && w.flags&oggLast == 0 {
+		return
+	}
+	page := make([]byte, 27, 27+len(w.lacing)+len(w.body))
+	copy(page, "OggS")
+	page[5] = w.flags
+	binary.LittleEndian.PutUint64(page[6:], uint64(w.granule))
+	binary.LittleEndian.PutUint32(page[14:], w.serial)
+	binary.LittleEndian.PutUint32(page[18:], w.sequence)
+	page[26] = byte(len(w.lacing))
+	page = append(append(page, w.lacing...), w.body...)
+	binary.LittleEndian.PutUint32(page[22:], oggChecksum(page))
+	w.out.Write(page)
+	w.sequence++
+	w.lacing, w.body, w.flags = w.lacing[:0], w.body[:0], 0
+}
+
+// readOgg returns the packets of the first stream in an Ogg file, and the granule position of
+// its last page
+func readOgg(data []byte) ([][]byte, int64, error) {
+	var packets [][]byte
+	var packet []byte
+	var granule int64
+	var serial uint32
+	found := false
+	for len(data) > 0 {
+		if len(data) < 27 || string(data[:4]) != "OggS" {
+			if found {
+				// a cut off file still has the pages before the cut
+				break
+			}
+			return nil, 0, errors.New("not an Ogg file")
+		}
+		lacing := int(data[26])
+		if len(data) < 27+lacing {
+			break
+		}
+		size := 27 + lacing
+		for _, l := range data[27 : 27+lacing] {
+			size += int(l)
+		}
+		if len(data) < size {
+			break
+		}
+		page := data[:size]
+		data = data[size:]
+		check := make([]byte, len(page))
+		copy(check, page)
+		binary.LittleEndian.PutUint32(check[22:], 0)
+		if oggChecksum(check) != binary.LittleEndian.Uint32(page[22:]) {
+			return nil, 0, errors.New("Ogg page is corrupt")
+		}
+		pageSerial := binary.LittleEndian.Uint32(page[14:])
+		if !found {
+			serial, found = pageSerial, true
+		}
+		if pageSerial != serial {
+			continue
+		}
+		if page[5]&oggContinued == 0 {
+			packet = nil
+		}
+		body := page[27+lacing:]
+		for _, l := range page[27 : 27+lacing] {
+			packet = append(packet, body[:l]...)
+			body = body[l:]
+			if l < 255 {
+				packets = append(packets, packet)
+				packet = nil
+			}
+		}
+		if g := int64(binary.LittleEndian.Uint64(page[6:])); g != -1 {
+			granule = g
+		}
+	}
+	if !found {
+		return nil, 0, errors.New("not an Ogg file")
+	}
+	return packets, granule, nil
+}
@@ -0,0 +1,158 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"gopkg.in/hraban/opus.v2"
+)
+
+const (
+	// Opus always decodes at 48kHz, and counts positions in it
+	opusRate = 48000
+	// samples at 48kHz libopus holds back, which decoders skip
+	opusPreSkip = 312
+	// 120ms at 48kHz, the longest a packet can be
+	opusMaxFrame = 5760
+	opusFrameMs  = 20
+)
+
+// EncodeOggOpus makes an Ogg Opus file from mono or stereo audio. bitrate is in bits per second,
+// 0 lets libopus choose
+func EncodeOggOpus(samples []int16, f Format, bitrate int) ([]byte, error) {
+	if f.Channels != 1 && f.Channels != 2 {
+		return nil, errors.New("Opus files can only be mono or stereo here")
+	}
+	rate := f.Rate
+	switch rate {
+	case 8000, 12000, 16000, 24000, 48000:
+	default:
+		samples = resampleChannels(samples, f, opusRate)
+		rate = opusRate
+	}
+	enc, err := opus.NewEncoder(rate, f.Channels, opus.AppAudio)
+	if err != nil {
+		return nil, err
+	}
+	if bitrate > 0 {
+		if err := enc.SetBitrate(bitrate); err != nil {
+			return nil, err
+		}
+	}
+	length := int64(len(samples)/f.Channels) * opusRate / int64(rate)
+	w := &oggWriter{serial: 0x77707664}
+
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1
+	head[9] = byte(f.Channels)
+	binary.LittleEndian.PutUint16(head[10:], opusPreSkip)
+	binary.LittleEndian.PutUint32(head[12:], uint32(f.Rate))
+	w.flags = oggFirst
+	w.add(head, 0)
+	w.flush()
+	vendor := "wire-pod"
+	tags := make([]byte, 16+len(vendor))
+	copy(tags, "OpusTags")
+	binary.LittleEndian.PutUint32(tags[8:], uint32(len(vendor)))
+	copy(tags[12:], vendor)
+	// and no comments
+	w.add(tags, 0)
+	w.flush()
+
+	// libopus holds back the pre-skip, so that much silence goes on the end to push out the rest
+	frame := rate * opusFrameMs / 1000 * f.Channels
+	padded := len(samples) + opusPreSkip*rate/opusRate*f.Channels
+	padded += (frame - padded%frame) % frame
+	pcm := make([]int16, padded)
+	copy(pcm, samples)
+	packet := make([]byte, 4000)
+	var granule int64
+	for i := 0; i < len(pcm); i += frame {
+		n, err := enc.Encode(pcm[i:i+frame], packet)
+		if err != nil {
+			return nil, err
+		}
+		granule += opusFrameMs * opusRate / 1000
+		if i+frame >= len(pcm) {
+			// the end of the audio, exactly
+			granule = opusPreSkip + length
+			w.flags |= oggLast
+		}
+		w.add(packet[:n], granule)
+		// a page a second
+		if granule%opusRate < opusFrameMs*opusRate/1000 {
+			w.flush()
+		}
+	}
+	w.flush()
+	return w.out.Bytes(), nil
+}
+
+// DecodeOggOpus reads a mono or stereo Ogg Opus file. the audio is at 48kHz
+func DecodeOggOpus(data []byte) ([]int16, Format, error) {
+	packets, granule, err := readOgg(data)
+	if err != nil {
+		return nil, Format{}, err
+	}
+	if len(packets) < 2 || len(packets[0]) < 19 || !bytes.HasPrefix(packets[0], []byte("OpusHead")) {
+		return nil, Format{}, errors.New("not an Ogg Opus file")
+	}
+	head := packets[0]
+	f := Format{Rate: opusRate, Channels: int(head[9])}
+	preSkip := int64(binary.LittleEndian.Uint16(head[10:]))
+	gain := int16(binary.LittleEndian.Uint16(head[16:]))
+	if head[18] != 0 || (f.Channels != 1 && f.Channels != 2) {
+		return nil, Format{}, errors.New("only mono and stereo Opus files are supported")
+	}
+	dec, err := opus.NewDecoder(opusRate, f.Channels)
+	if err != nil {
+		return nil, Format{}, err
+	}
+	frame := make([]int16, opusMaxFrame*f.Channels)
+	var samples []int16
+	for _, packet := range packets[2:] {
+		n, err := dec.Decode(packet, frame)
+		if err != nil {
+			return nil, Format{}, err
+		}
+		samples = append(samples, frame[:n*f.Channels]...)
+	}
+	// the start is the encoder's delay, and the last page says where the audio really ends
+	skip := int(preSkip) * f.Channels
+	if skip > len(samples) {
+		skip = len(samples)
+	}
+	samples = samples[skip:]
+	if end := int(granule-preSkip) * f.Channels; end >= 0 && end < len(samples) {
+		samples = samples[:end]
+	}
+	// the header's gain is in 1/256 dB
+	if gain != 0 {
+		Gain(samples, Decibels(float64(gain)/256))
+	}
+	return samples, f, nil
+}
+
+// resampleChannels resamples each channel of interleaved audio
+func resampleChannels(samples []int16, f Format, to int) []int16 {
+	if f.Channels == 1 {
+		return Resample(samples, f.Rate, to)
+	}
+	var out []int16
+	for c := 0; c < f.Channels; c++ {
+		channel := make([]int16, len(samples)/f.Channels)
+		for i := range channel {
+			channel[i] = samples[i*f.Channels+c]
+		}
+		channel = Resample(channel, f.Rate, to)
+		if out == nil {
+			out = make([]int16, len(channel)*f.Channels)
+		}
+		for i, s := range channel {
+			out[i*f.Channels+c] = s
+		}
+	}
+	return out
+}
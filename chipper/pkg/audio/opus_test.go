@@ -0,0 +1,87 @@
+package audio
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestOggRoundTrip(t *testing.T) {
+	w := &oggWriter{serial: 1}
+	packets := [][]byte{[]byte("first"), bytes.Repeat([]byte{7}, 255), bytes.Repeat([]byte{8}, 600), {}}
+	w.flags = oggFirst
+	for i, p := range packets {
+		w.add(p, int64(i*100))
+	}
+	w.flags |= oggLast
+	w.flush()
+	got, granule, err := readOgg(w.out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if granule != 300 || len(got) != len(packets) {
+		t.Fatalf("%d packets ending at %d, want %d ending at 300", len(got), granule, len(packets))
+	}
+	for i := range packets {
+		if !bytes.Equal(got[i], packets[i]) {
+			t.Errorf("packet %d is %d bytes, want %d", i, len(got[i]), len(packets[i]))
+		}
+	}
+	corrupt := append([]byte(nil), w.out.Bytes()...)
+	corrupt[len(corrupt)-1]++
+	if _, _, err := readOgg(corrupt); err == nil {
+		t.Error("no error for a corrupt page")
+	}
+}
+
+func TestOggManyPages(t *testing.T) {
+	w := &oggWriter{serial: 1}
+	// more segments than fit on one page
+	for i := 0; i < 300; i++ {
+		w.add(bytes.Repeat([]byte{byte(i)}, 300), int64(i))
+	}
+	w.flush()
+	got, granule, err := readOgg(w.out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 300 || granule != 299 || got[299][0] != byte(299%256) {
+		t.Errorf("%d packets ending at %d", len(got), granule)
+	}
+}
+
+func TestOggOpusRoundTrip(t *testing.T) {
+	in := sine(440, 16000, 1, 0.5)
+	file, err := EncodeOggOpus(in, Format{Rate: 16000, Channels: 1}, 32000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets, _, err := readOgg(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(packets[0], []byte("OpusHead")) || !bytes.HasPrefix(packets[1], []byte("OpusTags")) {
+		t.Fatal("the file doesn't start with Opus headers")
+	}
+	samples, f, err := DecodeOggOpus(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(samples) == 0 {
+		t.Skip("libopus didn't produce any audio; it's probably not the real library")
+	}
+	if f != (Format{Rate: 48000, Channels: 1}) || len(samples) != 48000 {
+		t.Fatalf("%d samples as %+v, want 48000 at 48kHz mono", len(samples), f)
+	}
+	near(t, "level", level(Resample(samples, 48000, 16000)), level(in), 1)
+}
+
+func BenchmarkOggOpusRoundTrip(b *testing.B) {
+	in := sine(440, 16000, 1, 0.5)
+	for i := 0; i < b.N; i++ {
+		file, err := EncodeOggOpus(in, Format{Rate: 16000, Channels: 1}, 32000)
+		if err != nil {
+			b.Fatal(err)
+		}
+		DecodeOggOpus(file)
+	}
+}
@@ -0,0 +1,128 @@
+// Package audio is the sample-level audio code shared by speech input, speech output and the
+// sound library: PCM conversion, resampling, filters, loudness normalization, and WAV and Ogg
+// Opus files. Samples are signed 16-bit, PCM bytes are little-endian, and audio with more than
+// one channel is interleaved.
+package audio
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// Format describes audio samples
+type Format struct {
+	Rate     int
+	Channels int
+}
+
+// Int16s reads 16-bit PCM. an odd byte at the end is dropped
+func Int16s(pcm []byte) []int16 {
+	samples := make([]int16, len(pcm)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(pcm[i*2:]))
+	}
+	return samples
+}
+
+// Bytes writes samples as 16-bit PCM
+func Bytes(samples []int16) []byte {
+	return AppendBytes(make([]byte, 0, len(samples)*2), samples)
+}
+
+// AppendBytes is Bytes onto the end of pcm
+func AppendBytes(pcm []byte, samples []int16) []byte {
+	for _, s := range samples {
+		pcm = append(pcm, byte(s), byte(uint16(s)>>8))
+	}
+	return pcm
+}
+
+// Float32s scales samples to -1 to 1, which is what most speech models take
+func Float32s(samples []int16) []float32 {
+	floats := make([]float32, len(samples))
+	for i, s := range samples {
+		floats[i] = float32(s) / 32768
+	}
+	return floats
+}
+
+// Mono averages the channels together
+func Mono(samples []int16, channels int) []int16 {
+	if channels <= 1 {
+		return samples
+	}
+	mono := make([]int16, len(samples)/channels)
+	for i := range mono {
+		sum := 0
+		for _, s := range samples[i*channels : i*channels+channels] {
+			sum += int(s)
+		}
+		mono[i] = int16(sum / channels)
+	}
+	return mono
+}
+
+// Clip rounds to the nearest sample, keeping within the range of int16
+func Clip(v float64) int16 {
+	switch {
+	case v >= math.MaxInt16:
+		return math.MaxInt16
+	case v <= math.MinInt16:
+		return math.MinInt16
+	case v < 0:
+		return int16(v - 0.5)
+	}
+	return int16(v + 0.5)
+}
+
+// Gain multiplies the samples by gain in place, clipping them
+func Gain(samples []int16, gain float64) []int16 {
+	if gain == 1 {
+		return samples
+	}
+	for i, s := range samples {
+		samples[i] = Clip(float64(s) * gain)
+	}
+	return samples
+}
+
+// Decibels is the gain factor for a change in dB
+func Decibels(db float64) float64 {
+	return math.Pow(10, db/20)
+}
+
+// RMS is the root mean square of the samples
+func RMS(samples []int16) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, s := range samples {
+		sum += float64(s) * float64(s)
+	}
+	return math.Sqrt(sum / float64(len(samples)))
+}
+
+// Peak is the largest absolute sample
+func Peak(samples []int16) float64 {
+	peak := 0
+	for _, s := range samples {
+		v := int(s)
+		if v < 0 {
+			v = -v
+		}
+		if v > peak {
+			peak = v
+		}
+	}
+	return float64(peak)
+}
+
+// Duration is how long a number of samples per channel plays for
+func Duration(samples int, rate int) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	return time.Duration(samples) * time.Second / time.Duration(rate)
+}
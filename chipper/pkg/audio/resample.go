@@ -0,0 +1,145 @@
+package audio
+
+import "math"
+
+const (
+	// rates which don't share a large factor would need a huge filter table, so the phases are
+	// limited to this many and the nearest is used
+	maxPhases = 1024
+	// zero crossings of the sinc kept either side, measured at the lower of the two rates
+	sincZeros = 16
+	// the filter starts rolling off below this fraction of the lower Nyquist frequency
+	passband = 0.9
+)
+
+// Resampler converts mono audio between any two sample rates with a polyphase windowed-sinc
+// filter. it keeps state between calls, so a stream can be converted in pieces
+type Resampler struct {
+	up, down int
+	half     int
+	phases   int
+	// phases rows of 2*half taps
+	filter []float64
+	// input still needed by later outputs
+	in []float64
+	// where the next output is, in 1/up input samples from in[0]
+	pos int64
+}
+
+func NewResampler(from, to int) *Resampler {
+	g := gcd(from, to)
+	r := &Resampler{up: to / g, down: from / g}
+	if r.up == r.down {
+		return r
+	}
+	r.phases = r.up
+	if r.phases > maxPhases {
+		r.phases = maxPhases
+	}
+	// in cycles per input sample
+	cutoff := 0.5 * passband
+	if to < from {
+		cutoff *= float64(to) / float64(from)
+	}
+	r.half = int(math.Ceil(sincZeros / (2 * cutoff)))
+	taps := 2 * r.half
+	r.filter = make([]float64, r.phases*taps)
+	for p := 0; p < r.phases; p++ {
+		row := r.filter[p*taps : p*taps+taps]
+		frac := float64(p) / float64(r.phases)
+		var sum float64
+		for i := range row {
+			t := float64(i-r.half+1) - frac
+			row[i] = 2 * cutoff * sinc(2*cutoff*t) * blackman(t/float64(r.half))
+			sum += row[i]
+		}
+		// every phase passes DC at exactly 1, so there's no ripple at the phase rate
+		for i := range row {
+			row[i] /= sum
+		}
+	}
+	// the first output lines up with the first input sample
+	r.in = make([]float64, r.half-1)
+	r.pos = int64(r.half-1) * int64(r.up)
+	return r
+}
+
+// Process takes the next samples of the stream and returns the output they complete. when the rates
+// are the same, it's the samples
+func (r *Resampler) Process(samples []int16) []int16 {
+	if r.up == r.down {
+		return samples
+	}
+	for _, s := range samples {
+		r.in = append(r.in, float64(s))
+	}
+	taps := 2 * r.half
+	up := int64(r.up)
+	out := make([]int16, 0, int64(len(samples))*up/int64(r.down)+1)
+	for {
+		k := int(r.pos / up)
+		if k+r.half >= len(r.in) {
+			break
+		}
+		phase := int(r.pos%up) * r.phases / r.up
+		row := r.filter[phase*taps : phase*taps+taps]
+		x := r.in[k-r.half+1 : k+r.half+1]
+		var y float64
+		for i, c := range row {
+			y += c * x[i]
+		}
+		out = append(out, Clip(y))
+		r.pos += int64(r.down)
+	}
+	if drop := int(r.pos/up) - r.half + 1; drop > 0 {
+		if drop > len(r.in) {
+			drop = len(r.in)
+		}
+		r.in = r.in[:copy(r.in, r.in[drop:])]
+		r.pos -= int64(drop) * up
+	}
+	return out
+}
+
+// Flush returns the end of the stream, which the filter was holding back
+func (r *Resampler) Flush() []int16 {
+	if r.up == r.down {
+		return nil
+	}
+	return r.Process(make([]int16, r.half))
+}
+
+// Resample converts mono audio from one sample rate to another
+func Resample(samples []int16, from, to int) []int16 {
+	if from == to || from <= 0 || to <= 0 || len(samples) == 0 {
+		return samples
+	}
+	r := NewResampler(from, to)
+	out := append(r.Process(samples), r.Flush()...)
+	if want := int(int64(len(samples)) * int64(to) / int64(from)); len(out) > want {
+		out = out[:want]
+	}
+	return out
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+// blackman is the Blackman window over -1 to 1
+func blackman(x float64) float64 {
+	if x <= -1 || x >= 1 {
+		return 0
+	}
+	return 0.42 + 0.5*math.Cos(math.Pi*x) + 0.08*math.Cos(2*math.Pi*x)
+}
+
+func gcd(a, b int) int {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
@@ -0,0 +1,88 @@
+package audio
+
+import "testing"
+
+func TestResampleLength(t *testing.T) {
+	for _, rates := range [][2]int{{24000, 16000}, {44100, 16000}, {22050, 16000}, {8000, 16000}, {16000, 48000}, {22051, 16000}} {
+		in := sine(440, rates[0], 1, 0.5)
+		out := Resample(in, rates[0], rates[1])
+		if len(out) != rates[1] {
+			t.Errorf("%d to %d: %d samples, want %d", rates[0], rates[1], len(out), rates[1])
+		}
+	}
+}
+
+func TestResampleKeepsTones(t *testing.T) {
+	for _, rates := range [][2]int{{24000, 16000}, {44100, 16000}, {8000, 16000}, {22051, 16000}} {
+		out := Resample(sine(1000, rates[0], 1, 0.5), rates[0], rates[1])
+		near(t, "level", level(out), level(sine(1000, rates[1], 1, 0.5)), 0.1)
+		// the tone is still 1kHz, and where it should be
+		want := sine(1000, rates[1], 1, 0.5)
+		var diff float64
+		for i := len(out) / 4; i < len(out)*3/4; i++ {
+			d := float64(out[i]) - float64(want[i])
+			diff += d * d
+		}
+		if rms := diff / float64(len(out)/2); rms > 100*100 {
+			t.Errorf("%d to %d: the output is off from a 1kHz tone by %.0f RMS", rates[0], rates[1], rms)
+		}
+	}
+}
+
+func TestResampleRemovesAliases(t *testing.T) {
+	// 10kHz can't be played at 16kHz, and mustn't fold back down as 6kHz
+	out := Resample(sine(10000, 48000, 1, 0.5), 48000, 16000)
+	if l := level(out); l > -60 {
+		t.Errorf("10kHz at 48kHz is %.1f dB after going to 16kHz, want below -60", l)
+	}
+}
+
+func TestResamplerStreams(t *testing.T) {
+	in := sine(300, 24000, 0.5, 0.5)
+	whole := Resample(in, 24000, 16000)
+	r := NewResampler(24000, 16000)
+	var pieces []int16
+	for i := 0; i < len(in); i += 317 {
+		end := i + 317
+		if end > len(in) {
+			end = len(in)
+		}
+		pieces = append(pieces, r.Process(in[i:end])...)
+	}
+	pieces = append(pieces, r.Flush()...)
+	if len(pieces) < len(whole) {
+		t.Fatalf("streamed %d samples, want at least %d", len(pieces), len(whole))
+	}
+	for i := range whole {
+		if pieces[i] != whole[i] {
+			t.Fatalf("streamed sample %d = %d, all at once = %d", i, pieces[i], whole[i])
+		}
+	}
+}
+
+func TestResampleSameRate(t *testing.T) {
+	in := []int16{1, 2, 3}
+	if out := Resample(in, 16000, 16000); len(out) != 3 || out[2] != 3 {
+		t.Errorf("Resample at the same rate = %v", out)
+	}
+}
+
+func benchmarkResample(b *testing.B, from, to int) {
+	in := sine(440, from, 1, 0.5)
+	b.SetBytes(int64(len(in) * 2))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Resample(in, from, to)
+	}
+}
+
+func BenchmarkResample24kTo16k(b *testing.B)   { benchmarkResample(b, 24000, 16000) }
+func BenchmarkResample44k1To16k(b *testing.B)  { benchmarkResample(b, 44100, 16000) }
+func BenchmarkResample22050To16k(b *testing.B) { benchmarkResample(b, 22050, 16000) }
+func BenchmarkResample16kTo48k(b *testing.B)   { benchmarkResample(b, 16000, 48000) }
+func BenchmarkResampleOddRate(b *testing.B)    { benchmarkResample(b, 22051, 16000) }
+func BenchmarkNewResampler44k1To16k(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		NewResampler(44100, 16000)
+	}
+}
@@ -0,0 +1,178 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// ErrNotPCM is for WAV files in a compressed format, which need something like ffmpeg
+var ErrNotPCM = errors.New("WAV isn't PCM")
+
+const (
+	wavPCM        = 1
+	wavFloat      = 3
+	wavExtensible = 0xfffe
+)
+
+// EncodeWAV makes a 16-bit PCM WAV file
+func EncodeWAV(samples []int16, f Format) []byte {
+	if f.Channels < 1 {
+		f.Channels = 1
+	}
+	size := len(samples) * 2
+	header := make([]byte, 44, 44+size)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(36+size))
+	copy(header[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], wavPCM)
+	binary.LittleEndian.PutUint16(header[22:], uint16(f.Channels))
+	binary.LittleEndian.PutUint32(header[24:], uint32(f.Rate))
+	binary.LittleEndian.PutUint32(header[28:], uint32(f.Rate*f.Channels*2))
+	binary.LittleEndian.PutUint16(header[32:], uint16(f.Channels*2))
+	binary.LittleEndian.PutUint16(header[34:], 16)
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], uint32(size))
+	return AppendBytes(header, samples)
+}
+
+// DecodeWAV reads a WAV file of 8, 16, 24 or 32-bit integer or 32 or 64-bit float PCM
+func DecodeWAV(data []byte) ([]int16, Format, error) {
+	r, err := NewWAVReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, Format{}, err
+	}
+	pcm, err := io.ReadAll(r)
+	if err != nil {
+		return nil, Format{}, err
+	}
+	return Int16s(pcm), r.Format, nil
+}
+
+// WAVReader reads the audio of a WAV file as 16-bit PCM while the file is still arriving.
+// programs writing WAV to a pipe can't go back to fill in the size, so a data chunk with no size
+// runs to the end of the file
+type WAVReader struct {
+	Format Format
+	src    io.Reader
+	float  bool
+	// bytes per sample
+	width int
+	buf   []byte
+	// a partial sample left over from the last read
+	in  []byte
+	out []byte
+	err error
+}
+
+// NewWAVReader reads the header, up to the start of the audio
+func NewWAVReader(src io.Reader) (*WAVReader, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(src, header); err != nil || string(header[:4]) != "RIFF" || string(header[8:12]) != "WAVE" {
+		return nil, errors.New("not a WAV file")
+	}
+	w := &WAVReader{buf: make([]byte, 4096)}
+	for {
+		chunk := make([]byte, 8)
+		if _, err := io.ReadFull(src, chunk); err != nil {
+			return nil, errors.New("WAV has no data")
+		}
+		id := string(chunk[:4])
+		size := int64(binary.LittleEndian.Uint32(chunk[4:]))
+		if id == "data" {
+			if w.width == 0 {
+				return nil, errors.New("WAV data before its format")
+			}
+			w.src = src
+			if size > 0 {
+				w.src = io.LimitReader(src, size)
+			}
+			return w, nil
+		}
+		if size > 1<<20 {
+			return nil, errors.New("WAV header is too big")
+		}
+		// chunks are padded to an even size
+		body := make([]byte, size+size%2)
+		if _, err := io.ReadFull(src, body); err != nil {
+			return nil, errors.New("WAV ends in its header")
+		}
+		if id == "fmt " {
+			if err := w.readFormat(body[:size]); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+func (w *WAVReader) readFormat(body []byte) error {
+	if len(body) < 16 {
+		return errors.New("WAV format chunk is too short")
+	}
+	format := binary.LittleEndian.Uint16(body)
+	// the real format is at the start of the extension's GUID
+	if format == wavExtensible && len(body) >= 26 {
+		format = binary.LittleEndian.Uint16(body[24:])
+	}
+	w.Format.Channels = int(binary.LittleEndian.Uint16(body[2:]))
+	w.Format.Rate = int(binary.LittleEndian.Uint32(body[4:]))
+	bits := int(binary.LittleEndian.Uint16(body[14:]))
+	if w.Format.Channels < 1 || w.Format.Rate <= 0 {
+		return errors.New("WAV format is broken")
+	}
+	switch {
+	case format == wavPCM && (bits == 8 || bits == 16 || bits == 24 || bits == 32):
+	case format == wavFloat && (bits == 32 || bits == 64):
+		w.float = true
+	case format == wavPCM || format == wavFloat:
+		return errors.New("WAV has an unusual sample size")
+	default:
+		return ErrNotPCM
+	}
+	w.width = bits / 8
+	return nil
+}
+
+func (w *WAVReader) Read(b []byte) (int, error) {
+	for len(w.out) == 0 {
+		if w.err != nil {
+			return 0, w.err
+		}
+		n, err := w.src.Read(w.buf)
+		w.in = append(w.in, w.buf[:n]...)
+		whole := len(w.in) - len(w.in)%w.width
+		w.out = w.convert(w.out, w.in[:whole])
+		w.in = w.in[:copy(w.in, w.in[whole:])]
+		w.err = err
+	}
+	n := copy(b, w.out)
+	w.out = w.out[:copy(w.out, w.out[n:])]
+	return n, nil
+}
+
+// convert appends data as 16-bit samples
+func (w *WAVReader) convert(out []byte, data []byte) []byte {
+	if w.width == 2 {
+		return append(out, data...)
+	}
+	for i := 0; i < len(data); i += w.width {
+		var s int16
+		switch {
+		case w.float && w.width == 4:
+			s = Clip(float64(math.Float32frombits(binary.LittleEndian.Uint32(data[i:]))) * 32768)
+		case w.float:
+			s = Clip(math.Float64frombits(binary.LittleEndian.Uint64(data[i:])) * 32768)
+		case w.width == 1:
+			// 8-bit WAV is unsigned
+			s = int16(int(data[i])-128) << 8
+		default:
+			// the most significant two bytes
+			s = int16(binary.LittleEndian.Uint16(data[i+w.width-2:]))
+		}
+		out = append(out, byte(s), byte(uint16(s)>>8))
+	}
+	return out
+}
@@ -0,0 +1,119 @@
+package audio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"testing"
+	"testing/iotest"
+)
+
+func TestWAVRoundTrip(t *testing.T) {
+	in := sine(440, 22050, 0.5, 0.5)
+	samples, f, err := DecodeWAV(EncodeWAV(in, Format{Rate: 22050, Channels: 1}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != (Format{Rate: 22050, Channels: 1}) {
+		t.Errorf("format = %+v", f)
+	}
+	if len(samples) != len(in) {
+		t.Fatalf("%d samples, want %d", len(samples), len(in))
+	}
+	for i := range in {
+		if samples[i] != in[i] {
+			t.Fatalf("sample %d = %d, want %d", i, samples[i], in[i])
+		}
+	}
+}
+
+// wavFile makes a WAV file with a chunk before the format and one after the data
+func wavFile(format, channels, rate, bits int, data []byte, dataSize uint32) []byte {
+	var w bytes.Buffer
+	w.WriteString("RIFF\xff\xff\xff\xffWAVE")
+	w.WriteString("LIST")
+	binary.Write(&w, binary.LittleEndian, uint32(3))
+	w.WriteString("abc\x00")
+	w.WriteString("fmt ")
+	binary.Write(&w, binary.LittleEndian, uint32(16))
+	binary.Write(&w, binary.LittleEndian, []uint16{uint16(format), uint16(channels)})
+	binary.Write(&w, binary.LittleEndian, []uint32{uint32(rate), uint32(rate * channels * bits / 8)})
+	binary.Write(&w, binary.LittleEndian, []uint16{uint16(channels * bits / 8), uint16(bits)})
+	w.WriteString("data")
+	binary.Write(&w, binary.LittleEndian, dataSize)
+	w.Write(data)
+	return w.Bytes()
+}
+
+func TestWAVFormats(t *testing.T) {
+	tests := []struct {
+		name   string
+		format int
+		bits   int
+		data   []byte
+		want   []int16
+	}{
+		{"8-bit", wavPCM, 8, []byte{128, 255, 0}, []int16{0, 127 << 8, -32768}},
+		{"24-bit", wavPCM, 24, []byte{0x00, 0x34, 0x12, 0x00, 0x00, 0x80}, []int16{0x1234, -32768}},
+		{"32-bit", wavPCM, 32, []byte{0, 0, 0x34, 0x12}, []int16{0x1234}},
+		{"float", wavFloat, 32, float32s(0.5, -1, 2), []int16{16384, -32768, math.MaxInt16}},
+	}
+	for _, test := range tests {
+		samples, f, err := DecodeWAV(wavFile(test.format, 1, 8000, test.bits, test.data, uint32(len(test.data))))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if f.Rate != 8000 || len(samples) != len(test.want) {
+			t.Errorf("%s: %d samples at %d, want %d at 8000", test.name, len(samples), f.Rate, len(test.want))
+			continue
+		}
+		for i := range test.want {
+			if samples[i] != test.want[i] {
+				t.Errorf("%s: sample %d = %d, want %d", test.name, i, samples[i], test.want[i])
+			}
+		}
+	}
+	if _, _, err := DecodeWAV(wavFile(2, 1, 8000, 4, []byte{1, 2}, 2)); err != ErrNotPCM {
+		t.Errorf("ADPCM gave %v, want ErrNotPCM", err)
+	}
+	if _, _, err := DecodeWAV([]byte("RIFX")); err == nil {
+		t.Error("no error for something which isn't a WAV file")
+	}
+}
+
+func float32s(values ...float32) []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, values)
+	return b.Bytes()
+}
+
+func TestWAVReaderStreams(t *testing.T) {
+	// from a pipe, a byte at a time, with no data size, stereo
+	data := Bytes([]int16{1, 2, 3, 4, 5, 6})
+	r, err := NewWAVReader(iotest.OneByteReader(bytes.NewReader(wavFile(wavPCM, 2, 16000, 16, data, 0))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pcm, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Format.Channels != 2 || !bytes.Equal(pcm, data) {
+		t.Errorf("read %v with %d channels", Int16s(pcm), r.Format.Channels)
+	}
+	// a data size runs out before the chunk after it
+	file := append(wavFile(wavPCM, 1, 16000, 16, data[:4], 4), "LIST\x00\x00\x00\x00"...)
+	if samples, _, _ := DecodeWAV(file); len(samples) != 2 {
+		t.Errorf("read %d samples, want 2", len(samples))
+	}
+}
+
+func BenchmarkDecodeWAV(b *testing.B) {
+	file := EncodeWAV(sine(440, 44100, 1, 0.5), Format{Rate: 44100, Channels: 1})
+	b.SetBytes(int64(len(file)))
+	for i := 0; i < b.N; i++ {
+		DecodeWAV(file)
+	}
+}
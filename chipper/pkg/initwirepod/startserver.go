@@ -20,6 +20,7 @@ import (
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
 	wpweb "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/config-ws"
 	wp "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/preqs"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/replay"
 	sdkWeb "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/sdkapp"
 	"github.com/soheilhy/cmux"
 
@@ -80,14 +81,14 @@ func grpcServe(l net.Listener, p *wp.Server) error {
 	return srv.Transport().Serve(l)
 }
 
-func BeginWirepodSpecific(sttInitFunc func() error, sttHandlerFunc interface{}, voiceProcessorName string) error {
+func BeginWirepodSpecific(voiceProcessorName string) error {
 	logger.Init()
 
 	// begin wirepod stuff
 	vars.Init()
 	var err error
-	voiceProcessor, err = wp.New(sttInitFunc, sttHandlerFunc, voiceProcessorName)
-	wpweb.SttInitFunc = sttInitFunc
+	voiceProcessor, err = wp.New(voiceProcessorName)
+	wpweb.SttInitFunc = vars.SttInitFunc
 	go sdkWeb.BeginServer()
 	http.HandleFunc("/api-chipper/", ChipperHTTPApi)
 	if err != nil {
@@ -96,12 +97,17 @@ func BeginWirepodSpecific(sttInitFunc func() error, sttHandlerFunc interface{},
 	return nil
 }
 
-func StartFromProgramInit(sttInitFunc func() error, sttHandlerFunc interface{}, voiceProcessorName string) {
+// voiceProcessorName is the STT engine used when the config doesn't choose one which is built in
+func StartFromProgramInit(voiceProcessorName string) {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay.Run(voiceProcessorName, os.Args[2:])
+		return
+	}
 	if runtime.GOOS == "android" || runtime.GOOS == "ios" {
 		os.Setenv("DEBUG_LOGGING", "true")
 		os.Setenv("STT_SERVICE", "vosk")
 	}
-	err := BeginWirepodSpecific(sttInitFunc, sttHandlerFunc, voiceProcessorName)
+	err := BeginWirepodSpecific(voiceProcessorName)
 	if err != nil {
 		logger.Println("\033[33m\033[1mWire-pod is not setup. Use the webserver at port 8080 to set up wire-pod.\033[0m")
 	} else if !vars.APIConfig.PastInitialSetup {
@@ -0,0 +1,267 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Anthropic's messages API, which streams server-sent events
+
+const (
+	defaultAnthropicEndpoint = "https://api.anthropic.com"
+	anthropicVersion         = "2023-06-01"
+)
+
+type anthropicProvider struct {
+	endpoint string
+	key      string
+	model    string
+}
+
+func newAnthropic(c Config) *anthropicProvider {
+	endpoint := strings.TrimSuffix(c.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = defaultAnthropicEndpoint
+	}
+	return &anthropicProvider{endpoint: endpoint, key: c.Key, model: c.Model}
+}
+
+func (p *anthropicProvider) Name() string {
+	return "anthropic (" + p.model + ")"
+}
+
+func (p *anthropicProvider) Model() string {
+	return p.model
+}
+
+type anthropicBlock struct {
+	Type string `json:"type"`
+	Text string `json:"text,omitempty"`
+	// image
+	Source *anthropicImage `json:"source,omitempty"`
+	// tool_use
+	ID    string          `json:"id,omitempty"`
+	Name  string          `json:"name,omitempty"`
+	Input json.RawMessage `json:"input,omitempty"`
+	// tool_result
+	ToolUseID string `json:"tool_use_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+}
+
+type anthropicImage struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content []anthropicBlock `json:"content"`
+}
+
+type anthropicTool struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	InputSchema any    `json:"input_schema"`
+}
+
+type anthropicRequest struct {
+	Model       string             `json:"model"`
+	MaxTokens   int                `json:"max_tokens"`
+	System      string             `json:"system,omitempty"`
+	Messages    []anthropicMessage `json:"messages"`
+	Tools       []anthropicTool    `json:"tools,omitempty"`
+	Temperature *float32           `json:"temperature,omitempty"`
+	Stream      bool               `json:"stream"`
+}
+
+// anthropicMessages converts messages. the system prompt is separate, tool results are user
+// messages, and a role can't come twice in a row, so those are merged
+func anthropicMessages(msgs []Message) (string, []anthropicMessage) {
+	var system []string
+	var out []anthropicMessage
+	for _, m := range msgs {
+		var role string
+		var blocks []anthropicBlock
+		switch m.Role {
+		case RoleSystem:
+			system = append(system, m.Content)
+			continue
+		case RoleTool:
+			role = RoleUser
+			blocks = append(blocks, anthropicBlock{Type: "tool_result", ToolUseID: m.ToolCallID, Content: m.Content})
+		default:
+			role = m.Role
+			for _, img := range m.Images {
+				blocks = append(blocks, anthropicBlock{Type: "image", Source: &anthropicImage{
+					Type:      "base64",
+					MediaType: img.MediaType,
+					Data:      base64.StdEncoding.EncodeToString(img.Data),
+				}})
+			}
+			if m.Content != "" {
+				blocks = append(blocks, anthropicBlock{Type: "text", Text: m.Content})
+			}
+			for _, call := range m.ToolCalls {
+				input := json.RawMessage(call.Arguments)
+				if !json.Valid(input) {
+					input = json.RawMessage("{}")
+				}
+				blocks = append(blocks, anthropicBlock{Type: "tool_use", ID: call.ID, Name: call.Name, Input: input})
+			}
+		}
+		if len(blocks) == 0 {
+			continue
+		}
+		if len(out) > 0 && out[len(out)-1].Role == role {
+			out[len(out)-1].Content = append(out[len(out)-1].Content, blocks...)
+			continue
+		}
+		out = append(out, anthropicMessage{Role: role, Content: blocks})
+	}
+	return strings.Join(system, "\n\n"), out
+}
+
+func (p *anthropicProvider) ChatStream(ctx context.Context, req Request) (Stream, error) {
+	system, msgs := anthropicMessages(req.Messages)
+	areq := anthropicRequest{
+		Model:     p.model,
+		MaxTokens: maxTokens(req),
+		System:    system,
+		Messages:  msgs,
+		Stream:    true,
+	}
+	if req.Temperature > 0 {
+		// anthropic only goes up to 1
+		temperature := req.Temperature
+		if temperature > 1 {
+			temperature = 1
+		}
+		areq.Temperature = &temperature
+	}
+	for _, tool := range req.Tools {
+		schema := tool.Parameters
+		if schema == nil {
+			schema = map[string]any{"type": "object", "properties": map[string]any{}}
+		}
+		areq.Tools = append(areq.Tools, anthropicTool{Name: tool.Name, Description: tool.Description, InputSchema: schema})
+	}
+	body, err := json.Marshal(areq)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint+"/v1/messages", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("x-api-key", p.key)
+	httpReq.Header.Set("anthropic-version", anthropicVersion)
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		errBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("anthropic returned %s: %s", resp.Status, strings.TrimSpace(string(errBody)))
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4<<20)
+	return &anthropicStream{body: resp.Body, scanner: scanner, blocks: make(map[int]*ToolCall)}, nil
+}
+
+type anthropicEvent struct {
+	Type         string `json:"type"`
+	Index        int    `json:"index"`
+	ContentBlock struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"content_block"`
+	Delta struct {
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+	} `json:"delta"`
+	Error struct {
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type anthropicStream struct {
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+	// tool_use blocks by content block index
+	blocks map[int]*ToolCall
+	order  []int
+	done   bool
+}
+
+func (s *anthropicStream) Recv() (string, error) {
+	for {
+		if s.done {
+			return "", io.EOF
+		}
+		if !s.scanner.Scan() {
+			if err := s.scanner.Err(); err != nil {
+				return "", err
+			}
+			return "", io.ErrUnexpectedEOF
+		}
+		line := s.scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		var event anthropicEvent
+		if err := json.Unmarshal([]byte(strings.TrimSpace(strings.TrimPrefix(line, "data:"))), &event); err != nil {
+			return "", err
+		}
+		switch event.Type {
+		case "content_block_start":
+			if event.ContentBlock.Type == "tool_use" {
+				s.blocks[event.Index] = &ToolCall{ID: event.ContentBlock.ID, Name: event.ContentBlock.Name}
+				s.order = append(s.order, event.Index)
+			}
+		case "content_block_delta":
+			switch event.Delta.Type {
+			case "text_delta":
+				if event.Delta.Text != "" {
+					return event.Delta.Text, nil
+				}
+			case "input_json_delta":
+				if call, ok := s.blocks[event.Index]; ok {
+					call.Arguments += event.Delta.PartialJSON
+				}
+			}
+		case "message_stop":
+			s.done = true
+		case "error":
+			return "", errors.New("anthropic: " + event.Error.Message)
+		}
+	}
+}
+
+func (s *anthropicStream) ToolCalls() []ToolCall {
+	var calls []ToolCall
+	for _, i := range s.order {
+		call := *s.blocks[i]
+		if call.Arguments == "" {
+			call.Arguments = "{}"
+		}
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+func (s *anthropicStream) Close() error {
+	return s.body.Close()
+}
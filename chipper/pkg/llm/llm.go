@@ -0,0 +1,213 @@
+// Package llm talks to chat LLMs. A Provider hides whether that is an OpenAI-compatible API,
+// Ollama's own API or Anthropic's messages API. A Chain tries providers in order, so a second
+// model or service can take over when the first one fails.
+package llm
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
+)
+
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+	// the result of a tool call
+	RoleTool = "tool"
+)
+
+const defaultMaxTokens = 2048
+
+type Image struct {
+	// like image/jpeg
+	MediaType string
+	Data      []byte
+}
+
+type ToolCall struct {
+	ID   string
+	Name string
+	// JSON object
+	Arguments string
+}
+
+type Message struct {
+	Role    string
+	Content string
+	// only for user messages
+	Images []Image
+	// the tools an assistant message calls
+	ToolCalls []ToolCall
+	// for tool messages, the call this is the result of
+	ToolCallID string
+	Name       string
+}
+
+type Tool struct {
+	Name        string
+	Description string
+	// JSON schema of the arguments. anything which marshals to one
+	Parameters any
+}
+
+type Request struct {
+	Messages    []Message
+	Tools       []Tool
+	MaxTokens   int
+	Temperature float32
+}
+
+// Stream is an answer being generated
+type Stream interface {
+	// Recv returns the next piece of text, and io.EOF once the answer is done
+	Recv() (string, error)
+	// ToolCalls are the tools the model called. complete once Recv returned io.EOF
+	ToolCalls() []ToolCall
+	Close() error
+}
+
+type Provider interface {
+	// like "openai (gpt-4o-mini)", for logs
+	Name() string
+	Model() string
+	ChatStream(ctx context.Context, req Request) (Stream, error)
+}
+
+// Config selects and sets up a provider
+type Config struct {
+	// openai, together, custom (any OpenAI-compatible API), ollama or anthropic
+	Type     string
+	Key      string
+	Endpoint string
+	Model    string
+}
+
+// New returns the provider for a config
+func New(c Config) (Provider, error) {
+	if c.Model == "" {
+		return nil, errors.New(c.Type + ": no model set")
+	}
+	switch c.Type {
+	case "openai":
+		// the endpoint is optional, for proxies
+		return newOpenAI(c, c.Endpoint), nil
+	case "together":
+		return newOpenAI(c, "https://api.together.xyz/v1"), nil
+	case "custom":
+		if c.Endpoint == "" {
+			return nil, errors.New("custom: no endpoint set")
+		}
+		return newOpenAI(c, c.Endpoint), nil
+	case "ollama":
+		return newOllama(c), nil
+	case "anthropic":
+		return newAnthropic(c), nil
+	}
+	return nil, errors.New("unknown LLM provider " + c.Type)
+}
+
+// Chain tries each provider until one starts answering
+type Chain []Provider
+
+// NewChain makes a chain from configs. ones which can't be set up are logged and left out
+func NewChain(configs ...Config) (Provider, error) {
+	var chain Chain
+	for _, c := range configs {
+		p, err := New(c)
+		if err != nil {
+			logger.Println("Not using LLM provider: " + err.Error())
+			continue
+		}
+		chain = append(chain, p)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no usable LLM provider")
+	}
+	if len(chain) == 1 {
+		return chain[0], nil
+	}
+	return chain, nil
+}
+
+func (c Chain) Name() string {
+	var names []string
+	for _, p := range c {
+		names = append(names, p.Name())
+	}
+	return strings.Join(names, " -> ")
+}
+
+func (c Chain) Model() string {
+	return c[0].Model()
+}
+
+// chainStream is a stream from one of a chain's providers
+type chainStream struct {
+	Stream
+	model string
+}
+
+// StreamModel is the model a stream from p comes from. for a chain, that's the model of the
+// provider which answered
+func StreamModel(p Provider, s Stream) string {
+	if s, ok := s.(chainStream); ok {
+		return s.model
+	}
+	return p.Model()
+}
+
+func (c Chain) ChatStream(ctx context.Context, req Request) (Stream, error) {
+	var err error
+	for i, p := range c {
+		var stream Stream
+		stream, err = p.ChatStream(ctx, req)
+		if err == nil {
+			return chainStream{Stream: stream, model: p.Model()}, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		if i < len(c)-1 {
+			logger.Println("LLM " + p.Name() + " failed (" + err.Error() + "), falling back to " + c[i+1].Name())
+		}
+	}
+	return nil, err
+}
+
+// Response is a whole answer
+type Response struct {
+	Content   string
+	ToolCalls []ToolCall
+}
+
+// Chat waits for the whole answer
+func Chat(ctx context.Context, p Provider, req Request) (Response, error) {
+	stream, err := p.ChatStream(ctx, req)
+	if err != nil {
+		return Response{}, err
+	}
+	defer stream.Close()
+	var content strings.Builder
+	for {
+		text, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return Response{}, err
+		}
+		content.WriteString(text)
+	}
+	return Response{Content: content.String(), ToolCalls: stream.ToolCalls()}, nil
+}
+
+func maxTokens(req Request) int {
+	if req.MaxTokens > 0 {
+		return req.MaxTokens
+	}
+	return defaultMaxTokens
+}
@@ -0,0 +1,183 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Ollama's own /api/chat, which streams JSON lines
+
+const defaultOllamaEndpoint = "http://localhost:11434"
+
+type ollamaProvider struct {
+	endpoint string
+	model    string
+}
+
+func newOllama(c Config) *ollamaProvider {
+	endpoint := strings.TrimSuffix(c.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = defaultOllamaEndpoint
+	}
+	// people paste the OpenAI-compatible url
+	endpoint = strings.TrimSuffix(endpoint, "/v1")
+	return &ollamaProvider{endpoint: endpoint, model: c.Model}
+}
+
+func (p *ollamaProvider) Name() string {
+	return "ollama (" + p.model + ")"
+}
+
+func (p *ollamaProvider) Model() string {
+	return p.model
+}
+
+type ollamaToolCall struct {
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+}
+
+type ollamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Images    [][]byte         `json:"images,omitempty"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+}
+
+type ollamaTool struct {
+	Type     string `json:"type"`
+	Function struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Parameters  any    `json:"parameters"`
+	} `json:"function"`
+}
+
+type ollamaRequest struct {
+	Model    string          `json:"model"`
+	Messages []ollamaMessage `json:"messages"`
+	Tools    []ollamaTool    `json:"tools,omitempty"`
+	Stream   bool            `json:"stream"`
+	Options  map[string]any  `json:"options,omitempty"`
+}
+
+type ollamaChunk struct {
+	Message ollamaMessage `json:"message"`
+	Done    bool          `json:"done"`
+	Error   string        `json:"error"`
+}
+
+func (p *ollamaProvider) ChatStream(ctx context.Context, req Request) (Stream, error) {
+	oreq := ollamaRequest{
+		Model:  p.model,
+		Stream: true,
+		Options: map[string]any{
+			"num_predict": maxTokens(req),
+		},
+	}
+	if req.Temperature > 0 {
+		oreq.Options["temperature"] = req.Temperature
+	}
+	for _, m := range req.Messages {
+		om := ollamaMessage{Role: m.Role, Content: m.Content}
+		// encoding/json sends []byte as base64, which is what ollama wants
+		for _, img := range m.Images {
+			om.Images = append(om.Images, img.Data)
+		}
+		for _, call := range m.ToolCalls {
+			var oc ollamaToolCall
+			oc.Function.Name = call.Name
+			oc.Function.Arguments = json.RawMessage(call.Arguments)
+			if !json.Valid(oc.Function.Arguments) {
+				oc.Function.Arguments = json.RawMessage("{}")
+			}
+			om.ToolCalls = append(om.ToolCalls, oc)
+		}
+		oreq.Messages = append(oreq.Messages, om)
+	}
+	for _, tool := range req.Tools {
+		var ot ollamaTool
+		ot.Type = "function"
+		ot.Function.Name = tool.Name
+		ot.Function.Description = tool.Description
+		ot.Function.Parameters = tool.Parameters
+		oreq.Tools = append(oreq.Tools, ot)
+	}
+	body, err := json.Marshal(oreq)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint+"/api/chat", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		errBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("ollama returned %s: %s", resp.Status, strings.TrimSpace(string(errBody)))
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 4<<20)
+	return &ollamaStream{body: resp.Body, scanner: scanner}, nil
+}
+
+type ollamaStream struct {
+	body    io.ReadCloser
+	scanner *bufio.Scanner
+	calls   []ToolCall
+	done    bool
+}
+
+func (s *ollamaStream) Recv() (string, error) {
+	for {
+		if s.done {
+			return "", io.EOF
+		}
+		if !s.scanner.Scan() {
+			if err := s.scanner.Err(); err != nil {
+				return "", err
+			}
+			return "", io.ErrUnexpectedEOF
+		}
+		var chunk ollamaChunk
+		if err := json.Unmarshal(s.scanner.Bytes(), &chunk); err != nil {
+			return "", err
+		}
+		if chunk.Error != "" {
+			return "", errors.New("ollama: " + chunk.Error)
+		}
+		for _, call := range chunk.Message.ToolCalls {
+			s.calls = append(s.calls, ToolCall{
+				ID:        fmt.Sprint("call_", len(s.calls)),
+				Name:      call.Function.Name,
+				Arguments: string(call.Function.Arguments),
+			})
+		}
+		s.done = chunk.Done
+		if chunk.Message.Content != "" {
+			return chunk.Message.Content, nil
+		}
+	}
+}
+
+func (s *ollamaStream) ToolCalls() []ToolCall {
+	return s.calls
+}
+
+func (s *ollamaStream) Close() error {
+	return s.body.Close()
+}
@@ -0,0 +1,176 @@
+package llm
+
+import (
+	"context"
+	"encoding/base64"
+	"sort"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// OpenAI and every API which copies it (together, LocalAI, vLLM, LM Studio...)
+type openAIProvider struct {
+	kind   string
+	model  string
+	client *openai.Client
+}
+
+func newOpenAI(c Config, baseURL string) *openAIProvider {
+	conf := openai.DefaultConfig(c.Key)
+	if baseURL != "" {
+		conf.BaseURL = baseURL
+	}
+	return &openAIProvider{kind: c.Type, model: c.Model, client: openai.NewClientWithConfig(conf)}
+}
+
+func (p *openAIProvider) Name() string {
+	return p.kind + " (" + p.model + ")"
+}
+
+func (p *openAIProvider) Model() string {
+	return p.model
+}
+
+// OpenAIMessages converts messages to go-openai's
+func OpenAIMessages(msgs []Message) []openai.ChatCompletionMessage {
+	var out []openai.ChatCompletionMessage
+	for _, m := range msgs {
+		om := openai.ChatCompletionMessage{
+			Role:       m.Role,
+			Name:       m.Name,
+			ToolCallID: m.ToolCallID,
+		}
+		if len(m.Images) > 0 {
+			if m.Content != "" {
+				om.MultiContent = append(om.MultiContent, openai.ChatMessagePart{
+					Type: openai.ChatMessagePartTypeText,
+					Text: m.Content,
+				})
+			}
+			for _, img := range m.Images {
+				om.MultiContent = append(om.MultiContent, openai.ChatMessagePart{
+					Type: openai.ChatMessagePartTypeImageURL,
+					ImageURL: &openai.ChatMessageImageURL{
+						URL:    "data:" + img.MediaType + ";base64," + base64.StdEncoding.EncodeToString(img.Data),
+						Detail: openai.ImageURLDetailLow,
+					},
+				})
+			}
+		} else {
+			om.Content = m.Content
+		}
+		for _, call := range m.ToolCalls {
+			om.ToolCalls = append(om.ToolCalls, openai.ToolCall{
+				ID:       call.ID,
+				Type:     openai.ToolTypeFunction,
+				Function: openai.FunctionCall{Name: call.Name, Arguments: call.Arguments},
+			})
+		}
+		out = append(out, om)
+	}
+	return out
+}
+
+// FromOpenAIMessages converts go-openai messages, like remembered chats, to messages
+func FromOpenAIMessages(msgs []openai.ChatCompletionMessage) []Message {
+	var out []Message
+	for _, om := range msgs {
+		m := Message{
+			Role:       om.Role,
+			Content:    om.Content,
+			Name:       om.Name,
+			ToolCallID: om.ToolCallID,
+		}
+		for _, part := range om.MultiContent {
+			if part.Type == openai.ChatMessagePartTypeText {
+				m.Content += part.Text
+			}
+		}
+		for _, call := range om.ToolCalls {
+			m.ToolCalls = append(m.ToolCalls, ToolCall{ID: call.ID, Name: call.Function.Name, Arguments: call.Function.Arguments})
+		}
+		out = append(out, m)
+	}
+	return out
+}
+
+func (p *openAIProvider) ChatStream(ctx context.Context, req Request) (Stream, error) {
+	oreq := openai.ChatCompletionRequest{
+		Model:       p.model,
+		Messages:    OpenAIMessages(req.Messages),
+		MaxTokens:   maxTokens(req),
+		Temperature: req.Temperature,
+		TopP:        1,
+		Stream:      true,
+	}
+	for _, tool := range req.Tools {
+		oreq.Tools = append(oreq.Tools, openai.Tool{
+			Type: openai.ToolTypeFunction,
+			Function: &openai.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+	stream, err := p.client.CreateChatCompletionStream(ctx, oreq)
+	if err != nil {
+		return nil, err
+	}
+	return &openAIStream{stream: stream, calls: make(map[int]*ToolCall)}, nil
+}
+
+type openAIStream struct {
+	stream *openai.ChatCompletionStream
+	// tool calls come in pieces, by index
+	calls map[int]*ToolCall
+}
+
+func (s *openAIStream) Recv() (string, error) {
+	for {
+		resp, err := s.stream.Recv()
+		if err != nil {
+			return "", err
+		}
+		if len(resp.Choices) == 0 {
+			continue
+		}
+		delta := resp.Choices[0].Delta
+		for i, call := range delta.ToolCalls {
+			index := i
+			if call.Index != nil {
+				index = *call.Index
+			}
+			c, ok := s.calls[index]
+			if !ok {
+				c = &ToolCall{}
+				s.calls[index] = c
+			}
+			if call.ID != "" {
+				c.ID = call.ID
+			}
+			c.Name += call.Function.Name
+			c.Arguments += call.Function.Arguments
+		}
+		if delta.Content != "" {
+			return delta.Content, nil
+		}
+	}
+}
+
+func (s *openAIStream) ToolCalls() []ToolCall {
+	var indexes []int
+	for i := range s.calls {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	var calls []ToolCall
+	for _, i := range indexes {
+		calls = append(calls, *s.calls[i])
+	}
+	return calls
+}
+
+func (s *openAIStream) Close() error {
+	return s.stream.Close()
+}
@@ -0,0 +1,118 @@
+package llm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// the part of JSON schema tool parameters use: objects of strings, numbers, integers and
+// booleans, with required, enum, minimum and maximum
+
+// ValidateArgs checks a tool call's arguments against the tool's parameter schema (a
+// map[string]any, like the ones given to Tool) and returns them decoded
+func ValidateArgs(schema any, args string) (map[string]any, error) {
+	decoded := map[string]any{}
+	if args != "" {
+		if err := json.Unmarshal([]byte(args), &decoded); err != nil {
+			return nil, errors.New("arguments aren't a JSON object")
+		}
+		if decoded == nil {
+			decoded = map[string]any{}
+		}
+	}
+	s, ok := schema.(map[string]any)
+	if !ok {
+		return decoded, nil
+	}
+	props, _ := s["properties"].(map[string]any)
+	for _, name := range stringList(s["required"]) {
+		if _, ok := decoded[name]; !ok {
+			return nil, errors.New("missing argument " + name)
+		}
+	}
+	var names []string
+	for name := range decoded {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		prop, ok := props[name].(map[string]any)
+		if !ok {
+			// models sometimes add things, which don't hurt
+			delete(decoded, name)
+			continue
+		}
+		if err := validateValue(prop, decoded[name]); err != nil {
+			return nil, fmt.Errorf("argument %s: %w", name, err)
+		}
+	}
+	return decoded, nil
+}
+
+func validateValue(schema map[string]any, value any) error {
+	switch schema["type"] {
+	case "string":
+		if _, ok := value.(string); !ok {
+			return errors.New("should be a string")
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return errors.New("should be true or false")
+		}
+	case "number", "integer":
+		n, ok := value.(float64)
+		if !ok {
+			return errors.New("should be a number")
+		}
+		if schema["type"] == "integer" && n != math.Trunc(n) {
+			return errors.New("should be a whole number")
+		}
+		if min, ok := toFloat(schema["minimum"]); ok && n < min {
+			return fmt.Errorf("should be at least %v", min)
+		}
+		if max, ok := toFloat(schema["maximum"]); ok && n > max {
+			return fmt.Errorf("should be at most %v", max)
+		}
+	}
+	if enum := stringList(schema["enum"]); len(enum) > 0 {
+		str, _ := value.(string)
+		for _, choice := range enum {
+			if str == choice {
+				return nil
+			}
+		}
+		return fmt.Errorf("should be one of %v", enum)
+	}
+	return nil
+}
+
+func toFloat(v any) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case int:
+		return float64(n), true
+	}
+	return 0, false
+}
+
+// stringList reads a []string or a []any of strings, so schemas can be written either way or
+// come from JSON
+func stringList(v any) []string {
+	switch list := v.(type) {
+	case []string:
+		return list
+	case []any:
+		var strs []string
+		for _, item := range list {
+			if str, ok := item.(string); ok {
+				strs = append(strs, str)
+			}
+		}
+		return strs
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// Package pluginapi is what wire-pod plugins (go build -buildmode=plugin, in ./plugins) build against.
+//
+// A version 2 plugin exports
+//
+//	var APIVersion = pluginapi.Version
+//	var Plugin pluginapi.Plugin = myPlugin{}
+//
+// Plugins which export Utterances, Name and Action (version 1) still load.
+package pluginapi
+
+import (
+	"context"
+
+	"github.com/fforchino/vector-go-sdk/pkg/vector"
+)
+
+// Version is the plugin API version this wire-pod understands
+const Version = 2
+
+// Utterance is something which triggers a plugin. set Text or Regex
+type Utterance struct {
+	// matches if the transcript contains it. "*" matches everything
+	Text string
+	// matches against the lowercase transcript. named groups ((?P<name>...)) become slots
+	Regex string
+	// higher is tried first. version 1 plugins are 0
+	Priority int
+}
+
+// Request is a matched voice request
+type Request struct {
+	// lowercase transcript
+	Text   string
+	ESN    string
+	Locale string
+	// connected to the robot. nil if wire-pod has no SDK token for it
+	Robot *vector.Vector
+	// named groups of the regex which matched
+	Slots map[string]string
+	// prints to the wire-pod log, prefixed with the plugin's name
+	Log func(a ...any)
+}
+
+// Result is what the plugin did. an empty Result means the plugin didn't handle
+// the request after all, and the next plugin or intent gets it
+type Result struct {
+	// sent to the robot, with Params
+	Intent string
+	Params map[string]string
+	// said by the robot
+	SpokenText string
+	// sent to the LLM as if the user had said it, and the answer is said by the robot.
+	// needs knowledge graph to be set up with an LLM
+	LLMFollowUp string
+}
+
+// Empty is true if the plugin declined the request
+func (r Result) Empty() bool {
+	return r.Intent == "" && r.SpokenText == "" && r.LLMFollowUp == ""
+}
+
+// Plugin is a version 2 plugin
+type Plugin interface {
+	Name() string
+	Utterances() []Utterance
+	// ctx is cancelled when the request times out or the robot goes away
+	Handle(ctx context.Context, req Request) (Result, error)
+}
@@ -0,0 +1,603 @@
+// Package pluginhost runs plugins as separate programs, written in any language.
+//
+// Every executable in the plugins directory is started, and talks to wire-pod with one JSON object
+// per line: requests on its stdin, responses on its stdout. Anything it prints to stderr is logged.
+//
+//	-> {"id": 1, "method": "describe"}
+//	<- {"id": 1, "result": {"name": "Lights", "utterances": [{"regex": "lights (?P<state>on|off)"}],
+//	    "functions": [{"name": "set_lights", "description": "...", "parameters": {...}}]}}
+//	-> {"id": 2, "method": "handle", "params": {"text": "lights on", "esn": "00e20145", "locale": "en-US",
+//	    "guid": "...", "target": "192.168.1.150:443", "slots": {"state": "on"}}}
+//	<- {"id": 2, "result": {"intent": "intent_imperative_praise", "spoken_text": "Done"}}
+//	-> {"id": 3, "method": "call", "params": {"function": "set_lights", "arguments": "{\"state\": \"on\"}"}}
+//	<- {"id": 3, "result": {"result": "the lights are on"}}
+//	-> {"id": 4, "method": "ping"}
+//	<- {"id": 4, "result": "pong"}
+//
+// A failed request is answered with {"id": n, "error": "..."}. An empty handle result means the plugin
+// declined. Plugins which stop answering pings, or exit, are restarted.
+package pluginhost
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/pluginapi"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
+)
+
+const DefaultDir = "./plugins/exec"
+
+const (
+	describeTimeout = time.Second * 10
+	pingInterval    = time.Second * 30
+	pingTimeout     = time.Second * 5
+	// restarts are delayed by this, doubling up to maxRestartDelay while the plugin keeps crashing
+	minRestartDelay = time.Second
+	maxRestartDelay = time.Minute
+	// a plugin which has been up this long isn't crashing anymore
+	stableUptime = time.Minute
+	// longest line a plugin can send
+	maxLineSize = 4 << 20
+	// a plugin which doesn't take a request from its stdin in this long is stuck, and killed
+	writeTimeout = time.Second * 5
+)
+
+// how long replaced plugin programs keep running, so requests they are handling can finish
+var ReplaceGrace = time.Second * 30
+
+var ErrNotRunning = errors.New("plugin isn't running")
+
+var errWriteTimeout = errors.New("plugin isn't reading its stdin")
+
+type request struct {
+	ID     int64       `json:"id"`
+	Method string      `json:"method"`
+	Params interface{} `json:"params,omitempty"`
+}
+
+// a line for writeLoop to send to the plugin
+type write struct {
+	line []byte
+	done chan error
+}
+
+type response struct {
+	ID     int64           `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+type Utterance struct {
+	Text     string `json:"text,omitempty"`
+	Regex    string `json:"regex,omitempty"`
+	Priority int    `json:"priority,omitempty"`
+}
+
+type Function struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Parameters  json.RawMessage `json:"parameters"`
+}
+
+type Description struct {
+	Name       string      `json:"name"`
+	Utterances []Utterance `json:"utterances"`
+	Functions  []Function  `json:"functions"`
+}
+
+type HandleParams struct {
+	Text   string            `json:"text"`
+	ESN    string            `json:"esn"`
+	Locale string            `json:"locale"`
+	GUID   string            `json:"guid"`
+	Target string            `json:"target"`
+	Slots  map[string]string `json:"slots"`
+}
+
+type HandleResult struct {
+	Intent      string            `json:"intent"`
+	Params      map[string]string `json:"params"`
+	SpokenText  string            `json:"spoken_text"`
+	LLMFollowUp string            `json:"llm_follow_up"`
+}
+
+type CallParams struct {
+	Function  string `json:"function"`
+	Arguments string `json:"arguments"`
+}
+
+type CallResult struct {
+	Result string `json:"result"`
+}
+
+// Process is a running plugin program
+type Process struct {
+	Path string
+
+	mu        sync.Mutex
+	desc      Description
+	cmd       *exec.Cmd
+	stdin     io.WriteCloser
+	writes    chan write
+	pending   map[int64]chan response
+	nextID    int64
+	running   bool
+	stopped   bool
+	exited    chan struct{}
+	startedAt time.Time
+}
+
+var processes []*Process
+var processesMu sync.Mutex
+
+func isExecutable(entry os.DirEntry) bool {
+	if entry.IsDir() {
+		return false
+	}
+	if runtime.GOOS == "windows" {
+		return strings.HasSuffix(strings.ToLower(entry.Name()), ".exe")
+	}
+	info, err := entry.Info()
+	return err == nil && info.Mode()&0111 != 0
+}
+
+// launch starts every plugin program in dir. if strict, it stops at the first one which fails
+func launch(dir string, strict bool) ([]*Process, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var started []*Process
+	for _, entry := range entries {
+		if !isExecutable(entry) {
+			continue
+		}
+		path, _ := filepath.Abs(filepath.Join(dir, entry.Name()))
+		p := &Process{Path: path}
+		logger.Println("Starting plugin program " + entry.Name())
+		if err := p.start(); err != nil {
+			err = errors.New("plugin program " + entry.Name() + ": " + err.Error())
+			if strict {
+				stop(started)
+				return nil, err
+			}
+			logger.Println("Error starting " + err.Error())
+			continue
+		}
+		logger.Println("Plugin program " + entry.Name() + " (" + p.Description().Name + ") started")
+		go p.supervise()
+		started = append(started, p)
+	}
+	return started, nil
+}
+
+func stop(procs []*Process) {
+	for _, p := range procs {
+		p.Stop()
+	}
+}
+
+// Start launches every plugin program in dir and returns the ones which described themselves
+func Start(dir string) []*Process {
+	started, err := launch(dir, false)
+	if err != nil {
+		logger.Println("Unable to load plugin programs: " + err.Error())
+	}
+	processesMu.Lock()
+	processes = append(processes, started...)
+	processesMu.Unlock()
+	return started
+}
+
+// Launch starts every plugin program in dir without making them active.
+// if any of them fails, the others are stopped again
+func Launch(dir string) ([]*Process, error) {
+	return launch(dir, true)
+}
+
+// Activate replaces the running plugin programs with procs (from Launch).
+// the old ones get until ReplaceGrace to finish what they are doing
+func Activate(procs []*Process) {
+	processesMu.Lock()
+	old := processes
+	processes = procs
+	processesMu.Unlock()
+	if len(old) > 0 {
+		time.AfterFunc(ReplaceGrace, func() {
+			stop(old)
+		})
+	}
+}
+
+// Discard stops plugin programs which were launched but not activated
+func Discard(procs []*Process) {
+	stop(procs)
+}
+
+// StopAll stops every plugin program
+func StopAll() {
+	processesMu.Lock()
+	stopping := processes
+	processes = nil
+	processesMu.Unlock()
+	stop(stopping)
+}
+
+func (p *Process) logName() string {
+	return "Plugin " + filepath.Base(p.Path)
+}
+
+func (p *Process) start() error {
+	cmd := exec.Command(p.Path)
+	cmd.Dir = filepath.Dir(p.Path)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan struct{})
+	writes := make(chan write)
+	p.mu.Lock()
+	p.cmd = cmd
+	p.stdin = stdin
+	p.writes = writes
+	p.pending = make(map[int64]chan response)
+	p.running = true
+	p.exited = exited
+	p.startedAt = time.Now()
+	p.mu.Unlock()
+
+	go p.logStderr(stderr)
+	go p.readLoop(stdout, cmd, exited)
+	go writeLoop(stdin, writes, exited)
+
+	ctx, cancel := context.WithTimeout(context.Background(), describeTimeout)
+	defer cancel()
+	var desc Description
+	if err := p.call(ctx, "describe", nil, &desc); err != nil {
+		p.kill()
+		return errors.New("describe: " + err.Error())
+	}
+	if desc.Name == "" {
+		desc.Name = filepath.Base(p.Path)
+	}
+	p.mu.Lock()
+	p.desc = desc
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *Process) logStderr(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		logger.Println(p.logName() + ": " + scanner.Text())
+	}
+}
+
+func (p *Process) readLoop(stdout io.Reader, cmd *exec.Cmd, exited chan struct{}) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLineSize)
+	for scanner.Scan() {
+		var resp response
+		if err := json.Unmarshal(scanner.Bytes(), &resp); err != nil {
+			logger.Println(p.logName() + " sent something which isn't a response: " + scanner.Text())
+			continue
+		}
+		p.mu.Lock()
+		ch, ok := p.pending[resp.ID]
+		delete(p.pending, resp.ID)
+		p.mu.Unlock()
+		if ok {
+			ch <- resp
+		}
+	}
+	err := cmd.Wait()
+	p.mu.Lock()
+	p.running = false
+	for id, ch := range p.pending {
+		ch <- response{ID: id, Error: ErrNotRunning.Error()}
+	}
+	p.pending = nil
+	p.mu.Unlock()
+	if err != nil {
+		logger.Println(p.logName() + " exited: " + err.Error())
+	} else {
+		logger.Println(p.logName() + " exited")
+	}
+	close(exited)
+}
+
+// writeLoop sends lines to the plugin one at a time, so a plugin which stops reading only holds
+// up its own requests
+func writeLoop(stdin io.Writer, writes chan write, exited chan struct{}) {
+	for {
+		select {
+		case w := <-writes:
+			_, err := stdin.Write(w.line)
+			w.done <- err
+		case <-exited:
+			return
+		}
+	}
+}
+
+// send has writeLoop write a line, and kills the plugin if it isn't taken in writeTimeout
+func (p *Process) send(ctx context.Context, writes chan write, exited chan struct{}, line []byte) error {
+	w := write{line: line, done: make(chan error, 1)}
+	timer := time.NewTimer(writeTimeout)
+	defer timer.Stop()
+	select {
+	case writes <- w:
+	case <-exited:
+		return ErrNotRunning
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		logger.Println(p.logName() + " isn't reading requests, killing it")
+		p.kill()
+		return errWriteTimeout
+	}
+	select {
+	case err := <-w.done:
+		return err
+	case <-timer.C:
+		logger.Println(p.logName() + " isn't reading requests, killing it")
+		p.kill()
+		return errWriteTimeout
+	}
+}
+
+func (p *Process) removePending(id int64) {
+	p.mu.Lock()
+	if p.pending != nil {
+		delete(p.pending, id)
+	}
+	p.mu.Unlock()
+}
+
+func (p *Process) call(ctx context.Context, method string, params interface{}, out interface{}) error {
+	p.mu.Lock()
+	if !p.running {
+		p.mu.Unlock()
+		return ErrNotRunning
+	}
+	p.nextID++
+	id := p.nextID
+	line, err := json.Marshal(request{ID: id, Method: method, Params: params})
+	if err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	ch := make(chan response, 1)
+	p.pending[id] = ch
+	writes := p.writes
+	exited := p.exited
+	p.mu.Unlock()
+
+	if err := p.send(ctx, writes, exited, append(line, '\n')); err != nil {
+		p.removePending(id)
+		return err
+	}
+
+	select {
+	case resp := <-ch:
+		if resp.Error != "" {
+			return errors.New(resp.Error)
+		}
+		if out != nil && len(resp.Result) > 0 {
+			return json.Unmarshal(resp.Result, out)
+		}
+		return nil
+	case <-ctx.Done():
+		p.removePending(id)
+		return ctx.Err()
+	}
+}
+
+func (p *Process) kill() {
+	p.mu.Lock()
+	cmd := p.cmd
+	p.mu.Unlock()
+	if cmd != nil && cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
+
+// supervise restarts the plugin when it exits or stops answering pings
+func (p *Process) supervise() {
+	delay := minRestartDelay
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		p.mu.Lock()
+		exited := p.exited
+		p.mu.Unlock()
+		select {
+		case <-exited:
+			p.mu.Lock()
+			stopped := p.stopped
+			uptime := time.Since(p.startedAt)
+			p.mu.Unlock()
+			if stopped {
+				return
+			}
+			if uptime > stableUptime {
+				delay = minRestartDelay
+			}
+			logger.Println(p.logName() + " will be restarted in " + delay.String())
+			time.Sleep(delay)
+			if p.isStopped() {
+				return
+			}
+			if err := p.start(); err != nil {
+				logger.Println("Error restarting " + p.logName() + ": " + err.Error())
+			}
+			delay *= 2
+			if delay > maxRestartDelay {
+				delay = maxRestartDelay
+			}
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+			err := p.call(ctx, "ping", nil, nil)
+			cancel()
+			if err != nil && err != ErrNotRunning {
+				logger.Println(p.logName() + " didn't answer a ping (" + err.Error() + "), killing it")
+				p.kill()
+			}
+		}
+	}
+}
+
+func (p *Process) isStopped() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stopped
+}
+
+// Stop kills the plugin and doesn't restart it
+func (p *Process) Stop() {
+	p.mu.Lock()
+	p.stopped = true
+	stdin := p.stdin
+	exited := p.exited
+	p.mu.Unlock()
+	if stdin != nil {
+		// well-behaved plugins exit when stdin closes
+		stdin.Close()
+	}
+	if exited == nil {
+		return
+	}
+	select {
+	case <-exited:
+	case <-time.After(time.Second * 2):
+		p.kill()
+	}
+}
+
+func (p *Process) Description() Description {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.desc
+}
+
+// Handle asks the plugin to handle a matched voice request
+func (p *Process) Handle(ctx context.Context, params HandleParams) (HandleResult, error) {
+	var result HandleResult
+	err := p.call(ctx, "handle", params, &result)
+	return result, err
+}
+
+// Call runs one of the plugin's LLM functions
+func (p *Process) Call(ctx context.Context, function string, arguments string) (string, error) {
+	var result CallResult
+	err := p.call(ctx, "call", CallParams{Function: function, Arguments: arguments}, &result)
+	return result.Result, err
+}
+
+// Functions returns the LLM functions of every plugin program
+func Functions() []openai.FunctionDefinition {
+	processesMu.Lock()
+	defer processesMu.Unlock()
+	var defs []openai.FunctionDefinition
+	for _, p := range processes {
+		for _, f := range p.Description().Functions {
+			def := openai.FunctionDefinition{Name: f.Name, Description: f.Description}
+			if len(f.Parameters) > 0 {
+				def.Parameters = f.Parameters
+			} else {
+				def.Parameters = json.RawMessage(`{"type": "object", "properties": {}}`)
+			}
+			defs = append(defs, def)
+		}
+	}
+	return defs
+}
+
+// FindFunction returns the plugin program which has an LLM function
+func FindFunction(name string) (*Process, bool) {
+	processesMu.Lock()
+	defer processesMu.Unlock()
+	for _, p := range processes {
+		for _, f := range p.Description().Functions {
+			if f.Name == name {
+				return p, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// remotePlugin lets a plugin program be matched like a .so plugin
+type remotePlugin struct {
+	p *Process
+}
+
+// Plugin returns the plugin program as a pluginapi.Plugin
+func (p *Process) Plugin() pluginapi.Plugin {
+	return remotePlugin{p: p}
+}
+
+func (r remotePlugin) Name() string {
+	return r.p.Description().Name
+}
+
+func (r remotePlugin) Utterances() []pluginapi.Utterance {
+	var utterances []pluginapi.Utterance
+	for _, u := range r.p.Description().Utterances {
+		utterances = append(utterances, pluginapi.Utterance{Text: u.Text, Regex: u.Regex, Priority: u.Priority})
+	}
+	return utterances
+}
+
+func (r remotePlugin) Handle(ctx context.Context, req pluginapi.Request) (pluginapi.Result, error) {
+	params := HandleParams{
+		Text:   req.Text,
+		ESN:    req.ESN,
+		Locale: req.Locale,
+		Slots:  req.Slots,
+	}
+	for _, bot := range vars.BotInfo.Robots {
+		if bot.Esn == req.ESN {
+			params.GUID = bot.GUID
+			params.Target = bot.IPAddress + ":443"
+		}
+	}
+	result, err := r.p.Handle(ctx, params)
+	if err != nil {
+		return pluginapi.Result{}, err
+	}
+	return pluginapi.Result{
+		Intent:      result.Intent,
+		Params:      result.Params,
+		SpokenText:  result.SpokenText,
+		LLMFollowUp: result.LLMFollowUp,
+	}, nil
+}
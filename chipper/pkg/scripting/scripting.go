@@ -13,6 +13,7 @@ import (
 	"github.com/kercre123/wire-pod/chipper/pkg/logger"
 	"github.com/kercre123/wire-pod/chipper/pkg/vars"
 	lualibs "github.com/vadv/gopher-lua-libs"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/sounds"
 	lua "github.com/yuin/gopher-lua"
 )
 
@@ -26,6 +27,8 @@ releaseBehaviorControl()
 <goroutine determines whether the function blocks or not>
 sayText(text string, goroutine bool)
 playAnimation(animation string, goroutine bool)
+playSound(sound string, goroutine bool)
+	-	a sound from the sound library
 
 */
 
@@ -57,6 +60,14 @@ func playAnimation(L *lua.LState) int {
 	return 0
 }
 
+func playSound(L *lua.LState) int {
+	soundToPlay := L.ToString(1)
+	executeWithGoroutine(L, func(L *lua.LState) error {
+		return sounds.Play(gRfLS(L), soundToPlay)
+	})
+	return 0
+}
+
 // get robot from LState
 func gRfLS(L *lua.LState) *vector.Vector {
 	ud := L.GetGlobal("bot").(*lua.LUserData)
@@ -70,6 +81,7 @@ func MakeLuaState(esn string, validating bool) (*lua.LState, error) {
 	L.SetContext(context.Background())
 	L.SetGlobal("sayText", L.NewFunction(sayText))
 	L.SetGlobal("playAnimation", L.NewFunction(playAnimation))
+	L.SetGlobal("playSound", L.NewFunction(playSound))
 	SetBControlFunctions(L)
 	ud := L.NewUserData()
 	if !validating {
@@ -142,10 +142,12 @@ func StoreBotInfo(ctx context.Context, thing string) {
 	if appendNew {
 		logger.Println("Adding " + botEsn + " to bot info store")
 		vars.BotInfo.Robots = append(vars.BotInfo.Robots, struct {
-			Esn       string `json:"esn"`
-			IPAddress string `json:"ip_address"`
-			GUID      string `json:"guid"`
-			Activated bool   `json:"activated"`
+			Esn       string           `json:"esn"`
+			IPAddress string           `json:"ip_address"`
+			GUID      string           `json:"guid"`
+			Activated bool             `json:"activated"`
+			VAD       vars.VADSettings `json:"vad"`
+			Persona   vars.Persona     `json:"persona"`
 		}{Esn: botEsn, IPAddress: ipAddr, GUID: "", Activated: false})
 	}
 	finalJsonBytes, _ := json.Marshal(vars.BotInfo)
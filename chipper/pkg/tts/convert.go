@@ -0,0 +1,76 @@
+package tts
+
+import (
+	"io"
+
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/audio"
+)
+
+// engines speak at all sorts of levels, so speech is brought to this (LUFS). small speakers need
+// speech on the loud side
+const loudness = -16
+
+// pcmStream converts 16-bit PCM from an engine to SampleRate mono at the same loudness as it's read
+type pcmStream struct {
+	src       io.ReadCloser
+	channels  int
+	resampler *audio.Resampler
+	leveler   *audio.Leveler
+	buf       []byte
+	// a partial frame left over from the last read
+	in  []byte
+	out []byte
+	err error
+}
+
+func newPCMStream(src io.ReadCloser, rate int, channels int) *pcmStream {
+	if channels < 1 {
+		channels = 1
+	}
+	return &pcmStream{
+		src:       src,
+		channels:  channels,
+		resampler: audio.NewResampler(rate, SampleRate),
+		leveler:   audio.NewLeveler(SampleRate, loudness),
+		buf:       make([]byte, 4096),
+	}
+}
+
+func (p *pcmStream) Read(b []byte) (int, error) {
+	for len(p.out) == 0 {
+		if p.err != nil {
+			return 0, p.err
+		}
+		n, err := p.src.Read(p.buf)
+		p.in = append(p.in, p.buf[:n]...)
+		whole := len(p.in) - len(p.in)%(2*p.channels)
+		samples := p.resampler.Process(audio.Mono(audio.Int16s(p.in[:whole]), p.channels))
+		p.in = p.in[:copy(p.in, p.in[whole:])]
+		if err == io.EOF {
+			samples = append(p.leveler.Process(append(samples, p.resampler.Flush()...)), p.leveler.Flush()...)
+		} else {
+			samples = p.leveler.Process(samples)
+		}
+		p.out = audio.AppendBytes(p.out, samples)
+		p.err = err
+	}
+	n := copy(b, p.out)
+	p.out = p.out[:copy(p.out, p.out[n:])]
+	return n, nil
+}
+
+func (p *pcmStream) Close() error {
+	return p.src.Close()
+}
+
+// wavStream reads WAV as it arrives
+func wavStream(src io.ReadCloser) (io.ReadCloser, error) {
+	r, err := audio.NewWAVReader(src)
+	if err != nil {
+		return nil, err
+	}
+	return newPCMStream(struct {
+		io.Reader
+		io.Closer
+	}{r, src}, r.Format.Rate, r.Format.Channels), nil
+}
@@ -0,0 +1,164 @@
+package tts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// engines which run a program on this machine, so speech works without the internet
+
+// Piper (github.com/rhasspy/piper). the voice is a .onnx model, or the name of one in VoiceDir
+type piperEngine struct {
+	path  string
+	model string
+	rate  int
+}
+
+func newPiper(c Config) (*piperEngine, error) {
+	if c.Voice == "" {
+		return nil, errors.New("piper: no voice model set")
+	}
+	model := c.Voice
+	if !strings.HasSuffix(model, ".onnx") {
+		model += ".onnx"
+	}
+	if !filepath.IsAbs(model) && !strings.ContainsRune(model, os.PathSeparator) {
+		model = filepath.Join(c.VoiceDir, model)
+	}
+	if _, err := os.Stat(model); err != nil {
+		return nil, errors.New("piper: voice model " + model + " not found")
+	}
+	e := &piperEngine{path: c.Path, model: model, rate: 22050}
+	if e.path == "" {
+		e.path = "piper"
+	}
+	// the model's config says which sample rate it speaks at
+	var modelConfig struct {
+		Audio struct {
+			SampleRate int `json:"sample_rate"`
+		} `json:"audio"`
+	}
+	if data, err := os.ReadFile(model + ".json"); err == nil {
+		if json.Unmarshal(data, &modelConfig) == nil && modelConfig.Audio.SampleRate > 0 {
+			e.rate = modelConfig.Audio.SampleRate
+		}
+	}
+	return e, nil
+}
+
+func (e *piperEngine) Name() string {
+	return "piper (" + strings.TrimSuffix(filepath.Base(e.model), ".onnx") + ")"
+}
+
+// piper reads a line of text and writes raw 16-bit mono PCM at the model's rate
+func (e *piperEngine) Stream(ctx context.Context, text string) (io.ReadCloser, error) {
+	out, err := start(ctx, e.path, strings.Join(strings.Fields(text), " ")+"\n", "--model", e.model, "--output_raw")
+	if err != nil {
+		return nil, err
+	}
+	return newPCMStream(out, e.rate, 1), nil
+}
+
+// eSpeak NG. robotic, but it speaks about a hundred languages and is installed almost everywhere.
+// the voice is a language or voice name like "de" or "en-us+f3"
+type espeakEngine struct {
+	path  string
+	voice string
+}
+
+func newEspeak(c Config) *espeakEngine {
+	e := &espeakEngine{path: c.Path, voice: c.Voice}
+	if e.path == "" {
+		e.path = "espeak-ng"
+		if _, err := exec.LookPath(e.path); err != nil {
+			e.path = "espeak"
+		}
+	}
+	return e
+}
+
+func (e *espeakEngine) Name() string {
+	return "espeak (" + e.voice + ")"
+}
+
+func (e *espeakEngine) Stream(ctx context.Context, text string) (io.ReadCloser, error) {
+	args := []string{"--stdout", "--stdin"}
+	if e.voice != "" {
+		args = append(args, "-v", e.voice)
+	}
+	out, err := start(ctx, e.path, text, args...)
+	if err != nil {
+		return nil, err
+	}
+	speech, err := wavStream(out)
+	if err != nil {
+		out.Close()
+		return nil, err
+	}
+	return speech, nil
+}
+
+// start gives text to a program and returns what it writes, as it writes it
+func start(ctx context.Context, path string, text string, args ...string) (io.ReadCloser, error) {
+	if _, err := exec.LookPath(path); err != nil {
+		return nil, errors.New(path + " isn't installed")
+	}
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdin = strings.NewReader(text)
+	p := &process{cmd: cmd}
+	cmd.Stderr = &p.stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	p.out = out
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// process is a running program's output. at the end it says why the program failed, if it did
+type process struct {
+	cmd    *exec.Cmd
+	out    io.ReadCloser
+	stderr bytes.Buffer
+	done   bool
+}
+
+func (p *process) Read(b []byte) (int, error) {
+	n, err := p.out.Read(b)
+	if err == io.EOF && !p.done {
+		if waitErr := p.wait(); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// Close stops the program if it's still going
+func (p *process) Close() error {
+	if !p.done {
+		p.cmd.Process.Kill()
+		p.wait()
+	}
+	return nil
+}
+
+func (p *process) wait() error {
+	p.done = true
+	err := p.cmd.Wait()
+	if err != nil {
+		if msg := strings.TrimSpace(p.stderr.String()); msg != "" {
+			return errors.New(filepath.Base(p.cmd.Path) + ": " + msg)
+		}
+	}
+	return err
+}
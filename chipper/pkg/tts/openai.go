@@ -0,0 +1,62 @@
+package tts
+
+import (
+	"context"
+	"io"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// OpenAI's speech API, and the ones which copy it (LocalAI, openedai-speech, Kokoro-FastAPI...)
+type openAIEngine struct {
+	kind   string
+	model  string
+	voice  string
+	client *openai.Client
+}
+
+func newOpenAI(c Config, baseURL string) *openAIEngine {
+	conf := openai.DefaultConfig(c.Key)
+	if baseURL != "" {
+		conf.BaseURL = baseURL
+	}
+	e := &openAIEngine{kind: c.Type, model: c.Model, voice: c.Voice, client: openai.NewClientWithConfig(conf)}
+	if e.model == "" {
+		e.model = string(openai.TTSModel1)
+	}
+	if e.voice == "" {
+		e.voice = string(openai.VoiceFable)
+	}
+	return e
+}
+
+func (e *openAIEngine) Name() string {
+	return e.kind + " (" + e.model + ", " + e.voice + ")"
+}
+
+// OpenAI itself gives raw 24kHz PCM. other servers don't all do raw PCM, but they do WAV, which
+// says its own sample rate. both come in as they're synthesized
+func (e *openAIEngine) Stream(ctx context.Context, text string) (io.ReadCloser, error) {
+	format := openai.SpeechResponseFormatWav
+	if e.kind == "openai" {
+		format = openai.SpeechResponseFormatPcm
+	}
+	resp, err := e.client.CreateSpeech(ctx, openai.CreateSpeechRequest{
+		Model:          openai.SpeechModel(e.model),
+		Input:          text,
+		Voice:          openai.SpeechVoice(e.voice),
+		ResponseFormat: format,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if format == openai.SpeechResponseFormatPcm {
+		return newPCMStream(resp, 24000, 1), nil
+	}
+	speech, err := wavStream(resp)
+	if err != nil {
+		resp.Close()
+		return nil, err
+	}
+	return speech, nil
+}
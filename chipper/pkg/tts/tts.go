@@ -0,0 +1,166 @@
+// Package tts turns text into speech for the robot. An Engine is a local program (Piper or
+// eSpeak NG, which work offline) or an OpenAI-compatible speech API. Speech is 16kHz mono 16-bit
+// little-endian PCM, which is what the robot plays. It streams, so the robot can start speaking
+// before a sentence is all synthesized, and recent phrases are cached.
+package tts
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+)
+
+const SampleRate = 16000
+
+const (
+	// the cache is for short phrases which come up again, like greetings
+	cacheMaxPhrases = 200
+	cacheMaxBytes   = 32 << 20
+)
+
+type Engine interface {
+	// like "piper (en_US-lessac-medium)". phrases are cached by this, so it includes the voice
+	Name() string
+	// Stream starts synthesizing and returns the speech as it's made. closing it stops the engine
+	Stream(ctx context.Context, text string) (io.ReadCloser, error)
+}
+
+// Config selects and sets up an engine
+type Config struct {
+	// piper, espeak, openai or custom (any OpenAI-compatible speech API)
+	Type string
+	// the program for piper and espeak. found on the PATH if empty
+	Path     string
+	Key      string
+	Endpoint string
+	Model    string
+	// piper model, espeak voice or OpenAI voice
+	Voice string
+	// where piper models given by name are
+	VoiceDir string
+}
+
+// New returns the engine for a config
+func New(c Config) (Engine, error) {
+	switch c.Type {
+	case "piper":
+		return newPiper(c)
+	case "espeak":
+		return newEspeak(c), nil
+	case "openai":
+		if c.Key == "" {
+			return nil, errors.New("openai: no key set")
+		}
+		return newOpenAI(c, c.Endpoint), nil
+	case "custom":
+		if c.Endpoint == "" {
+			return nil, errors.New("custom: no endpoint set")
+		}
+		return newOpenAI(c, c.Endpoint), nil
+	}
+	return nil, errors.New("unknown TTS engine " + c.Type)
+}
+
+type cacheEntry struct {
+	key string
+	pcm []byte
+}
+
+var (
+	cache      = list.New()
+	cacheIndex = make(map[string]*list.Element)
+	cacheBytes int
+	cacheMu    sync.Mutex
+)
+
+// Stream is e.Stream, but phrases said recently come from the cache, and phrases read to the end
+// go into it
+func Stream(ctx context.Context, e Engine, text string) (io.ReadCloser, error) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	key := e.Name() + "\x00" + text
+	if pcm, ok := cached(key); ok {
+		return io.NopCloser(bytes.NewReader(pcm)), nil
+	}
+	speech, err := e.Stream(ctx, text)
+	if err != nil {
+		return nil, err
+	}
+	return &cachingReader{ReadCloser: speech, key: key, name: e.Name()}, nil
+}
+
+// Synthesize is all of Stream at once
+func Synthesize(ctx context.Context, e Engine, text string) ([]byte, error) {
+	speech, err := Stream(ctx, e, text)
+	if err != nil {
+		return nil, err
+	}
+	defer speech.Close()
+	return io.ReadAll(speech)
+}
+
+// cachingReader keeps what's read, and caches it once the engine is done
+type cachingReader struct {
+	io.ReadCloser
+	key  string
+	name string
+	pcm  []byte
+	// too big to cache
+	skip bool
+}
+
+func (r *cachingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	if !r.skip {
+		r.pcm = append(r.pcm, b[:n]...)
+		if len(r.pcm) > cacheMaxBytes/4 {
+			r.pcm, r.skip = nil, true
+		}
+	}
+	if err == io.EOF {
+		if r.skip {
+			return n, err
+		}
+		if len(r.pcm) == 0 {
+			return n, errors.New(r.name + ": no audio")
+		}
+		addToCache(r.key, r.pcm)
+	}
+	return n, err
+}
+
+func cached(key string) ([]byte, bool) {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	el, ok := cacheIndex[key]
+	if !ok {
+		return nil, false
+	}
+	cache.MoveToFront(el)
+	return el.Value.(*cacheEntry).pcm, true
+}
+
+func addToCache(key string, pcm []byte) {
+	if len(pcm) > cacheMaxBytes/4 {
+		return
+	}
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+	if _, ok := cacheIndex[key]; ok {
+		return
+	}
+	cacheIndex[key] = cache.PushFront(&cacheEntry{key: key, pcm: pcm})
+	cacheBytes += len(pcm)
+	for cache.Len() > cacheMaxPhrases || cacheBytes > cacheMaxBytes {
+		oldest := cache.Back().Value.(*cacheEntry)
+		cache.Remove(cache.Back())
+		delete(cacheIndex, oldest.key)
+		cacheBytes -= len(oldest.pcm)
+	}
+}
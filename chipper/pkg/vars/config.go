@@ -34,11 +34,66 @@ type apiConfig struct {
 		SaveChat               bool   `json:"save_chat"`
 		CommandsEnable         bool   `json:"commands_enable"`
 		Endpoint               string `json:"endpoint"`
+		// tried in order when the provider above fails
+		Fallbacks []LLMBackend `json:"fallbacks"`
+		// looks at the pictures getImage takes, for models which can't see them themselves
+		Vision struct {
+			// a model which can see, like gpt-4o-mini or llava. the provider, key and endpoint
+			// are the ones above if they're empty. no model means the one above does the looking
+			LLMBackend
+			// how many pictures getImage takes, half a second apart. 1 if 0
+			Frames int `json:"frames"`
+		} `json:"vision"`
 	} `json:"knowledge"`
 	STT struct {
 		Service  string `json:"provider"`
 		Language string `json:"language"`
 	} `json:"STT"`
+	IntentMatch struct {
+		// score every intent and custom intent instead of taking the first substring match
+		Fuzzy bool `json:"fuzzy"`
+		// 0-1. the best intent has to score at least this or the request is unmatched (LLM if intent graph is on)
+		Threshold float64 `json:"threshold"`
+		// also compare how words sound. only for languages with an encoder (en)
+		Phonetic bool `json:"phonetic"`
+		// classify transcripts by nearest keyphrase embedding instead of matching text
+		Classifier struct {
+			Enable bool `json:"enable"`
+			// "local" (an embedding model run by ollama, nomic-embed-text unless set) or "openai" (any OpenAI-compatible embeddings endpoint)
+			Provider string `json:"provider"`
+			Endpoint string `json:"endpoint"`
+			Key      string `json:"key"`
+			Model    string `json:"model"`
+			// 0-1 cosine similarity the nearest example has to reach
+			Threshold float64 `json:"threshold"`
+		} `json:"classifier"`
+	} `json:"intent_match"`
+	TTS struct {
+		// piper, espeak, openai or custom (any OpenAI-compatible speech API). empty is the robot's own
+		// voice, or OpenAI TTS (knowledge.openai_voice) for other languages if the LLM is OpenAI
+		Engine string `json:"engine"`
+		// the piper or espeak-ng program, if it isn't on the PATH
+		Path     string `json:"path"`
+		Key      string `json:"key"`
+		Endpoint string `json:"endpoint"`
+		Model    string `json:"model"`
+		// piper model, espeak voice or OpenAI voice. personas can have their own
+		Voice string `json:"voice"`
+		// the robot's own voice is used for English unless this is set
+		WithEnglish bool `json:"with_english"`
+	} `json:"tts"`
+	History struct {
+		// delete messages older than this. 0 keeps them forever
+		RetentionDays int `json:"retention_days"`
+		// how much of the history is sent to the LLM. 0 is the default (1500)
+		ContextTokens int `json:"context_tokens"`
+		// summarize what falls out of the context window instead of forgetting it
+		Summarize bool `json:"summarize"`
+	} `json:"history"`
+	Recorder struct {
+		// save every voice request to RecordingsPath
+		Enable bool `json:"enable"`
+	} `json:"recorder"`
 	Server struct {
 		// false for ip, true for escape pod
 		EPConfig bool   `json:"epconfig"`
@@ -74,6 +129,8 @@ func CreateConfigFromEnv() {
 	} else {
 		APIConfig.Knowledge.Enable = false
 	}
+	// older chats are summarized unless turned off in the web interface
+	APIConfig.History.Summarize = true
 	WriteSTT()
 	APIConfig.HasReadFromEnv = true
 	writeBytes, _ := json.Marshal(APIConfig)
@@ -103,6 +160,8 @@ func ReadConfig() {
 			logger.Println(err)
 			return
 		}
+		// on unless the config turns it off, for configs from before it existed
+		APIConfig.History.Summarize = true
 		err = json.Unmarshal(configBytes, &APIConfig)
 		if err != nil {
 			APIConfig.Knowledge.Enable = false
@@ -111,8 +170,8 @@ func ReadConfig() {
 			logger.Println(err)
 			return
 		}
-		// stt service is the only thing controlled by shell
-		if APIConfig.STT.Service != os.Getenv("STT_SERVICE") {
+		// stt service comes from the shell until one is chosen in the web interface
+		if APIConfig.STT.Service == "" {
 			WriteSTT()
 		}
 		if !APIConfig.HasReadFromEnv {
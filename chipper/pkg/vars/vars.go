@@ -12,6 +12,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/fforchino/vector-go-sdk/pkg/vector"
 	"github.com/sashabaranov/go-openai"
@@ -43,6 +44,11 @@ var (
 	VoskModelPath     string = "../vosk/models/"
 	WhisperModelPath  string = "../whisper.cpp/models/"
 	SessionCertPath   string = "./session-certs/"
+	RecordingsPath    string = "./recordings/"
+	EmbeddingsPath    string = "./intentEmbeddings.json"
+	ChatHistoryPath   string = "./chatHistory.db"
+	SoundsPath        string = "./sounds/"
+	PiperVoicePath    string = "../piper/voices/"
 	VersionFile       string = "./version"
 )
 
@@ -70,6 +76,10 @@ var SttInitFunc func() error
 
 var IntentList []JsonIntent
 
+// IntentList and CustomIntents are replaced whole when they are reloaded, never changed in place,
+// so a request which already got them finishes with the old set
+var intentsMu sync.RWMutex
+
 //var MatchListList [][]string
 // var IntentsList = []string{}
 
@@ -79,24 +89,114 @@ var ChipperKeysLoaded bool
 
 var RecurringInfo []RecurringInfoStore
 
-type RememberedChat struct {
-	ESN   string                         `json:"esn"`
-	Chats []openai.ChatCompletionMessage `json:"chats"`
-}
-
-var RememberedChats []RememberedChat
-
 type RobotInfoStore struct {
 	GlobalGUID string `json:"global_guid"`
 	Robots     []struct {
 		Esn       string `json:"esn"`
 		IPAddress string `json:"ip_address"`
 		// 192.168.1.150:443
-		GUID      string `json:"guid"`
-		Activated bool   `json:"activated"`
+		GUID      string      `json:"guid"`
+		Activated bool        `json:"activated"`
+		VAD       VADSettings `json:"vad"`
+		Persona   Persona     `json:"persona"`
 	} `json:"robots"`
 }
 
+// a robot's own knowledge graph settings. empty fields use the ones in APIConfig.Knowledge
+type Persona struct {
+	Prompt    string `json:"prompt"`
+	RobotName string `json:"robot_name"`
+	Provider  string `json:"provider"`
+	// only needed if the key or endpoint is different from the global one
+	Key      string `json:"key"`
+	Endpoint string `json:"endpoint"`
+	Model    string `json:"model"`
+	// 0 means the default
+	Temperature float32 `json:"temperature"`
+	MaxTokens   int     `json:"max_tokens"`
+	// LLM commands the robot may use. empty means all of them
+	Commands        []string `json:"commands"`
+	DisableCommands bool     `json:"disable_commands"`
+	// language the LLM should answer in, like "de-DE". empty leaves it up to the LLM
+	Language string `json:"language"`
+	// text-to-speech voice, for the engine in the TTS settings
+	Voice string `json:"voice"`
+}
+
+// LLMBackend is an LLM provider to fall back to
+type LLMBackend struct {
+	// openai, together, custom, ollama or anthropic
+	Provider string `json:"provider"`
+	Key      string `json:"key"`
+	Endpoint string `json:"endpoint"`
+	Model    string `json:"model"`
+}
+
+// Knowledge is the knowledge graph config for one robot, with its persona applied
+type Knowledge struct {
+	Provider  string
+	Key       string
+	Endpoint  string
+	Model     string
+	Prompt    string
+	RobotName string
+	Language  string
+	// the persona's language, or the STT language
+	SpeechLanguage string
+	// the persona's TTS voice, empty for the global one
+	Voice          string
+	Temperature    float32
+	MaxTokens      int
+	CommandsEnable bool
+	// empty means all
+	Commands  []string
+	SaveChat  bool
+	Fallbacks []LLMBackend
+	// the model which looks at pictures. no model means the one above
+	Vision LLMBackend
+	// how many pictures getImage takes
+	VisionFrames int
+}
+
+const (
+	defaultLLMTemperature = 1
+	defaultLLMMaxTokens   = 2048
+	defaultTogetherModel  = "meta-llama/Llama-3-70b-chat-hf"
+	defaultOllamaModel    = "llama3"
+	defaultAnthropicModel = "claude-3-5-sonnet-latest"
+)
+
+// getImage takes at most this many pictures
+const maxVisionFrames = 5
+
+// end-of-speech detection settings for a robot
+type VADSettings struct {
+	// if false, DefaultVADSettings are used
+	Custom bool `json:"custom"`
+	// webrtc vad aggressiveness, 0-3
+	Mode int `json:"mode"`
+	// how long the user has to be quiet for before end of speech
+	SilenceMs int `json:"silence_ms"`
+	// how much speech there has to be before end of speech can be detected
+	MinSpeechMs int `json:"min_speech_ms"`
+	// end of speech is forced after this much audio. 0 means no limit
+	MaxUtteranceMs int `json:"max_utterance_ms"`
+	// gain applied before and after the high-pass filter
+	Gain     float64 `json:"gain"`
+	PostGain float64 `json:"post_gain"`
+	// estimate the noise floor from the first frames and ignore anything which isn't louder than it
+	Adaptive bool `json:"adaptive"`
+}
+
+var DefaultVADSettings = VADSettings{
+	Mode:           2,
+	SilenceMs:      230,
+	MinSpeechMs:    190,
+	MaxUtteranceMs: 0,
+	Gain:           5,
+	PostGain:       1.5,
+}
+
 type RecurringInfoStore struct {
 	// Vector-R2D2
 	ID string `json:"id"`
@@ -107,9 +207,36 @@ type RecurringInfoStore struct {
 }
 
 type JsonIntent struct {
-	Name              string   `json:"name"`
-	Keyphrases        []string `json:"keyphrases"`
-	RequireExactMatch bool     `json:"requiresexact"`
+	Name              string     `json:"name"`
+	Keyphrases        []string   `json:"keyphrases"`
+	RequireExactMatch bool       `json:"requiresexact"`
+	Slots             []JsonSlot `json:"slots,omitempty"`
+	// intent sent to the robot once the slots are filled, if it isn't this one
+	SendAs string `json:"sendas,omitempty"`
+	// intent sent to 0.10 robots (PCM stream), which don't know some _extend intents
+	LegacyName string `json:"legacyname,omitempty"`
+}
+
+// JsonSlot is a parameter pulled out of the transcript and sent with the intent
+type JsonSlot struct {
+	Name string `json:"name"`
+	// enum, color, number, duration, location, or text
+	Type string `json:"type"`
+	// enum and color: what is sent, and the words which mean it
+	Values []JsonSlotValue `json:"values,omitempty"`
+	// location and text: the value is whatever comes after one of these
+	After []string `json:"after,omitempty"`
+	// sent if nothing was found
+	Default string `json:"default,omitempty"`
+	// if nothing was found, send the intent as-is without parameters
+	Required bool `json:"required,omitempty"`
+	// if nothing was found, the robot asks this and the next voice request fills the slot
+	Prompt string `json:"prompt,omitempty"`
+}
+
+type JsonSlotValue struct {
+	Value    string   `json:"value"`
+	Synonyms []string `json:"synonyms"`
 }
 
 type CustomIntent struct {
@@ -121,10 +248,48 @@ type CustomIntent struct {
 		ParamName  string `json:"paramname"`
 		ParamValue string `json:"paramvalue"`
 	} `json:"params"`
-	Exec           string   `json:"exec"`
-	ExecArgs       []string `json:"execargs"`
-	IsSystemIntent bool     `json:"issystem"`
-	LuaScript      string   `json:"luascript"`
+	Exec           string       `json:"exec"`
+	ExecArgs       []string     `json:"execargs"`
+	ExecOptions    *ExecOptions `json:"execoptions,omitempty"`
+	IsSystemIntent bool         `json:"issystem"`
+	LuaScript      string       `json:"luascript"`
+	Sound          string       `json:"sound"`
+	Webhook        *Webhook     `json:"webhook,omitempty"`
+}
+
+// limits for a custom intent's Exec
+type ExecOptions struct {
+	// seconds before the program is killed, 10 if 0
+	Timeout int `json:"timeout"`
+	// working directory. wire-pod's if empty
+	Dir string `json:"dir"`
+	// if set, the only environment variables passed through from wire-pod. the program then gets these,
+	// PATH, and the WIREPOD_ ones. it gets all of wire-pod's if empty
+	Env []string `json:"env"`
+	// bytes of output kept, 64KiB if 0
+	MaxOutput int `json:"maxoutput"`
+	// run as this user (not on windows). wire-pod has to be running as root
+	User string `json:"user"`
+	// send the intent without waiting for the program. ignored for system intents, which need the output
+	Async bool `json:"async"`
+}
+
+// an HTTP request made when a custom intent matches
+type Webhook struct {
+	URL string `json:"url"`
+	// GET, POST, PUT... POST if empty
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	// go template. has .SpeechText, .ESN, .Locale, .Name, .Intent and .Slots, and a json function for quoting
+	Body string `json:"body"`
+	// seconds, 5 if 0
+	Timeout int `json:"timeout"`
+	// dot-separated paths into the JSON response ("data.reply", "results.0.text").
+	// the robot says what's at Say, and sends the intent at Intent instead of the custom intent's
+	Response struct {
+		Say    string `json:"say"`
+		Intent string `json:"intent"`
+	} `json:"response"`
 }
 
 type AJdoc struct {
@@ -179,6 +344,11 @@ func Init() {
 		ServerConfigPath = join(podDir, "./certs/server_config.json")
 		Certs = join(podDir, "./certs")
 		SessionCertPath = join(podDir, SessionCertPath)
+		RecordingsPath = join(podDir, RecordingsPath)
+		EmbeddingsPath = join(podDir, EmbeddingsPath)
+		ChatHistoryPath = join(podDir, ChatHistoryPath)
+		SoundsPath = join(podDir, SoundsPath)
+		PiperVoicePath = join(podDir, "./piper/voices/")
 		if runtime.GOOS == "android" {
 			VersionFile = AndroidPath + "/static/version"
 		}
@@ -269,19 +439,64 @@ func GetDownloadedVoskModels() {
 	}
 }
 
+func GetIntentList() []JsonIntent {
+	intentsMu.RLock()
+	defer intentsMu.RUnlock()
+	return IntentList
+}
+
+func SetIntentList(list []JsonIntent) {
+	intentsMu.Lock()
+	IntentList = list
+	intentsMu.Unlock()
+}
+
+func GetCustomIntents() []CustomIntent {
+	intentsMu.RLock()
+	defer intentsMu.RUnlock()
+	return CustomIntents
+}
+
+// SetCustomIntents replaces the custom intents. don't change the slice after giving it here
+func SetCustomIntents(list []CustomIntent) {
+	intentsMu.Lock()
+	CustomIntents = list
+	CustomIntentsExist = true
+	intentsMu.Unlock()
+}
+
+// ParseCustomIntents reads a customIntents.json and checks every intent can be matched
+func ParseCustomIntents(jsonBytes []byte) ([]CustomIntent, error) {
+	var intents []CustomIntent
+	if err := json.Unmarshal(jsonBytes, &intents); err != nil {
+		return nil, err
+	}
+	for i, intent := range intents {
+		if intent.Name == "" || len(intent.Utterances) == 0 {
+			return nil, fmt.Errorf("custom intent %d needs a name and utterances", i+1)
+		}
+	}
+	return intents, nil
+}
+
 func LoadCustomIntents() {
 	jsonBytes, err := os.ReadFile(CustomIntentsPath)
 	if err == nil {
-		json.Unmarshal(jsonBytes, &CustomIntents)
-		CustomIntentsExist = true
+		intents, err := ParseCustomIntents(jsonBytes)
+		if err != nil {
+			logger.Println("Error loading custom intents: " + err.Error())
+			return
+		}
+		SetCustomIntents(intents)
 		logger.Println("Loaded custom intents:")
-		for _, intent := range CustomIntents {
+		for _, intent := range intents {
 			logger.Println(intent.Name)
 		}
 	}
 }
 
-func LoadIntents() ([]JsonIntent, error) {
+// IntentsPath is the intent-data file for the STT language
+func IntentsPath() string {
 	var path string
 	if runtime.GOOS == "darwin" && Packaged {
 		appPath, _ := os.Executable()
@@ -291,7 +506,25 @@ func LoadIntents() ([]JsonIntent, error) {
 	} else {
 		path = "./"
 	}
-	jsonFile, err := os.ReadFile(path + "intent-data/" + APIConfig.STT.Language + ".json")
+	return path + "intent-data/" + APIConfig.STT.Language + ".json"
+}
+
+// ParseIntents reads an intent-data file and checks every intent has a name and keyphrases
+func ParseIntents(jsonBytes []byte) ([]JsonIntent, error) {
+	var intents []JsonIntent
+	if err := json.Unmarshal(jsonBytes, &intents); err != nil {
+		return nil, err
+	}
+	for i, intent := range intents {
+		if intent.Name == "" || len(intent.Keyphrases) == 0 {
+			return nil, fmt.Errorf("intent %d needs a name and keyphrases", i+1)
+		}
+	}
+	return intents, nil
+}
+
+func LoadIntents() ([]JsonIntent, error) {
+	jsonFile, err := os.ReadFile(IntentsPath())
 
 	// var matches [][]string
 	// var intents []string
@@ -437,6 +670,187 @@ func GetRobot(esn string) (*vector.Vector, error) {
 	return robot, nil
 }
 
+func GetVADSettings(esn string) VADSettings {
+	for _, bot := range BotInfo.Robots {
+		if strings.EqualFold(esn, bot.Esn) && bot.VAD.Custom {
+			return bot.VAD
+		}
+	}
+	return DefaultVADSettings
+}
+
+func SetVADSettings(esn string, settings VADSettings) error {
+	if settings.Mode < 0 || settings.Mode > 3 {
+		return errors.New("vad mode must be between 0 and 3")
+	}
+	if settings.SilenceMs <= 0 || settings.MinSpeechMs < 0 || settings.MaxUtteranceMs < 0 {
+		return errors.New("vad timings must be positive")
+	}
+	if settings.Gain <= 0 || settings.PostGain <= 0 {
+		return errors.New("vad gain must be positive")
+	}
+	for num, bot := range BotInfo.Robots {
+		if strings.EqualFold(esn, bot.Esn) {
+			BotInfo.Robots[num].VAD = settings
+			writeBytes, _ := json.Marshal(BotInfo)
+			os.WriteFile(BotInfoPath, writeBytes, 0644)
+			return nil
+		}
+	}
+	return errors.New("robot not in botsdkinfo")
+}
+
+func GetPersona(esn string) Persona {
+	for _, bot := range BotInfo.Robots {
+		if strings.EqualFold(esn, bot.Esn) {
+			return bot.Persona
+		}
+	}
+	return Persona{}
+}
+
+func SetPersona(esn string, persona Persona) error {
+	switch persona.Provider {
+	case "", "openai", "together", "custom", "ollama", "anthropic":
+	default:
+		return errors.New("provider must be openai, together, custom, ollama or anthropic")
+	}
+	if persona.Temperature < 0 || persona.Temperature > 2 {
+		return errors.New("temperature must be between 0 and 2")
+	}
+	if persona.MaxTokens < 0 {
+		return errors.New("max tokens can't be negative")
+	}
+	// the global key and endpoint belong to the global provider, so another provider needs its own
+	if persona.Provider != "" && persona.Provider != APIConfig.Knowledge.Provider {
+		if persona.Provider != "ollama" && persona.Key == "" {
+			return errors.New("a provider other than the global one needs its own key")
+		}
+		if persona.Provider == "custom" && persona.Endpoint == "" {
+			return errors.New("a custom provider needs an endpoint")
+		}
+	} else if persona.Provider == "custom" && persona.Endpoint == "" && APIConfig.Knowledge.Endpoint == "" {
+		return errors.New("a custom provider needs an endpoint")
+	}
+	for num, bot := range BotInfo.Robots {
+		if strings.EqualFold(esn, bot.Esn) {
+			BotInfo.Robots[num].Persona = persona
+			writeBytes, _ := json.Marshal(BotInfo)
+			os.WriteFile(BotInfoPath, writeBytes, 0644)
+			return nil
+		}
+	}
+	return errors.New("robot not in botsdkinfo")
+}
+
+// GetKnowledge returns the knowledge graph config for a robot, falling back to APIConfig.Knowledge
+func GetKnowledge(esn string) Knowledge {
+	global := APIConfig.Knowledge
+	persona := GetPersona(esn)
+	k := Knowledge{
+		Provider:       global.Provider,
+		Key:            global.Key,
+		Endpoint:       global.Endpoint,
+		Model:          global.Model,
+		Prompt:         strings.TrimSpace(global.OpenAIPrompt),
+		RobotName:      global.RobotName,
+		SpeechLanguage: APIConfig.STT.Language,
+		Temperature:    defaultLLMTemperature,
+		MaxTokens:      defaultLLMMaxTokens,
+		CommandsEnable: global.CommandsEnable,
+		SaveChat:       global.SaveChat,
+		Fallbacks:      global.Fallbacks,
+	}
+	if persona.Provider != "" && persona.Provider != k.Provider {
+		// the global model, key and endpoint are for another provider
+		k.Provider = persona.Provider
+		k.Model = ""
+		k.Key = ""
+		k.Endpoint = ""
+	}
+	if persona.Key != "" {
+		k.Key = persona.Key
+	}
+	if persona.Endpoint != "" {
+		k.Endpoint = persona.Endpoint
+	}
+	// the global model is only used for providers other than openai
+	if persona.Model != "" {
+		k.Model = persona.Model
+	} else if k.Provider == "openai" {
+		k.Model = openai.GPT4oMini
+	} else if k.Model == "" {
+		switch k.Provider {
+		case "together":
+			k.Model = defaultTogetherModel
+		case "ollama":
+			k.Model = defaultOllamaModel
+		case "anthropic":
+			k.Model = defaultAnthropicModel
+		}
+	}
+	if strings.TrimSpace(persona.Prompt) != "" {
+		k.Prompt = strings.TrimSpace(persona.Prompt)
+	}
+	if persona.RobotName != "" {
+		k.RobotName = persona.RobotName
+	}
+	if k.RobotName == "" {
+		k.RobotName = "Vector"
+	}
+	if persona.Language != "" {
+		k.Language = persona.Language
+		k.SpeechLanguage = persona.Language
+	}
+	k.Voice = persona.Voice
+	if persona.Temperature > 0 {
+		k.Temperature = persona.Temperature
+	}
+	if persona.MaxTokens > 0 {
+		k.MaxTokens = persona.MaxTokens
+	}
+	if persona.DisableCommands {
+		k.CommandsEnable = false
+	}
+	k.Commands = persona.Commands
+	k.Vision = global.Vision.LLMBackend
+	if k.Vision.Provider == "" {
+		k.Vision.Provider = k.Provider
+	}
+	// a key or endpoint for another provider is no use
+	if k.Vision.Provider == k.Provider {
+		if k.Vision.Key == "" {
+			k.Vision.Key = k.Key
+		}
+		if k.Vision.Endpoint == "" {
+			k.Vision.Endpoint = k.Endpoint
+		}
+	}
+	k.VisionFrames = global.Vision.Frames
+	if k.VisionFrames < 1 {
+		k.VisionFrames = 1
+	} else if k.VisionFrames > maxVisionFrames {
+		k.VisionFrames = maxVisionFrames
+	}
+	return k
+}
+
+// CommandAllowed is true if the robot may use an LLM command
+func (k Knowledge) CommandAllowed(command string) bool {
+	if !k.CommandsEnable {
+		return false
+	}
+	if len(k.Commands) == 0 {
+		return true
+	}
+	for _, c := range k.Commands {
+		if strings.EqualFold(c, command) {
+			return true
+		}
+	}
+	return false
+}
+
 func GetOutboundIP() net.IP {
 	if runtime.GOOS == "android" {
 		ifaces, _ := anet.Interfaces()
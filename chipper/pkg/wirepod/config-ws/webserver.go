@@ -10,14 +10,20 @@ import (
 	"path"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/scripting"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/tts"
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/history"
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/localization"
 	processreqs "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/preqs"
 	botsetup "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/setup"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/sounds"
+	stt "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/stt"
+	ttr "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/ttr"
 )
 
 var SttInitFunc func() error
@@ -49,6 +55,26 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 		handleGetDownloadStatus(w)
 	case "get_stt_info":
 		handleGetSTTInfo(w)
+	case "set_stt_service":
+		handleSetSTTService(w, r)
+	case "get_stt_engines":
+		handleGetSTTEngines(w)
+	case "get_vad_settings":
+		handleGetVADSettings(w, r)
+	case "set_vad_settings":
+		handleSetVADSettings(w, r)
+	case "get_persona":
+		handleGetPersona(w, r)
+	case "set_persona":
+		handleSetPersona(w, r)
+	case "set_intent_match":
+		handleSetIntentMatch(w, r)
+	case "get_intent_match":
+		handleGetIntentMatch(w)
+	case "set_recorder":
+		handleSetRecorder(w, r)
+	case "get_recorder":
+		handleGetRecorder(w)
 	case "get_config":
 		handleGetConfig(w)
 	case "get_logs":
@@ -58,7 +84,31 @@ func apiHandler(w http.ResponseWriter, r *http.Request) {
 	case "is_running":
 		handleIsRunning(w)
 	case "delete_chats":
-		handleDeleteChats(w)
+		handleDeleteChats(w, r)
+	case "get_chat_sessions":
+		handleGetChatSessions(w, r)
+	case "get_chat_history":
+		handleGetChatHistory(w, r)
+	case "export_chats":
+		handleExportChats(w, r)
+	case "set_history_settings":
+		handleSetHistorySettings(w, r)
+	case "get_history_settings":
+		handleGetHistorySettings(w)
+	case "get_chat_summary":
+		handleGetChatSummary(w, r)
+	case "set_chat_summary":
+		handleSetChatSummary(w, r)
+	case "set_tts":
+		handleSetTTS(w, r)
+	case "get_tts":
+		handleGetTTS(w)
+	case "get_sounds":
+		handleGetSounds(w)
+	case "upload_sound":
+		handleUploadSound(w, r)
+	case "delete_sound":
+		handleDeleteSound(w, r)
 	case "get_ota":
 		handleGetOTA(w, r)
 	case "get_version_info":
@@ -89,8 +139,25 @@ func handleAddCustomIntent(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
-	vars.CustomIntentsExist = true
-	vars.CustomIntents = append(vars.CustomIntents, intent)
+	intent.Sound = strings.TrimSpace(intent.Sound)
+	if intent.Sound != "" && !sounds.Exists(intent.Sound) {
+		http.Error(w, "there is no sound called "+intent.Sound+" in the sound library", http.StatusBadRequest)
+		return
+	}
+	if intent.Webhook != nil && strings.TrimSpace(intent.Webhook.URL) == "" {
+		intent.Webhook = nil
+	}
+	if err := ttr.ValidateWebhook(intent.Webhook); err != nil {
+		http.Error(w, "webhook validation error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := ttr.ValidateExecOptions(intent.ExecOptions); err != nil {
+		http.Error(w, "exec options error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	current := vars.GetCustomIntents()
+	// the full slice expression makes append copy, requests using the old list keep it
+	vars.SetCustomIntents(append(current[:len(current):len(current)], intent))
 	saveCustomIntents()
 	fmt.Fprint(w, "Intent added successfully.")
 }
@@ -104,11 +171,12 @@ func handleEditCustomIntent(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid request body", http.StatusBadRequest)
 		return
 	}
-	if request.Number < 1 || request.Number > len(vars.CustomIntents) {
+	intents := append([]vars.CustomIntent(nil), vars.GetCustomIntents()...)
+	if request.Number < 1 || request.Number > len(intents) {
 		http.Error(w, "invalid intent number", http.StatusBadRequest)
 		return
 	}
-	intent := &vars.CustomIntents[request.Number-1]
+	intent := &intents[request.Number-1]
 	if request.Name != "" {
 		intent.Name = request.Name
 	}
@@ -140,7 +208,38 @@ func handleEditCustomIntent(w http.ResponseWriter, r *http.Request) {
 	if len(request.ExecArgs) != 0 {
 		intent.ExecArgs = request.ExecArgs
 	}
+	if request.Sound != "" {
+		// "none" removes the sound
+		if request.Sound == "none" {
+			intent.Sound = ""
+		} else if !sounds.Exists(request.Sound) {
+			http.Error(w, "there is no sound called "+request.Sound+" in the sound library", http.StatusBadRequest)
+			return
+		} else {
+			intent.Sound = request.Sound
+		}
+	}
+	if request.ExecOptions != nil {
+		if err := ttr.ValidateExecOptions(request.ExecOptions); err != nil {
+			http.Error(w, "exec options error: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		intent.ExecOptions = request.ExecOptions
+	}
+	if request.Webhook != nil {
+		if err := ttr.ValidateWebhook(request.Webhook); err != nil {
+			http.Error(w, "webhook validation error: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		// an empty url removes the webhook
+		if strings.TrimSpace(request.Webhook.URL) == "" {
+			intent.Webhook = nil
+		} else {
+			intent.Webhook = request.Webhook
+		}
+	}
 	intent.IsSystemIntent = false
+	vars.SetCustomIntents(intents)
 	saveCustomIntents()
 	fmt.Fprint(w, "Intent edited successfully.")
 }
@@ -168,11 +267,15 @@ func handleRemoveCustomIntent(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid request body", http.StatusBadRequest)
 		return
 	}
-	if request.Number < 1 || request.Number > len(vars.CustomIntents) {
+	current := vars.GetCustomIntents()
+	if request.Number < 1 || request.Number > len(current) {
 		http.Error(w, "invalid intent number", http.StatusBadRequest)
 		return
 	}
-	vars.CustomIntents = append(vars.CustomIntents[:request.Number-1], vars.CustomIntents[request.Number:]...)
+	var intents []vars.CustomIntent
+	intents = append(intents, current[:request.Number-1]...)
+	intents = append(intents, current[request.Number:]...)
+	vars.SetCustomIntents(intents)
 	saveCustomIntents()
 	fmt.Fprint(w, "Intent removed successfully.")
 }
@@ -265,6 +368,107 @@ func handleGetSTTInfo(w http.ResponseWriter) {
 	json.NewEncoder(w).Encode(vars.APIConfig.STT)
 }
 
+func handleSetSTTService(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Provider string `json:"provider"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := processreqs.SwitchSTTEngine(request.Provider); err != nil {
+		http.Error(w, "failed to switch stt engine: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	vars.WriteConfigToDisk()
+	logger.Println("Switched voice processor to " + request.Provider)
+	fmt.Fprint(w, "STT engine switched successfully.")
+}
+
+func handleGetSTTEngines(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Current string           `json:"current"`
+		Engines []stt.EngineInfo `json:"engines"`
+	}{
+		Current: processreqs.VoiceProcessor,
+		Engines: stt.List(),
+	})
+}
+
+func handleGetVADSettings(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vars.GetVADSettings(r.FormValue("esn")))
+}
+
+func handleSetVADSettings(w http.ResponseWriter, r *http.Request) {
+	var settings vars.VADSettings
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := vars.SetVADSettings(r.FormValue("esn"), settings); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprint(w, "VAD settings saved.")
+}
+
+func handleGetPersona(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vars.GetPersona(r.FormValue("esn")))
+}
+
+func handleSetPersona(w http.ResponseWriter, r *http.Request) {
+	var persona vars.Persona
+	if err := json.NewDecoder(r.Body).Decode(&persona); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := vars.SetPersona(r.FormValue("esn"), persona); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprint(w, "Persona saved.")
+}
+
+func handleSetIntentMatch(w http.ResponseWriter, r *http.Request) {
+	settings := vars.APIConfig.IntentMatch
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if settings.Threshold < 0 || settings.Threshold > 1 ||
+		settings.Classifier.Threshold < 0 || settings.Classifier.Threshold > 1 {
+		http.Error(w, "threshold must be between 0 and 1", http.StatusBadRequest)
+		return
+	}
+	vars.APIConfig.IntentMatch = settings
+	vars.WriteConfigToDisk()
+	fmt.Fprint(w, "Changes successfully applied.")
+}
+
+func handleGetIntentMatch(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vars.APIConfig.IntentMatch)
+}
+
+func handleSetRecorder(w http.ResponseWriter, r *http.Request) {
+	settings := vars.APIConfig.Recorder
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	vars.APIConfig.Recorder = settings
+	vars.WriteConfigToDisk()
+	fmt.Fprint(w, "Changes successfully applied.")
+}
+
+func handleGetRecorder(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vars.APIConfig.Recorder)
+}
+
 func handleGetConfig(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(vars.APIConfig)
@@ -285,11 +489,192 @@ func handleIsRunning(w http.ResponseWriter) {
 	w.Write([]byte("true"))
 }
 
-func handleDeleteChats(w http.ResponseWriter) {
-	vars.RememberedChats = []vars.RememberedChat{}
+// deletes one robot's chats if esn is given, otherwise everyone's
+func handleDeleteChats(w http.ResponseWriter, r *http.Request) {
+	if err := history.Delete(r.FormValue("esn")); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 	fmt.Fprint(w, "done")
 }
 
+func handleGetChatSessions(w http.ResponseWriter, r *http.Request) {
+	sessions, err := history.Sessions(r.FormValue("esn"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// esn is required. session, search and limit are optional
+func handleGetChatHistory(w http.ResponseWriter, r *http.Request) {
+	esn := r.FormValue("esn")
+	if esn == "" {
+		http.Error(w, "missing esn", http.StatusBadRequest)
+		return
+	}
+	session, _ := strconv.ParseInt(r.FormValue("session"), 10, 64)
+	limit, _ := strconv.Atoi(r.FormValue("limit"))
+	msgs, err := history.Search(esn, session, r.FormValue("search"), limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(msgs)
+}
+
+// a robot's whole history as a download, JSON or (format=text) a readable transcript
+func handleExportChats(w http.ResponseWriter, r *http.Request) {
+	esn := r.FormValue("esn")
+	if esn == "" {
+		http.Error(w, "missing esn", http.StatusBadRequest)
+		return
+	}
+	msgs, err := history.Search(esn, 0, "", 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.FormValue("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"chats-"+esn+".txt\"")
+		var session int64
+		for _, m := range msgs {
+			if m.Session != session {
+				session = m.Session
+				fmt.Fprintf(w, "\n--- %s ---\n", m.Time.Format("2006-01-02 15:04"))
+			}
+			fmt.Fprintf(w, "[%s] %s: %s\n", m.Time.Format("15:04:05"), m.Role, m.Content)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", "attachment; filename=\"chats-"+esn+".json\"")
+	json.NewEncoder(w).Encode(msgs)
+}
+
+func handleSetHistorySettings(w http.ResponseWriter, r *http.Request) {
+	settings := vars.APIConfig.History
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if settings.RetentionDays < 0 || settings.ContextTokens < 0 {
+		http.Error(w, "retention and context tokens can't be negative", http.StatusBadRequest)
+		return
+	}
+	vars.APIConfig.History = settings
+	vars.WriteConfigToDisk()
+	fmt.Fprint(w, "Changes successfully applied.")
+}
+
+func handleGetHistorySettings(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vars.APIConfig.History)
+}
+
+func handleSetTTS(w http.ResponseWriter, r *http.Request) {
+	settings := vars.APIConfig.TTS
+	if err := json.NewDecoder(r.Body).Decode(&settings); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	switch settings.Engine {
+	case "", "espeak", "openai", "custom":
+	case "piper":
+		// makes sure the voice model is there
+		if _, err := tts.New(tts.Config{Type: "piper", Voice: settings.Voice, VoiceDir: vars.PiperVoicePath}); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "unknown TTS engine "+settings.Engine, http.StatusBadRequest)
+		return
+	}
+	if settings.Engine == "custom" && strings.TrimSpace(settings.Endpoint) == "" {
+		http.Error(w, "an OpenAI-compatible speech API needs an endpoint", http.StatusBadRequest)
+		return
+	}
+	vars.APIConfig.TTS = settings
+	vars.WriteConfigToDisk()
+	fmt.Fprint(w, "Changes successfully applied.")
+}
+
+func handleGetTTS(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(vars.APIConfig.TTS)
+}
+
+func handleGetChatSummary(w http.ResponseWriter, r *http.Request) {
+	esn := r.FormValue("esn")
+	if esn == "" {
+		http.Error(w, "missing esn", http.StatusBadRequest)
+		return
+	}
+	summary, err := history.GetSummary(esn)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
+
+func handleSetChatSummary(w http.ResponseWriter, r *http.Request) {
+	esn := r.FormValue("esn")
+	if esn == "" {
+		http.Error(w, "missing esn", http.StatusBadRequest)
+		return
+	}
+	var summary history.Summary
+	if err := json.NewDecoder(r.Body).Decode(&summary); err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := history.SetSummary(esn, summary.Summary); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, "Memory saved.")
+}
+
+func handleGetSounds(w http.ResponseWriter) {
+	list := sounds.Sounds()
+	if list == nil {
+		list = []sounds.Sound{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// multipart form with the file as "sound"
+func handleUploadSound(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, sounds.MaxFileSize+1<<20)
+	file, header, err := r.FormFile("sound")
+	if err != nil {
+		http.Error(w, "must provide a sound file ("+err.Error()+")", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	name, err := sounds.Save(header.Filename, file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprint(w, "Sound "+name+" added.")
+}
+
+func handleDeleteSound(w http.ResponseWriter, r *http.Request) {
+	if err := sounds.Delete(r.FormValue("name")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprint(w, "Sound deleted.")
+}
+
 func handleGetOTA(w http.ResponseWriter, r *http.Request) {
 	otaName := strings.Split(r.URL.Path, "/")[3]
 	targetURL, err := url.Parse("https://archive.org/download/vector-pod-firmware/" + strings.TrimSpace(otaName))
@@ -380,7 +765,7 @@ func handleGenerateCerts(w http.ResponseWriter) {
 }
 
 func saveCustomIntents() {
-	customIntentJSONFile, _ := json.Marshal(vars.CustomIntents)
+	customIntentJSONFile, _ := json.Marshal(vars.GetCustomIntents())
 	os.WriteFile(vars.CustomIntentsPath, customIntentJSONFile, 0644)
 }
 
@@ -0,0 +1,595 @@
+package history
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/llm"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
+	"golang.org/x/image/draw"
+)
+
+// conversation history for the LLM, per robot, in an SQLite database at vars.ChatHistoryPath.
+// a session is a run of messages with no gap longer than SessionGap
+
+const (
+	SessionGap           = 30 * time.Minute
+	DefaultContextTokens = 1500
+	// summarize once this many tokens have fallen out of the context window
+	summarizeAfterTokens = 500
+	pruneEvery           = time.Hour
+	// pictures are shrunk to this many pixels on their long side before they're saved
+	maxImageSide = 640
+	imageQuality = 80
+)
+
+// words which mean the user is talking about the last photo, so it goes back to the LLM. words
+// which start with one of the spaced ones count too ("photos"), the others can be anywhere
+var (
+	photoWords         = []string{"photo", "picture", "image", "snapshot", "foto", "bild", "imagen", "immagine", "zdjęci", "фото"}
+	photoWordsUnspaced = []string{"照片", "图片", "图像", "相片", "拍的"}
+)
+
+type Message struct {
+	ID      int64     `json:"id"`
+	Session int64     `json:"session"`
+	ESN     string    `json:"esn"`
+	Role    string    `json:"role"`
+	Content string    `json:"content"`
+	Time    time.Time `json:"time"`
+	// estimated, see EstimateTokens
+	Tokens int `json:"tokens"`
+	// only for assistant messages
+	Model string `json:"model"`
+}
+
+// Summary is the robot's memory of the messages which fell out of the context window
+type Summary struct {
+	ESN     string `json:"esn"`
+	Summary string `json:"summary"`
+	// the last message which is part of the summary
+	Upto int64     `json:"upto"`
+	Time time.Time `json:"time"`
+}
+
+type Session struct {
+	ID       int64     `json:"id"`
+	ESN      string    `json:"esn"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Messages int       `json:"messages"`
+	Tokens   int       `json:"tokens"`
+}
+
+// Summarizer folds messages into the previous summary of a robot's conversation. set by ttr,
+// which has the LLM. summarization is skipped while it's nil
+var Summarizer func(esn string, previous string, msgs []Message) (string, error)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS sessions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	esn TEXT NOT NULL,
+	started INTEGER NOT NULL,
+	ended INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS sessions_esn ON sessions (esn, ended);
+CREATE TABLE IF NOT EXISTS messages (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	session INTEGER NOT NULL REFERENCES sessions (id) ON DELETE CASCADE,
+	esn TEXT NOT NULL,
+	role TEXT NOT NULL,
+	content TEXT NOT NULL,
+	time INTEGER NOT NULL,
+	tokens INTEGER NOT NULL,
+	model TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS messages_esn ON messages (esn, id);
+-- pictures from the camera, with the message they came with
+CREATE TABLE IF NOT EXISTS images (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	message INTEGER NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+	media_type TEXT NOT NULL,
+	data BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS images_message ON images (message);
+CREATE TABLE IF NOT EXISTS summaries (
+	esn TEXT PRIMARY KEY,
+	summary TEXT NOT NULL,
+	-- the last message which is part of the summary
+	upto INTEGER NOT NULL,
+	time INTEGER NOT NULL
+);
+`
+
+var (
+	db          *sql.DB
+	dbErr       error
+	openOnce    sync.Once
+	lastPrune   time.Time
+	pruneMu     sync.Mutex
+	summarizing = make(map[string]bool)
+	summarizeMu sync.Mutex
+)
+
+func open() (*sql.DB, error) {
+	openOnce.Do(func() {
+		// sqlite only has one writer anyway, and this avoids "database is locked"
+		db, dbErr = sql.Open("sqlite3", "file:"+vars.ChatHistoryPath+"?_foreign_keys=on&_busy_timeout=5000")
+		if dbErr != nil {
+			return
+		}
+		db.SetMaxOpenConns(1)
+		if _, dbErr = db.Exec(schema); dbErr != nil {
+			logger.Println("Error setting up chat history database: " + dbErr.Error())
+			return
+		}
+		logger.Println("Chat history database: " + vars.ChatHistoryPath)
+	})
+	return db, dbErr
+}
+
+func contextTokens() int {
+	if vars.APIConfig.History.ContextTokens > 0 {
+		return vars.APIConfig.History.ContextTokens
+	}
+	return DefaultContextTokens
+}
+
+// EstimateTokens guesses how many tokens text is. about 4 characters of latin text per token,
+// and one per CJK character
+func EstimateTokens(text string) int {
+	var other, wide int
+	for _, r := range text {
+		if unicode.Is(unicode.Han, r) || unicode.Is(unicode.Hiragana, r) || unicode.Is(unicode.Katakana, r) || unicode.Is(unicode.Hangul, r) {
+			wide++
+		} else {
+			other++
+		}
+	}
+	return wide + (other+3)/4
+}
+
+// Add saves a message, continuing the robot's session or starting a new one
+func Add(esn, role, content, model string) error {
+	return AddWithImages(esn, role, content, model, nil)
+}
+
+// AddWithImages is Add for a message with pictures, which are saved shrunk. the newest pictures go
+// back to the LLM with the context right after they're taken, or when the user asks about them
+func AddWithImages(esn, role, content, model string, images []llm.Image) error {
+	d, err := open()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var session, end int64
+	err = tx.QueryRow("SELECT id, ended FROM sessions WHERE esn = ? ORDER BY ended DESC LIMIT 1", esn).Scan(&session, &end)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && now.Sub(time.Unix(end, 0)) > SessionGap) {
+		res, err := tx.Exec("INSERT INTO sessions (esn, started, ended) VALUES (?, ?, ?)", esn, now.Unix(), now.Unix())
+		if err != nil {
+			return err
+		}
+		session, _ = res.LastInsertId()
+	} else if err != nil {
+		return err
+	} else if _, err := tx.Exec("UPDATE sessions SET ended = ? WHERE id = ?", now.Unix(), session); err != nil {
+		return err
+	}
+	res, err := tx.Exec("INSERT INTO messages (session, esn, role, content, time, tokens, model) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		session, esn, role, content, now.Unix(), EstimateTokens(content), model)
+	if err != nil {
+		return err
+	}
+	id, _ := res.LastInsertId()
+	for _, img := range images {
+		img = shrinkImage(img)
+		if _, err := tx.Exec("INSERT INTO images (message, media_type, data) VALUES (?, ?, ?)", id, img.MediaType, img.Data); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	go prune()
+	return nil
+}
+
+// Context returns the newest messages which fit in the context window, oldest first, after the
+// summary of the ones before them (if there is one). text is what the user just said
+func Context(esn string, text string) []llm.Message {
+	d, err := open()
+	if err != nil {
+		logger.Println("Chat history unavailable: " + err.Error())
+		return nil
+	}
+	window, _, err := window(d, esn)
+	if err != nil {
+		logger.Println("Error reading chat history: " + err.Error())
+		return nil
+	}
+	var msgs []llm.Message
+	if summary, _ := summaryOf(d, esn); summary != "" {
+		msgs = append(msgs, llm.Message{
+			Role:    llm.RoleSystem,
+			Content: "Memory so far (a summary of your earlier conversation with the user): " + summary,
+		})
+	}
+	var photo int64
+	var images []llm.Image
+	if photoID := lastPhoto(d, esn); photoID != 0 && (photoIsLatest(window, photoID) || mentionsPhoto(text)) {
+		photo, images = photoID, imagesOf(d, photoID)
+	}
+	for _, m := range window {
+		msg := llm.Message{Role: m.Role, Content: m.Content}
+		if m.ID == photo {
+			msg.Images = images
+		}
+		msgs = append(msgs, msg)
+	}
+	go summarize(esn)
+	return msgs
+}
+
+// window returns the messages in the context window, and the id of the newest message before it
+func window(d *sql.DB, esn string) ([]Message, int64, error) {
+	rows, err := d.Query("SELECT id, session, role, content, time, tokens, model FROM messages WHERE esn = ? ORDER BY id DESC", esn)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	budget := contextTokens()
+	var newestFirst []Message
+	var before int64
+	for rows.Next() {
+		m, err := scanMessage(rows, esn)
+		if err != nil {
+			return nil, 0, err
+		}
+		if budget-m.Tokens < 0 {
+			before = m.ID
+			break
+		}
+		budget -= m.Tokens
+		newestFirst = append(newestFirst, m)
+	}
+	// a window starting with the answer to a question that fell out of it confuses the model
+	for len(newestFirst) > 0 && newestFirst[len(newestFirst)-1].Role != llm.RoleUser {
+		before = newestFirst[len(newestFirst)-1].ID
+		newestFirst = newestFirst[:len(newestFirst)-1]
+	}
+	var msgs []Message
+	for i := len(newestFirst) - 1; i >= 0; i-- {
+		msgs = append(msgs, newestFirst[i])
+	}
+	return msgs, before, rows.Err()
+}
+
+// lastPhoto returns the robot's newest message with pictures, 0 if there isn't one
+func lastPhoto(d *sql.DB, esn string) int64 {
+	var message sql.NullInt64
+	d.QueryRow("SELECT MAX(i.message) FROM images i JOIN messages m ON m.id = i.message WHERE m.esn = ?", esn).Scan(&message)
+	return message.Int64
+}
+
+// photoIsLatest is true if the photo is from the last question in the window, so the user is most
+// likely asking about it
+func photoIsLatest(window []Message, photo int64) bool {
+	for i := len(window) - 1; i >= 0; i-- {
+		if window[i].Role == llm.RoleUser {
+			return window[i].ID == photo
+		}
+	}
+	return false
+}
+
+func mentionsPhoto(text string) bool {
+	text = strings.ToLower(text)
+	for _, word := range photoWordsUnspaced {
+		if strings.Contains(text, word) {
+			return true
+		}
+	}
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool { return !unicode.IsLetter(r) }) {
+		for _, word := range photoWords {
+			if strings.HasPrefix(field, word) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// imagesOf returns the pictures of a message
+func imagesOf(d *sql.DB, message int64) []llm.Image {
+	rows, err := d.Query("SELECT media_type, data FROM images WHERE message = ? ORDER BY id", message)
+	if err != nil {
+		logger.Println("Error reading chat history images: " + err.Error())
+		return nil
+	}
+	defer rows.Close()
+	var images []llm.Image
+	for rows.Next() {
+		var img llm.Image
+		if err := rows.Scan(&img.MediaType, &img.Data); err != nil {
+			logger.Println("Error reading chat history images: " + err.Error())
+			return nil
+		}
+		images = append(images, img)
+	}
+	return images
+}
+
+// shrinkImage scales a picture down to maxImageSide and saves it as a JPEG. pictures which can't
+// be decoded are kept as they are
+func shrinkImage(img llm.Image) llm.Image {
+	src, _, err := image.Decode(bytes.NewReader(img.Data))
+	if err != nil {
+		return img
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxImageSide && h <= maxImageSide {
+		return img
+	}
+	if w > h {
+		w, h = maxImageSide, h*maxImageSide/w
+	} else {
+		w, h = w*maxImageSide/h, maxImageSide
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+	var out bytes.Buffer
+	if err := jpeg.Encode(&out, dst, &jpeg.Options{Quality: imageQuality}); err != nil {
+		return img
+	}
+	return llm.Image{MediaType: "image/jpeg", Data: out.Bytes()}
+}
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanMessage(row scanner, esn string) (Message, error) {
+	var m Message
+	var t int64
+	err := row.Scan(&m.ID, &m.Session, &m.Role, &m.Content, &t, &m.Tokens, &m.Model)
+	m.ESN = esn
+	m.Time = time.Unix(t, 0)
+	return m, err
+}
+
+func summaryOf(d *sql.DB, esn string) (string, int64) {
+	var summary string
+	var upto int64
+	d.QueryRow("SELECT summary, upto FROM summaries WHERE esn = ?", esn).Scan(&summary, &upto)
+	return summary, upto
+}
+
+// summarize folds messages which fell out of the context window into the summary
+func summarize(esn string) {
+	if !vars.APIConfig.History.Summarize || Summarizer == nil {
+		return
+	}
+	summarizeMu.Lock()
+	if summarizing[esn] {
+		summarizeMu.Unlock()
+		return
+	}
+	summarizing[esn] = true
+	summarizeMu.Unlock()
+	defer func() {
+		summarizeMu.Lock()
+		delete(summarizing, esn)
+		summarizeMu.Unlock()
+	}()
+
+	d, err := open()
+	if err != nil {
+		return
+	}
+	_, before, err := window(d, esn)
+	if err != nil || before == 0 {
+		return
+	}
+	previous, upto := summaryOf(d, esn)
+	rows, err := d.Query("SELECT id, session, role, content, time, tokens, model FROM messages WHERE esn = ? AND id > ? AND id <= ? ORDER BY id", esn, upto, before)
+	if err != nil {
+		return
+	}
+	var msgs []Message
+	var tokens int
+	for rows.Next() {
+		m, err := scanMessage(rows, esn)
+		if err != nil {
+			rows.Close()
+			return
+		}
+		tokens += m.Tokens
+		msgs = append(msgs, m)
+	}
+	rows.Close()
+	if tokens < summarizeAfterTokens {
+		return
+	}
+	logger.Println("Summarizing " + esn + "'s older chat history")
+	summary, err := Summarizer(esn, previous, msgs)
+	if err != nil {
+		logger.Println("Error summarizing chat history: " + err.Error())
+		return
+	}
+	_, err = d.Exec("INSERT INTO summaries (esn, summary, upto, time) VALUES (?, ?, ?, ?) ON CONFLICT (esn) DO UPDATE SET summary = excluded.summary, upto = excluded.upto, time = excluded.time",
+		esn, strings.TrimSpace(summary), msgs[len(msgs)-1].ID, time.Now().Unix())
+	if err != nil {
+		logger.Println("Error saving chat summary: " + err.Error())
+	}
+}
+
+// GetSummary returns a robot's summary. it's empty if there isn't one yet
+func GetSummary(esn string) (Summary, error) {
+	d, err := open()
+	if err != nil {
+		return Summary{}, err
+	}
+	s := Summary{ESN: esn}
+	var t int64
+	err = d.QueryRow("SELECT summary, upto, time FROM summaries WHERE esn = ?", esn).Scan(&s.Summary, &s.Upto, &t)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s, nil
+	}
+	s.Time = time.Unix(t, 0)
+	return s, err
+}
+
+// SetSummary replaces a robot's summary, from the web UI. the messages it covers stay the same, so
+// an empty summary makes the robot forget them without summarizing them again
+func SetSummary(esn, summary string) error {
+	d, err := open()
+	if err != nil {
+		return err
+	}
+	_, err = d.Exec("INSERT INTO summaries (esn, summary, upto, time) VALUES (?, ?, 0, ?) ON CONFLICT (esn) DO UPDATE SET summary = excluded.summary, time = excluded.time",
+		esn, strings.TrimSpace(summary), time.Now().Unix())
+	return err
+}
+
+// prune deletes messages older than the retention period, at most once every pruneEvery
+func prune() {
+	days := vars.APIConfig.History.RetentionDays
+	if days <= 0 {
+		return
+	}
+	pruneMu.Lock()
+	if time.Since(lastPrune) < pruneEvery {
+		pruneMu.Unlock()
+		return
+	}
+	lastPrune = time.Now()
+	pruneMu.Unlock()
+	d, err := open()
+	if err != nil {
+		return
+	}
+	cutoff := time.Now().AddDate(0, 0, -days).Unix()
+	res, err := d.Exec("DELETE FROM messages WHERE time < ?", cutoff)
+	if err != nil {
+		logger.Println("Error pruning chat history: " + err.Error())
+		return
+	}
+	d.Exec("DELETE FROM sessions WHERE id NOT IN (SELECT DISTINCT session FROM messages)")
+	if n, _ := res.RowsAffected(); n > 0 {
+		logger.Println("Deleted chat history older than " + time.Unix(cutoff, 0).Format("2006-01-02"))
+	}
+}
+
+// Sessions lists a robot's sessions, newest first. all robots' if esn is empty
+func Sessions(esn string) ([]Session, error) {
+	d, err := open()
+	if err != nil {
+		return nil, err
+	}
+	query := "SELECT s.id, s.esn, s.started, s.ended, COUNT(m.id), COALESCE(SUM(m.tokens), 0) FROM sessions s LEFT JOIN messages m ON m.session = s.id"
+	var args []any
+	if esn != "" {
+		query += " WHERE s.esn = ?"
+		args = append(args, esn)
+	}
+	query += " GROUP BY s.id ORDER BY s.ended DESC"
+	rows, err := d.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		var start, end int64
+		if err := rows.Scan(&s.ID, &s.ESN, &start, &end, &s.Messages, &s.Tokens); err != nil {
+			return nil, err
+		}
+		s.Start = time.Unix(start, 0)
+		s.End = time.Unix(end, 0)
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// Search returns a robot's messages, oldest first. session 0 means all sessions, an empty query
+// matches everything, and limit 0 means no limit (the newest ones are kept)
+func Search(esn string, session int64, query string, limit int) ([]Message, error) {
+	d, err := open()
+	if err != nil {
+		return nil, err
+	}
+	q := "SELECT id, session, role, content, time, tokens, model FROM messages WHERE esn = ?"
+	args := []any{esn}
+	if session != 0 {
+		q += " AND session = ?"
+		args = append(args, session)
+	}
+	if query = strings.TrimSpace(query); query != "" {
+		q += " AND content LIKE ? ESCAPE '\\'"
+		escaped := strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_").Replace(query)
+		args = append(args, "%"+escaped+"%")
+	}
+	q += " ORDER BY id DESC"
+	if limit > 0 {
+		q += " LIMIT ?"
+		args = append(args, limit)
+	}
+	rows, err := d.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var newestFirst []Message
+	for rows.Next() {
+		m, err := scanMessage(rows, esn)
+		if err != nil {
+			return nil, err
+		}
+		newestFirst = append(newestFirst, m)
+	}
+	msgs := []Message{}
+	for i := len(newestFirst) - 1; i >= 0; i-- {
+		msgs = append(msgs, newestFirst[i])
+	}
+	return msgs, rows.Err()
+}
+
+// Delete removes a robot's history and summary. everyone's if esn is empty
+func Delete(esn string) error {
+	d, err := open()
+	if err != nil {
+		return err
+	}
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	where, args := "", []any{}
+	if esn != "" {
+		where, args = " WHERE esn = ?", []any{esn}
+	}
+	for _, table := range []string{"messages", "sessions", "summaries"} {
+		if _, err := tx.Exec("DELETE FROM "+table+where, args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
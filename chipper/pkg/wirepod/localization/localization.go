@@ -39,6 +39,9 @@ const STR_NAME_IS2 = "str_name_is1"
 const STR_NAME_IS3 = "str_name_is2"
 const STR_FOR = "str_for"
 
+// not for grammer, the robot says these
+const STR_WEATHER_WHERE = "str_weather_where"
+
 // for grammer
 var ALL_STR []string = []string{
 	"str_weather_in",
@@ -115,6 +118,7 @@ var texts = map[string][]string{
 	STR_NAME_IS2:                       {"'s", "sono ", "soy ", "suis ", "bin ", " się ", "的", "'nin", "", "", ""},
 	STR_NAME_IS3:                       {"names", " chiamo ", " llamo ", "appelle ", "werde", "imię", "名字", "adlar", "имена", "namen", "імена"},
 	STR_FOR:                            {" for ", " per ", " para ", " pour ", " für ", " dla ", "给", " için ", "для", " voor ", " для "},
+	STR_WEATHER_WHERE:                  {"Where do you want the weather for?", "Per quale città vuoi il meteo?", "¿De qué ciudad quieres el tiempo?", "Pour quelle ville veux-tu la météo?", "Für welche Stadt möchtest du das Wetter?", "Dla jakiego miasta podać pogodę?", "你想知道哪里的天气？", "Hangi şehrin hava durumunu istiyorsun?", "Для какого города нужна погода?", "Voor welke stad wil je het weer?", "Для якого міста потрібна погода?"},
 }
 
 func GetText(key string) string {
@@ -147,7 +151,8 @@ func GetText(key string) string {
 
 func ReloadVosk() {
 	if vars.APIConfig.STT.Service == "vosk" || vars.APIConfig.STT.Service == "whisper.cpp" {
-		vars.IntentList, _ = vars.LoadIntents()
+		intents, _ := vars.LoadIntents()
+		vars.SetIntentList(intents)
 		vars.SttInitFunc()
 	}
 }
@@ -13,19 +13,25 @@ import (
 func (s *Server) ProcessIntentGraph(req *vtt.IntentGraphRequest) (*vtt.IntentGraphResponse, error) {
 	var successMatched bool
 	speechReq := sr.ReqToSpeechRequest(req)
+	defer speechReq.Recording.Finish()
 	var transcribedText string
 	if !isSti {
 		var err error
-		transcribedText, err = sttHandler(speechReq)
+		var committed bool
+		transcribedText, committed, err = sttHandlerWithPartials(req, speechReq)
 		if err != nil {
 			ttr.IntentPass(req, "intent_system_noaudio", "voice processing error: "+err.Error(), map[string]string{"error": err.Error()}, true)
 			return nil, nil
 		}
+		if committed {
+			logger.Println("Bot " + speechReq.Device + " request served.")
+			return nil, nil
+		}
 		if strings.TrimSpace(transcribedText) == "" {
 			ttr.IntentPass(req, "intent_system_noaudio", "", map[string]string{}, false)
 			return nil, nil
 		}
-		successMatched = ttr.ProcessTextAll(req, transcribedText, vars.IntentList, speechReq.IsOpus)
+		successMatched = ttr.ProcessTextAll(req, transcribedText, vars.GetIntentList(), speechReq.IsOpus)
 	} else {
 		intent, slots, err := stiHandler(speechReq)
 		if err != nil {
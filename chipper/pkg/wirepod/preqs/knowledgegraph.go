@@ -90,7 +90,7 @@ func streamingKG(req *vtt.KnowledgeGraphRequest, speechReq sr.SpeechRequest) str
 // Takes a SpeechRequest, figures out knowledgegraph provider, makes request, returns API response
 func KgRequest(req *vtt.KnowledgeGraphRequest, speechReq sr.SpeechRequest) string {
 	if vars.APIConfig.Knowledge.Enable {
-		if vars.APIConfig.Knowledge.Provider == "houndify" {
+		if vars.GetKnowledge(req.Device).Provider == "houndify" {
 			return houndifyKG(speechReq)
 		}
 	}
@@ -100,7 +100,9 @@ func KgRequest(req *vtt.KnowledgeGraphRequest, speechReq sr.SpeechRequest) strin
 func (s *Server) ProcessKnowledgeGraph(req *vtt.KnowledgeGraphRequest) (*vtt.KnowledgeGraphResponse, error) {
 	InitKnowledge()
 	speechReq := sr.ReqToSpeechRequest(req)
-	if vars.APIConfig.Knowledge.Enable && vars.APIConfig.Knowledge.Provider != "houndify" {
+	defer speechReq.Recording.Finish()
+	// a robot's persona can use an LLM even if houndify is the global provider
+	if vars.APIConfig.Knowledge.Enable && vars.GetKnowledge(req.Device).Provider != "houndify" {
 		streamingKG(req, speechReq)
 	} else {
 		apiResponse := KgRequest(req, speechReq)
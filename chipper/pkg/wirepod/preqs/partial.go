@@ -0,0 +1,65 @@
+package processreqs
+
+import (
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
+	sr "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/speechrequest"
+	stt "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/stt"
+	ttr "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/ttr"
+)
+
+// how many times in a row the same partial transcript has to come in before it is trusted,
+// unless the engine says otherwise
+const partialStableCount = 3
+
+type sttResult struct {
+	text string
+	err  error
+}
+
+// sttHandlerWithPartials is sttHandler, but if the engine gives partial transcripts they are matched
+// against the intent list as they come in. committed is true if an intent was already sent
+func sttHandlerWithPartials(req interface{}, speechReq sr.SpeechRequest) (text string, committed bool, err error) {
+	running, done := useEngine()
+	engine, is := running.(stt.PartialEngine)
+	if !is {
+		done()
+		text, err = sttHandler(speechReq)
+		return text, false, err
+	}
+	stableCount := partialStableCount
+	if n := engine.Capabilities().StablePartials; n > 0 {
+		stableCount = n
+	}
+	partials := make(chan string)
+	stop := make(chan struct{})
+	result := make(chan sttResult, 1)
+	go func() {
+		defer done()
+		text, err := engine.TranscribePartial(speechReq, partials, stop)
+		result <- sttResult{text: text, err: err}
+	}()
+	var lastPartial string
+	var stable int
+	for partial := range partials {
+		if committed {
+			continue
+		}
+		if partial == lastPartial {
+			stable++
+		} else {
+			lastPartial = partial
+			stable = 1
+		}
+		if stable == stableCount && ttr.ProcessTextPartial(req, partial, vars.GetIntentList(), speechReq.IsOpus) {
+			committed = true
+			close(stop)
+		}
+	}
+	res := <-result
+	if committed {
+		speechReq.Recording.SetTranscript(lastPartial)
+		return lastPartial, true, nil
+	}
+	speechReq.Recording.SetTranscript(res.text)
+	return res.text, false, res.err
+}
@@ -0,0 +1,192 @@
+package processreqs
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/pluginhost"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
+	stt "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/stt"
+	ttr "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/ttr"
+	xiao_wan_plugins "github.com/wangergou2023/xiao_wan/chipper/plugins/xiao_wan/plugins"
+)
+
+// watches plugins and intent data, and reloads them when they change.
+// files are polled, which also works on network and docker volumes
+
+const reloadPollInterval = time.Second * 2
+
+type fileState struct {
+	modTime time.Time
+	size    int64
+}
+
+// a group of files which are reloaded together
+type watchGroup struct {
+	name string
+	// files, or directories whose files (not subdirectories) are watched
+	paths  func() []string
+	reload func() error
+	last   map[string]fileState
+	// a change is only reloaded once it stops changing, so half-written files aren't loaded
+	pending map[string]fileState
+}
+
+func statPaths(paths []string) map[string]fileState {
+	state := make(map[string]fileState)
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !info.IsDir() {
+			state[path] = fileState{modTime: info.ModTime(), size: info.Size()}
+			continue
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if entry.IsDir() {
+				continue
+			}
+			if info, err := entry.Info(); err == nil {
+				state[filepath.Join(path, entry.Name())] = fileState{modTime: info.ModTime(), size: info.Size()}
+			}
+		}
+	}
+	return state
+}
+
+func sameState(a, b map[string]fileState) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, state := range a {
+		if other, ok := b[path]; !ok || !other.modTime.Equal(state.modTime) || other.size != state.size {
+			return false
+		}
+	}
+	return true
+}
+
+func (g *watchGroup) check() {
+	state := statPaths(g.paths())
+	if sameState(state, g.last) {
+		g.pending = nil
+		return
+	}
+	if g.pending == nil || !sameState(state, g.pending) {
+		g.pending = state
+		return
+	}
+	g.pending = nil
+	g.last = state
+	logger.Println("Hot reload: " + g.name + " changed, reloading")
+	if err := g.reload(); err != nil {
+		logger.Println("Hot reload: not reloading " + g.name + ", keeping the old version: " + err.Error())
+		return
+	}
+	logger.Println("Hot reload: reloaded " + g.name)
+}
+
+func loadIntentList() {
+	intents, _ := vars.LoadIntents()
+	vars.SetIntentList(intents)
+}
+
+// the grammar of some local models is made from the intents. requests which are transcribing
+// keep the old one until they're done
+func refreshGrammar() error {
+	engine, done := useEngine()
+	defer done()
+	if engine, ok := engine.(stt.GrammarEngine); ok {
+		return engine.ReloadGrammar()
+	}
+	return nil
+}
+
+func reloadIntentList() error {
+	jsonBytes, err := os.ReadFile(vars.IntentsPath())
+	if err != nil {
+		return err
+	}
+	intents, err := vars.ParseIntents(jsonBytes)
+	if err != nil {
+		return err
+	}
+	old := vars.GetIntentList()
+	vars.SetIntentList(intents)
+	if err := refreshGrammar(); err != nil {
+		vars.SetIntentList(old)
+		return err
+	}
+	return nil
+}
+
+func reloadCustomIntents() error {
+	jsonBytes, err := os.ReadFile(vars.CustomIntentsPath)
+	if err != nil {
+		return err
+	}
+	intents, err := vars.ParseCustomIntents(jsonBytes)
+	if err != nil {
+		return err
+	}
+	if reflect.DeepEqual(intents, vars.GetCustomIntents()) {
+		// written by the web interface, which already swapped them in
+		return nil
+	}
+	old := vars.GetCustomIntents()
+	vars.SetCustomIntents(intents)
+	if err := refreshGrammar(); err != nil {
+		vars.SetCustomIntents(old)
+		return err
+	}
+	return nil
+}
+
+func watchFiles() {
+	xiaoWanDir, _ := xiao_wan_plugins.CompiledDir()
+	groups := []*watchGroup{
+		{
+			name:   "intent data",
+			paths:  func() []string { return []string{vars.IntentsPath()} },
+			reload: reloadIntentList,
+		},
+		{
+			name:   "custom intents",
+			paths:  func() []string { return []string{vars.CustomIntentsPath} },
+			reload: reloadCustomIntents,
+		},
+		{
+			name:   "plugins",
+			paths:  func() []string { return []string{"./plugins"} },
+			reload: func() error { return ttr.ReloadPlugins(false) },
+		},
+		{
+			name:   "plugin programs",
+			paths:  func() []string { return []string{pluginhost.DefaultDir} },
+			reload: func() error { return ttr.ReloadPlugins(true) },
+		},
+	}
+	if xiaoWanDir != "" {
+		groups = append(groups, &watchGroup{
+			name:   "xiao_wan plugins",
+			paths:  func() []string { return []string{xiaoWanDir} },
+			reload: ttr.ReloadXiaoWanPlugins,
+		})
+	}
+	for _, g := range groups {
+		g.last = statPaths(g.paths())
+	}
+	for range time.Tick(reloadPollInterval) {
+		for _, g := range groups {
+			g.check()
+		}
+	}
+}
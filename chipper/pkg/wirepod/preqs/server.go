@@ -2,10 +2,12 @@ package processreqs
 
 import (
 	"fmt"
+	"sync"
 
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
 	sr "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/speechrequest"
+	stt "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/stt"
 	ttr "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/ttr"
 )
 
@@ -22,55 +24,132 @@ type JsonIntent struct {
 
 var sttLanguage string = "en-US"
 
+var sttEngine stt.STTEngine
+var sttEngineMu sync.RWMutex
+
+// the requests using sttEngine. a replaced engine is closed once they are done
+var sttEngineUsers = new(sync.WaitGroup)
+
+var isSti bool = false
+
+func currentEngine() stt.STTEngine {
+	sttEngineMu.RLock()
+	defer sttEngineMu.RUnlock()
+	return sttEngine
+}
+
+// useEngine returns the running engine. done has to be called once the request is finished with it
+func useEngine() (engine stt.STTEngine, done func()) {
+	sttEngineMu.RLock()
+	defer sttEngineMu.RUnlock()
+	users := sttEngineUsers
+	users.Add(1)
+	return sttEngine, users.Done
+}
+
 // speech-to-text
-var sttHandler func(sr.SpeechRequest) (string, error)
+func sttHandler(req sr.SpeechRequest) (string, error) {
+	engine, done := useEngine()
+	defer done()
+	if engine == nil {
+		return "", fmt.Errorf("no stt engine initiated")
+	}
+	text, err := engine.Transcribe(req)
+	req.Recording.SetTranscript(text)
+	return text, err
+}
 
 // speech-to-intent (rhino)
-var stiHandler func(sr.SpeechRequest) (string, map[string]string, error)
+func stiHandler(req sr.SpeechRequest) (string, map[string]string, error) {
+	running, done := useEngine()
+	defer done()
+	engine, is := running.(stt.STIEngine)
+	if !is {
+		return "", nil, fmt.Errorf("stt engine does not support speech-to-intent")
+	}
+	intent, slots, err := engine.TranscribeIntent(req)
+	req.Recording.SetTranscript(intent)
+	return intent, slots, err
+}
 
-var isSti bool = false
+func initCurrentEngine() error {
+	engine := currentEngine()
+	if engine == nil {
+		return fmt.Errorf("no stt engine initiated")
+	}
+	return engine.Init()
+}
 
 func ReloadVosk() {
-	if vars.APIConfig.STT.Service == "vosk" || vars.APIConfig.STT.Service == "whisper.cpp" {
+	engine := currentEngine()
+	if engine != nil && engine.Capabilities().LocalModel {
 		vars.SttInitFunc()
-		vars.IntentList, _ = vars.LoadIntents()
+		loadIntentList()
 	}
 }
 
-// New returns a new server
-func New(InitFunc func() error, SttHandler interface{}, voiceProcessor string) (*Server, error) {
-
-	// Decide the TTS language
-	if voiceProcessor != "vosk" && voiceProcessor != "whisper.cpp" {
+// SwitchSTTEngine initiates the named engine and, if that works, replaces the running one with it
+func SwitchSTTEngine(name string) error {
+	engine, err := stt.Get(name)
+	if err != nil {
+		return err
+	}
+	// Decide the STT language
+	if len(engine.Capabilities().Languages) == 0 {
 		vars.APIConfig.STT.Language = "en-US"
 	}
 	sttLanguage = vars.APIConfig.STT.Language
-	vars.IntentList, _ = vars.LoadIntents()
-	logger.Println("Initiating " + voiceProcessor + " voice processor with language " + sttLanguage)
-	vars.SttInitFunc = InitFunc
-	err := InitFunc()
+	logger.Println("Initiating " + name + " voice processor with language " + sttLanguage)
+	err = engine.Init()
 	if err != nil {
-		return nil, err
+		logger.Println("Failed to initiate " + name + ": " + err.Error())
+		return err
 	}
-
-	// SttHandler can either be `func(sr.SpeechRequest) (string, error)` or `func (sr.SpeechRequest) (string, map[string]string, error)`
-	// second one exists to accomodate Rhino
-
-	// check function type
-	if str, is := SttHandler.(func(sr.SpeechRequest) (string, error)); is {
-		sttHandler = str
-	} else if str, is := SttHandler.(func(sr.SpeechRequest) (string, map[string]string, error)); is {
-		stiHandler = str
-		isSti = true
-	} else {
-		return nil, fmt.Errorf("stthandler not of correct type")
+	sttEngineMu.Lock()
+	oldEngine := sttEngine
+	oldUsers := sttEngineUsers
+	sttEngine = engine
+	sttEngineUsers = new(sync.WaitGroup)
+	_, isSti = engine.(stt.STIEngine)
+	VoiceProcessor = name
+	sttEngineMu.Unlock()
+	if oldEngine != nil && oldEngine.Name() != name {
+		// requests already transcribing with it get to finish first
+		go func() {
+			oldUsers.Wait()
+			if current := currentEngine(); current != nil && current.Name() == oldEngine.Name() {
+				// switched back to it meanwhile
+				return
+			}
+			logger.Println("Closing " + oldEngine.Name() + " voice processor")
+			oldEngine.Close()
+		}()
 	}
+	vars.APIConfig.STT.Service = name
+	vars.SttInitFunc = initCurrentEngine
+	loadIntentList()
+	return nil
+}
 
-	// Initiating the chosen voice processor and load intents from json
-	VoiceProcessor = voiceProcessor
+// New returns a new server
+func New(defaultEngine string) (*Server, error) {
+	// the engine chosen in the web interface wins over the one this binary was built for
+	engineName := vars.APIConfig.STT.Service
+	if _, err := stt.Get(engineName); err != nil {
+		if engineName != "" {
+			logger.Println(err)
+		}
+		engineName = defaultEngine
+	}
+	vars.SttInitFunc = initCurrentEngine
+	err := SwitchSTTEngine(engineName)
+	if err != nil {
+		return nil, err
+	}
 
 	// Load plugins
 	ttr.LoadPlugins()
+	go watchFiles()
 
 	ttr.Xiao_wan_start("你好啊")
 
@@ -0,0 +1,194 @@
+package recorder
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
+)
+
+// saves voice requests so they can be replayed through STT and the intent matcher later (chipper replay)
+
+// each recording is a directory in RecordingsPath/<date>/ with these files
+const (
+	InfoFile = "recording.json"
+	OpusFile = "audio.ogg"
+	PCMFile  = "audio.pcm"
+)
+
+type Recording struct {
+	ESN        string            `json:"esn"`
+	Session    string            `json:"session"`
+	IsOpus     bool              `json:"is_opus"`
+	Transcript string            `json:"transcript"`
+	Intent     string            `json:"intent"`
+	Params     map[string]string `json:"params"`
+	STTService string            `json:"stt_service"`
+	Language   string            `json:"language"`
+	// sizes of the raw chunks as they came from the robot, so replay can split the audio the same way
+	Chunks []int `json:"chunks"`
+	// timing
+	StartTime  time.Time `json:"start_time"`
+	AudioMs    int       `json:"audio_ms"`
+	STTMs      int64     `json:"stt_ms"`
+	IntentMs   int64     `json:"intent_ms"`
+	TotalMs    int64     `json:"total_ms"`
+	raw        []byte
+	pcm        []byte
+	sttDone    time.Time
+	intentDone time.Time
+	mu         sync.Mutex
+}
+
+// recordings which haven't been finished yet, by esn+session, so IntentPass can find them
+var active = make(map[string]*Recording)
+var activeMu sync.Mutex
+
+func key(esn, session string) string {
+	return esn + ":" + session
+}
+
+// Start returns nil if the recorder isn't enabled. all Recording methods are fine to call on nil
+func Start(esn string, session string, isOpus bool) *Recording {
+	if !vars.APIConfig.Recorder.Enable {
+		return nil
+	}
+	r := &Recording{
+		ESN:        esn,
+		Session:    session,
+		IsOpus:     isOpus,
+		STTService: vars.APIConfig.STT.Service,
+		Language:   vars.APIConfig.STT.Language,
+		StartTime:  time.Now(),
+	}
+	activeMu.Lock()
+	active[key(esn, session)] = r
+	activeMu.Unlock()
+	return r
+}
+
+// AddAudio takes a raw chunk from the robot and the 16khz PCM decoded from it
+func (r *Recording) AddAudio(raw []byte, pcm []byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.raw = append(r.raw, raw...)
+	r.pcm = append(r.pcm, pcm...)
+	r.Chunks = append(r.Chunks, len(raw))
+}
+
+func (r *Recording) SetTranscript(text string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Transcript = text
+	r.sttDone = time.Now()
+}
+
+// SetIntent is called when an intent is sent to the robot
+func SetIntent(esn string, session string, intent string, params map[string]string) {
+	activeMu.Lock()
+	r, ok := active[key(esn, session)]
+	activeMu.Unlock()
+	if !ok {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Intent = intent
+	r.Params = params
+	r.intentDone = time.Now()
+}
+
+// Finish writes the recording to disk
+func (r *Recording) Finish() {
+	if r == nil {
+		return
+	}
+	activeMu.Lock()
+	delete(active, key(r.ESN, r.Session))
+	activeMu.Unlock()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.AudioMs = len(r.pcm) / 32
+	if !r.sttDone.IsZero() {
+		r.STTMs = r.sttDone.Sub(r.StartTime).Milliseconds()
+	}
+	if !r.intentDone.IsZero() {
+		r.IntentMs = r.intentDone.Sub(r.StartTime).Milliseconds()
+	}
+	r.TotalMs = time.Since(r.StartTime).Milliseconds()
+
+	session := r.Session
+	if len(session) > 8 {
+		session = session[:8]
+	}
+	dir := filepath.Join(vars.RecordingsPath, r.StartTime.Format("2006-01-02"), r.StartTime.Format("150405")+"-"+r.ESN+"-"+session)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		logger.Println("Error creating recording directory: " + err.Error())
+		return
+	}
+	if r.IsOpus {
+		os.WriteFile(filepath.Join(dir, OpusFile), r.raw, 0644)
+	}
+	os.WriteFile(filepath.Join(dir, PCMFile), r.pcm, 0644)
+	infoBytes, _ := json.MarshalIndent(r, "", "  ")
+	os.WriteFile(filepath.Join(dir, InfoFile), infoBytes, 0644)
+	logger.Println("Bot " + r.ESN + " request recorded to " + dir)
+}
+
+// Load reads a recording directory written by Finish. RawChunks gives the audio as the robot sent it
+func Load(dir string) (*Recording, error) {
+	infoBytes, err := os.ReadFile(filepath.Join(dir, InfoFile))
+	if err != nil {
+		return nil, err
+	}
+	var r Recording
+	err = json.Unmarshal(infoBytes, &r)
+	if err != nil {
+		return nil, err
+	}
+	if r.IsOpus {
+		r.raw, err = os.ReadFile(filepath.Join(dir, OpusFile))
+	} else {
+		r.raw, err = os.ReadFile(filepath.Join(dir, PCMFile))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (r *Recording) RawChunks() [][]byte {
+	var chunks [][]byte
+	raw := r.raw
+	for _, size := range r.Chunks {
+		if size > len(raw) {
+			break
+		}
+		chunks = append(chunks, raw[:size])
+		raw = raw[size:]
+	}
+	return chunks
+}
+
+// FindRecordings returns every recording directory under dir
+func FindRecordings(dir string) []string {
+	var dirs []string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && strings.EqualFold(info.Name(), InfoFile) {
+			dirs = append(dirs, filepath.Dir(path))
+		}
+		return nil
+	})
+	return dirs
+}
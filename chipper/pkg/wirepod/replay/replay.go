@@ -0,0 +1,128 @@
+package replay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	pb "github.com/digital-dream-labs/api/go/chipperpb"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/vtt"
+	wp "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/preqs"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/recorder"
+	stt "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/stt"
+	ttr "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/ttr"
+	"google.golang.org/grpc"
+)
+
+// chipper replay [directory]
+// runs every recording made by the recorder through the current STT engine and intent matcher,
+// and reports where the intent or transcript differs from what was recorded
+
+// fakeStream plays back recorded chunks as if they were coming from the robot, and keeps what is sent back
+type fakeStream struct {
+	grpc.ServerStream
+	chunks [][]byte
+	sent   *pb.IntentResponse
+}
+
+func (s *fakeStream) Recv() (*pb.StreamingIntentRequest, error) {
+	if len(s.chunks) == 0 {
+		return nil, io.EOF
+	}
+	chunk := s.chunks[0]
+	s.chunks = s.chunks[1:]
+	return &pb.StreamingIntentRequest{InputAudio: chunk}, nil
+}
+
+func (s *fakeStream) Send(resp *pb.IntentResponse) error {
+	s.sent = resp
+	return nil
+}
+
+func (s *fakeStream) Context() context.Context {
+	return context.Background()
+}
+
+func Run(defaultEngine string, args []string) {
+	logger.Init()
+	vars.Init()
+	// nothing should be recorded, said on the robot, or sent to an LLM while replaying
+	vars.APIConfig.Recorder.Enable = false
+	vars.APIConfig.Knowledge.Enable = false
+	ttr.DryRun = true
+
+	dir := vars.RecordingsPath
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	engineName := vars.APIConfig.STT.Service
+	if _, err := stt.Get(engineName); err != nil {
+		engineName = defaultEngine
+	}
+	err := wp.SwitchSTTEngine(engineName)
+	if err != nil {
+		fmt.Println("Error initiating " + engineName + ": " + err.Error())
+		os.Exit(1)
+	}
+	processor := &wp.Server{}
+
+	recordings := recorder.FindRecordings(dir)
+	if len(recordings) == 0 {
+		fmt.Println("No recordings found in " + dir)
+		return
+	}
+	fmt.Println("Replaying " + fmt.Sprint(len(recordings)) + " recordings with " + engineName)
+	var intentMatches int
+	var transcriptMatches int
+	var total int
+	for _, recDir := range recordings {
+		rec, err := recorder.Load(recDir)
+		if err != nil {
+			fmt.Println("ERROR " + recDir + ": " + err.Error())
+			continue
+		}
+		chunks := rec.RawChunks()
+		if len(chunks) == 0 || rec.Intent == "" {
+			// knowledge graph requests and requests which errored out don't have an intent to compare
+			continue
+		}
+		total++
+		stream := &fakeStream{chunks: chunks[1:]}
+		req := &vtt.IntentRequest{
+			Time:     time.Now(),
+			Stream:   stream,
+			Device:   rec.ESN,
+			Session:  "replay-" + rec.Session,
+			FirstReq: &pb.StreamingIntentRequest{InputAudio: chunks[0]},
+		}
+		processor.ProcessIntent(req)
+		var intent string
+		var transcript string
+		if stream.sent != nil && stream.sent.IntentResult != nil {
+			intent = stream.sent.IntentResult.Action
+			transcript = stream.sent.IntentResult.QueryText
+		}
+		if intent == rec.Intent {
+			intentMatches++
+			fmt.Println("OK   " + recDir + ": " + intent)
+		} else {
+			fmt.Println("DIFF " + recDir + ": intent " + rec.Intent + " -> " + intent)
+		}
+		if strings.EqualFold(strings.TrimSpace(transcript), strings.TrimSpace(rec.Transcript)) {
+			transcriptMatches++
+		} else {
+			fmt.Println("     transcript '" + rec.Transcript + "' -> '" + transcript + "'")
+		}
+	}
+	if total == 0 {
+		fmt.Println("No recordings with an intent to compare")
+		return
+	}
+	fmt.Printf("Intent accuracy: %d/%d (%.1f%%)\n", intentMatches, total, float64(intentMatches)/float64(total)*100)
+	fmt.Printf("Transcript accuracy: %d/%d (%.1f%%)\n", transcriptMatches, total, float64(transcriptMatches)/float64(total)*100)
+}
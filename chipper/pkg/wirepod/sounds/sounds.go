@@ -0,0 +1,401 @@
+package sounds
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fforchino/vector-go-sdk/pkg/vector"
+	"github.com/fforchino/vector-go-sdk/pkg/vectorpb"
+	"github.com/hajimehoshi/go-mp3"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/audio"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
+)
+
+// the sound library: WAV, MP3, OGG and Opus files in vars.SoundsPath, named after the file without its
+// extension. they are transcoded to 16kHz mono PCM when played. Vorbis OGG (and WAV which isn't
+// plain PCM) goes through ffmpeg, which has to be installed for those
+
+const (
+	SampleRate = 16000
+	// biggest file Save accepts
+	MaxFileSize = 20 << 20
+	chunkSize   = 1024
+	// how far ahead of the robot's playback chunks are sent
+	sendAhead = 200 * time.Millisecond
+)
+
+var Formats = []string{".wav", ".mp3", ".ogg", ".opus"}
+
+type Sound struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+	Size int64  `json:"size"`
+}
+
+// uploads and deletes while a sound is being read would be confusing
+var libraryMu sync.RWMutex
+
+func isFormat(ext string) bool {
+	for _, format := range Formats {
+		if ext == format {
+			return true
+		}
+	}
+	return false
+}
+
+// Sounds is everything in the library, sorted by name
+func Sounds() []Sound {
+	libraryMu.RLock()
+	defer libraryMu.RUnlock()
+	return sounds()
+}
+
+func sounds() []Sound {
+	entries, err := os.ReadDir(vars.SoundsPath)
+	if err != nil {
+		return nil
+	}
+	var list []Sound
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		// uploads are written to dot files first
+		if entry.IsDir() || !isFormat(ext) || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		list = append(list, Sound{
+			Name: strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name())),
+			File: entry.Name(),
+			Size: info.Size(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+	return list
+}
+
+// List is the names of the sounds in the library
+func List() []string {
+	var names []string
+	for _, sound := range Sounds() {
+		names = append(names, sound.Name)
+	}
+	return names
+}
+
+func Exists(name string) bool {
+	libraryMu.RLock()
+	defer libraryMu.RUnlock()
+	_, err := find(name)
+	return err == nil
+}
+
+func find(name string) (Sound, error) {
+	for _, sound := range sounds() {
+		if sound.Name == name {
+			return sound, nil
+		}
+	}
+	return Sound{}, errors.New("no sound called " + name + " in the library")
+}
+
+// SoundName makes a sound name from a file name: letters, numbers, - and _, spaces become _
+func SoundName(file string) string {
+	name := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		case r == ' ':
+			return '_'
+		}
+		return -1
+	}, name)
+}
+
+// Save adds a file to the library, replacing a sound with the same name. it has to decode, so
+// broken files don't end up in the library. returns the sound's name
+func Save(file string, data io.Reader) (string, error) {
+	ext := strings.ToLower(filepath.Ext(file))
+	if !isFormat(ext) {
+		return "", errors.New("sounds must be one of " + strings.Join(Formats, ", "))
+	}
+	name := SoundName(file)
+	if name == "" {
+		return "", errors.New("the file name needs some letters or numbers")
+	}
+	libraryMu.Lock()
+	defer libraryMu.Unlock()
+	if err := os.MkdirAll(vars.SoundsPath, 0777); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(vars.SoundsPath, ".upload-*"+ext)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, io.LimitReader(data, MaxFileSize+1))
+	tmp.Close()
+	if err != nil {
+		return "", err
+	}
+	if n > MaxFileSize {
+		return "", errors.New("sounds can be at most 20MB")
+	}
+	if _, err := decode(tmp.Name()); err != nil {
+		return "", errors.New("couldn't read the sound: " + err.Error())
+	}
+	if old, err := find(name); err == nil {
+		os.Remove(filepath.Join(vars.SoundsPath, old.File))
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(vars.SoundsPath, name+ext)); err != nil {
+		return "", err
+	}
+	logger.Println("Added sound " + name + " to the library")
+	return name, nil
+}
+
+func Delete(name string) error {
+	libraryMu.Lock()
+	defer libraryMu.Unlock()
+	sound, err := find(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(vars.SoundsPath, sound.File))
+}
+
+// Load reads a sound from the library as 16kHz mono 16-bit little-endian PCM
+func Load(name string) ([]byte, error) {
+	libraryMu.RLock()
+	defer libraryMu.RUnlock()
+	sound, err := find(name)
+	if err != nil {
+		return nil, err
+	}
+	return decode(filepath.Join(vars.SoundsPath, sound.File))
+}
+
+func decode(file string) ([]byte, error) {
+	var samples []int16
+	var f audio.Format
+	var err error
+	switch strings.ToLower(filepath.Ext(file)) {
+	case ".wav":
+		samples, f, err = readFile(file, audio.DecodeWAV)
+	case ".mp3":
+		samples, f, err = readFile(file, decodeMP3)
+	default:
+		// .ogg is usually Vorbis, which only ffmpeg does
+		samples, f, err = readFile(file, audio.DecodeOggOpus)
+		if err != nil {
+			return transcode(file)
+		}
+	}
+	if errors.Is(err, audio.ErrNotPCM) {
+		return transcode(file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return audio.Bytes(audio.Resample(audio.Mono(samples, f.Channels), f.Rate, SampleRate)), nil
+}
+
+func readFile(file string, decode func([]byte) ([]int16, audio.Format, error)) ([]int16, audio.Format, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, audio.Format{}, err
+	}
+	return decode(data)
+}
+
+// go-mp3 always gives 16-bit stereo
+func decodeMP3(data []byte) ([]int16, audio.Format, error) {
+	d, err := mp3.NewDecoder(bytes.NewReader(data))
+	if err != nil {
+		return nil, audio.Format{}, err
+	}
+	pcm, err := io.ReadAll(d)
+	if err != nil {
+		return nil, audio.Format{}, err
+	}
+	return audio.Int16s(pcm), audio.Format{Rate: d.SampleRate(), Channels: 2}, nil
+}
+
+// transcode has ffmpeg do the whole conversion
+func transcode(file string) ([]byte, error) {
+	if _, err := exec.LookPath("ffmpeg"); err != nil {
+		return nil, errors.New("ffmpeg is needed for " + filepath.Ext(file) + " sounds but isn't installed")
+	}
+	out, err := exec.Command("ffmpeg", "-v", "error", "-i", file, "-f", "s16le", "-ac", "1", "-ar", "16000", "-").Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return nil, errors.New("ffmpeg: " + strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, err
+	}
+	if len(out) == 0 {
+		return nil, errors.New("ffmpeg: no audio in the file")
+	}
+	return out, nil
+}
+
+// Length is how long 16kHz mono 16-bit PCM plays for
+func Length(pcm []byte) time.Duration {
+	return samplesLength(len(pcm) / 2)
+}
+
+func samplesLength(samples int) time.Duration {
+	return audio.Duration(samples, SampleRate)
+}
+
+// Play plays a sound from the library on the robot, and returns once it's finished
+func Play(robot *vector.Vector, name string) error {
+	pcm, err := Load(name)
+	if err != nil {
+		return err
+	}
+	return PlayPCM(robot, pcm)
+}
+
+// PlayPCM plays 16kHz mono 16-bit PCM on the robot, and returns once it's finished
+func PlayPCM(robot *vector.Vector, pcm []byte) error {
+	return PlayStream(robot, bytes.NewReader(pcm))
+}
+
+// PlayStream plays 16kHz mono 16-bit PCM on the robot as it's read, so speech can start playing
+// before it's all synthesized. it returns once the robot says it's finished
+func PlayStream(robot *vector.Vector, pcm io.Reader) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client, err := robot.Conn.ExternalAudioStreamPlayback(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.CloseSend()
+	err = client.Send(&vectorpb.ExternalAudioStreamRequest{
+		AudioRequestType: &vectorpb.ExternalAudioStreamRequest_AudioStreamPrepare{
+			AudioStreamPrepare: &vectorpb.ExternalAudioStreamPrepare{
+				AudioFrameRate: SampleRate,
+				AudioVolume:    100,
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	// the robot says when it has more audio than it can hold, and when it's done playing
+	backlog := make(chan time.Duration, 1)
+	finished := make(chan error, 1)
+	go func() {
+		for {
+			resp, err := client.Recv()
+			if err == io.EOF {
+				err = nil
+			}
+			if err != nil {
+				finished <- err
+				return
+			}
+			if overrun := resp.GetAudioStreamBufferOverrun(); overrun != nil {
+				select {
+				case backlog <- samplesLength(int(overrun.AudioSamplesSent) - int(overrun.AudioSamplesPlayed)):
+				default:
+				}
+			} else if resp.GetAudioStreamPlaybackComplete() != nil {
+				finished <- nil
+				return
+			} else if resp.GetAudioStreamPlaybackFailyer() != nil {
+				finished <- errors.New("the robot couldn't play the audio")
+				return
+			}
+		}
+	}()
+	start := time.Now()
+	var sent time.Duration
+	chunk := make([]byte, chunkSize)
+	for {
+		n, readErr := io.ReadFull(pcm, chunk)
+		n -= n % 2
+		if n > 0 {
+			// audio which comes slower than it plays leaves the robot waiting, so pace from now
+			if behind := time.Since(start) - sent; behind > 0 {
+				start = start.Add(behind)
+			}
+			err = client.Send(&vectorpb.ExternalAudioStreamRequest{
+				AudioRequestType: &vectorpb.ExternalAudioStreamRequest_AudioStreamChunk{
+					AudioStreamChunk: &vectorpb.ExternalAudioStreamChunk{
+						AudioChunkSizeBytes: uint32(n),
+						AudioChunkSamples:   chunk[:n],
+					},
+				},
+			})
+			if err != nil {
+				return err
+			}
+			sent += Length(chunk[:n])
+			// the robot only buffers a little, so keep just ahead of it
+			wait := sent - time.Since(start) - sendAhead
+			select {
+			case queued := <-backlog:
+				if queued-sendAhead > wait {
+					wait = queued - sendAhead
+				}
+			case err := <-finished:
+				if err == nil {
+					err = errors.New("the robot stopped playing")
+				}
+				return err
+			default:
+			}
+			if wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			client.Send(&vectorpb.ExternalAudioStreamRequest{
+				AudioRequestType: &vectorpb.ExternalAudioStreamRequest_AudioStreamCancel{
+					AudioStreamCancel: &vectorpb.ExternalAudioStreamCancel{},
+				},
+			})
+			return readErr
+		}
+	}
+	if sent == 0 {
+		return nil
+	}
+	err = client.Send(&vectorpb.ExternalAudioStreamRequest{
+		AudioRequestType: &vectorpb.ExternalAudioStreamRequest_AudioStreamComplete{
+			AudioStreamComplete: &vectorpb.ExternalAudioStreamComplete{},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	// in case the robot never says it's done, stop waiting a little after it should be
+	select {
+	case err := <-finished:
+		return err
+	case <-time.After(sent - time.Since(start) + 500*time.Millisecond):
+		return nil
+	}
+}
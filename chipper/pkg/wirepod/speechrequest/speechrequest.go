@@ -1,27 +1,24 @@
 package speechrequest
 
 import (
-	"bytes"
-	"encoding/binary"
 	"errors"
 	"fmt"
-	"math"
 	"os"
 	"time"
 
 	pb "github.com/digital-dream-labs/api/go/chipperpb"
 	"github.com/digital-dream-labs/opus-go/opus"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/audio"
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/vtt"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/recorder"
 	"github.com/maxhawkins/go-webrtcvad"
 )
 
 // one type and many functions for dealing with intent, intent-graph, and knowledge-graph requests
 // also some functions to help decode the stream bytes into ones friendly for stt engines
 
-var debugWriteFile bool = false
-var debugFile *os.File
-
 type SpeechRequest struct {
 	Device          string
 	Session         string
@@ -40,14 +37,17 @@ type SpeechRequest struct {
 	LastAudioChunk  []byte
 	IsOpus          bool
 	OpusStream      *opus.OggStream
+	VAD             vars.VADSettings
+	TotalFrames     int
+	NoiseFloor      float64
+	NoiseFrames     int
+	HighPass        *audio.Biquad
+	// nil unless the recorder is enabled
+	Recording *recorder.Recording
 }
 
 func BytesToSamples(buf []byte) []int16 {
-	samples := make([]int16, len(buf)/2)
-	for i := 0; i < len(buf)/2; i++ {
-		samples[i] = int16(binary.LittleEndian.Uint16(buf[i*2:]))
-	}
-	return samples
+	return audio.Int16s(buf)
 }
 
 func (req *SpeechRequest) OpusDetect() bool {
@@ -105,27 +105,69 @@ func BytesToIntVAD(stream opus.OggStream, data []byte, die bool, isOpus bool) []
 	}
 }
 
+// each chunk given to the VAD is 10ms of audio
+const vadFrameMs = 10
+
+// the noise floor is estimated from this many frames at the start of the request (adaptive mode)
+const noiseFloorFrames = 15
+
+// in adaptive mode, a frame has to be this much louder than the noise floor to count as speech
+const noiseFloorRatio = 2.0
+
+func frameRMS(chunk []byte) float64 {
+	return audio.RMS(BytesToSamples(chunk))
+}
+
+// isActive runs the frame through webrtc vad and, in adaptive mode, the noise floor check
+func (req *SpeechRequest) isActive(chunk []byte) (bool, error) {
+	active, err := req.VADInst.Process(16000, chunk)
+	if err != nil || !req.VAD.Adaptive {
+		return active, err
+	}
+	rms := frameRMS(chunk)
+	if req.NoiseFrames < noiseFloorFrames {
+		// running average of the first frames
+		req.NoiseFrames = req.NoiseFrames + 1
+		req.NoiseFloor = req.NoiseFloor + (rms-req.NoiseFloor)/float64(req.NoiseFrames)
+		return false, nil
+	}
+	if active && rms < req.NoiseFloor*noiseFloorRatio {
+		active = false
+	}
+	if !active {
+		// let the floor follow slow changes in background noise
+		req.NoiseFloor = req.NoiseFloor*0.95 + rms*0.05
+	}
+	return active, nil
+}
+
 // Uses VAD to detect when the user stops speaking
 func (req *SpeechRequest) DetectEndOfSpeech() (bool, bool) {
 	// changes InactiveFrames and ActiveFrames in req
-	inactiveNumMax := 23
+	inactiveNumMax := req.VAD.SilenceMs / vadFrameMs
+	activeNumMin := req.VAD.MinSpeechMs / vadFrameMs
 	for _, chunk := range SplitVAD(req.LastAudioChunk) {
-		active, err := req.VADInst.Process(16000, chunk)
+		active, err := req.isActive(chunk)
 		if err != nil {
 			logger.Println("VAD err:")
 			logger.Println(err)
 			return true, false
 		}
+		req.TotalFrames = req.TotalFrames + 1
 		if active {
 			req.ActiveFrames = req.ActiveFrames + 1
 			req.InactiveFrames = 0
 		} else {
 			req.InactiveFrames = req.InactiveFrames + 1
 		}
-		if req.InactiveFrames >= inactiveNumMax && req.ActiveFrames > 18 {
+		if req.InactiveFrames >= inactiveNumMax && req.ActiveFrames >= activeNumMin {
 			logger.Println("(Bot " + req.Device + ") End of speech detected.")
 			return true, true
 		}
+		if req.VAD.MaxUtteranceMs > 0 && req.TotalFrames*vadFrameMs >= req.VAD.MaxUtteranceMs {
+			logger.Println("(Bot " + req.Device + ") Max utterance length reached, ending speech.")
+			return true, true
+		}
 	}
 	if req.ActiveFrames < 5 {
 		return false, false
@@ -133,90 +175,28 @@ func (req *SpeechRequest) DetectEndOfSpeech() (bool, bool) {
 	return false, true
 }
 
-func bytesToInt16(data []byte) ([]int16, error) {
-	var samples []int16
-	buf := bytes.NewReader(data)
-	for buf.Len() > 0 {
-		var sample int16
-		err := binary.Read(buf, binary.LittleEndian, &sample)
-		if err != nil {
-			return nil, err
-		}
-		samples = append(samples, sample)
-	}
-	return samples, nil
-}
-
-func int16ToBytes(samples []int16) []byte {
-	buf := new(bytes.Buffer)
-	for _, sample := range samples {
-		err := binary.Write(buf, binary.LittleEndian, sample)
-		if err != nil {
-			return nil
-		}
-	}
-	return buf.Bytes()
-}
-
-func applyGain(samples []int16, gain float64) []int16 {
-	for i, sample := range samples {
-		amplifiedSample := float64(sample) * gain
-		if amplifiedSample > math.MaxInt16 {
-			samples[i] = math.MaxInt16
-		} else if amplifiedSample < math.MinInt16 {
-			samples[i] = math.MinInt16
-		} else {
-			samples[i] = int16(amplifiedSample)
-		}
-	}
-	return samples
-}
-
-// remove noise
-func highPassFilter(data []byte) []byte {
+// remove noise, and bring the quiet mic up to where the VAD hears speech. the filter keeps its state
+// from one chunk to the next.
+// the gains are the robot's VAD settings rather than an audio.Leveler: a leveler holds back up to a
+// second at the start, but the VAD has to see each chunk as it comes in, and FilteredMicData has to
+// line up with DecodedMicData. STT engines transcribe DecodedMicData, which isn't changed (apart
+// from vosk, which starts with the filtered FirstReq)
+func (req *SpeechRequest) highPassFilter(data []byte) []byte {
 	bTime := time.Now()
-	sampleRate := 16000
-	cutoffFreq := 300.0
-	samples, err := bytesToInt16(data)
-	if err != nil {
-		return nil
-	}
-	samples = applyGain(samples, 5)
-	filteredSamples := make([]float64, len(samples))
-	rc := 1.0 / (2.0 * math.Pi * cutoffFreq)
-	dt := 1.0 / float64(sampleRate)
-	alpha := dt / (rc + dt)
-
-	previous := float64(samples[0])
-	for i := 1; i < len(samples); i++ {
-		current := float64(samples[i])
-		filtered := alpha * (filteredSamples[i-1] + current - previous)
-		filteredSamples[i] = filtered
-		previous = current
-	}
-	int16FilteredSamples := make([]int16, len(filteredSamples))
-	for i, sample := range filteredSamples {
-		int16FilteredSamples[i] = int16(sample)
-	}
-
-	gained := applyGain(int16FilteredSamples, 1.5)
+	samples := audio.Gain(audio.Int16s(data), req.VAD.Gain)
+	samples = audio.Gain(req.HighPass.Process(samples), req.VAD.PostGain)
 	if os.Getenv("DEBUG_PRINT_HIGHPASS") == "true" {
 		logger.Println("highpass filter took: " + fmt.Sprint(time.Since(bTime)))
 	}
-
-	return int16ToBytes(gained)
+	return audio.Bytes(samples)
 }
 
 // Converts a vtt.*Request to a SpeechRequest, which allows functions like DetectEndOfSpeech to work
 func ReqToSpeechRequest(req interface{}) SpeechRequest {
-	if debugWriteFile {
-		debugFile, _ = os.Create("/tmp/wirepodtest.ogg")
-	}
 	var request SpeechRequest
 	request.PrevLen = 0
 	var err error
 	request.VADInst, err = webrtcvad.New()
-	request.VADInst.SetMode(2)
 	if err != nil {
 		logger.Println(err)
 	}
@@ -242,23 +222,27 @@ func ReqToSpeechRequest(req interface{}) SpeechRequest {
 		request.Session = req1.Session
 		request.Stream = req1.Stream
 		request.FirstReq = req1.FirstReq.InputAudio
-		if debugWriteFile {
-			debugFile.Write(req1.FirstReq.InputAudio)
-		}
 		request.MicData = append(request.MicData, req1.FirstReq.InputAudio...)
 	} else {
 		logger.Println("reqToSpeechRequest: invalid type")
 	}
+	request.VAD = vars.GetVADSettings(request.Device)
+	request.VADInst.SetMode(request.VAD.Mode)
+	request.HighPass = audio.HighPass(16000, 300, audio.Butterworth)
 	isOpus := request.OpusDetect()
+	request.Recording = recorder.Start(request.Device, request.Session, isOpus)
 	if isOpus {
 		request.OpusStream = &opus.OggStream{}
 		decodedFirstReq, _ := request.OpusStream.Decode(request.FirstReq)
-		request.FirstReq = highPassFilter(decodedFirstReq)
+		request.FirstReq = request.highPassFilter(decodedFirstReq)
 		request.FilteredMicData = append(request.FilteredMicData, request.FirstReq...)
 		request.DecodedMicData = append(request.DecodedMicData, decodedFirstReq...)
 		request.LastAudioChunk = request.FilteredMicData[request.PrevLen:]
 		request.PrevLen = len(request.DecodedMicData)
 		request.IsOpus = true
+		request.Recording.AddAudio(request.MicData, decodedFirstReq)
+	} else {
+		request.Recording.AddAudio(request.MicData, request.MicData)
 	}
 	return request
 }
@@ -275,8 +259,9 @@ func (req *SpeechRequest) GetNextStreamChunk() ([]byte, error) {
 		}
 		req.MicData = append(req.MicData, chunk.InputAudio...)
 		req.DecodedMicData = append(req.DecodedMicData, req.OpusDecode(chunk.InputAudio)...)
-		req.FilteredMicData = append(req.FilteredMicData, highPassFilter(req.OpusDecode(chunk.InputAudio))...)
+		req.FilteredMicData = append(req.FilteredMicData, req.highPassFilter(req.OpusDecode(chunk.InputAudio))...)
 		dataReturn := req.DecodedMicData[req.PrevLen:]
+		req.Recording.AddAudio(chunk.InputAudio, dataReturn)
 		req.LastAudioChunk = req.FilteredMicData[req.PrevLen:]
 		req.PrevLen = len(req.DecodedMicData)
 		return dataReturn, nil
@@ -289,13 +274,11 @@ func (req *SpeechRequest) GetNextStreamChunk() ([]byte, error) {
 		}
 		req.MicData = append(req.MicData, chunk.InputAudio...)
 		req.DecodedMicData = append(req.DecodedMicData, req.OpusDecode(chunk.InputAudio)...)
-		req.FilteredMicData = append(req.FilteredMicData, highPassFilter(req.OpusDecode(chunk.InputAudio))...)
+		req.FilteredMicData = append(req.FilteredMicData, req.highPassFilter(req.OpusDecode(chunk.InputAudio))...)
 		dataReturn := req.DecodedMicData[req.PrevLen:]
+		req.Recording.AddAudio(chunk.InputAudio, dataReturn)
 		req.LastAudioChunk = req.FilteredMicData[req.PrevLen:]
 		req.PrevLen = len(req.DecodedMicData)
-		if debugWriteFile {
-			debugFile.Write(chunk.InputAudio)
-		}
 		return dataReturn, nil
 	} else if str, ok := req.Stream.(pb.ChipperGrpc_StreamingKnowledgeGraphServer); ok {
 		var stream pb.ChipperGrpc_StreamingKnowledgeGraphServer = str
@@ -306,8 +289,9 @@ func (req *SpeechRequest) GetNextStreamChunk() ([]byte, error) {
 		}
 		req.MicData = append(req.MicData, chunk.InputAudio...)
 		req.DecodedMicData = append(req.DecodedMicData, req.OpusDecode(chunk.InputAudio)...)
-		req.FilteredMicData = append(req.FilteredMicData, highPassFilter(req.OpusDecode(chunk.InputAudio))...)
+		req.FilteredMicData = append(req.FilteredMicData, req.highPassFilter(req.OpusDecode(chunk.InputAudio))...)
 		dataReturn := req.DecodedMicData[req.PrevLen:]
+		req.Recording.AddAudio(chunk.InputAudio, dataReturn)
 		req.LastAudioChunk = req.FilteredMicData[req.PrevLen:]
 		req.PrevLen = len(req.DecodedMicData)
 		return dataReturn, nil
@@ -329,6 +313,7 @@ func (req *SpeechRequest) GetNextStreamChunkOpus() ([]byte, error) {
 		req.DecodedMicData = append(req.DecodedMicData, req.OpusDecode(chunk.InputAudio)...)
 		dataReturn := req.MicData[req.PrevLenRaw:]
 		req.LastAudioChunk = req.DecodedMicData[req.PrevLen:]
+		req.Recording.AddAudio(chunk.InputAudio, req.LastAudioChunk)
 		req.PrevLen = len(req.DecodedMicData)
 		req.PrevLenRaw = len(req.MicData)
 		return dataReturn, nil
@@ -343,6 +328,7 @@ func (req *SpeechRequest) GetNextStreamChunkOpus() ([]byte, error) {
 		req.DecodedMicData = append(req.DecodedMicData, req.OpusDecode(chunk.InputAudio)...)
 		dataReturn := req.MicData[req.PrevLenRaw:]
 		req.LastAudioChunk = req.DecodedMicData[req.PrevLen:]
+		req.Recording.AddAudio(chunk.InputAudio, req.LastAudioChunk)
 		req.PrevLen = len(req.DecodedMicData)
 		req.PrevLenRaw = len(req.MicData)
 		return dataReturn, nil
@@ -357,6 +343,7 @@ func (req *SpeechRequest) GetNextStreamChunkOpus() ([]byte, error) {
 		req.DecodedMicData = append(req.DecodedMicData, req.OpusDecode(chunk.InputAudio)...)
 		dataReturn := req.MicData[req.PrevLenRaw:]
 		req.LastAudioChunk = req.DecodedMicData[req.PrevLen:]
+		req.Recording.AddAudio(chunk.InputAudio, req.LastAudioChunk)
 		req.PrevLen = len(req.DecodedMicData)
 		req.PrevLenRaw = len(req.MicData)
 		return dataReturn, nil
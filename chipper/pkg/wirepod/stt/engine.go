@@ -0,0 +1,99 @@
+package wirepod_stt
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	sr "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/speechrequest"
+)
+
+// Capabilities describes what an STT engine can do, shown in the web interface
+type Capabilities struct {
+	// engine reads the request stream as it comes in rather than after end of speech
+	Streaming bool `json:"streaming"`
+	// engine can give partial transcripts before the final one
+	Partials bool `json:"partials"`
+	// how many times in a row the same partial transcript has to come in before it's trusted.
+	// 0 is the default, for engines which send them often
+	StablePartials int `json:"-"`
+	// languages the engine can be set to. empty means en-US only
+	Languages []string `json:"languages"`
+	// engine needs a downloaded model for the chosen language
+	LocalModel bool `json:"localModel"`
+}
+
+// STTEngine is implemented by every speech-to-text engine
+type STTEngine interface {
+	Name() string
+	Init() error
+	Transcribe(req sr.SpeechRequest) (string, error)
+	Close() error
+	Capabilities() Capabilities
+}
+
+// STIEngine is an STTEngine which can also return an intent and slots directly (rhino)
+type STIEngine interface {
+	STTEngine
+	TranscribeIntent(req sr.SpeechRequest) (string, map[string]string, error)
+}
+
+// PartialEngine is an STTEngine which can send partial transcripts while the user is still talking.
+// it must close partials when it returns, and should return the last partial transcript
+// as soon as it can once stop is closed
+type PartialEngine interface {
+	STTEngine
+	TranscribePartial(req sr.SpeechRequest, partials chan<- string, stop <-chan struct{}) (string, error)
+}
+
+// GrammarEngine is an STTEngine whose recognizers are made from the intent list (vosk with grammer).
+// ReloadGrammar remakes them after the intents change, without reloading the model
+type GrammarEngine interface {
+	STTEngine
+	ReloadGrammar() error
+}
+
+type EngineInfo struct {
+	Name         string       `json:"name"`
+	Capabilities Capabilities `json:"capabilities"`
+}
+
+var engines = make(map[string]STTEngine)
+var enginesMu sync.Mutex
+
+// Register should be called from an engine package's init()
+func Register(engine STTEngine) {
+	enginesMu.Lock()
+	defer enginesMu.Unlock()
+	engines[engine.Name()] = engine
+}
+
+func Get(name string) (STTEngine, error) {
+	enginesMu.Lock()
+	defer enginesMu.Unlock()
+	engine, ok := engines[name]
+	if !ok {
+		return nil, fmt.Errorf("stt engine " + name + " is not built into this binary")
+	}
+	return engine, nil
+}
+
+func Names() []string {
+	enginesMu.Lock()
+	defer enginesMu.Unlock()
+	var names []string
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func List() []EngineInfo {
+	var list []EngineInfo
+	for _, name := range Names() {
+		engine, _ := Get(name)
+		list = append(list, EngineInfo{Name: name, Capabilities: engine.Capabilities()})
+	}
+	return list
+}
@@ -0,0 +1,35 @@
+package wirepod_vosk
+
+import (
+	sr "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/speechrequest"
+	stt "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/stt"
+)
+
+type engine struct{}
+
+func init() {
+	stt.Register(engine{})
+}
+
+func (engine) Name() string {
+	return Name
+}
+
+func (engine) Init() error {
+	return Init()
+}
+
+func (engine) Transcribe(req sr.SpeechRequest) (string, error) {
+	return STT(req)
+}
+
+func (engine) Close() error {
+	return nil
+}
+
+func (engine) Capabilities() stt.Capabilities {
+	return stt.Capabilities{
+		Streaming: true,
+		Partials:  false,
+	}
+}
@@ -40,7 +40,7 @@ func Init() error {
 	if picovoiceKeyOS == "" {
 		if leopardKeyOS == "" {
 			fmt.Println("You must set PICOVOICE_APIKEY to a value.")
-			os.Exit(1)
+			return fmt.Errorf("picovoice api key not found")
 		} else {
 			fmt.Println("PICOVOICE_APIKEY is not set, using LEOPARD_APIKEY")
 			picovoiceKey = leopardKeyOS
@@ -0,0 +1,37 @@
+package wirepod_leopard
+
+import (
+	leopard "github.com/Picovoice/leopard/binding/go/v2"
+	sr "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/speechrequest"
+	stt "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/stt"
+)
+
+type engine struct{}
+
+func init() {
+	stt.Register(engine{})
+}
+
+func (engine) Name() string {
+	return Name
+}
+
+func (engine) Init() error {
+	return Init()
+}
+
+func (engine) Transcribe(req sr.SpeechRequest) (string, error) {
+	return STT(req)
+}
+
+func (engine) Close() error {
+	for ind := range leopardSTTArray {
+		leopardSTTArray[ind].Delete()
+	}
+	leopardSTTArray = []leopard.Leopard{}
+	return nil
+}
+
+func (engine) Capabilities() stt.Capabilities {
+	return stt.Capabilities{}
+}
@@ -2,8 +2,8 @@ package wirepod_vosk
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -20,17 +20,30 @@ var GrammerEnable bool = false
 
 var Name string = "vosk"
 
-var model *vosk.VoskModel
 var recsmu sync.Mutex
 
-var grmRecs []ARec
-var gpRecs []ARec
+// the loaded model. a reload replaces it, and the old one is freed once the requests using it
+// are done with its recognizers
+var current *voskModel
 
 var modelLoaded bool
 
+type voskModel struct {
+	model   *vosk.VoskModel
+	grmRecs []*ARec
+	gpRecs  []*ARec
+	// recognizers of this model which are in use
+	inUse   int
+	retired bool
+}
+
+// ARec is a recognizer, handed to a request by getRec and back by releaseRec
 type ARec struct {
 	InUse bool
 	Rec   *vosk.VoskRecognizer
+	model *voskModel
+	// replaced by a reload or a new grammar, so it's freed once it's released
+	retired bool
 }
 
 var Grammer string
@@ -42,18 +55,6 @@ func Init() error {
 	}
 	if vars.APIConfig.PastInitialSetup {
 		vosk.SetLogLevel(-1)
-		if modelLoaded {
-			logger.Println("A model was already loaded, freeing all recognizers and model")
-			for ind, _ := range grmRecs {
-				grmRecs[ind].Rec.Free()
-			}
-			for ind, _ := range gpRecs {
-				gpRecs[ind].Rec.Free()
-			}
-			gpRecs = []ARec{}
-			grmRecs = []ARec{}
-			model.Free()
-		}
 		sttLanguage := vars.APIConfig.STT.Language
 		if len(sttLanguage) == 0 {
 			sttLanguage = "en-US"
@@ -66,41 +67,115 @@ func Init() error {
 		logger.Println("Opening VOSK model (" + modelPath + ")")
 		aModel, err := vosk.NewModel(modelPath)
 		if err != nil {
-			log.Fatal(err)
 			return err
 		}
-		model = aModel
+		m := &voskModel{model: aModel}
+		grammer := Grammer
 		if GrammerEnable {
 			logger.Println("Initializing grammer list")
-			Grammer = GetGrammerList(vars.APIConfig.STT.Language)
+			grammer = GetGrammerList(vars.APIConfig.STT.Language, aModel)
 		}
 
 		logger.Println("Initializing VOSK recognizers")
 		if GrammerEnable {
-			grmRecognizer, err := vosk.NewRecognizerGrm(aModel, 16000.0, Grammer)
+			grmRecognizer, err := vosk.NewRecognizerGrm(aModel, 16000.0, grammer)
 			if err != nil {
-				log.Fatal(err)
+				aModel.Free()
+				return err
 			}
-			var grmrec ARec
-			grmrec.Rec = grmRecognizer
-			grmrec.InUse = false
-			grmRecs = append(grmRecs, grmrec)
+			m.grmRecs = append(m.grmRecs, &ARec{Rec: grmRecognizer, model: m})
 		}
 		gpRecognizer, err := vosk.NewRecognizer(aModel, 16000.0)
-		var gprec ARec
-		gprec.Rec = gpRecognizer
-		gprec.InUse = false
-		gpRecs = append(gpRecs, gprec)
 		if err != nil {
-			log.Fatal(err)
+			for _, rec := range m.grmRecs {
+				rec.Rec.Free()
+			}
+			aModel.Free()
+			return err
 		}
+		m.gpRecs = append(m.gpRecs, &ARec{Rec: gpRecognizer, model: m})
+		recsmu.Lock()
+		if current != nil {
+			logger.Println("A model was already loaded, freeing it once it isn't in use")
+			retireModel(current)
+		}
+		current = m
+		Grammer = grammer
 		modelLoaded = true
+		recsmu.Unlock()
 		logger.Println("VOSK initiated successfully")
 		runTest()
 	}
 	return nil
 }
 
+// freeModel stops handing out the loaded model. it's freed once it isn't in use
+func freeModel() {
+	recsmu.Lock()
+	defer recsmu.Unlock()
+	if current != nil {
+		retireModel(current)
+	}
+	current = nil
+	modelLoaded = false
+}
+
+// ReloadGrammer rebuilds the grammer recognizers from the current intents. requests which are
+// using the old ones finish with them, and they're freed after
+func ReloadGrammer() error {
+	if !GrammerEnable {
+		return nil
+	}
+	recsmu.Lock()
+	m := current
+	if m == nil {
+		recsmu.Unlock()
+		return nil
+	}
+	// keeps the model around while the recognizer is made
+	m.inUse++
+	recsmu.Unlock()
+	grammer := GetGrammerList(vars.APIConfig.STT.Language, m.model)
+	grmRecognizer, err := vosk.NewRecognizerGrm(m.model, 16000.0, grammer)
+	recsmu.Lock()
+	defer recsmu.Unlock()
+	m.inUse--
+	if err == nil && !m.retired {
+		for _, rec := range m.grmRecs {
+			retireRec(rec)
+		}
+		m.grmRecs = []*ARec{{Rec: grmRecognizer, model: m}}
+		Grammer = grammer
+	} else if err == nil {
+		// the model was replaced meanwhile, with the new intents
+		grmRecognizer.Free()
+	}
+	if m.retired && m.inUse == 0 {
+		m.model.Free()
+	}
+	return err
+}
+
+// retireModel frees a model's recognizers which aren't in use, and the model once none are.
+// recsmu must be held
+func retireModel(m *voskModel) {
+	m.retired = true
+	for _, rec := range append(m.grmRecs, m.gpRecs...) {
+		retireRec(rec)
+	}
+	if m.inUse == 0 {
+		m.model.Free()
+	}
+}
+
+// recsmu must be held
+func retireRec(rec *ARec) {
+	rec.retired = true
+	if !rec.InUse {
+		rec.Rec.Free()
+	}
+}
+
 func runTest() {
 	// make sure recognizer is all loaded into RAM
 	logger.Println("Running recognizer test")
@@ -112,7 +187,12 @@ func runTest() {
 		logger.Println("Using general recognizer")
 		withGrm = false
 	}
-	rec, recind := getRec(withGrm)
+	rec, err := getRec(withGrm)
+	if err != nil {
+		logger.Println("Vosk test failed: " + err.Error())
+		return
+	}
+	defer releaseRec(rec)
 	sttTestPath := "./stttest.pcm"
 	if runtime.GOOS == "android" {
 		sttTestPath = vars.AndroidPath + "/static/stttest.pcm"
@@ -122,16 +202,11 @@ func runTest() {
 	cTime := time.Now()
 	micData = sr.SplitVAD(pcmBytes)
 	for _, sample := range micData {
-		rec.AcceptWaveform(sample)
+		rec.Rec.AcceptWaveform(sample)
 	}
 	var jres map[string]interface{}
-	json.Unmarshal([]byte(rec.FinalResult()), &jres)
-	if withGrm {
-		grmRecs[recind].InUse = false
-	} else {
-		gpRecs[recind].InUse = false
-	}
-	transcribedText := jres["text"].(string)
+	json.Unmarshal([]byte(rec.Rec.FinalResult()), &jres)
+	transcribedText, _ := jres["text"].(string)
 	tTime := time.Now().Sub(cTime)
 	logger.Println("Text (from test):", transcribedText)
 	if tTime.Seconds() > 3 {
@@ -141,49 +216,84 @@ func runTest() {
 
 }
 
-func getRec(withGrm bool) (*vosk.VoskRecognizer, int) {
+// getRec hands out a free recognizer of the current model, making one if they're all in use
+func getRec(withGrm bool) (*ARec, error) {
 	recsmu.Lock()
-	defer recsmu.Unlock()
-	if withGrm && GrammerEnable {
-		for ind, rec := range grmRecs {
-			if !rec.InUse {
-				grmRecs[ind].InUse = true
-				return grmRecs[ind].Rec, ind
-			}
-		}
-	} else {
-		for ind, rec := range gpRecs {
-			if !rec.InUse {
-				gpRecs[ind].InUse = true
-				return gpRecs[ind].Rec, ind
-			}
+	m := current
+	if m == nil {
+		recsmu.Unlock()
+		return nil, errors.New("vosk model isn't loaded")
+	}
+	withGrm = withGrm && GrammerEnable
+	recs := m.gpRecs
+	if withGrm {
+		recs = m.grmRecs
+	}
+	for _, rec := range recs {
+		if !rec.InUse {
+			rec.InUse = true
+			m.inUse++
+			recsmu.Unlock()
+			return rec, nil
 		}
 	}
+	// counted as in use while it's made, so the model isn't freed under it
+	m.inUse++
+	grammer := Grammer
 	recsmu.Unlock()
-	var newrec ARec
 	var newRec *vosk.VoskRecognizer
 	var err error
-	newrec.InUse = true
 	if withGrm {
-		newRec, err = vosk.NewRecognizerGrm(model, 16000.0, Grammer)
+		newRec, err = vosk.NewRecognizerGrm(m.model, 16000.0, grammer)
 	} else {
-		newRec, err = vosk.NewRecognizer(model, 16000.0)
+		newRec, err = vosk.NewRecognizer(m.model, 16000.0)
 	}
+	recsmu.Lock()
+	defer recsmu.Unlock()
 	if err != nil {
-		log.Fatal(err)
+		m.inUse--
+		if m.retired && m.inUse == 0 {
+			m.model.Free()
+		}
+		return nil, err
 	}
-	newrec.Rec = newRec
+	rec := &ARec{InUse: true, Rec: newRec, model: m}
+	switch {
+	case m.retired, withGrm && grammer != Grammer:
+		// it's for a model or grammer which was replaced while it was made
+		rec.retired = true
+	case withGrm:
+		m.grmRecs = append(m.grmRecs, rec)
+	default:
+		m.gpRecs = append(m.gpRecs, rec)
+	}
+	return rec, nil
+}
+
+func releaseRec(rec *ARec) {
 	recsmu.Lock()
-	if withGrm {
-		grmRecs = append(grmRecs, newrec)
-		return grmRecs[len(grmRecs)-1].Rec, len(grmRecs) - 1
-	} else {
-		gpRecs = append(gpRecs, newrec)
-		return gpRecs[len(gpRecs)-1].Rec, len(gpRecs) - 1
+	defer recsmu.Unlock()
+	rec.InUse = false
+	rec.model.inUse--
+	if rec.retired {
+		rec.Rec.Free()
+	}
+	if rec.model.retired && rec.model.inUse == 0 {
+		rec.model.model.Free()
 	}
 }
 
 func STT(req sr.SpeechRequest) (string, error) {
+	return transcribe(req, nil, nil)
+}
+
+// TranscribePartial sends vosk's partial results while the user is still talking
+func TranscribePartial(req sr.SpeechRequest, partials chan<- string, stop <-chan struct{}) (string, error) {
+	defer close(partials)
+	return transcribe(req, partials, stop)
+}
+
+func transcribe(req sr.SpeechRequest, partials chan<- string, stop <-chan struct{}) (string, error) {
 	logger.Println("(Bot " + req.Device + ", Vosk) Processing...")
 	var withGrm bool
 	if (vars.APIConfig.Knowledge.IntentGraph || req.IsKG) || !GrammerEnable {
@@ -193,18 +303,41 @@ func STT(req sr.SpeechRequest) (string, error) {
 		logger.Println("Using grammer-optimized recognizer")
 		withGrm = true
 	}
-	rec, recind := getRec(withGrm)
+	arec, err := getRec(withGrm)
+	if err != nil {
+		return "", err
+	}
+	defer releaseRec(arec)
+	rec := arec.Rec
 	rec.SetWords(1)
 	rec.AcceptWaveform(req.FirstReq)
 	req.DetectEndOfSpeech()
+	var lastPartial string
 	for {
+		select {
+		case <-stop:
+			// intent was already sent from a partial, get the recognizer ready for the next request
+			rec.Reset()
+			logger.Println("Bot " + req.Device + " Transcribed text (partial): " + lastPartial)
+			return lastPartial, nil
+		default:
+		}
 		chunk, err := req.GetNextStreamChunk()
 		if err != nil {
+			rec.Reset()
 			return "", err
 		}
 		speechIsDone, doProcess := req.DetectEndOfSpeech()
 		if doProcess {
-			rec.AcceptWaveform(chunk)
+			if rec.AcceptWaveform(chunk) == 0 && partials != nil {
+				var pres map[string]interface{}
+				json.Unmarshal([]byte(rec.PartialResult()), &pres)
+				partial, _ := pres["partial"].(string)
+				if partial != "" {
+					lastPartial = partial
+					partials <- partial
+				}
+			}
 		}
 		if speechIsDone {
 			break
@@ -212,11 +345,6 @@ func STT(req sr.SpeechRequest) (string, error) {
 	}
 	var jres map[string]interface{}
 	json.Unmarshal([]byte(rec.FinalResult()), &jres)
-	if withGrm {
-		grmRecs[recind].InUse = false
-	} else {
-		gpRecs[recind].InUse = false
-	}
 	transcribedText := jres["text"].(string)
 	logger.Println("Bot " + req.Device + " Transcribed text: " + transcribedText)
 	return transcribedText, nil
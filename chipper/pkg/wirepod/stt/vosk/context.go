@@ -3,6 +3,7 @@ package wirepod_vosk
 import (
 	"strings"
 
+	vosk "github.com/kercre123/vosk-api/go"
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/localization"
 )
@@ -20,11 +21,13 @@ func removeDuplicates(strings []string) []string {
 	}
 	return result
 }
-func GetGrammerList(lang string) string {
+
+// GetGrammerList makes the grammer of the words model knows from the intents
+func GetGrammerList(lang string, model *vosk.VoskModel) string {
 	var wordsList []string
 	var grammer string
 	// add words in intent json
-	for _, words := range vars.IntentList {
+	for _, words := range vars.GetIntentList() {
 		for _, word := range words.Keyphrases {
 			wors := strings.Split(word, " ")
 			for _, wor := range wors {
@@ -35,6 +38,24 @@ func GetGrammerList(lang string) string {
 			}
 		}
 	}
+	// add words from intent slots
+	for _, intent := range vars.GetIntentList() {
+		for _, slot := range intent.Slots {
+			var texts []string
+			texts = append(texts, slot.After...)
+			for _, value := range slot.Values {
+				texts = append(texts, value.Synonyms...)
+			}
+			for _, text := range texts {
+				for _, wor := range strings.Fields(text) {
+					found := model.FindWord(wor)
+					if found != -1 {
+						wordsList = append(wordsList, wor)
+					}
+				}
+			}
+		}
+	}
 	// add words in localization
 	for _, str := range localization.ALL_STR {
 		text := localization.GetText(str)
@@ -47,7 +68,7 @@ func GetGrammerList(lang string) string {
 		}
 	}
 	// add custom intent matches
-	for _, intent := range vars.CustomIntents {
+	for _, intent := range vars.GetCustomIntents() {
 		for _, utterance := range intent.Utterances {
 			wors := strings.Split(utterance, " ")
 			for _, wor := range wors {
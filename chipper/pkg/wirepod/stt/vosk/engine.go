@@ -0,0 +1,51 @@
+package wirepod_vosk
+
+import (
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/localization"
+	sr "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/speechrequest"
+	stt "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/stt"
+)
+
+type engine struct{}
+
+func init() {
+	stt.Register(engine{})
+}
+
+func (engine) Name() string {
+	return Name
+}
+
+func (engine) Init() error {
+	return Init()
+}
+
+func (engine) Transcribe(req sr.SpeechRequest) (string, error) {
+	return STT(req)
+}
+
+func (engine) Close() error {
+	if modelLoaded {
+		logger.Println("Freeing VOSK recognizers and model")
+		freeModel()
+	}
+	return nil
+}
+
+func (engine) Capabilities() stt.Capabilities {
+	return stt.Capabilities{
+		Streaming:  true,
+		Partials:   true,
+		Languages:  localization.ValidVoskModels,
+		LocalModel: true,
+	}
+}
+
+func (engine) ReloadGrammar() error {
+	return ReloadGrammer()
+}
+
+func (engine) TranscribePartial(req sr.SpeechRequest, partials chan<- string, stop <-chan struct{}) (string, error) {
+	return TranscribePartial(req, partials, stop)
+}
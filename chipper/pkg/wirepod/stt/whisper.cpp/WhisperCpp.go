@@ -1,14 +1,15 @@
 package wirepod_whispercpp
 
 import (
-	"encoding/binary"
-	"math"
+	"errors"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strings"
+	"sync"
 
 	whisper "github.com/ggerganov/whisper.cpp/bindings/go"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/audio"
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
 	sr "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/speechrequest"
@@ -19,6 +20,9 @@ var Name string = "whisper.cpp"
 var context *whisper.Context
 var params whisper.Params
 
+// the context can only run one decode at a time
+var contextMu sync.Mutex
+
 func padPCM(data []byte) []byte {
 	const sampleRate = 16000
 	const minDurationMs = 1020
@@ -61,27 +65,75 @@ func Init() error {
 	}
 	logger.Println("Opening Whisper model (" + modelPath + ")")
 	//logger.Println(whisper.Whisper_print_system_info())
-	context = whisper.Whisper_init(modelPath)
-	params = context.Whisper_full_default_params(whisper.SAMPLING_GREEDY)
-	params.SetTranslate(false)
-	params.SetPrintSpecial(false)
-	params.SetPrintProgress(false)
-	params.SetPrintRealtime(false)
-	params.SetPrintTimestamps(false)
-	params.SetThreads(runtime.NumCPU())
-	params.SetNoContext(true)
-	params.SetSingleSegment(true)
-	params.SetLanguage(context.Whisper_lang_id(sttLanguage))
+	newContext := whisper.Whisper_init(modelPath)
+	newParams := newContext.Whisper_full_default_params(whisper.SAMPLING_GREEDY)
+	newParams.SetTranslate(false)
+	newParams.SetPrintSpecial(false)
+	newParams.SetPrintProgress(false)
+	newParams.SetPrintRealtime(false)
+	newParams.SetPrintTimestamps(false)
+	newParams.SetThreads(runtime.NumCPU())
+	newParams.SetNoContext(true)
+	newParams.SetSingleSegment(true)
+	newParams.SetLanguage(newContext.Whisper_lang_id(sttLanguage))
+	// Init runs again when the engine is switched back to, so the last model is freed here
+	contextMu.Lock()
+	defer contextMu.Unlock()
+	if context != nil {
+		context.Whisper_free()
+	}
+	context = newContext
+	params = newParams
 	return nil
 }
 
+// how much new audio there has to be before whisper is run again for a partial transcript
+const partialChunkBytes = 16000
+
 func STT(req sr.SpeechRequest) (string, error) {
+	return transcribe(req, nil, nil)
+}
+
+// TranscribePartial decodes the audio received so far every half second while the user is still talking.
+// the decoding happens beside the stream, and a tick is skipped if the last one isn't done yet
+func TranscribePartial(req sr.SpeechRequest, partials chan<- string, stop <-chan struct{}) (string, error) {
+	defer close(partials)
+	return transcribe(req, partials, stop)
+}
+
+func transcribe(req sr.SpeechRequest, partials chan<- string, stop <-chan struct{}) (string, error) {
 	logger.Println("(Bot " + req.Device + ", Whisper) Processing...")
 	speechIsDone := false
 	var err error
+	var lastDecoded int
+	var lastPartial string
+	// a partial decode which hasn't started yet is given up on when this is closed.
+	// one which has started has to be waited for, as the engine can be closed once this returns
+	cancel := make(chan struct{})
+	var partialDecode sync.WaitGroup
+	stopDecoding := func() {
+		close(cancel)
+		partialDecode.Wait()
+	}
+	decoded := make(chan string, 1)
+	decoding := false
 	for {
+		select {
+		case <-stop:
+			stopDecoding()
+			logger.Println("Bot " + req.Device + " Transcribed text (partial): " + lastPartial)
+			return lastPartial, nil
+		case partial := <-decoded:
+			decoding = false
+			if partial != "" {
+				lastPartial = partial
+				partials <- partial
+			}
+		default:
+		}
 		_, err = req.GetNextStreamChunk()
 		if err != nil {
+			stopDecoding()
 			return "", err
 		}
 		// has to be split into 320 []byte chunks for VAD
@@ -89,8 +141,20 @@ func STT(req sr.SpeechRequest) (string, error) {
 		if speechIsDone {
 			break
 		}
+		if partials != nil && !decoding && len(req.DecodedMicData)-lastDecoded >= partialChunkBytes {
+			lastDecoded = len(req.DecodedMicData)
+			decoding = true
+			data := BytesToFloat32Buffer(padPCM(req.DecodedMicData))
+			partialDecode.Add(1)
+			go func() {
+				defer partialDecode.Done()
+				partial, _ := process(data, cancel)
+				decoded <- strings.ToLower(partial)
+			}()
+		}
 	}
-	transcribedText, err := process(BytesToFloat32Buffer(padPCM(req.DecodedMicData)))
+	stopDecoding()
+	transcribedText, err := process(BytesToFloat32Buffer(padPCM(req.DecodedMicData)), nil)
 	if err != nil {
 		return "", err
 	}
@@ -99,19 +163,27 @@ func STT(req sr.SpeechRequest) (string, error) {
 	return transcribedText, nil
 }
 
-func process(data []float32) (string, error) {
+// process decodes the audio. it's given up on if cancel is closed before whisper starts on it
+func process(data []float32, cancel <-chan struct{}) (string, error) {
+	contextMu.Lock()
+	defer contextMu.Unlock()
+	if context == nil {
+		return "", errors.New("whisper model isn't loaded")
+	}
 	var transcribedText string
-	context.Whisper_full(params, data, nil, func(_ int) {
+	context.Whisper_full(params, data, func() bool {
+		select {
+		case <-cancel:
+			return false
+		default:
+			return true
+		}
+	}, func(_ int) {
 		transcribedText = strings.TrimSpace(context.Whisper_full_get_segment_text(0))
 	}, nil)
 	return transcribedText, nil
 }
 
 func BytesToFloat32Buffer(buf []byte) []float32 {
-	newB := make([]float32, len(buf)/2)
-	factor := math.Pow(2, float64(16)-1)
-	for i := 0; i < len(buf)/2; i++ {
-		newB[i] = float32(float64(int16(binary.LittleEndian.Uint16(buf[i*2:]))) / factor)
-	}
-	return newB
+	return audio.Float32s(audio.Int16s(buf))
 }
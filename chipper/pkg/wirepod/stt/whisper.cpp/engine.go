@@ -0,0 +1,49 @@
+package wirepod_whispercpp
+
+import (
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/localization"
+	sr "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/speechrequest"
+	stt "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/stt"
+)
+
+type engine struct{}
+
+func init() {
+	stt.Register(engine{})
+}
+
+func (engine) Name() string {
+	return Name
+}
+
+func (engine) Init() error {
+	return Init()
+}
+
+func (engine) Transcribe(req sr.SpeechRequest) (string, error) {
+	return STT(req)
+}
+
+func (engine) Close() error {
+	contextMu.Lock()
+	defer contextMu.Unlock()
+	if context != nil {
+		context.Whisper_free()
+		context = nil
+	}
+	return nil
+}
+
+func (engine) Capabilities() stt.Capabilities {
+	return stt.Capabilities{
+		Partials: true,
+		// a partial only comes every half second of speech, so a third one is often too late
+		StablePartials: 2,
+		Languages:      localization.ValidVoskModels,
+		LocalModel:     true,
+	}
+}
+
+func (engine) TranscribePartial(req sr.SpeechRequest, partials chan<- string, stop <-chan struct{}) (string, error) {
+	return TranscribePartial(req, partials, stop)
+}
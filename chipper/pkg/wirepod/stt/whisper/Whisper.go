@@ -2,7 +2,6 @@ package wirepod_whisper
 
 import (
 	"bytes"
-	"encoding/binary"
 	"encoding/json"
 	"io"
 	"mime/multipart"
@@ -10,11 +9,9 @@ import (
 	"os"
 	"strings"
 
-	"github.com/go-audio/audio"
-	"github.com/go-audio/wav"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/audio"
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
 	sr "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/speechrequest"
-	"github.com/orcaman/writerseeker"
 )
 
 var Name string = "whisper"
@@ -31,51 +28,6 @@ func Init() error {
 	return nil
 }
 
-func pcm2wav(in io.Reader) []byte {
-
-	// Output file.
-	out := &writerseeker.WriterSeeker{}
-
-	// 8 kHz, 16 bit, 1 channel, WAV.
-	e := wav.NewEncoder(out, 16000, 16, 1, 1)
-
-	// Create new audio.IntBuffer.
-	audioBuf, err := newAudioIntBuffer(in)
-	if err != nil {
-		logger.Println(err)
-	}
-	// Write buffer to output file. This writes a RIFF header and the PCM chunks from the audio.IntBuffer.
-	if err := e.Write(audioBuf); err != nil {
-		logger.Println(err)
-	}
-	if err := e.Close(); err != nil {
-		logger.Println(err)
-	}
-	outBuf := new(bytes.Buffer)
-	io.Copy(outBuf, out.BytesReader())
-	return outBuf.Bytes()
-}
-
-func newAudioIntBuffer(r io.Reader) (*audio.IntBuffer, error) {
-	buf := audio.IntBuffer{
-		Format: &audio.Format{
-			NumChannels: 1,
-			SampleRate:  16000,
-		},
-	}
-	for {
-		var sample int16
-		err := binary.Read(r, binary.LittleEndian, &sample)
-		switch {
-		case err == io.EOF:
-			return &buf, nil
-		case err != nil:
-			return nil, err
-		}
-		buf.Data = append(buf.Data, int(sample))
-	}
-}
-
 func makeOpenAIReq(in []byte) string {
 	url := "https://api.openai.com/v1/audio/transcriptions"
 
@@ -126,9 +78,7 @@ func STT(req sr.SpeechRequest) (string, error) {
 		}
 	}
 
-	pcmBufTo := &writerseeker.WriterSeeker{}
-	pcmBufTo.Write(req.DecodedMicData)
-	pcmBuf := pcm2wav(pcmBufTo.BytesReader())
+	pcmBuf := audio.EncodeWAV(audio.Int16s(req.DecodedMicData), audio.Format{Rate: 16000, Channels: 1})
 
 	transcribedText := strings.ToLower(makeOpenAIReq(pcmBuf))
 	logger.Println("Bot " + req.Device + " Transcribed text: " + transcribedText)
@@ -0,0 +1,387 @@
+package wirepod_ttr
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
+)
+
+// embedding-based intent classifier, used when vars.APIConfig.IntentMatch.Classifier is enabled.
+// every keyphrase is an example of its intent. the transcript is embedded and the intent of
+// the nearest example wins if it is similar enough. the embeddings come from a local model
+// run by ollama, or from any OpenAI-compatible embeddings endpoint
+
+const DefaultClassifierThreshold = 0.6
+const defaultEmbeddingModel = "text-embedding-3-small"
+
+// used by the local provider unless an endpoint and model are set
+const (
+	defaultLocalEmbeddingEndpoint = "http://localhost:11434/v1"
+	defaultLocalEmbeddingModel    = "nomic-embed-text"
+)
+
+// how many texts are sent in one embeddings request
+const embeddingBatchSize = 100
+
+// how long one embeddings request for intent examples gets
+const embeddingTimeout = 10 * time.Second
+
+// how long embedding a transcript gets. it holds up the voice request, so it's kept short
+const queryEmbeddingTimeout = 3 * time.Second
+
+// how long to wait before trying to embed the intent examples again after it failed
+const classifierRetryDelay = time.Minute
+
+// how many transcripts' embeddings are kept, for when the same thing is said again
+const queryEmbeddingCacheSize = 256
+
+type classifierExample struct {
+	Intent string
+	Phrase string
+	Vector []float32
+}
+
+// the index is built beside voice requests, which fall back to keyphrase matching until it's ready
+var classifierIndex []classifierExample
+var classifierIndexKey string
+var classifierBuilding bool
+var classifierFailedKey string
+var classifierRetryAt time.Time
+var classifierMu sync.Mutex
+
+// keyphrase embeddings by endpoint|model|text, saved to vars.EmbeddingsPath
+var embeddingCache map[string][]float32
+var embeddingCacheMu sync.Mutex
+
+type queryEmbedding struct {
+	key string
+	vec []float32
+}
+
+// recent transcripts' embeddings, by the same key. the least recently used go first
+var (
+	queryEmbeddings     = list.New()
+	queryEmbeddingIndex = make(map[string]*list.Element)
+)
+
+func classifierThreshold() float64 {
+	if vars.APIConfig.IntentMatch.Classifier.Threshold <= 0 {
+		return DefaultClassifierThreshold
+	}
+	return vars.APIConfig.IntentMatch.Classifier.Threshold
+}
+
+func localEmbeddings() bool {
+	switch vars.APIConfig.IntentMatch.Classifier.Provider {
+	case "", "local", "ollama":
+		return true
+	}
+	return false
+}
+
+func embeddingModel() string {
+	if vars.APIConfig.IntentMatch.Classifier.Model != "" {
+		return vars.APIConfig.IntentMatch.Classifier.Model
+	}
+	if localEmbeddings() {
+		return defaultLocalEmbeddingModel
+	}
+	return defaultEmbeddingModel
+}
+
+// embeddingEndpoint is "" for OpenAI itself
+func embeddingEndpoint() string {
+	if vars.APIConfig.IntentMatch.Classifier.Endpoint == "" && localEmbeddings() {
+		return defaultLocalEmbeddingEndpoint
+	}
+	return vars.APIConfig.IntentMatch.Classifier.Endpoint
+}
+
+func cosine(a, b []float32) float64 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(na) * math.Sqrt(nb))
+}
+
+func loadEmbeddingCache() {
+	if embeddingCache != nil {
+		return
+	}
+	embeddingCache = make(map[string][]float32)
+	cacheBytes, err := os.ReadFile(vars.EmbeddingsPath)
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(cacheBytes, &embeddingCache); err != nil {
+		logger.Println("Error reading intent embeddings cache, starting over: " + err.Error())
+		embeddingCache = make(map[string][]float32)
+	}
+}
+
+func saveEmbeddingCache() {
+	cacheBytes, err := json.Marshal(embeddingCache)
+	if err != nil {
+		logger.Println("Error saving intent embeddings cache: " + err.Error())
+		return
+	}
+	os.WriteFile(vars.EmbeddingsPath, cacheBytes, 0644)
+}
+
+// embedTexts gets vectors from the embeddings endpoint. keyphrases are kept on disk, since they
+// come up every time the index is built. transcripts only go into a small in-memory cache
+func embedTexts(texts []string, keyphrases bool) ([][]float32, error) {
+	conf := vars.APIConfig.IntentMatch.Classifier
+	switch conf.Provider {
+	case "", "local", "ollama", "openai":
+	default:
+		return nil, errors.New("unknown embeddings provider " + conf.Provider)
+	}
+	endpoint := embeddingEndpoint()
+	cacheKeyPrefix := endpoint + "|" + embeddingModel() + "|"
+	vecs := make([][]float32, len(texts))
+	var missing []string
+	missingIdx := make(map[string][]int)
+	embeddingCacheMu.Lock()
+	loadEmbeddingCache()
+	for i, text := range texts {
+		if vec, ok := cachedEmbedding(cacheKeyPrefix + text); ok {
+			vecs[i] = vec
+			continue
+		}
+		if _, ok := missingIdx[text]; !ok {
+			missing = append(missing, text)
+		}
+		missingIdx[text] = append(missingIdx[text], i)
+	}
+	embeddingCacheMu.Unlock()
+	if len(missing) == 0 {
+		return vecs, nil
+	}
+	var c *openai.Client
+	if endpoint != "" {
+		clientConf := openai.DefaultConfig(conf.Key)
+		clientConf.BaseURL = endpoint
+		c = openai.NewClientWithConfig(clientConf)
+	} else {
+		c = openai.NewClient(conf.Key)
+	}
+	timeout := embeddingTimeout
+	if !keyphrases {
+		timeout = queryEmbeddingTimeout
+	}
+	fetched := make(map[string][]float32)
+	var err error
+	for start := 0; start < len(missing); start += embeddingBatchSize {
+		end := start + embeddingBatchSize
+		if end > len(missing) {
+			end = len(missing)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		var resp openai.EmbeddingResponse
+		resp, err = c.CreateEmbeddings(ctx, openai.EmbeddingRequestStrings{
+			Input: missing[start:end],
+			Model: openai.EmbeddingModel(embeddingModel()),
+		})
+		cancel()
+		if err != nil {
+			// keep what was already fetched
+			break
+		}
+		for _, e := range resp.Data {
+			if e.Index >= 0 && e.Index < end-start {
+				fetched[missing[start+e.Index]] = e.Embedding
+			}
+		}
+	}
+	embeddingCacheMu.Lock()
+	for text, vec := range fetched {
+		if keyphrases {
+			embeddingCache[cacheKeyPrefix+text] = vec
+		} else {
+			cacheQueryEmbedding(cacheKeyPrefix+text, vec)
+		}
+	}
+	if keyphrases && len(fetched) > 0 {
+		saveEmbeddingCache()
+	}
+	embeddingCacheMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for _, text := range missing {
+		vec, ok := fetched[text]
+		if !ok {
+			return nil, errors.New("embeddings endpoint didn't return a vector for '" + text + "'")
+		}
+		for _, i := range missingIdx[text] {
+			vecs[i] = vec
+		}
+	}
+	return vecs, nil
+}
+
+// embeddingCacheMu must be held
+func cachedEmbedding(key string) ([]float32, bool) {
+	if vec, ok := embeddingCache[key]; ok {
+		return vec, true
+	}
+	el, ok := queryEmbeddingIndex[key]
+	if !ok {
+		return nil, false
+	}
+	queryEmbeddings.MoveToFront(el)
+	return el.Value.(*queryEmbedding).vec, true
+}
+
+// embeddingCacheMu must be held
+func cacheQueryEmbedding(key string, vec []float32) {
+	if el, ok := queryEmbeddingIndex[key]; ok {
+		queryEmbeddings.MoveToFront(el)
+		return
+	}
+	queryEmbeddingIndex[key] = queryEmbeddings.PushFront(&queryEmbedding{key: key, vec: vec})
+	for queryEmbeddings.Len() > queryEmbeddingCacheSize {
+		oldest := queryEmbeddings.Back().Value.(*queryEmbedding)
+		queryEmbeddings.Remove(queryEmbeddings.Back())
+		delete(queryEmbeddingIndex, oldest.key)
+	}
+}
+
+// classifierExamples returns the keyphrases to embed, and a key which changes with them or the provider
+func classifierExamples(intents []vars.JsonIntent) ([]classifierExample, []string, string) {
+	conf := vars.APIConfig.IntentMatch.Classifier
+	var examples []classifierExample
+	var phrases []string
+	for _, b := range intents {
+		// exact match intents aren't classified
+		if b.RequireExactMatch {
+			continue
+		}
+		for _, c := range b.Keyphrases {
+			phrase := strings.ToLower(strings.TrimSpace(c))
+			if phrase == "" {
+				continue
+			}
+			examples = append(examples, classifierExample{Intent: b.Name, Phrase: phrase})
+			phrases = append(phrases, phrase)
+		}
+	}
+	indexKey := conf.Provider + "|" + embeddingEndpoint() + "|" + embeddingModel() + "|" + strings.Join(phrases, "\n")
+	return examples, phrases, indexKey
+}
+
+// buildClassifierIndex embeds the examples. it runs on its own, so classifierMu isn't held while
+// waiting on the endpoint
+func buildClassifierIndex(examples []classifierExample, phrases []string, indexKey string) {
+	logger.Println("Embedding " + fmt.Sprint(len(phrases)) + " intent examples...")
+	vecs, err := embedTexts(phrases, true)
+	classifierMu.Lock()
+	defer classifierMu.Unlock()
+	classifierBuilding = false
+	if err != nil {
+		logger.Println("Error embedding intent examples, trying again in " + classifierRetryDelay.String() + ": " + err.Error())
+		classifierFailedKey = indexKey
+		classifierRetryAt = time.Now().Add(classifierRetryDelay)
+		return
+	}
+	for i := range examples {
+		examples[i].Vector = vecs[i]
+	}
+	classifierIndex = examples
+	classifierIndexKey = indexKey
+	logger.Println("Intent classifier is ready")
+}
+
+// classifyIntent returns the intent of the example nearest to the transcript. if the examples
+// aren't embedded yet, that is started and an error is returned
+func classifyIntent(voiceText string, intents []vars.JsonIntent) (intentScore, error) {
+	examples, phrases, indexKey := classifierExamples(intents)
+	classifierMu.Lock()
+	index, ready := classifierIndex, indexKey == classifierIndexKey
+	failed := indexKey == classifierFailedKey && time.Now().Before(classifierRetryAt)
+	if !ready && !failed && !classifierBuilding {
+		classifierBuilding = true
+		go buildClassifierIndex(examples, phrases, indexKey)
+	}
+	classifierMu.Unlock()
+	if failed {
+		return intentScore{}, errors.New("couldn't embed the intent examples, trying again later")
+	}
+	if !ready {
+		return intentScore{}, errors.New("the intent examples are still being embedded")
+	}
+	vecs, err := embedTexts([]string{voiceText}, false)
+	if err != nil {
+		return intentScore{}, err
+	}
+	var best intentScore
+	for _, example := range index {
+		score := cosine(vecs[0], example.Vector)
+		if score > best.Score {
+			best = intentScore{Intent: example.Intent, Phrase: example.Phrase, Score: score}
+		}
+	}
+	return best, nil
+}
+
+// classifierIntentHandler matches custom intents and exact-match intents like normal, then classifies.
+// an error means the classifier couldn't run and the keyphrase matchers should be used instead
+func classifierIntentHandler(req interface{}, voiceText string, intents []vars.JsonIntent, isOpus bool, botSerial string) (bool, error) {
+	voiceText = strings.ToLower(strings.TrimSpace(voiceText))
+	if customIntentHandler(req, voiceText, botSerial) {
+		return true, nil
+	}
+	for _, b := range intents {
+		if !b.RequireExactMatch {
+			continue
+		}
+		for _, c := range b.Keyphrases {
+			if voiceText == strings.ToLower(c) {
+				logger.Println("Bot " + botSerial + " Perfect match for intent " + b.Name + " (" + voiceText + ")")
+				if isOpus {
+					ParamChecker(req, b.Name, voiceText, botSerial)
+				} else {
+					prehistoricParamChecker(req, b.Name, voiceText)
+				}
+				return true, nil
+			}
+		}
+	}
+	best, err := classifyIntent(voiceText, intents)
+	if err != nil {
+		return false, err
+	}
+	threshold := classifierThreshold()
+	if best.Intent == "" || best.Score < threshold {
+		logger.Println("Bot " + botSerial + " Nearest intent example " + best.String() + " is below " + fmt.Sprint(threshold))
+		return false, nil
+	}
+	logger.Println("Bot " + botSerial + " Classified intent " + best.String())
+	if isOpus {
+		ParamChecker(req, best.Intent, voiceText, botSerial)
+	} else {
+		prehistoricParamChecker(req, best.Intent, voiceText)
+	}
+	return true, nil
+}
@@ -0,0 +1,163 @@
+package wirepod_ttr
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fforchino/vector-go-sdk/pkg/vector"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
+	lcztn "github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/localization"
+)
+
+// follow-up questions for built-in intents. if something an intent needs isn't in the transcript
+// (a slot with a prompt, or a weather location), the robot asks for it and listens again.
+// the next voice request from that robot is the answer. unanswered questions are forgotten after dialogTimeout
+
+const dialogTimeout = time.Second * 20
+
+type pendingDialog struct {
+	Intent   string
+	Question string
+	// sends the pending intent with the answer merged in
+	Resume  func(req interface{}, answer string)
+	Expires time.Time
+}
+
+// by esn
+var dialogs = make(map[string]*pendingDialog)
+var dialogsMu sync.Mutex
+
+func robotIsKnown(esn string) bool {
+	for _, bot := range vars.BotInfo.Robots {
+		if bot.Esn == esn {
+			return true
+		}
+	}
+	return false
+}
+
+// startDialog ends the current request quietly, then has the robot ask the question and listen for the answer.
+// returns false if the robot can't be asked (replay, or a robot wire-pod has no token for)
+func startDialog(req interface{}, esn string, speechText string, d *pendingDialog) bool {
+	if DryRun || !robotIsKnown(esn) {
+		return false
+	}
+	d.Expires = time.Now().Add(dialogTimeout)
+	dialogsMu.Lock()
+	dialogs[esn] = d
+	dialogsMu.Unlock()
+	logger.Println("Bot " + esn + " is missing something for " + d.Intent + ", asking: " + d.Question)
+	IntentPass(req, "intent_system_noaudio", speechText, map[string]string{}, false)
+	err := kgSimThen(esn, d.Question, func(robot *vector.Vector) {
+		DoNewRequest(robot)
+	})
+	if err != nil {
+		logger.Println("Error asking follow-up question: " + err.Error())
+		clearDialog(esn)
+	}
+	return true
+}
+
+// pendingDialogFor returns the robot's unanswered question, if it hasn't expired
+func pendingDialogFor(esn string) (*pendingDialog, bool) {
+	dialogsMu.Lock()
+	defer dialogsMu.Unlock()
+	d, ok := dialogs[esn]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(d.Expires) {
+		logger.Println("Bot " + esn + " didn't answer the question for " + d.Intent + " in time, forgetting it")
+		delete(dialogs, esn)
+		return nil, false
+	}
+	return d, true
+}
+
+func clearDialog(esn string) {
+	dialogsMu.Lock()
+	delete(dialogs, esn)
+	dialogsMu.Unlock()
+}
+
+// DialogPending is true if the robot's next voice request is the answer to a question
+func DialogPending(esn string) bool {
+	_, ok := pendingDialogFor(esn)
+	return ok
+}
+
+// resumeDialog sends the pending intent if this request answers a question
+func resumeDialog(req interface{}, esn string, answer string) bool {
+	d, ok := pendingDialogFor(esn)
+	if !ok {
+		return false
+	}
+	clearDialog(esn)
+	logger.Println("Bot " + esn + " answered the question for " + d.Intent + ": " + answer)
+	d.Resume(req, answer)
+	return true
+}
+
+// missingPromptSlot returns the first slot with a prompt which isn't in the transcript
+func missingPromptSlot(intent vars.JsonIntent, speechText string) (vars.JsonSlot, bool) {
+	speechText = strings.ToLower(speechText)
+	for _, slot := range intent.Slots {
+		if slot.Prompt == "" {
+			continue
+		}
+		if _, found := extractSlot(slot, speechText); !found {
+			return slot, true
+		}
+	}
+	return vars.JsonSlot{}, false
+}
+
+// askForSlot asks for a slot's value, then sends the intent with the rest of the slots from the original transcript
+func askForSlot(req interface{}, intent vars.JsonIntent, slot vars.JsonSlot, speechText string, botSerial string) bool {
+	return startDialog(req, botSerial, speechText, &pendingDialog{
+		Intent:   intent.Name,
+		Question: slot.Prompt,
+		Resume: func(req interface{}, answer string) {
+			answer = strings.ToLower(answer)
+			value, found := extractSlot(slot, answer)
+			if !found && (slot.Type == "location" || slot.Type == "text") {
+				// the answer is usually just the value, without "for" or "in"
+				value = strings.Trim(answer, " .,!?")
+				found = value != ""
+			}
+			answered := make(map[string]string)
+			if found {
+				logger.Println("Slot " + slot.Name + " parsed from answer: `" + value + "`")
+				answered[slot.Name] = value
+			} else {
+				logger.Println("No " + slot.Name + " parsed from answer")
+			}
+			newIntent, intentParams, isParam := extractSlots(intent, speechText, false, answered)
+			IntentPass(req, newIntent, speechText+" "+answer, intentParams, isParam)
+		},
+	})
+}
+
+// askForWeatherLocation asks where, then sends the weather as if the location had been said
+func askForWeatherLocation(req interface{}, intent string, speechText string, botSerial string, botUnits string) bool {
+	return startDialog(req, botSerial, speechText, &pendingDialog{
+		Intent:   intent,
+		Question: lcztn.GetText(lcztn.STR_WEATHER_WHERE),
+		Resume: func(req interface{}, answer string) {
+			answer = strings.ToLower(strings.Trim(answer, " .,!?"))
+			if !strings.Contains(" "+answer, lcztn.GetText(lcztn.STR_WEATHER_IN)) {
+				answer = strings.TrimSpace(lcztn.GetText(lcztn.STR_WEATHER_IN)) + " " + answer
+			}
+			fullText := removeEndPunctuation(speechText) + " " + answer
+			condition, is_forecast, local_datetime, speakable_location_string, temperature, temperature_unit := weatherParser(fullText, "", botUnits)
+			if local_datetime == "test" {
+				IntentPass(req, "intent_system_unmatched", fullText, map[string]string{"": ""}, false)
+				return
+			}
+			intentParams := map[string]string{"condition": condition, "is_forecast": is_forecast, "local_datetime": local_datetime, "speakable_location_string": speakable_location_string, "temperature": temperature, "temperature_unit": temperature_unit}
+			IntentPass(req, intent, fullText, intentParams, true)
+		},
+	})
+}
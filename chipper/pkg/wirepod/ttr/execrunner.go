@@ -0,0 +1,180 @@
+package wirepod_ttr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
+)
+
+// runs custom intent Exec programs with a timeout, an optionally limited environment and capped output
+
+const defaultExecTimeout = 10
+const defaultExecMaxOutput = 64 * 1024
+
+// limitedBuffer keeps the first max bytes written to it and drops the rest
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+	mu        sync.Mutex
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if room := l.max - l.buf.Len(); room < len(p) {
+		if room > 0 {
+			l.buf.Write(p[:room])
+		}
+		l.truncated = true
+		// the program shouldn't get an error for writing too much
+		return len(p), nil
+	}
+	return l.buf.Write(p)
+}
+
+func (l *limitedBuffer) Bytes() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Bytes()
+}
+
+func execOptions(c vars.CustomIntent) vars.ExecOptions {
+	var opts vars.ExecOptions
+	if c.ExecOptions != nil {
+		opts = *c.ExecOptions
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultExecTimeout
+	}
+	if opts.MaxOutput <= 0 {
+		opts.MaxOutput = defaultExecMaxOutput
+	}
+	return opts
+}
+
+// ValidateExecOptions checks exec options before they are saved
+func ValidateExecOptions(opts *vars.ExecOptions) error {
+	if opts == nil {
+		return nil
+	}
+	if opts.Timeout < 0 || opts.MaxOutput < 0 {
+		return errors.New("timeout and max output can't be negative")
+	}
+	if opts.Dir != "" {
+		if info, err := os.Stat(opts.Dir); err != nil || !info.IsDir() {
+			return errors.New("working directory " + opts.Dir + " doesn't exist")
+		}
+	}
+	if opts.User != "" {
+		if _, err := lookupRunAs(opts.User); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// speech text is passed as a single argument, but scripts often hand it to a shell.
+// quotes, backslashes, $ and control characters are dropped so that can't go wrong
+func sanitizeExecArg(text string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune("\"'`$\\", r) {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// execEnv is wire-pod's environment, or only PATH and the variables in opts.Env if there are any.
+// the WIREPOD_ ones are added either way
+func execEnv(opts vars.ExecOptions, c vars.CustomIntent, botSerial string, voiceText string) []string {
+	env := os.Environ()
+	if len(opts.Env) > 0 {
+		env = []string{"PATH=" + os.Getenv("PATH")}
+	}
+	for _, name := range opts.Env {
+		if name == "" || name == "PATH" {
+			continue
+		}
+		if value, ok := os.LookupEnv(name); ok {
+			env = append(env, name+"="+value)
+		}
+	}
+	return append(env,
+		"WIREPOD_ESN="+botSerial,
+		"WIREPOD_SPEECH_TEXT="+sanitizeExecArg(voiceText),
+		"WIREPOD_INTENT_NAME="+c.Name,
+		"WIREPOD_LOCALE="+vars.APIConfig.STT.Language,
+	)
+}
+
+// exec results go to the web interface log too
+func execLog(msg string) {
+	logger.Println(msg)
+	logger.LogUI(msg)
+}
+
+// runCustomExec runs a custom intent's program and returns what it printed
+func runCustomExec(c vars.CustomIntent, botSerial string, voiceText string) []byte {
+	opts := execOptions(c)
+	var args []string
+	for _, arg := range c.ExecArgs {
+		if arg == "!botSerial" {
+			arg = botSerial
+		} else if arg == "!speechText" {
+			arg = "\"" + sanitizeExecArg(voiceText) + "\""
+		} else if arg == "!intentName" {
+			arg = c.Name
+		} else if arg == "!locale" {
+			arg = vars.APIConfig.STT.Language
+		}
+		args = append(args, arg)
+	}
+	customIntentExec := exec.Command(c.Exec, args...)
+	customIntentExec.Dir = opts.Dir
+	customIntentExec.Env = execEnv(opts, c, botSerial, voiceText)
+	if err := sandboxCommand(customIntentExec, opts); err != nil {
+		execLog("Bot " + botSerial + " Not executing " + c.Exec + ": " + err.Error())
+		return nil
+	}
+	stdout := &limitedBuffer{max: opts.MaxOutput}
+	stderr := &limitedBuffer{max: opts.MaxOutput}
+	customIntentExec.Stdout = stdout
+	customIntentExec.Stderr = stderr
+
+	execLog("Bot " + botSerial + " Executing: " + c.Exec + " " + strings.Join(args, " "))
+	start := time.Now()
+	if err := customIntentExec.Start(); err != nil {
+		execLog("Bot " + botSerial + " Error starting " + c.Exec + ": " + err.Error())
+		return nil
+	}
+	timer := time.AfterFunc(time.Duration(opts.Timeout)*time.Second, func() {
+		killCommand(customIntentExec)
+	})
+	err := customIntentExec.Wait()
+	// if the timer can't be stopped, it already fired
+	timedOut := !timer.Stop()
+
+	took := fmt.Sprint(time.Since(start).Round(time.Millisecond))
+	if timedOut {
+		execLog("Bot " + botSerial + " " + c.Exec + " was killed after " + fmt.Sprint(opts.Timeout) + "s")
+	} else if err != nil {
+		execLog("Bot " + botSerial + " " + c.Exec + " failed after " + took + ": " + err.Error() + ": " + strings.TrimSpace(string(stderr.Bytes())))
+	} else {
+		execLog("Bot " + botSerial + " " + c.Exec + " finished in " + took)
+	}
+	if stdout.truncated {
+		execLog("Bot " + botSerial + " " + c.Exec + " output was cut off at " + fmt.Sprint(opts.MaxOutput) + " bytes")
+	}
+	execLog("Bot " + botSerial + " Custom Intent Exec Output: " + strings.TrimSpace(string(stdout.Bytes())))
+	return stdout.Bytes()
+}
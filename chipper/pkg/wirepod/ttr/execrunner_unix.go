@@ -0,0 +1,52 @@
+//go:build !windows
+// +build !windows
+
+package wirepod_ttr
+
+import (
+	"errors"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
+)
+
+func lookupRunAs(name string) (*syscall.Credential, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, errors.New("user " + name + " not found")
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+// the program gets its own process group so everything it started can be killed on timeout
+func sandboxCommand(cmd *exec.Cmd, opts vars.ExecOptions) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if opts.User != "" {
+		cred, err := lookupRunAs(opts.User)
+		if err != nil {
+			return err
+		}
+		cmd.SysProcAttr.Credential = cred
+	}
+	return nil
+}
+
+func killCommand(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,29 @@
+//go:build windows
+// +build windows
+
+package wirepod_ttr
+
+import (
+	"errors"
+	"os/exec"
+
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
+)
+
+func lookupRunAs(name string) (struct{}, error) {
+	return struct{}{}, errors.New("running as another user isn't supported on windows")
+}
+
+func sandboxCommand(cmd *exec.Cmd, opts vars.ExecOptions) error {
+	if opts.User != "" {
+		_, err := lookupRunAs(opts.User)
+		return err
+	}
+	return nil
+}
+
+func killCommand(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
@@ -103,40 +103,42 @@ func ParamChecker(req interface{}, intent string, speechText string, botSerial s
 		}
 	}
 	logger.Println("Checking params for candidate intent " + intent)
-	if strings.Contains(intent, "intent_photo_take_extend") {
-		isParam = true
-		newIntent = intent
-		if strings.Contains(speechText, lcztn.GetText(lcztn.STR_ME)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_SELF)) {
-			intentParam = "entity_photo_selfie"
-			intentParamValue = "photo_selfie"
-		} else {
-			intentParam = "entity_photo_selfie"
-			intentParamValue = ""
+	// names can't be learned by voice with the vosk grammar
+	if strings.Contains(intent, "intent_names_username_extend") && vars.VoskGrammerEnable {
+		var guid string
+		var target string
+		matched := false
+		for _, bot := range vars.BotInfo.Robots {
+			if botSerial == bot.Esn {
+				guid = bot.GUID
+				target = bot.IPAddress + ":443"
+				matched = true
+				break
+			}
 		}
-		intentParams = map[string]string{intentParam: intentParamValue}
-	} else if strings.Contains(intent, "intent_imperative_eyecolor") {
-		isParam = true
-		newIntent = "intent_imperative_eyecolor_specific_extend"
-		intentParam = "eye_color"
-		if strings.Contains(speechText, lcztn.GetText(lcztn.STR_EYE_COLOR_PURPLE)) {
-			intentParamValue = "COLOR_PURPLE"
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_EYE_COLOR_BLUE)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_EYE_COLOR_SAPPHIRE)) {
-			intentParamValue = "COLOR_BLUE"
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_EYE_COLOR_YELLOW)) {
-			intentParamValue = "COLOR_YELLOW"
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_EYE_COLOR_TEAL)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_EYE_COLOR_TEAL2)) {
-			intentParamValue = "COLOR_TEAL"
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_EYE_COLOR_GREEN)) {
-			intentParamValue = "COLOR_GREEN"
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_EYE_COLOR_ORANGE)) {
-			intentParamValue = "COLOR_ORANGE"
-		} else {
-			newIntent = intent
-			intentParamValue = ""
-			isParam = false
+		if matched && !DryRun {
+			vec, err := vector.New(vector.WithSerialNo(botSerial), vector.WithToken(guid), vector.WithTarget(target))
+			if err != nil {
+				logger.Println("error connecting to vector:", err)
+			} else {
+				sayText(vec, "You must add a face in the web interface. It cannot be done via voice by default.")
+			}
 		}
-		intentParams = map[string]string{intentParam: intentParamValue}
+		logger.Println("You must add a face via the web interface (Bot Settings -> Connect -> Faces).")
+		logger.LogUI("You must add a face via the web interface (Bot Settings -> Connect -> Faces).")
+	}
+	if slots, ok := slotIntent(intent); ok {
+		if slot, missing := missingPromptSlot(slots, speechText); missing && askForSlot(req, slots, slot, speechText, botSerial) {
+			return
+		}
+		newIntent, intentParams, isParam = extractSlots(slots, speechText, false, nil)
 	} else if strings.Contains(intent, "intent_weather_extend") {
+		// no location said and none set in the app
+		if vars.APIConfig.Weather.Enable && (!jdocExists || botLocation == "") && !strings.Contains(speechText, lcztn.GetText(lcztn.STR_WEATHER_IN)) {
+			if askForWeatherLocation(req, intent, speechText, botSerial, botUnits) {
+				return
+			}
+		}
 		isParam = true
 		newIntent = intent
 		condition, is_forecast, local_datetime, speakable_location_string, temperature, temperature_unit := weatherParser(speechText, botLocation, botUnits)
@@ -147,142 +149,6 @@ func ParamChecker(req interface{}, intent string, speechText string, botSerial s
 		} else {
 			intentParams = map[string]string{"condition": condition, "is_forecast": is_forecast, "local_datetime": local_datetime, "speakable_location_string": speakable_location_string, "temperature": temperature, "temperature_unit": temperature_unit}
 		}
-	} else if strings.Contains(intent, "intent_imperative_volumelevel_extend") {
-		isParam = true
-		newIntent = intent
-		if strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_MEDIUM_LOW)) {
-			intentParam = "volume_level"
-			intentParamValue = "VOLUME_2"
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_LOW)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_QUIET)) {
-			intentParam = "volume_level"
-			intentParamValue = "VOLUME_1"
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_MEDIUM_HIGH)) {
-			intentParam = "volume_level"
-			intentParamValue = "VOLUME_4"
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_MEDIUM)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_NORMAL)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_REGULAR)) {
-			intentParam = "volume_level"
-			intentParamValue = "VOLUME_3"
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_HIGH)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_LOUD)) {
-			intentParam = "volume_level"
-			intentParamValue = "VOLUME_5"
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_MUTE)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_NOTHING)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_SILENT)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_OFF)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_ZERO)) {
-			// there is no VOLUME_0 :(
-			intentParam = "volume_level"
-			intentParamValue = "VOLUME_1"
-		} else {
-			intentParam = "volume_level"
-			intentParamValue = "VOLUME_1"
-		}
-		intentParams = map[string]string{intentParam: intentParamValue}
-	} else if strings.Contains(intent, "intent_names_username_extend") {
-		if vars.VoskGrammerEnable {
-			var guid string
-			var target string
-			matched := false
-			for _, bot := range vars.BotInfo.Robots {
-				if botSerial == bot.Esn {
-					guid = bot.GUID
-					target = bot.IPAddress + ":443"
-					matched = true
-					break
-				}
-			}
-			if matched {
-				vec, err := vector.New(vector.WithSerialNo(botSerial), vector.WithToken(guid), vector.WithTarget(target))
-				if err != nil {
-					logger.Println("error connecting to vector:", err)
-				} else {
-					sayText(vec, "You must add a face in the web interface. It cannot be done via voice by default.")
-				}
-			}
-			logger.Println("You must add a face via the web interface (Bot Settings -> Connect -> Faces).")
-			logger.LogUI("You must add a face via the web interface (Bot Settings -> Connect -> Faces).")
-		}
-		var username string
-		var nameSplitter string = ""
-		isParam = true
-		newIntent = intent
-		if strings.Contains(speechText, lcztn.GetText(lcztn.STR_NAME_IS)) {
-			nameSplitter = lcztn.GetText(lcztn.STR_NAME_IS)
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_NAME_IS2)) {
-			nameSplitter = lcztn.GetText(lcztn.STR_NAME_IS2)
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_NAME_IS3)) {
-			nameSplitter = lcztn.GetText(lcztn.STR_NAME_IS3)
-		}
-		if nameSplitter != "" {
-			splitPhrase := strings.SplitAfter(speechText, nameSplitter)
-			username = strings.TrimSpace(splitPhrase[1])
-			if len(splitPhrase) == 3 {
-				username = username + " " + strings.TrimSpace(splitPhrase[2])
-			} else if len(splitPhrase) == 4 {
-				username = username + " " + strings.TrimSpace(splitPhrase[2]) + " " + strings.TrimSpace(splitPhrase[3])
-			} else if len(splitPhrase) > 4 {
-				username = username + " " + strings.TrimSpace(splitPhrase[2]) + " " + strings.TrimSpace(splitPhrase[3])
-			}
-			logger.Println("Name parsed from speech: " + "`" + username + "`")
-			intentParam = "username"
-			intentParamValue = username
-			intentParams = map[string]string{intentParam: intentParamValue}
-		} else {
-			logger.Println("No name parsed from speech")
-			intentParam = "username"
-			intentParamValue = ""
-			intentParams = map[string]string{intentParam: intentParamValue}
-		}
-	} else if strings.Contains(intent, "intent_clock_settimer_extend") {
-		isParam = true
-		newIntent = intent
-		timerSecs := words2num(speechText)
-		logger.Println("Seconds parsed from speech: " + timerSecs)
-		intentParam = "timer_duration"
-		intentParamValue = timerSecs
-		intentParams = map[string]string{intentParam: intentParamValue}
-	} else if strings.Contains(intent, "intent_global_stop_extend") {
-		isParam = true
-		newIntent = intent
-		intentParam = "what_to_stop"
-		intentParamValue = "timer"
-		intentParams = map[string]string{intentParam: intentParamValue}
-	} else if strings.Contains(intent, "intent_message_playmessage_extend") {
-		var given_name string
-		isParam = true
-		newIntent = intent
-		intentParam = "given_name"
-		if strings.Contains(speechText, lcztn.GetText(lcztn.STR_FOR)) {
-			splitPhrase := strings.SplitAfter(speechText, lcztn.GetText(lcztn.STR_FOR))
-			given_name = strings.TrimSpace(splitPhrase[1])
-			if len(splitPhrase) == 3 {
-				given_name = given_name + " " + strings.TrimSpace(splitPhrase[2])
-			} else if len(splitPhrase) == 4 {
-				given_name = given_name + " " + strings.TrimSpace(splitPhrase[2]) + " " + strings.TrimSpace(splitPhrase[3])
-			} else if len(splitPhrase) > 4 {
-				given_name = given_name + " " + strings.TrimSpace(splitPhrase[2]) + " " + strings.TrimSpace(splitPhrase[3])
-			}
-			intentParamValue = given_name
-		} else {
-			intentParamValue = ""
-		}
-		intentParams = map[string]string{intentParam: intentParamValue}
-	} else if strings.Contains(intent, "intent_message_recordmessage_extend") {
-		var given_name string
-		isParam = true
-		newIntent = intent
-		intentParam = "given_name"
-		if strings.Contains(speechText, lcztn.GetText(lcztn.STR_FOR)) {
-			splitPhrase := strings.SplitAfter(speechText, lcztn.GetText(lcztn.STR_FOR))
-			given_name = strings.TrimSpace(splitPhrase[1])
-			if len(splitPhrase) == 3 {
-				given_name = given_name + " " + strings.TrimSpace(splitPhrase[2])
-			} else if len(splitPhrase) == 4 {
-				given_name = given_name + " " + strings.TrimSpace(splitPhrase[2]) + " " + strings.TrimSpace(splitPhrase[3])
-			} else if len(splitPhrase) > 4 {
-				given_name = given_name + " " + strings.TrimSpace(splitPhrase[2]) + " " + strings.TrimSpace(splitPhrase[3])
-			}
-			intentParamValue = given_name
-		} else {
-			intentParamValue = ""
-		}
-		intentParams = map[string]string{intentParam: intentParamValue}
 	} else {
 		if intentParam == "" {
 			newIntent = intent
@@ -374,19 +240,11 @@ func ParamCheckerSlotsEnUS(req interface{}, intent string, slots map[string]stri
 			newIntent = "intent_imperative_volumelevel_extend"
 			isParam = true
 			intentParam = "volume_level"
-			if strings.Contains(slots["volume"], "medium low") {
-				intentParamValue = "VOLUME_2"
-			} else if strings.Contains(slots["volume"], "low") {
-				intentParamValue = "VOLUME_1"
-			} else if strings.Contains(slots["volume"], "medium high") {
-				intentParamValue = "VOLUME_4"
-			} else if strings.Contains(slots["volume"], "high") {
-				intentParamValue = "VOLUME_5"
-			} else if strings.Contains(slots["volume"], "medium") {
-				intentParamValue = "VOLUME_3"
-			} else {
-				intentParamValue = "VOLUME_1"
+			volume, found := resolveSlot("intent_imperative_volumelevel_extend", "volume_level", slots["volume"])
+			if !found {
+				volume = "VOLUME_1"
 			}
+			intentParamValue = volume
 		} else {
 			isParam = false
 			intentParam = ""
@@ -397,18 +255,9 @@ func ParamCheckerSlotsEnUS(req interface{}, intent string, slots map[string]stri
 		isParam = true
 		newIntent = "intent_imperative_eyecolor_specific_extend"
 		intentParam = "eye_color"
-		if strings.Contains(slots["eye_color"], "purple") {
-			intentParamValue = "COLOR_PURPLE"
-		} else if strings.Contains(slots["eye_color"], "blue") || strings.Contains(slots["eye_color"], "sapphire") {
-			intentParamValue = "COLOR_BLUE"
-		} else if strings.Contains(slots["eye_color"], "yellow") {
-			intentParamValue = "COLOR_YELLOW"
-		} else if strings.Contains(slots["eye_color"], "teal") || strings.Contains(slots["eye_color"], "tell") {
-			intentParamValue = "COLOR_TEAL"
-		} else if strings.Contains(slots["eye_color"], "green") {
-			intentParamValue = "COLOR_GREEN"
-		} else if strings.Contains(slots["eye_color"], "orange") {
-			intentParamValue = "COLOR_ORANGE"
+		color, found := resolveSlot("intent_imperative_eyecolor", "eye_color", slots["eye_color"])
+		if found {
+			intentParamValue = color
 		} else {
 			newIntent = intent
 			intentParamValue = ""
@@ -526,158 +375,13 @@ func prehistoricParamChecker(req interface{}, intent string, speechText string)
 	var intentParams map[string]string
 	var botLocation string = "San Francisco"
 	var botUnits string = "F"
-	if strings.Contains(intent, "intent_photo_take_extend") {
-		isParam = true
-		newIntent = intent
-		if strings.Contains(speechText, lcztn.GetText(lcztn.STR_ME)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_SELF)) {
-			intentParam = "entity_photo_selfie"
-			intentParamValue = "photo_selfie"
-		} else {
-			intentParam = "entity_photo_selfie"
-			intentParamValue = ""
-		}
-		intentParams = map[string]string{intentParam: intentParamValue}
-	} else if strings.Contains(intent, "intent_imperative_eyecolor") {
-		// leaving stuff like this in case someone wants to add features like this to older software
-		isParam = true
-		newIntent = "intent_imperative_eyecolor_specific_extend"
-		intentParam = "eye_color"
-		if strings.Contains(speechText, lcztn.GetText(lcztn.STR_EYE_COLOR_PURPLE)) {
-			intentParamValue = "COLOR_PURPLE"
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_EYE_COLOR_BLUE)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_EYE_COLOR_SAPPHIRE)) {
-			intentParamValue = "COLOR_BLUE"
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_EYE_COLOR_YELLOW)) {
-			intentParamValue = "COLOR_YELLOW"
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_EYE_COLOR_TEAL)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_EYE_COLOR_TEAL2)) {
-			intentParamValue = "COLOR_TEAL"
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_EYE_COLOR_GREEN)) {
-			intentParamValue = "COLOR_GREEN"
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_EYE_COLOR_ORANGE)) {
-			intentParamValue = "COLOR_ORANGE"
-		} else {
-			newIntent = intent
-			intentParamValue = ""
-			isParam = false
-		}
-		intentParams = map[string]string{intentParam: intentParamValue}
+	if slots, ok := slotIntent(intent); ok {
+		newIntent, intentParams, isParam = extractSlots(slots, speechText, true, nil)
 	} else if strings.Contains(intent, "intent_weather_extend") {
 		isParam = true
 		newIntent = intent
 		condition, is_forecast, local_datetime, speakable_location_string, temperature, temperature_unit := weatherParser(speechText, botLocation, botUnits)
 		intentParams = map[string]string{"condition": condition, "is_forecast": is_forecast, "local_datetime": local_datetime, "speakable_location_string": speakable_location_string, "temperature": temperature, "temperature_unit": temperature_unit}
-	} else if strings.Contains(intent, "intent_imperative_volumelevel_extend") {
-		isParam = true
-		newIntent = intent
-		if strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_MEDIUM_LOW)) {
-			intentParam = "volume_level"
-			intentParamValue = "VOLUME_2"
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_LOW)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_QUIET)) {
-			intentParam = "volume_level"
-			intentParamValue = "VOLUME_1"
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_MEDIUM_HIGH)) {
-			intentParam = "volume_level"
-			intentParamValue = "VOLUME_4"
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_MEDIUM)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_NORMAL)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_REGULAR)) {
-			intentParam = "volume_level"
-			intentParamValue = "VOLUME_3"
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_HIGH)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_LOUD)) {
-			intentParam = "volume_level"
-			intentParamValue = "VOLUME_5"
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_MUTE)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_NOTHING)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_SILENT)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_OFF)) || strings.Contains(speechText, lcztn.GetText(lcztn.STR_VOLUME_ZERO)) {
-			// there is no VOLUME_0 :(
-			intentParam = "volume_level"
-			intentParamValue = "VOLUME_1"
-		} else {
-			intentParam = "volume_level"
-			intentParamValue = "VOLUME_1"
-		}
-		intentParams = map[string]string{intentParam: intentParamValue}
-	} else if strings.Contains(intent, "intent_names_username_extend") {
-		var username string
-		var nameSplitter string = ""
-		isParam = true
-		newIntent = "intent_names_username"
-		if strings.Contains(speechText, lcztn.GetText(lcztn.STR_NAME_IS)) {
-			nameSplitter = lcztn.GetText(lcztn.STR_NAME_IS)
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_NAME_IS2)) {
-			nameSplitter = lcztn.GetText(lcztn.STR_NAME_IS2)
-		} else if strings.Contains(speechText, lcztn.GetText(lcztn.STR_NAME_IS3)) {
-			nameSplitter = lcztn.GetText(lcztn.STR_NAME_IS3)
-		}
-		if nameSplitter != "" {
-			splitPhrase := strings.SplitAfter(speechText, nameSplitter)
-			username = strings.TrimSpace(splitPhrase[1])
-			if len(splitPhrase) == 3 {
-				username = username + " " + strings.TrimSpace(splitPhrase[2])
-			} else if len(splitPhrase) == 4 {
-				username = username + " " + strings.TrimSpace(splitPhrase[2]) + " " + strings.TrimSpace(splitPhrase[3])
-			} else if len(splitPhrase) > 4 {
-				username = username + " " + strings.TrimSpace(splitPhrase[2]) + " " + strings.TrimSpace(splitPhrase[3])
-			}
-			logger.Println("Name parsed from speech: " + "`" + username + "`")
-			intentParam = "username"
-			intentParamValue = username
-			intentParams = map[string]string{intentParam: intentParamValue}
-		} else {
-			logger.Println("No name parsed from speech")
-			intentParam = "username"
-			intentParamValue = ""
-			intentParams = map[string]string{intentParam: intentParamValue}
-		}
-	} else if strings.Contains(intent, "intent_clock_settimer_extend") {
-		isParam = true
-		newIntent = "intent_clock_settimer"
-		timerSecs := words2num(speechText)
-		logger.Println("Seconds parsed from speech: " + timerSecs)
-		intentParam = "timer_duration"
-		intentParamValue = timerSecs
-		intentParams = map[string]string{intentParam: intentParamValue}
-	} else if strings.Contains(intent, "intent_global_stop_extend") {
-		isParam = true
-		newIntent = "intent_global_stop"
-		intentParam = "what_to_stop"
-		intentParamValue = "timer"
-		intentParams = map[string]string{intentParam: intentParamValue}
-	} else if strings.Contains(intent, "intent_message_playmessage_extend") {
-		var given_name string
-		isParam = true
-		newIntent = "intent_message_playmessage"
-		intentParam = "given_name"
-		if strings.Contains(speechText, lcztn.GetText(lcztn.STR_FOR)) {
-			splitPhrase := strings.SplitAfter(speechText, lcztn.GetText(lcztn.STR_FOR))
-			given_name = strings.TrimSpace(splitPhrase[1])
-			if len(splitPhrase) == 3 {
-				given_name = given_name + " " + strings.TrimSpace(splitPhrase[2])
-			} else if len(splitPhrase) == 4 {
-				given_name = given_name + " " + strings.TrimSpace(splitPhrase[2]) + " " + strings.TrimSpace(splitPhrase[3])
-			} else if len(splitPhrase) > 4 {
-				given_name = given_name + " " + strings.TrimSpace(splitPhrase[2]) + " " + strings.TrimSpace(splitPhrase[3])
-			}
-			intentParamValue = given_name
-		} else {
-			intentParamValue = ""
-		}
-		intentParams = map[string]string{intentParam: intentParamValue}
-	} else if strings.Contains(intent, "intent_message_recordmessage_extend") {
-		var given_name string
-		isParam = true
-		newIntent = "intent_message_recordmessage"
-		intentParam = "given_name"
-		if strings.Contains(speechText, lcztn.GetText(lcztn.STR_FOR)) {
-			splitPhrase := strings.SplitAfter(speechText, lcztn.GetText(lcztn.STR_FOR))
-			given_name = strings.TrimSpace(splitPhrase[1])
-			if len(splitPhrase) == 3 {
-				given_name = given_name + " " + strings.TrimSpace(splitPhrase[2])
-			} else if len(splitPhrase) == 4 {
-				given_name = given_name + " " + strings.TrimSpace(splitPhrase[2]) + " " + strings.TrimSpace(splitPhrase[3])
-			} else if len(splitPhrase) > 4 {
-				given_name = given_name + " " + strings.TrimSpace(splitPhrase[2]) + " " + strings.TrimSpace(splitPhrase[3])
-			}
-			intentParamValue = given_name
-		} else {
-			intentParamValue = ""
-		}
-		intentParams = map[string]string{intentParam: intentParamValue}
 	} else if strings.Contains(intent, "intent_play_blackjack") {
 		isParam = true
 		newIntent = "intent_play_specific_extend"
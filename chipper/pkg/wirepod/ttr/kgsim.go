@@ -7,6 +7,7 @@ import (
 	"io"
 	"log"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 	"unicode"
@@ -16,53 +17,93 @@ import (
 
 	"github.com/fforchino/vector-go-sdk/pkg/vector"
 	"github.com/fforchino/vector-go-sdk/pkg/vectorpb"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/llm"
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
-	"github.com/sashabaranov/go-openai"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/history"
 )
 
-func GetChat(esn string) vars.RememberedChat {
-	for _, chat := range vars.RememberedChats {
-		if chat.ESN == esn {
-			return chat
-		}
+func init() {
+	history.Summarizer = summarizeChat
+}
+
+// Remember saves a question and its answer to the robot's chat history
+func Remember(user, ai llm.Message, esn string, model string) {
+	userText := user.Content
+	if userText == "" && len(user.Images) > 0 {
+		userText = "(a picture from the camera)"
 	}
-	return vars.RememberedChat{
-		ESN: esn,
+	if err := history.AddWithImages(esn, user.Role, userText, "", user.Images); err != nil {
+		logger.Println("Error saving chat history: " + err.Error())
+		return
+	}
+	if err := history.Add(esn, ai.Role, ai.Content, model); err != nil {
+		logger.Println("Error saving chat history: " + err.Error())
 	}
 }
 
-func PlaceChat(chat vars.RememberedChat) {
-	for i, achat := range vars.RememberedChats {
-		if achat.ESN == chat.ESN {
-			vars.RememberedChats[i] = chat
-			return
-		}
+// rememberReply saves a streamed reply once the LLM is done with it. model is asked then too,
+// since a fallback provider may have answered
+func rememberReply(esn, userText string, llmDone chan bool, model func() string, reply func() string) {
+	<-llmDone
+	aiText := reply()
+	if strings.TrimSpace(aiText) == "" {
+		return
 	}
-	vars.RememberedChats = append(vars.RememberedChats, chat)
+	Remember(llm.Message{
+		Role:    llm.RoleUser,
+		Content: userText,
+	},
+		llm.Message{
+			Role:    llm.RoleAssistant,
+			Content: aiText,
+		},
+		esn, model())
 }
 
-// remember last 16 lines of chat
-func Remember(user, ai openai.ChatCompletionMessage, esn string) {
-	chatAppend := []openai.ChatCompletionMessage{
-		user,
-		ai,
-	}
-	currentChat := GetChat(esn)
-	if len(currentChat.Chats) == 16 {
-		var newChat vars.RememberedChat
-		newChat.ESN = currentChat.ESN
-		for i, chat := range currentChat.Chats {
-			if i < 2 {
-				continue
-			}
-			newChat.Chats = append(newChat.Chats, chat)
-		}
-		currentChat = newChat
+// cutOffReply is what the robot got through before the user interrupted it at sentence n, so the
+// LLM knows where it was stopped
+func cutOffReply(sentences []string, n int, withTools bool) string {
+	if n < 1 {
+		n = 1
+	}
+	spoken := sentences
+	if n < len(spoken) {
+		spoken = spoken[:n]
+	}
+	said := strings.Join(spoken, " ")
+	if withTools {
+		said = stripCommands(said)
+	}
+	return strings.TrimSpace(said + " (the user interrupted this reply at sentence " + strconv.Itoa(n) + ")")
+}
+
+// summarizeChat is the history summarizer, using the robot's LLM
+func summarizeChat(esn string, previous string, msgs []history.Message) (string, error) {
+	k := vars.GetKnowledge(esn)
+	provider, err := newLLMProvider(k)
+	if err != nil {
+		return "", err
+	}
+	var transcript strings.Builder
+	for _, m := range msgs {
+		transcript.WriteString(m.Role + ": " + m.Content + "\n")
+	}
+	prompt := "Summarize this conversation between a user and " + k.RobotName + ", a robot, in a few sentences. Keep facts about the user, their preferences and anything they asked the robot to remember."
+	if previous != "" {
+		prompt += " Include what matters from this summary of the conversation before it: " + previous
+	}
+	resp, err := llm.Chat(context.Background(), provider, llm.Request{
+		Messages: []llm.Message{
+			{Role: llm.RoleSystem, Content: prompt},
+			{Role: llm.RoleUser, Content: transcript.String()},
+		},
+		MaxTokens: 300,
+	})
+	if err != nil {
+		return "", err
 	}
-	currentChat.ESN = esn
-	currentChat.Chats = append(currentChat.Chats, chatAppend...)
-	PlaceChat(currentChat)
+	return resp.Content, nil
 }
 
 func isMn(r rune) bool {
@@ -114,54 +155,56 @@ func removeEmojis(input string) string {
 	return result
 }
 
-func CreateAIReq(transcribedText, esn string, gpt3tryagain, isKG bool) openai.ChatCompletionRequest {
-	defaultPrompt := "You are a helpful, animated robot called Vector. Keep the response concise yet informative."
+// newLLMProvider sets up a robot's knowledge graph provider, followed by the fallbacks
+func newLLMProvider(k vars.Knowledge) (llm.Provider, error) {
+	configs := []llm.Config{{Type: k.Provider, Key: k.Key, Endpoint: k.Endpoint, Model: k.Model}}
+	for _, f := range k.Fallbacks {
+		configs = append(configs, llm.Config{Type: f.Provider, Key: f.Key, Endpoint: f.Endpoint, Model: f.Model})
+	}
+	return llm.NewChain(configs...)
+}
+
+// CreateAIReq sets up a robot's request. with tools, the LLM commands are native tool calls
+func CreateAIReq(transcribedText, esn string, isKG bool, tools bool) llm.Request {
+	k := vars.GetKnowledge(esn)
+	defaultPrompt := "You are a helpful, animated robot called " + k.RobotName + ". Keep the response concise yet informative."
 
-	var nChat []openai.ChatCompletionMessage
+	var nChat []llm.Message
 
-	smsg := openai.ChatCompletionMessage{
-		Role: openai.ChatMessageRoleSystem,
+	smsg := llm.Message{
+		Role: llm.RoleSystem,
 	}
-	if strings.TrimSpace(vars.APIConfig.Knowledge.OpenAIPrompt) != "" {
-		smsg.Content = strings.TrimSpace(vars.APIConfig.Knowledge.OpenAIPrompt)
+	if k.Prompt != "" {
+		smsg.Content = k.Prompt
 	} else {
 		smsg.Content = defaultPrompt
 	}
 
-	var model string
-
-	if gpt3tryagain {
-		model = openai.GPT3Dot5Turbo
-	} else if vars.APIConfig.Knowledge.Provider == "openai" {
-		model = openai.GPT4oMini
-		logger.Println("Using " + model)
-	} else {
-		logger.Println("Using " + vars.APIConfig.Knowledge.Model)
-		model = vars.APIConfig.Knowledge.Model
-	}
+	logger.Println("Using " + k.Model)
 
-	smsg.Content = CreatePrompt(smsg.Content, model, isKG)
+	smsg.Content = CreatePrompt(smsg.Content, k.Model, k, isKG, tools)
 
 	nChat = append(nChat, smsg)
-	if vars.APIConfig.Knowledge.SaveChat {
-		rchat := GetChat(esn)
-		logger.Println("Using remembered chats, length of " + fmt.Sprint(len(rchat.Chats)) + " messages")
-		nChat = append(nChat, rchat.Chats...)
+	if k.SaveChat {
+		rchat := history.Context(esn, transcribedText)
+		if !modelCanSee(k.Model) {
+			rchat = withoutImages(rchat)
+		}
+		logger.Println("Using remembered chats, length of " + fmt.Sprint(len(rchat)) + " messages")
+		nChat = append(nChat, rchat...)
 	}
-	nChat = append(nChat, openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleUser,
+	nChat = append(nChat, llm.Message{
+		Role:    llm.RoleUser,
 		Content: transcribedText,
 	})
 
-	aireq := openai.ChatCompletionRequest{
-		Model:            model,
-		MaxTokens:        2048,
-		Temperature:      1,
-		TopP:             1,
-		FrequencyPenalty: 0,
-		PresencePenalty:  0,
-		Messages:         nChat,
-		Stream:           true,
+	aireq := llm.Request{
+		Messages:    nChat,
+		MaxTokens:   k.MaxTokens,
+		Temperature: k.Temperature,
+	}
+	if tools && k.CommandsEnable {
+		aireq.Tools = LLMTools(k, k.Model)
 	}
 	return aireq
 }
@@ -218,62 +261,123 @@ func StreamingKGSim(req interface{}, esn string, transcribedText string, isKG bo
 	var fullfullRespText string
 	var fullRespSlice []string
 	var isDone bool
-	var c *openai.Client
-	if vars.APIConfig.Knowledge.Provider == "together" {
-		if vars.APIConfig.Knowledge.Model == "" {
-			vars.APIConfig.Knowledge.Model = "meta-llama/Llama-3-70b-chat-hf"
-			vars.WriteConfigToDisk()
-		}
-		conf := openai.DefaultConfig(vars.APIConfig.Knowledge.Key)
-		conf.BaseURL = "https://api.together.xyz/v1"
-		c = openai.NewClientWithConfig(conf)
-	} else if vars.APIConfig.Knowledge.Provider == "custom" {
-		conf := openai.DefaultConfig(vars.APIConfig.Knowledge.Key)
-		conf.BaseURL = vars.APIConfig.Knowledge.Endpoint
-		c = openai.NewClientWithConfig(conf)
-	} else if vars.APIConfig.Knowledge.Provider == "openai" {
-		c = openai.NewClient(vars.APIConfig.Knowledge.Key)
-	}
+	// the whole reply, once the LLM is done
+	var fullReply string
+	k := vars.GetKnowledge(esn)
 	speakReady := make(chan string)
 	successIntent := make(chan bool)
+	// closed once the LLM stream is over, however it ended
+	llmDone := make(chan bool)
+	// cancelled if the user interrupts the response
+	llmCtx, cancelLLM := context.WithCancel(ctx)
+	defer cancelLLM()
+	// closed once the robot is under behavior control, which tool calls wait for
+	controlled := make(chan struct{})
+	runToolAction := func(action RobotAction) error {
+		select {
+		case successIntent <- true:
+		case <-controlled:
+		case <-llmCtx.Done():
+			return llmCtx.Err()
+		}
+		select {
+		case <-controlled:
+		case <-llmCtx.Done():
+			return llmCtx.Err()
+		}
+		// the actions which need the conversation end the response, so they aren't done here
+		_, err := doAction(nil, action, robot, nil)
+		return err
+	}
 
-	aireq := CreateAIReq(transcribedText, esn, false, isKG)
-
-	stream, err := c.CreateChatCompletionStream(ctx, aireq)
-	if err != nil {
-		if strings.Contains(err.Error(), "does not exist") && vars.APIConfig.Knowledge.Provider == "openai" {
-			logger.Println("GPT-4 model cannot be accessed with this API key. You likely need to add more than $5 dollars of funds to your OpenAI account.")
-			logger.LogUI("GPT-4 model cannot be accessed with this API key. You likely need to add more than $5 dollars of funds to your OpenAI account.")
-			aireq := CreateAIReq(transcribedText, esn, true, isKG)
-			logger.Println("Falling back to " + aireq.Model)
-			logger.LogUI("Falling back to " + aireq.Model)
-			stream, err = c.CreateChatCompletionStream(ctx, aireq)
-			if err != nil {
-				logger.Println("OpenAI still not returning a response even after falling back. Erroring.")
-				return "", err
+	var aireq llm.Request
+	var stream llm.Stream
+	provider, err := newLLMProvider(k)
+	if err == nil {
+		useTools := k.CommandsEnable && providerSupportsTools(provider)
+		aireq = CreateAIReq(transcribedText, esn, isKG, useTools)
+		stream, err = provider.ChatStream(llmCtx, aireq)
+		if err != nil && useTools && toolsUnsupported(err) {
+			// a model without tool support, which gets the commands in the prompt instead
+			logger.Println("LLM error with tools (" + err.Error() + "), trying again without them")
+			aireq = CreateAIReq(transcribedText, esn, isKG, false)
+			stream, err = provider.ChatStream(llmCtx, aireq)
+			if err == nil {
+				setNoToolSupport(provider)
 			}
-		} else {
-			if isKG {
-				kgStopLooping = true
-				for range kgReadyToAnswer {
-					break
-				}
-				stop <- true
-				time.Sleep(time.Second / 3)
-				KGSim(esn, "There was an error getting data from the L. L. M.")
+		}
+	}
+	if err != nil {
+		logger.Println("LLM error: " + err.Error())
+		if isKG {
+			kgStopLooping = true
+			for range kgReadyToAnswer {
+				break
 			}
-			return "", err
+			stop <- true
+			time.Sleep(time.Second / 3)
+			KGSim(esn, "There was an error getting data from the L. L. M.")
 		}
+		return "", err
 	}
+	// the model of the provider which is answering
+	model := llm.StreamModel(provider, stream)
 	nChat := aireq.Messages
-	nChat = append(nChat, openai.ChatCompletionMessage{
-		Role: openai.ChatMessageRoleAssistant,
+	nChat = append(nChat, llm.Message{
+		Role: llm.RoleAssistant,
 	})
+	// the conversation including tool calls and their results, once there are any
+	var toolChat []llm.Message
+	var roundText string
+	toolRounds := 0
 	fmt.Println("LLM stream response: ")
 	go func() {
+		defer func() {
+			stream.Close()
+			close(llmDone)
+		}()
 		for {
 			response, err := stream.Recv()
 			if errors.Is(err, io.EOF) {
+				if calls := stream.ToolCalls(); len(calls) > 0 && toolRounds < maxToolRounds {
+					toolRounds++
+					stream.Close()
+					// what was said before the calls comes first
+					if strings.TrimSpace(fullRespText) != "" {
+						fullRespSlice = append(fullRespSlice, strings.TrimSpace(fullRespText))
+						fullRespText = ""
+					}
+					cmds, results, more := toolCallsToCommands(k, model, calls, robot, runToolAction)
+					aireq.Messages = append(aireq.Messages, llm.Message{
+						Role:      llm.RoleAssistant,
+						Content:   roundText,
+						ToolCalls: calls,
+					})
+					aireq.Messages = append(aireq.Messages, results...)
+					toolChat = aireq.Messages
+					roundText = ""
+					fullRespSlice = append(fullRespSlice, cmds...)
+					if len(fullRespSlice) > 0 {
+						select {
+						case successIntent <- true:
+						default:
+						}
+						select {
+						case speakReady <- "":
+						default:
+						}
+					}
+					if more {
+						// the LLM gets the results and carries on
+						next, err := provider.ChatStream(llmCtx, aireq)
+						if err == nil {
+							stream = next
+							model = llm.StreamModel(provider, next)
+							continue
+						}
+						logger.Println("LLM error: " + err.Error())
+					}
+				}
 				// prevents a crash
 				if len(fullRespSlice) == 0 {
 					logger.Println("LLM returned no response")
@@ -298,34 +402,35 @@ func StreamingKGSim(req interface{}, esn string, transcribedText string, isKG bo
 					}
 					newStr = newStr + " " + str
 				}
+				// with tools, the commands are in fullRespSlice but not in what the LLM said
+				if len(aireq.Tools) > 0 {
+					newStr = stripCommands(newStr)
+				}
 				if strings.TrimSpace(newStr) != strings.TrimSpace(fullfullRespText) {
-					logger.Println("LLM debug: there is content after the last punctuation mark")
 					extraBit := strings.TrimPrefix(fullRespText, newStr)
-					fullRespSlice = append(fullRespSlice, extraBit)
-				}
-				if vars.APIConfig.Knowledge.SaveChat {
-					Remember(openai.ChatCompletionMessage{
-						Role:    openai.ChatMessageRoleUser,
-						Content: transcribedText,
-					},
-						openai.ChatCompletionMessage{
-							Role:    openai.ChatMessageRoleAssistant,
-							Content: newStr,
-						},
-						esn)
+					if strings.TrimSpace(extraBit) != "" {
+						logger.Println("LLM debug: there is content after the last punctuation mark")
+						fullRespSlice = append(fullRespSlice, extraBit)
+					}
 				}
+				fullReply = newStr
 				logger.LogUI("LLM response for " + esn + ": " + newStr)
 				logger.Println("LLM stream finished")
 				return
 			}
 
 			if err != nil {
-				logger.Println("Stream error: " + err.Error())
+				if llmCtx.Err() != nil {
+					logger.Println("LLM stream cancelled")
+				} else {
+					logger.Println("Stream error: " + err.Error())
+				}
 				return
 			}
 
-			fullfullRespText = fullfullRespText + removeSpecialCharacters(response.Choices[0].Delta.Content)
-			fullRespText = fullRespText + removeSpecialCharacters(response.Choices[0].Delta.Content)
+			roundText = roundText + response
+			fullfullRespText = fullfullRespText + removeSpecialCharacters(response)
+			fullRespText = fullRespText + removeSpecialCharacters(response)
 			if strings.Contains(fullRespText, "...") || strings.Contains(fullRespText, ".'") || strings.Contains(fullRespText, ".\"") || strings.Contains(fullRespText, ".") || strings.Contains(fullRespText, "?") || strings.Contains(fullRespText, "!") {
 				var sepStr string
 				if strings.Contains(fullRespText, "...") {
@@ -369,9 +474,28 @@ func StreamingKGSim(req interface{}, esn string, transcribedText string, isKG bo
 	if !isKG {
 		BControl(robot, ctx, start, stop)
 	}
-	interrupted := false
+	// closed if the user interrupts the response. goroutines check it with interrupted()
+	interruptCh := make(chan bool)
+	interrupted := func() bool {
+		select {
+		case <-interruptCh:
+			return true
+		default:
+			return false
+		}
+	}
+	stopTTSLoop := make(chan bool)
 	go func() {
-		interrupted = InterruptKGSimWhenTouchedOrWaked(robot, stop, stopStop)
+		var wakeWord bool
+		if InterruptKGSimWhenTouchedOrWaked(robot, stop, stopStop, func(w bool) {
+			wakeWord = w
+			close(interruptCh)
+			cancelLLM()
+			StopSpeaking(esn)
+		}) && !wakeWord {
+			// the wake word has the robot listening already, a touch doesn't
+			DoNewRequest(robot)
+		}
 	}()
 	var TTSLoopAnimation string
 	var TTSGetinAnimation string
@@ -383,9 +507,9 @@ func StreamingKGSim(req interface{}, esn string, transcribedText string, isKG bo
 		TTSGetinAnimation = "anim_getin_tts_01"
 	}
 
-	var stopTTSLoop bool
 	TTSLoopStopped := make(chan bool)
 	for range start {
+		close(controlled)
 		if isKG {
 			kgStopLooping = true
 			for range kgReadyToAnswer {
@@ -403,12 +527,17 @@ func StreamingKGSim(req interface{}, esn string, transcribedText string, isKG bo
 				Loops: 1,
 			},
 		)
-		if !vars.APIConfig.Knowledge.CommandsEnable {
+		if !k.CommandsEnable {
 			go func() {
 				for {
-					if stopTTSLoop {
+					select {
+					case <-stopTTSLoop:
 						TTSLoopStopped <- true
-						break
+						return
+					case <-interruptCh:
+						TTSLoopStopped <- true
+						return
+					default:
 					}
 					robot.Conn.PlayAnimation(
 						ctx,
@@ -426,35 +555,46 @@ func StreamingKGSim(req interface{}, esn string, transcribedText string, isKG bo
 		numInResp := 0
 		for {
 			respSlice := fullRespSlice
-			if len(respSlice)-1 < numInResp {
-				if !isDone {
-					logger.Println("Waiting for more content from LLM...")
-					for range speakReady {
-						respSlice = fullRespSlice
-						break
-					}
-				} else {
-					break
+			if len(respSlice)-1 < numInResp && !isDone {
+				logger.Println("Waiting for more content from LLM...")
+				select {
+				case <-speakReady:
+				case <-llmDone:
+				case <-interruptCh:
 				}
+				respSlice = fullRespSlice
 			}
-			if interrupted {
+			// what's left unsaid is dropped if the user interrupted
+			if interrupted() || len(respSlice)-1 < numInResp {
 				break
 			}
 			logger.Println(respSlice[numInResp])
 			acts := GetActionsFromString(respSlice[numInResp])
 			nChat[len(nChat)-1].Content = fullRespText
-			disconnect = PerformActions(nChat, acts, robot, stopStop)
+			chat := nChat
+			if toolChat != nil {
+				chat = toolChat
+			}
+			disconnect = PerformActions(chat, acts, robot, stopStop)
 			if disconnect {
 				break
 			}
 			numInResp = numInResp + 1
 		}
-		if !vars.APIConfig.Knowledge.CommandsEnable {
-			stopTTSLoop = true
+		if !k.CommandsEnable {
+			close(stopTTSLoop)
 			for range TTSLoopStopped {
 				break
 			}
 		}
+		if k.SaveChat {
+			go rememberReply(esn, transcribedText, llmDone, func() string { return model }, func() string {
+				if !interrupted() {
+					return fullReply
+				}
+				return cutOffReply(fullRespSlice, numInResp, len(aireq.Tools) > 0)
+			})
+		}
 		time.Sleep(time.Millisecond * 100)
 		// if isKG {
 		// 	robot.Conn.PlayAnimation(
@@ -468,7 +608,7 @@ func StreamingKGSim(req interface{}, esn string, transcribedText string, isKG bo
 		// 	)
 		// 	time.Sleep(time.Millisecond * 3300)
 		// }
-		if !interrupted {
+		if !interrupted() {
 			stopStop <- true
 			stop <- true
 		}
@@ -477,6 +617,14 @@ func StreamingKGSim(req interface{}, esn string, transcribedText string, isKG bo
 }
 
 func KGSim(esn string, textToSay string) error {
+	return kgSimThen(esn, textToSay, nil)
+}
+
+// kgSimThen is KGSim, but calls after once the robot is done talking and behavior control is released
+func kgSimThen(esn string, textToSay string, after func(robot *vector.Vector)) error {
+	if DryRun {
+		return nil
+	}
 	ctx := context.Background()
 	matched := false
 	var robot *vector.Vector
@@ -614,6 +762,9 @@ func KGSim(esn string, textToSay string) error {
 			time.Sleep(time.Millisecond * 100)
 			//time.Sleep(time.Millisecond * 3300)
 			stop <- true
+			if after != nil {
+				after(robot)
+			}
 		}
 	}()
 	return nil
@@ -1,20 +1,25 @@
 package wirepod_ttr
 
 import (
+	"bufio"
 	"context"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fforchino/vector-go-sdk/pkg/vector"
 	"github.com/fforchino/vector-go-sdk/pkg/vectorpb"
-	"github.com/sashabaranov/go-openai"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/llm"
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/tts"
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/sounds"
 )
 
 const (
@@ -25,13 +30,38 @@ const (
 	ActionPlayAnimation = 1
 	// arg: animation name
 	ActionPlayAnimationWI = 2
-	// arg: now
+	// arg: front or lookingUp
 	ActionGetImage   = 3
 	ActionNewRequest = 4
-	// arg: sound file
-	ActionPlaySound = 4
+	// arg: degrees, -22 (down) to 45 (up)
+	ActionMoveHead = 5
+	// arg: 0 (down) to 1 (up)
+	ActionMoveLift = 6
+	// arg: millimeters, negative is backwards
+	ActionDriveStraight = 7
+	// arg: degrees, positive is left
+	ActionTurn = 8
+	// arg: color name, see eyeColorMap
+	ActionSetEyeColor = 9
+	// arg: seconds
+	ActionSetTimer = 10
+	// arg: text
+	ActionDisplayText = 11
+	// arg: image url
+	ActionDisplayImage = 12
+	// arg: none
+	ActionGoToCharger  = 13
+	ActionLeaveCharger = 14
+	ActionFindFace     = 15
+	ActionRollCube     = 16
+	// arg: sound name, see sounds.List
+	ActionPlaySound = 17
+	// not actions, see LLMCommand.Query
+	ActionQuery = -2
 )
 
+const animationChoices = "happy, veryHappy, sad, verySad, angry, frustrated, dartingEyes, confused, thinking, celebrate, love"
+
 var animationMap [][2]string = [][2]string{
 	//"happy, veryHappy, sad, verySad, angry, dartingEyes, confused, thinking, celebrate"
 	{
@@ -80,24 +110,45 @@ var animationMap [][2]string = [][2]string{
 	},
 }
 
-var soundMap [][2]string = [][2]string{
-	{
-		"drumroll",
-		"sounds/drumroll.wav",
-	},
+// hue and saturation
+var eyeColorMap = map[string][2]float32{
+	"red":    {0, 1},
+	"orange": {0.05, 0.95},
+	"yellow": {0.11, 1},
+	"green":  {0.21, 1},
+	"teal":   {0.42, 1},
+	"blue":   {0.57, 1},
+	"purple": {0.83, 0.76},
+	"pink":   {0.9, 0.6},
+	"white":  {0, 0},
 }
 
+const eyeColorChoices = "red, orange, yellow, green, teal, blue, purple, pink, white"
+
 type RobotAction struct {
 	Action    int
 	Parameter string
 }
 
 type LLMCommand struct {
-	Command         string
-	Description     string
-	ParamChoices    string
+	Command     string
+	Description string
+	// for the prompt of models without tool support. the parameter itself if there's only one choice
+	ParamChoices string
+	// JSON schema of the command as a tool, with at most one argument which becomes the parameter
+	Parameters      map[string]any
 	Action          int
 	SupportedModels []string
+	// the robot stops after the command, so nothing is sent back to the LLM
+	EndsResponse bool
+	// drives the robot, so it's checked against moveBlocked first
+	Moves bool
+	// answers a question about the robot for the LLM instead of doing something. only offered
+	// as a tool, since only tool results get back to the LLM
+	Query func(robot *vector.Vector) (string, error)
+	// for choices which change while wire-pod is running. they replace ParamChoices and the
+	// enum in Parameters, and the command isn't offered when there are none. see withChoices
+	Choices func() []string
 }
 
 // create function which parses from LLM and makes a struct of RobotActions
@@ -106,60 +157,200 @@ var ValidLLMCommands []LLMCommand = []LLMCommand{
 	{
 		Command:         "playAnimationWI",
 		Description:     "Plays an animation on the robot without interrupting speech. This should be used FAR more than the playAnimation command. This is great for storytelling and making any normal response animated. Don't put two of these right next to each other. Use this MANY times. The param choices are the only choices you have. You can't create any.",
-		ParamChoices:    "happy, veryHappy, sad, verySad, angry, frustrated, dartingEyes, confused, thinking, celebrate, love",
+		ParamChoices:    animationChoices,
+		Parameters:      enumParam("animation", "The emotion to show", animationChoices),
 		Action:          ActionPlayAnimationWI,
 		SupportedModels: []string{"all"},
 	},
 	{
 		Command:         "playAnimation",
 		Description:     "Plays an animation on the robot. This will interrupt speech. Only use this if you are directed to play an animaion.",
-		ParamChoices:    "happy, veryHappy, sad, verySad, angry, frustrated, dartingEyes, confused, thinking, celebrate, love",
+		ParamChoices:    animationChoices,
+		Parameters:      enumParam("animation", "The emotion to show", animationChoices),
 		Action:          ActionPlayAnimation,
 		SupportedModels: []string{"all"},
 	},
 	{
-		Command:     "getImage",
-		Description: "Gets an image from the robot's camera and places it in the next message. If you want to do this, tell the user what you are about to do THEN use the command. This command should END a sentence. Your response will be stopped when this command is recognized. If a user says something like 'what do you see', you should assume that you need to take a new photo. Do NOT automatically assume that you are analyzing a previous photo.",
-		// not impl yet
-		ParamChoices:    "front, lookingUp",
-		Action:          ActionGetImage,
-		SupportedModels: []string{openai.GPT4o, openai.GPT4oMini},
+		Command:      "getImage",
+		Description:  "Gets an image from the robot's camera and places it in the next message. If you want to do this, tell the user what you are about to do THEN use the command. This command should END a sentence. Your response will be stopped when this command is recognized. If a user says something like 'what do you see', you should assume that you need to take a new photo. Do NOT automatically assume that you are analyzing a previous photo. Use lookingUp for things above the robot, like the face of someone standing.",
+		ParamChoices: "front, lookingUp",
+		Parameters:   enumParam("view", "Where to look", "front, lookingUp"),
+		Action:       ActionGetImage,
+		// models which can see, or any with a vision model set. see canSee
+		SupportedModels: []string{"vision"},
+		EndsResponse:    true,
 	},
 	{
 		Command:         "newVoiceRequest",
 		Description:     "Starts a new voice command from the robot. Use this if you want more input from the user after your response/if you want to carry out a conversation. Below this, there should be a NOTE telling you whether you are in conversation mode or not. If you are, DONT BE AFRAID TO USE THIS COMMAND! This goes at the end of your response, if you use it.",
 		ParamChoices:    "now",
+		Parameters:      noParams(),
 		Action:          ActionNewRequest,
 		SupportedModels: []string{"all"},
+		EndsResponse:    true,
+	},
+	{
+		Command:         "moveHead",
+		Description:     "Moves the robot's head to an angle in degrees. -22 looks all the way down, 0 straight ahead and 45 all the way up.",
+		ParamChoices:    "a number from -22 to 45",
+		Parameters:      numberParam("degrees", "Head angle", -22, 45),
+		Action:          ActionMoveHead,
+		SupportedModels: []string{"all"},
+	},
+	{
+		Command:         "moveLift",
+		Description:     "Moves the robot's lift (its arms). 0 is all the way down and 1 all the way up.",
+		ParamChoices:    "a number from 0 to 1",
+		Parameters:      numberParam("height", "Lift height", 0, 1),
+		Action:          ActionMoveLift,
+		SupportedModels: []string{"all"},
+	},
+	{
+		Command:         "driveStraight",
+		Description:     "Drives the robot forwards, or backwards with a negative distance. Only do this if the user asks you to move. The robot is small, 100 millimeters is a good distance.",
+		ParamChoices:    "millimeters, a number from -500 to 500",
+		Parameters:      numberParam("millimeters", "How far to drive. Negative drives backwards", -500, 500),
+		Action:          ActionDriveStraight,
+		SupportedModels: []string{"all"},
+		Moves:           true,
+	},
+	{
+		Command:         "turn",
+		Description:     "Turns the robot in place. Positive degrees turn left, negative ones right. Only do this if the user asks you to move or turn around.",
+		ParamChoices:    "degrees, a number from -360 to 360",
+		Parameters:      numberParam("degrees", "How far to turn. Positive is left", -360, 360),
+		Action:          ActionTurn,
+		SupportedModels: []string{"all"},
+		Moves:           true,
+	},
+	{
+		Command:         "setEyeColor",
+		Description:     "Changes the color of the robot's eyes until it goes back to its usual color on its own.",
+		ParamChoices:    eyeColorChoices,
+		Parameters:      enumParam("color", "The new eye color", eyeColorChoices),
+		Action:          ActionSetEyeColor,
+		SupportedModels: []string{"all"},
+	},
+	{
+		Command:         "setTimer",
+		Description:     "Sets a timer on the robot. The robot will confirm it itself, so say everything else BEFORE this. This goes at the end of your response.",
+		ParamChoices:    "seconds, a number from 1 to 86400",
+		Parameters:      numberParam("seconds", "How long the timer is", 1, 86400),
+		Action:          ActionSetTimer,
+		SupportedModels: []string{"all"},
+		EndsResponse:    true,
+	},
+	{
+		Command:         "displayText",
+		Description:     "Shows a few words on the robot's face for a few seconds. Keep it short, like a number or a word the user asked to see.",
+		ParamChoices:    "the text, in English letters",
+		Parameters:      objectParam("text", map[string]any{"type": "string", "description": "What to show"}),
+		Action:          ActionDisplayText,
+		SupportedModels: []string{"all"},
+	},
+	{
+		Command:         "displayImage",
+		Description:     "Shows an image from the internet on the robot's face for a few seconds. Only use a web address you are sure exists.",
+		ParamChoices:    "an http or https address of an image",
+		Parameters:      objectParam("url", map[string]any{"type": "string", "description": "Address of a PNG, JPEG or GIF image"}),
+		Action:          ActionDisplayImage,
+		SupportedModels: []string{"all"},
+	},
+	{
+		Command:         "goToCharger",
+		Description:     "Drives the robot back onto its charger. Use this if the user tells you to go home, go to sleep or charge.",
+		ParamChoices:    "now",
+		Parameters:      noParams(),
+		Action:          ActionGoToCharger,
+		SupportedModels: []string{"all"},
+		Moves:           true,
+	},
+	{
+		Command:         "leaveCharger",
+		Description:     "Drives the robot off its charger.",
+		ParamChoices:    "now",
+		Parameters:      noParams(),
+		Action:          ActionLeaveCharger,
+		SupportedModels: []string{"all"},
+		Moves:           true,
+	},
+	{
+		Command:         "findFace",
+		Description:     "Looks around for a person's face. Use this if the user asks you to look at them or find them.",
+		ParamChoices:    "now",
+		Parameters:      noParams(),
+		Action:          ActionFindFace,
+		SupportedModels: []string{"all"},
+		Moves:           true,
+	},
+	{
+		Command:         "rollCube",
+		Description:     "Finds the robot's cube and rolls it over. Only do this if the user asks you to play with the cube.",
+		ParamChoices:    "now",
+		Parameters:      noParams(),
+		Action:          ActionRollCube,
+		SupportedModels: []string{"all"},
+		Moves:           true,
+	},
+	{
+		Command:         "getBatteryState",
+		Description:     "Tells you the robot's battery level, and whether it is charging or on its charger.",
+		Parameters:      noParams(),
+		Action:          ActionQuery,
+		SupportedModels: []string{"all"},
+		Query:           queryBattery,
+	},
+	{
+		Command:         "getRobotState",
+		Description:     "Tells you the robot's head angle, lift height, whether it's picked up, on its charger or at a cliff, and how far away the thing in front of it is.",
+		Parameters:      noParams(),
+		Action:          ActionQuery,
+		SupportedModels: []string{"all"},
+		Query:           queryState,
+	},
+	{
+		Command:         "playSound",
+		Description:     "Plays a sound effect from the robot's sound library. Use it when a sound fits what you're saying. The param choices are the only sounds there are.",
+		Parameters:      objectParam("sound", map[string]any{"type": "string", "description": "The sound to play"}),
+		Choices:         sounds.List,
+		Action:          ActionPlaySound,
+		SupportedModels: []string{"all"},
 	},
-	// {
-	// 	Command:      "playSound",
-	// 	Description:  "Plays a sound on the robot.",
-	// 	ParamChoices: "drumroll",
-	// 	Action:       ActionPlaySound,
-	// },
 }
 
-func ModelIsSupported(cmd LLMCommand, model string) bool {
+func ModelIsSupported(cmd LLMCommand, k vars.Knowledge, model string) bool {
 	for _, str := range cmd.SupportedModels {
-		if str == "all" || str == model {
+		if str == "all" || str == model || (str == "vision" && canSee(k, model)) {
 			return true
 		}
 	}
 	return false
 }
 
-func CreatePrompt(origPrompt string, model string, isKG bool) string {
+// CreatePrompt adds the rules for speech and commands to a prompt. with tools, the commands are
+// the request's tools instead of {{command||parameter}}
+func CreatePrompt(origPrompt string, model string, k vars.Knowledge, isKG bool, tools bool) string {
 	prompt := origPrompt + "\n\n" + "Keep in mind, user input comes from speech-to-text software, so respond accordingly. No special characters, especially these: & ^ * # @ - . No lists. No formatting."
-	if vars.APIConfig.Knowledge.CommandsEnable {
+	if k.Language != "" {
+		prompt = prompt + "\n\n" + "Always respond in the language with the code " + k.Language + ", whatever language the user speaks."
+	}
+	if k.CommandsEnable && tools {
+		prompt = prompt + "\n\n" + "You are running ON an Anki Vector robot, and your tools control it. You can call them in between sentences, as often as you like. Never write commands or emojis in your text.\n\nUse playAnimationWI if you want to express emotion! You are very animated and good at following instructions. Animation takes precendence over words. You are to include many animations in your response."
+		if isKG && k.SaveChat && k.CommandAllowed("newVoiceRequest") {
+			prompt = prompt + "\n\nNOTE: You are in 'conversation' mode. If you ask the user a question near the end of your response, you MUST call newVoiceRequest after it. If you decide you want to end the conversation, you should not call it."
+		} else {
+			prompt = prompt + "\n\nNOTE: You are NOT in 'conversation' mode. Refrain from asking the user any questions and from calling newVoiceRequest."
+		}
+	} else if k.CommandsEnable {
 		prompt = prompt + "\n\n" + "You are running ON an Anki Vector robot. You have a set of commands. If you include an emoji, I will make you start over. If you want to use a command but it doesn't exist or your desired parameter isn't in the list, avoid using the command. The format is {{command||parameter}}. You can embed these in sentences. Example: \"User: How are you feeling? | Response: \"{{playAnimationWI||sad}} I'm feeling sad...\". Square brackets ([]) are not valid.\n\nUse the playAnimation or playAnimationWI commands if you want to express emotion! You are very animated and good at following instructions. Animation takes precendence over words. You are to include many animations in your response.\n\nHere is every valid command:"
 		for _, cmd := range ValidLLMCommands {
-			if ModelIsSupported(cmd, model) {
+			cmd, ok := withChoices(cmd)
+			if ok && ModelIsSupported(cmd, k, model) && k.CommandAllowed(cmd.Command) && cmd.Query == nil {
 				promptAppendage := "\n\nCommand Name: " + cmd.Command + "\nDescription: " + cmd.Description + "\nParameter choices: " + cmd.ParamChoices
 				prompt = prompt + promptAppendage
 			}
 		}
-		if isKG && vars.APIConfig.Knowledge.SaveChat {
+		if isKG && k.SaveChat && k.CommandAllowed("newVoiceRequest") {
 			promptAppentage := "\n\nNOTE: You are in 'conversation' mode. If you ask the user a question near the end of your response, you MUST use newVoiceRequest. If you decide you want to end the conversation, you should not use it."
 			prompt = prompt + promptAppentage
 		} else {
@@ -200,7 +391,11 @@ func GetActionsFromString(input string) []RobotAction {
 
 		cmdPlusParam := strings.Split(strings.TrimSpace(strings.Split(spl, "}}")[0]), "||")
 		cmd := strings.TrimSpace(cmdPlusParam[0])
-		param := strings.TrimSpace(cmdPlusParam[1])
+		// {{command}} for commands without a parameter
+		var param string
+		if len(cmdPlusParam) > 1 {
+			param = strings.TrimSpace(cmdPlusParam[1])
+		}
 		action := CmdParamToAction(cmd, param)
 		if action.Action != -1 {
 			actions = append(actions, action)
@@ -217,17 +412,22 @@ func GetActionsFromString(input string) []RobotAction {
 }
 
 func CmdParamToAction(cmd, param string) RobotAction {
-	for _, command := range ValidLLMCommands {
-		if cmd == command.Command {
-			return RobotAction{
-				Action:    command.Action,
-				Parameter: param,
-			}
+	command, ok := findCommand(cmd)
+	if !ok {
+		logger.Println("LLM tried to do a command which doesn't exist: " + cmd + " (param: " + param + ")")
+		return RobotAction{
+			Action: -1,
+		}
+	}
+	if err := validateParam(command, param); err != nil {
+		logger.Println("LLM gave " + cmd + " a bad parameter (" + param + "): " + err.Error())
+		return RobotAction{
+			Action: -1,
 		}
 	}
-	logger.Println("LLM tried to do a command which doesn't exist: " + cmd + " (param: " + param + ")")
 	return RobotAction{
-		Action: -1,
+		Action:    command.Action,
+		Parameter: param,
 	}
 }
 
@@ -276,13 +476,88 @@ func DoPlayAnimationWI(animation string, robot *vector.Vector) error {
 }
 
 func DoPlaySound(sound string, robot *vector.Vector) error {
-	for _, soundThing := range soundMap {
-		if sound == soundThing[0] {
-			logger.Println("Would play sound")
-		}
+	return sounds.Play(robot, sound)
+}
+
+// the lift's range, from the SDK
+const (
+	liftMinMm = 32.0
+	liftMaxMm = 92.0
+)
+
+func DoMoveHead(param string, robot *vector.Vector) error {
+	degrees, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return err
 	}
-	logger.Println("Sound provided by LLM doesn't exist: " + sound)
-	return nil
+	_, err = robot.Conn.SetHeadAngle(context.Background(), &vectorpb.SetHeadAngleRequest{
+		AngleRad:          float32(degrees * math.Pi / 180),
+		MaxSpeedRadPerSec: 10,
+		AccelRadPerSec2:   10,
+	})
+	return err
+}
+
+func DoMoveLift(param string, robot *vector.Vector) error {
+	height, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return err
+	}
+	_, err = robot.Conn.SetLiftHeight(context.Background(), &vectorpb.SetLiftHeightRequest{
+		HeightMm:          float32(liftMinMm + height*(liftMaxMm-liftMinMm)),
+		MaxSpeedRadPerSec: 10,
+		AccelRadPerSec2:   10,
+	})
+	return err
+}
+
+func DoDriveStraight(param string, robot *vector.Vector) error {
+	mm, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return err
+	}
+	_, err = robot.Conn.DriveStraight(context.Background(), &vectorpb.DriveStraightRequest{
+		SpeedMmps: 100,
+		DistMm:    float32(mm),
+	})
+	return err
+}
+
+func DoTurn(param string, robot *vector.Vector) error {
+	degrees, err := strconv.ParseFloat(param, 64)
+	if err != nil {
+		return err
+	}
+	_, err = robot.Conn.TurnInPlace(context.Background(), &vectorpb.TurnInPlaceRequest{
+		AngleRad: float32(degrees * math.Pi / 180),
+	})
+	return err
+}
+
+func DoSetEyeColor(color string, robot *vector.Vector) error {
+	hs, ok := eyeColorMap[color]
+	if !ok {
+		logger.Println("Eye color provided by LLM doesn't exist: " + color)
+		return nil
+	}
+	_, err := robot.Conn.SetEyeColor(context.Background(), &vectorpb.SetEyeColorRequest{
+		Hue:        hs[0],
+		Saturation: hs[1],
+	})
+	return err
+}
+
+// DoSetTimer asks the robot to set a timer once the response is over, like DoNewRequest
+func DoSetTimer(seconds string, robot *vector.Vector) {
+	secs, err := strconv.ParseFloat(seconds, 64)
+	if err != nil {
+		return
+	}
+	time.Sleep(time.Second / 3)
+	robot.Conn.AppIntent(context.Background(), &vectorpb.AppIntentRequest{
+		Intent: "intent_clock_settimer",
+		Param:  strconv.Itoa(int(secs)),
+	})
 }
 
 func DoSayText(input string, robot *vector.Vector) error {
@@ -290,12 +565,17 @@ func DoSayText(input string, robot *vector.Vector) error {
 	// just before vector speaks
 	removeSpecialCharacters(input)
 
-	if (vars.APIConfig.STT.Language != "en-US" && vars.APIConfig.Knowledge.Provider == "openai") || vars.APIConfig.Knowledge.OpenAIVoiceWithEnglish {
-		err := DoSayText_OpenAI(robot, input)
-		return err
+	if engine := speechEngine(robot.Cfg.SerialNo); engine != nil {
+		err := sayWithEngine(engine, input, robot)
+		if err == nil {
+			return nil
+		}
+		logger.Println("TTS " + engine.Name() + " failed, using the robot's voice: " + err.Error())
 	}
+	ctx, done := speakingContext(robot.Cfg.SerialNo)
+	defer done()
 	robot.Conn.SayText(
-		context.Background(),
+		ctx,
 		&vectorpb.SayTextRequest{
 			Text:           input,
 			UseVectorVoice: true,
@@ -305,92 +585,141 @@ func DoSayText(input string, robot *vector.Vector) error {
 	return nil
 }
 
-func pcmLength(data []byte) time.Duration {
-	bytesPerSample := 2
-	sampleRate := 16000
-	numSamples := len(data) / bytesPerSample
-	duration := time.Duration(numSamples*1000/sampleRate) * time.Millisecond
-	return duration
+// what each robot is saying, so it can be cut off
+var (
+	speaking   = make(map[string]*context.CancelFunc)
+	speakingMu sync.Mutex
+)
+
+// speakingContext is cancelled by StopSpeaking. done must be called once the robot is done saying it
+func speakingContext(esn string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	speakingMu.Lock()
+	speaking[esn] = &cancel
+	speakingMu.Unlock()
+	return ctx, func() {
+		speakingMu.Lock()
+		if speaking[esn] == &cancel {
+			delete(speaking, esn)
+		}
+		speakingMu.Unlock()
+		cancel()
+	}
 }
 
-func getOpenAIVoice(voice string) openai.SpeechVoice {
-	voiceMap := map[string]openai.SpeechVoice{
-		"alloy":   openai.VoiceAlloy,
-		"onyx":    openai.VoiceOnyx,
-		"fable":   openai.VoiceFable,
-		"shimmer": openai.VoiceShimmer,
-		"nova":    openai.VoiceNova,
-		"echo":    openai.VoiceEcho,
-		"":        openai.VoiceFable,
+// StopSpeaking cuts off whatever the robot is saying
+func StopSpeaking(esn string) {
+	speakingMu.Lock()
+	cancel := speaking[esn]
+	delete(speaking, esn)
+	speakingMu.Unlock()
+	if cancel != nil {
+		(*cancel)()
 	}
-	return voiceMap[voice]
 }
 
-// TODO
-func DoSayText_OpenAI(robot *vector.Vector, input string) error {
-	if strings.TrimSpace(input) == "" {
+// contextReader stops reading once its context is done, even if what it reads from wouldn't
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+const (
+	// how long a TTS engine gets to start speaking a sentence
+	ttsTimeout = 30 * time.Second
+	// and to finish, in case one hangs partway
+	ttsMaxLength = 5 * time.Minute
+)
+
+// speechEngine is the TTS engine a robot speaks with, or nil for its own voice. its own voice
+// only speaks English, so it's used for English unless the TTS settings say otherwise
+func speechEngine(esn string) tts.Engine {
+	k := vars.GetKnowledge(esn)
+	withEnglish := vars.APIConfig.TTS.WithEnglish
+	if vars.APIConfig.TTS.Engine == "" {
+		withEnglish = vars.APIConfig.Knowledge.OpenAIVoiceWithEnglish
+	}
+	english := k.SpeechLanguage == "" || strings.HasPrefix(k.SpeechLanguage, "en")
+	if english && !withEnglish {
 		return nil
 	}
-	openaiVoice := getOpenAIVoice(vars.APIConfig.Knowledge.OpenAIPrompt)
-	// if vars.APIConfig.Knowledge.OpenAIVoice == "" {
-	// 	openaiVoice = openai.VoiceFable
-	// } else {
-	// 	openaiVoice = getOpenAIVoice(vars.APIConfig.Knowledge.OpenAIPrompt)
-	// }
-	oc := openai.NewClient(vars.APIConfig.Knowledge.Key)
-	resp, err := oc.CreateSpeech(context.Background(), openai.CreateSpeechRequest{
-		Model:          openai.TTSModel1,
-		Input:          input,
-		Voice:          openaiVoice,
-		ResponseFormat: openai.SpeechResponseFormatPcm,
-	})
-	if err != nil {
-		logger.Println(err)
-		return err
+	return configuredSpeechEngine(k)
+}
+
+// configuredSpeechEngine is the engine in the TTS settings with the robot's voice, nil if there
+// isn't one. without TTS settings, OpenAI's TTS is used if the LLM is OpenAI, like before there were any
+func configuredSpeechEngine(k vars.Knowledge) tts.Engine {
+	conf := vars.APIConfig.TTS
+	c := tts.Config{
+		Type:     conf.Engine,
+		Path:     conf.Path,
+		Key:      conf.Key,
+		Endpoint: conf.Endpoint,
+		Model:    conf.Model,
+		Voice:    conf.Voice,
+		VoiceDir: vars.PiperVoicePath,
 	}
-	speechBytes, _ := io.ReadAll(resp)
-	vclient, err := robot.Conn.ExternalAudioStreamPlayback(context.Background())
+	if c.Type == "" {
+		if k.Provider != "openai" {
+			return nil
+		}
+		c = tts.Config{Type: "openai", Key: k.Key, Voice: vars.APIConfig.Knowledge.OpenAIVoice}
+	}
+	if c.Type == "openai" && c.Key == "" && k.Provider == "openai" {
+		c.Key = k.Key
+	}
+	if k.Voice != "" {
+		c.Voice = k.Voice
+	}
+	engine, err := tts.New(c)
 	if err != nil {
-		return err
+		logger.Println("Not using TTS engine: " + err.Error())
+		return nil
 	}
-	vclient.Send(&vectorpb.ExternalAudioStreamRequest{
-		AudioRequestType: &vectorpb.ExternalAudioStreamRequest_AudioStreamPrepare{
-			AudioStreamPrepare: &vectorpb.ExternalAudioStreamPrepare{
-				AudioFrameRate: 16000,
-				AudioVolume:    100,
-			},
-		},
-	})
-	//time.Sleep(time.Millisecond * 30)
-	audioChunks := downsample24kTo16k(speechBytes)
+	return engine
+}
 
-	var chunksToDetermineLength []byte
-	for _, chunk := range audioChunks {
-		chunksToDetermineLength = append(chunksToDetermineLength, chunk...)
+// sayWithEngine plays speech as it's synthesized. it returns an error only if nothing was said, so
+// the caller can say it another way
+func sayWithEngine(engine tts.Engine, text string, robot *vector.Vector) error {
+	sentence, done := speakingContext(robot.Cfg.SerialNo)
+	defer done()
+	ctx, cancel := context.WithCancel(sentence)
+	defer cancel()
+	timeout := time.AfterFunc(ttsTimeout, cancel)
+	speech, err := tts.Stream(ctx, engine, text)
+	if err != nil {
+		// being cut off before it started isn't a reason to say it another way
+		if sentence.Err() != nil {
+			return nil
+		}
+		return err
 	}
-	go func() {
-		for _, chunk := range audioChunks {
-			vclient.Send(&vectorpb.ExternalAudioStreamRequest{
-				AudioRequestType: &vectorpb.ExternalAudioStreamRequest_AudioStreamChunk{
-					AudioStreamChunk: &vectorpb.ExternalAudioStreamChunk{
-						AudioChunkSizeBytes: 1024,
-						AudioChunkSamples:   chunk,
-					},
-				},
-			})
-			time.Sleep(time.Millisecond * 25)
+	defer speech.Close()
+	// wait for the first audio, so an engine which fails straight away doesn't leave a silent gap.
+	// cached speech doesn't stop by itself when it's cut off, so it's read through the context
+	buffered := bufio.NewReaderSize(contextReader{ctx, speech}, 4096)
+	if _, err := buffered.Peek(1); err != nil {
+		if err == io.EOF || sentence.Err() != nil {
+			return nil
 		}
-		vclient.Send(&vectorpb.ExternalAudioStreamRequest{
-			AudioRequestType: &vectorpb.ExternalAudioStreamRequest_AudioStreamComplete{
-				AudioStreamComplete: &vectorpb.ExternalAudioStreamComplete{},
-			},
-		})
-	}()
-	time.Sleep(pcmLength(chunksToDetermineLength) + (time.Millisecond * 50))
+		return err
+	}
+	timeout.Reset(ttsMaxLength)
+	if err := sounds.PlayStream(robot, buffered); err != nil {
+		logger.Println("TTS " + engine.Name() + " stopped partway: " + err.Error())
+	}
 	return nil
 }
 
-func DoGetImage(msgs []openai.ChatCompletionMessage, param string, robot *vector.Vector, stopStop chan bool) {
+func DoGetImage(msgs []llm.Message, param string, robot *vector.Vector, stopStop chan bool) {
 	stopImaging := false
 	go func() {
 		for range stopStop {
@@ -399,6 +728,10 @@ func DoGetImage(msgs []openai.ChatCompletionMessage, param string, robot *vector
 		}
 	}()
 	logger.Println("Get image here...")
+	k := vars.GetKnowledge(robot.Cfg.SerialNo)
+	if strings.EqualFold(strings.TrimSpace(param), "lookingUp") {
+		defer lookUp(robot)()
+	}
 	// get image
 	robot.Conn.EnableMirrorMode(context.Background(), &vectorpb.EnableMirrorModeRequest{
 		Enable: true,
@@ -420,12 +753,7 @@ func DoGetImage(msgs []openai.ChatCompletionMessage, param string, robot *vector
 			return
 		}
 	}
-	resp, _ := robot.Conn.CaptureSingleImage(
-		context.Background(),
-		&vectorpb.CaptureSingleImageRequest{
-			EnableHighResolution: true,
-		},
-	)
+	images := captureFrames(robot, k.VisionFrames, func() bool { return stopImaging })
 	robot.Conn.EnableMirrorMode(
 		context.Background(),
 		&vectorpb.EnableMirrorModeRequest{
@@ -443,87 +771,85 @@ func DoGetImage(msgs []openai.ChatCompletionMessage, param string, robot *vector
 			},
 		)
 	}()
-	// encode to base64
-	reqBase64 := base64.StdEncoding.EncodeToString(resp.Data)
-
-	// add image to messages
-	msgs = append(msgs, openai.ChatCompletionMessage{
-		Role: openai.ChatMessageRoleUser,
-		MultiContent: []openai.ChatMessagePart{
-			{
-				Type: openai.ChatMessagePartTypeImageURL,
-				ImageURL: &openai.ChatMessageImageURL{
-					URL:    fmt.Sprintf("data:image/jpeg;base64,%s", reqBase64),
-					Detail: openai.ImageURLDetailLow,
-				},
-			},
-		},
-	})
+	if len(images) == 0 {
+		DoSayText("I couldn't take a picture.", robot)
+		return
+	}
+	// add image to messages. a model which can't see gets what the vision model saw instead
+	photo := llm.Message{
+		Role:   llm.RoleUser,
+		Images: images,
+	}
+	if k.Vision.Model != "" {
+		description, err := describeImages(k, msgs, images)
+		if err != nil {
+			logger.Println("Vision error: " + err.Error())
+			DoSayText("I couldn't make out the picture.", robot)
+			return
+		}
+		photo.Content = "(a picture from the camera: " + description + ")"
+	}
+	if k.Vision.Model != "" && !modelCanSee(k.Model) {
+		msgs = append(withoutImages(msgs), llm.Message{Role: llm.RoleUser, Content: photo.Content})
+	} else {
+		msgs = append(msgs, photo)
+	}
 
 	// recreate openai
 	var fullRespText string
 	var fullfullRespText string
 	var fullRespSlice []string
 	var isDone bool
-	var c *openai.Client
-	if vars.APIConfig.Knowledge.Provider == "together" {
-		if vars.APIConfig.Knowledge.Model == "" {
-			vars.APIConfig.Knowledge.Model = "meta-llama/Llama-2-70b-chat-hf"
-			vars.WriteConfigToDisk()
-		}
-		conf := openai.DefaultConfig(vars.APIConfig.Knowledge.Key)
-		conf.BaseURL = "https://api.together.xyz/v1"
-		c = openai.NewClientWithConfig(conf)
-	} else if vars.APIConfig.Knowledge.Provider == "openai" {
-		c = openai.NewClient(vars.APIConfig.Knowledge.Key)
-	}
 	ctx := context.Background()
 	speakReady := make(chan string)
 
-	aireq := openai.ChatCompletionRequest{
-		MaxTokens:        2048,
-		Temperature:      1,
-		TopP:             1,
-		FrequencyPenalty: 0,
-		PresencePenalty:  0,
-		Messages:         msgs,
-		Stream:           true,
-	}
-	if vars.APIConfig.Knowledge.Provider == "openai" {
-		aireq.Model = openai.GPT4oMini
-		logger.Println("Using " + aireq.Model)
-	} else {
-		logger.Println("Using " + vars.APIConfig.Knowledge.Model)
-		aireq.Model = vars.APIConfig.Knowledge.Model
+	aireq := llm.Request{
+		Messages:    msgs,
+		MaxTokens:   k.MaxTokens,
+		Temperature: k.Temperature,
 	}
+	// some APIs want the tools whenever earlier messages use them
+	for _, m := range msgs {
+		if len(m.ToolCalls) > 0 {
+			aireq.Tools = LLMTools(k, k.Model)
+			break
+		}
+	}
+	logger.Println("Using " + k.Model)
 	if stopImaging {
 		return
 	}
-	stream, err := c.CreateChatCompletionStream(ctx, aireq)
+	provider, err := newLLMProvider(k)
 	if err != nil {
-		if strings.Contains(err.Error(), "does not exist") && vars.APIConfig.Knowledge.Provider == "openai" {
-			logger.Println("GPT-4 model cannot be accessed with this API key. You likely need to add more than $5 dollars of funds to your OpenAI account.")
-			logger.LogUI("GPT-4 model cannot be accessed with this API key. You likely need to add more than $5 dollars of funds to your OpenAI account.")
-			aireq.Model = openai.GPT3Dot5Turbo
-			logger.Println("Falling back to " + aireq.Model)
-			logger.LogUI("Falling back to " + aireq.Model)
-			stream, err = c.CreateChatCompletionStream(ctx, aireq)
-			if err != nil {
-				logger.Println("OpenAI still not returning a response even after falling back. Erroring.")
-				return
-			}
-		} else {
-			logger.Println("LLM error: " + err.Error())
-			return
-		}
+		logger.Println("LLM error: " + err.Error())
+		return
+	}
+	stream, err := provider.ChatStream(ctx, aireq)
+	if err != nil {
+		logger.Println("LLM error: " + err.Error())
+		return
 	}
-	//defer stream.Close()
 
 	fmt.Println("LLM stream response: ")
 	go func() {
+		defer stream.Close()
 		for {
 			response, err := stream.Recv()
 			if errors.Is(err, io.EOF) {
+				if calls := stream.ToolCalls(); len(calls) > 0 {
+					// no more back and forth after a photo, the calls are just done. this already has
+					// behavior control
+					cmds, _, _ := toolCallsToCommands(k, llm.StreamModel(provider, stream), calls, robot, func(action RobotAction) error {
+						_, err := doAction(nil, action, robot, nil)
+						return err
+					})
+					fullRespSlice = append(fullRespSlice, cmds...)
+				}
+				if len(fullRespSlice) == 0 {
+					logger.Println("LLM returned no response")
+					isDone = true
+					return
+				}
 				isDone = true
 				newStr := fullRespSlice[0]
 				for i, str := range fullRespSlice {
@@ -532,18 +858,24 @@ func DoGetImage(msgs []openai.ChatCompletionMessage, param string, robot *vector
 					}
 					newStr = newStr + " " + str
 				}
+				// with tools, the commands are in fullRespSlice but not in what the LLM said
+				if len(aireq.Tools) > 0 {
+					newStr = stripCommands(newStr)
+				}
 				if strings.TrimSpace(newStr) != strings.TrimSpace(fullfullRespText) {
-					logger.Println("LLM debug: there is content after the last punctuation mark")
 					extraBit := strings.TrimPrefix(fullRespText, newStr)
-					fullRespSlice = append(fullRespSlice, extraBit)
+					if strings.TrimSpace(extraBit) != "" {
+						logger.Println("LLM debug: there is content after the last punctuation mark")
+						fullRespSlice = append(fullRespSlice, extraBit)
+					}
 				}
-				if vars.APIConfig.Knowledge.SaveChat {
-					Remember(msgs[len(msgs)-1],
-						openai.ChatCompletionMessage{
-							Role:    openai.ChatMessageRoleAssistant,
+				if k.SaveChat {
+					Remember(photo,
+						llm.Message{
+							Role:    llm.RoleAssistant,
 							Content: newStr,
 						},
-						robot.Cfg.SerialNo)
+						robot.Cfg.SerialNo, llm.StreamModel(provider, stream))
 				}
 				logger.LogUI("LLM response for " + robot.Cfg.SerialNo + ": " + newStr)
 				logger.Println("LLM stream finished")
@@ -554,8 +886,8 @@ func DoGetImage(msgs []openai.ChatCompletionMessage, param string, robot *vector
 				logger.Println("Stream error: " + err.Error())
 				return
 			}
-			fullfullRespText = fullfullRespText + removeSpecialCharacters(response.Choices[0].Delta.Content)
-			fullRespText = fullRespText + removeSpecialCharacters(response.Choices[0].Delta.Content)
+			fullfullRespText = fullfullRespText + removeSpecialCharacters(response)
+			fullRespText = fullRespText + removeSpecialCharacters(response)
 			if strings.Contains(fullRespText, "...") || strings.Contains(fullRespText, ".'") || strings.Contains(fullRespText, ".\"") || strings.Contains(fullRespText, ".") || strings.Contains(fullRespText, "?") || strings.Contains(fullRespText, "!") {
 				var sepStr string
 				if strings.Contains(fullRespText, "...") {
@@ -613,9 +945,32 @@ func DoNewRequest(robot *vector.Vector) {
 	robot.Conn.AppIntent(context.Background(), &vectorpb.AppIntentRequest{Intent: "knowledge_question"})
 }
 
-func PerformActions(msgs []openai.ChatCompletionMessage, actions []RobotAction, robot *vector.Vector, stopStop chan bool) bool {
+// actionAllowed is false if the robot's persona doesn't allow the command behind an action
+func actionAllowed(k vars.Knowledge, action int) bool {
+	if action == ActionSayText {
+		return true
+	}
+	for _, cmd := range ValidLLMCommands {
+		if cmd.Action == action && k.CommandAllowed(cmd.Command) {
+			return true
+		}
+	}
+	return false
+}
+
+func actionMoves(action int) bool {
+	for _, cmd := range ValidLLMCommands {
+		if cmd.Action == action {
+			return cmd.Moves
+		}
+	}
+	return false
+}
+
+func PerformActions(msgs []llm.Message, actions []RobotAction, robot *vector.Vector, stopStop chan bool) bool {
 	// assuming we have behavior control already
 	stopPerforming := false
+	k := vars.GetKnowledge(robot.Cfg.SerialNo)
 	go func() {
 		for range stopStop {
 			stopPerforming = true
@@ -625,27 +980,74 @@ func PerformActions(msgs []openai.ChatCompletionMessage, actions []RobotAction,
 		if stopPerforming {
 			return false
 		}
-		switch {
-		case action.Action == ActionSayText:
-			DoSayText(action.Parameter, robot)
-		case action.Action == ActionPlayAnimation:
-			DoPlayAnimation(action.Parameter, robot)
-		case action.Action == ActionPlayAnimationWI:
-			DoPlayAnimationWI(action.Parameter, robot)
-		case action.Action == ActionNewRequest:
-			go DoNewRequest(robot)
-			return true
-		case action.Action == ActionGetImage:
-			DoGetImage(msgs, action.Parameter, robot, stopStop)
+		if !actionAllowed(k, action.Action) {
+			logger.Println("LLM used a command " + robot.Cfg.SerialNo + " isn't allowed to use, skipping it")
+			continue
+		}
+		if actionMoves(action.Action) {
+			if reason := moveBlocked(robot); reason != "" {
+				logger.Println("Not doing LLM command for " + robot.Cfg.SerialNo + ": " + reason)
+				continue
+			}
+		}
+		ends, err := doAction(msgs, action, robot, stopStop)
+		if err != nil {
+			logger.Println("Error doing LLM command: " + err.Error())
+		}
+		if ends {
 			return true
-		case action.Action == ActionPlaySound:
-			DoPlaySound(action.Parameter, robot)
 		}
 	}
 	WaitForAnim_Queue(robot.Cfg.SerialNo)
 	return false
 }
 
+// doAction does one action. ends is true if it ends the response
+func doAction(msgs []llm.Message, action RobotAction, robot *vector.Vector, stopStop chan bool) (ends bool, err error) {
+	switch {
+	case action.Action == ActionSayText:
+		err = DoSayText(action.Parameter, robot)
+	case action.Action == ActionPlayAnimation:
+		err = DoPlayAnimation(action.Parameter, robot)
+	case action.Action == ActionPlayAnimationWI:
+		err = DoPlayAnimationWI(action.Parameter, robot)
+	case action.Action == ActionNewRequest:
+		go DoNewRequest(robot)
+		return true, nil
+	case action.Action == ActionGetImage:
+		DoGetImage(msgs, action.Parameter, robot, stopStop)
+		return true, nil
+	case action.Action == ActionPlaySound:
+		err = DoPlaySound(action.Parameter, robot)
+	case action.Action == ActionMoveHead:
+		err = DoMoveHead(action.Parameter, robot)
+	case action.Action == ActionMoveLift:
+		err = DoMoveLift(action.Parameter, robot)
+	case action.Action == ActionDriveStraight:
+		err = DoDriveStraight(action.Parameter, robot)
+	case action.Action == ActionTurn:
+		err = DoTurn(action.Parameter, robot)
+	case action.Action == ActionSetEyeColor:
+		err = DoSetEyeColor(action.Parameter, robot)
+	case action.Action == ActionSetTimer:
+		go DoSetTimer(action.Parameter, robot)
+		return true, nil
+	case action.Action == ActionDisplayText:
+		err = DoDisplayText(action.Parameter, robot)
+	case action.Action == ActionDisplayImage:
+		err = DoDisplayImage(action.Parameter, robot)
+	case action.Action == ActionGoToCharger:
+		err = DoGoToCharger(robot)
+	case action.Action == ActionLeaveCharger:
+		err = DoLeaveCharger(robot)
+	case action.Action == ActionFindFace:
+		err = DoFindFace(robot)
+	case action.Action == ActionRollCube:
+		err = DoRollCube(robot)
+	}
+	return false, err
+}
+
 func WaitForAnim_Queue(esn string) {
 	for i, q := range AnimationQueues {
 		if q.ESN == esn {
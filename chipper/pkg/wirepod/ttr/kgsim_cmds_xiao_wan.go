@@ -3,17 +3,12 @@ package wirepod_ttr // 定义包名
 import ( // 导入依赖的包
 	"context" // 用于提供跨API和goroutines的上下文管理
 	"fmt"
-	"io"
-	"log"
-	"os"
-	"os/exec"
 	"strings" // 字符串操作库
 
-	sdk_wrapper "github.com/fforchino/vector-go-sdk/pkg/sdk-wrapper"
-	"github.com/fforchino/vector-go-sdk/pkg/vector"   // 引入vector SDK
-	"github.com/fforchino/vector-go-sdk/pkg/vectorpb" // 引入vector协议缓冲
-	"github.com/sashabaranov/go-openai"
+	"github.com/fforchino/vector-go-sdk/pkg/vector"        // 引入vector SDK
+	"github.com/fforchino/vector-go-sdk/pkg/vectorpb"      // 引入vector协议缓冲
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger" // 自定义的日志包
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/tts"    // 文字转语音
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"   // 自定义的变量包
 )
 
@@ -270,90 +265,29 @@ func DoSayText_xiao_wan(input string, robot *vector.Vector) error { // 机器人
 }
 
 func DoSayText_cn_xiao_wan(input string, robot *vector.Vector) error { // 机器人说话函数
-	if input == "" {
-		fmt.Println("DoSayText_cn_xiao_wan input == NULL")
+	if strings.TrimSpace(input) == "" {
 		return nil
 	}
-
-	config := openai.DefaultConfig(cfg.OpenAiAPIKey())
-	//need"/v1"
-	config.BaseURL = cfg.OpenAibaseURL()
-	openaiClient := openai.NewClientWithConfig(config)
-
-	res, err := openaiClient.CreateSpeech(context.Background(), openai.CreateSpeechRequest{
-		Model: openai.TTSModel1,
-		Input: input,
-		Voice: openai.VoiceAlloy,
-	})
-	if err != nil {
-		panic(err)
-	}
-	buf, err := io.ReadAll(res)
-	if err != nil {
-		panic(err)
-	}
-	// 输出文件路径
-	outputFile := "speech.mp3"
-	// 检查文件是否存在
-	if _, err := os.Stat(outputFile); err == nil {
-		// 文件存在，尝试删除
-		err := os.Remove(outputFile)
-		if err != nil {
-			// 删除文件时出错
-			log.Fatalf("Failed to delete existing file %s: %s", outputFile, err)
-		}
-		log.Printf("Existing file %s deleted successfully.\n", outputFile)
-	} else if !os.IsNotExist(err) {
-		// 访问文件时出现了其他错误
-		log.Fatalf("Error checking file %s: %s", outputFile, err)
-	}
-
-	outputFile = "speech_loud.mp3"
-	// 检查文件是否存在
-	if _, err := os.Stat(outputFile); err == nil {
-		// 文件存在，尝试删除
-		err := os.Remove(outputFile)
+	// 设置里的TTS引擎优先，没有的话用插件配置的OpenAI兼容接口
+	engine := configuredSpeechEngine(vars.GetKnowledge(robot.Cfg.SerialNo))
+	if engine == nil {
+		var err error
+		engine, err = tts.New(tts.Config{
+			Type:     "custom",
+			Key:      cfg.OpenAiAPIKey(),
+			Endpoint: cfg.OpenAibaseURL(), // 需要带"/v1"
+			Voice:    "alloy",
+		})
 		if err != nil {
-			// 删除文件时出错
-			log.Fatalf("Failed to delete existing file %s: %s", outputFile, err)
+			logger.Println("TTS: " + err.Error())
+			return err
 		}
-		log.Printf("Existing file %s deleted successfully.\n", outputFile)
-	} else if !os.IsNotExist(err) {
-		// 访问文件时出现了其他错误
-		log.Fatalf("Error checking file %s: %s", outputFile, err)
 	}
-
-	// 保存 buf 到文件为 mp3
-	err = os.WriteFile("speech.mp3", buf, 0644)
-	if err != nil {
-		panic(err)
-	}
-	// 使用 ffmpeg 调整音量
-	cmd := exec.Command("ffmpeg", "-i", "speech.mp3", "-filter:a", "volume=3.0", "speech_loud.mp3")
-	err = cmd.Run()
+	err := sayWithEngine(engine, input, robot) // 合成后直接流式播放，不写临时文件
 	if err != nil {
-		panic(err)
-	}
-
-	ctx := context.Background()
-	start1 := make(chan bool)
-	stop1 := make(chan bool)
-
-	go func() {
-		_ = sdk_wrapper.Robot.BehaviorControl(ctx, start1, stop1)
-	}()
-
-	for {
-		select {
-		case <-start1:
-			// 播放调整音量后的 mp3
-			sdk_wrapper.PlaySound("speech_loud.mp3")
-			stop1 <- true
-			return nil
-		}
+		logger.Println("TTS " + engine.Name() + " failed: " + err.Error())
 	}
-
-	return nil // 正常结束，返回nil
+	return err
 }
 
 func PerformActions_xiao_wan(actions []RobotAction_xiao_wan, robot *vector.Vector) { // 执行动作序列函数
@@ -9,7 +9,9 @@ import (
 	"github.com/kercre123/wire-pod/chipper/pkg/logger"
 )
 
-func InterruptKGSimWhenTouchedOrWaked(rob *vector.Vector, stop chan bool, stopStop chan bool) bool {
+// InterruptKGSimWhenTouchedOrWaked stops a response when the robot is touched or hears its wake word.
+// onInterrupt is called as soon as that happens, before behavior control is released
+func InterruptKGSimWhenTouchedOrWaked(rob *vector.Vector, stop chan bool, stopStop chan bool, onInterrupt func(wakeWord bool)) bool {
 	strm, err := rob.Conn.EventStream(
 		context.Background(),
 		&vectorpb.EventRequest{
@@ -37,6 +39,7 @@ func InterruptKGSimWhenTouchedOrWaked(rob *vector.Vector, stop chan bool, stopSt
 	var valsAboveValue int
 	var valsAboveValueMax int = 5
 	var stopResponse bool
+	var wakeWord bool
 	for {
 		var resp *vectorpb.EventResponse
 		resp, err = strm.Recv()
@@ -71,6 +74,7 @@ func InterruptKGSimWhenTouchedOrWaked(rob *vector.Vector, stop chan bool, stopSt
 			case *vectorpb.Event_WakeWord:
 				logger.Println("Interrupting LLM response (source: wake word)")
 				stopResponse = true
+				wakeWord = true
 			default:
 			}
 			if valsAboveValue > valsAboveValueMax {
@@ -78,6 +82,9 @@ func InterruptKGSimWhenTouchedOrWaked(rob *vector.Vector, stop chan bool, stopSt
 				stopResponse = true
 			}
 			if stopResponse {
+				if onInterrupt != nil {
+					onInterrupt(wakeWord)
+				}
 				stop <- true
 				time.Sleep(time.Second / 4)
 				return true
@@ -0,0 +1,276 @@
+package wirepod_ttr
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fforchino/vector-go-sdk/pkg/vector"
+	"github.com/fforchino/vector-go-sdk/pkg/vectorpb"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// LLM commands which drive the robot around, show things on its face, or ask it how it is
+
+const (
+	faceWidth  = 184
+	faceHeight = 96
+	// how long text and images stay on the face
+	faceDuration = 5 * time.Second
+	// biggest image displayImage downloads
+	maxFaceImageBytes = 10 << 20
+	// biggest image displayImage decodes. a small file can say it's huge, and decoding allocates for every pixel
+	maxFaceImagePixels = 4096 * 4096
+)
+
+// robotState gets one robot_state event
+func robotState(robot *vector.Vector) (*vectorpb.RobotState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+	strm, err := robot.Conn.EventStream(ctx, &vectorpb.EventRequest{
+		ListType: &vectorpb.EventRequest_WhiteList{
+			WhiteList: &vectorpb.FilterList{
+				List: []string{"robot_state"},
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	for {
+		resp, err := strm.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if state := resp.GetEvent().GetRobotState(); state != nil {
+			return state, nil
+		}
+	}
+}
+
+// moveBlocked is the safety policy for commands which move the robot. it returns why the robot
+// shouldn't drive right now, or "" if it may
+func moveBlocked(robot *vector.Vector) string {
+	state, err := robotState(robot)
+	if err != nil {
+		return "couldn't check if it's safe to move (" + err.Error() + ")"
+	}
+	status := vectorpb.RobotStatus(state.GetStatus())
+	switch {
+	case status&vectorpb.RobotStatus_ROBOT_STATUS_IS_PICKED_UP != 0, status&vectorpb.RobotStatus_ROBOT_STATUS_IS_BEING_HELD != 0:
+		return "the robot is being held"
+	case status&vectorpb.RobotStatus_ROBOT_STATUS_IS_FALLING != 0:
+		return "the robot is falling"
+	case status&vectorpb.RobotStatus_ROBOT_STATUS_CLIFF_DETECTED != 0:
+		return "the robot is at the edge of a cliff"
+	}
+	return ""
+}
+
+func DoDisplayText(text string, robot *vector.Vector) error {
+	return displayOnFace(faceText(text), robot)
+}
+
+// imageClient only connects to public addresses, so the LLM can't be talked into having wire-pod
+// fetch things from the local network or the machine it runs on. redirects are checked too, since
+// the check is on the address actually dialed
+var imageClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				ip := net.ParseIP(host)
+				if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+					ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+					return errors.New("not fetching images from local address " + host)
+				}
+				return nil
+			},
+		}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+}
+
+// DoDisplayImage shows an image from the internet on the face
+func DoDisplayImage(url string, robot *vector.Vector) error {
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return errors.New("not a web address: " + url)
+	}
+	resp, err := imageClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("getting image: " + resp.Status)
+	}
+	imgBytes, err := io.ReadAll(io.LimitReader(resp.Body, maxFaceImageBytes))
+	if err != nil {
+		return err
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(imgBytes))
+	if err != nil {
+		return err
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width > maxFaceImagePixels/config.Height {
+		return fmt.Errorf("image is too big (%dx%d)", config.Width, config.Height)
+	}
+	img, _, err := image.Decode(bytes.NewReader(imgBytes))
+	if err != nil {
+		return err
+	}
+	return displayOnFace(faceImage(img), robot)
+}
+
+func displayOnFace(data []byte, robot *vector.Vector) error {
+	_, err := robot.Conn.DisplayFaceImageRGB(context.Background(), &vectorpb.DisplayFaceImageRGBRequest{
+		FaceData:         data,
+		DurationMs:       uint32(faceDuration.Milliseconds()),
+		InterruptRunning: true,
+	})
+	return err
+}
+
+// faceText draws text in the middle of the face, twice as big if it fits
+func faceText(text string) []byte {
+	const charWidth, lineHeight = 7, 13
+	scale := 2
+	lines := wrapText(text, faceWidth/scale/charWidth)
+	if len(lines)*lineHeight*scale > faceHeight {
+		scale = 1
+		lines = wrapText(text, faceWidth/charWidth)
+	}
+	width, height := faceWidth/scale, faceHeight/scale
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	d := font.Drawer{Dst: img, Src: image.White, Face: basicfont.Face7x13}
+	top := (height - len(lines)*lineHeight) / 2
+	for i, line := range lines {
+		d.Dot = fixed.P((width-utf8.RuneCountInString(line)*charWidth)/2, top+(i+1)*lineHeight-3)
+		d.DrawString(line)
+	}
+	return faceImage(img)
+}
+
+func wrapText(text string, width int) []string {
+	var lines []string
+	var line string
+	for _, word := range strings.Fields(text) {
+		if line != "" && utf8.RuneCountInString(line+" "+word) > width {
+			lines = append(lines, line)
+			line = ""
+		}
+		if line != "" {
+			line += " "
+		}
+		line += word
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// faceImage scales an image to fit the face and converts it to the face's big-endian RGB565
+func faceImage(img image.Image) []byte {
+	b := img.Bounds()
+	scale := math.Min(float64(faceWidth)/float64(b.Dx()), float64(faceHeight)/float64(b.Dy()))
+	w, h := int(float64(b.Dx())*scale), int(float64(b.Dy())*scale)
+	left, top := (faceWidth-w)/2, (faceHeight-h)/2
+	data := make([]byte, faceWidth*faceHeight*2)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBAModel.Convert(img.At(b.Min.X+int(float64(x)/scale), b.Min.Y+int(float64(y)/scale))).(color.RGBA)
+			px := uint16(c.R>>3)<<11 | uint16(c.G>>2)<<5 | uint16(c.B>>3)
+			i := ((top+y)*faceWidth + left + x) * 2
+			data[i] = byte(px >> 8)
+			data[i+1] = byte(px)
+		}
+	}
+	return data
+}
+
+func DoGoToCharger(robot *vector.Vector) error {
+	_, err := robot.Conn.DriveOnCharger(context.Background(), &vectorpb.DriveOnChargerRequest{})
+	return err
+}
+
+func DoLeaveCharger(robot *vector.Vector) error {
+	_, err := robot.Conn.DriveOffCharger(context.Background(), &vectorpb.DriveOffChargerRequest{})
+	return err
+}
+
+func DoFindFace(robot *vector.Vector) error {
+	_, err := robot.Conn.FindFaces(context.Background(), &vectorpb.FindFacesRequest{})
+	return err
+}
+
+func DoRollCube(robot *vector.Vector) error {
+	resp, err := robot.Conn.ConnectCube(context.Background(), &vectorpb.ConnectCubeRequest{})
+	if err != nil {
+		return err
+	}
+	if !resp.GetSuccess() {
+		return errors.New("couldn't connect to the cube")
+	}
+	_, err = robot.Conn.RollBlock(context.Background(), &vectorpb.RollBlockRequest{})
+	return err
+}
+
+func queryBattery(robot *vector.Vector) (string, error) {
+	resp, err := robot.Conn.BatteryState(context.Background(), &vectorpb.BatteryStateRequest{})
+	if err != nil {
+		return "", err
+	}
+	level := strings.ToLower(strings.TrimPrefix(resp.GetBatteryLevel().String(), "BATTERY_LEVEL_"))
+	info := fmt.Sprintf("Battery level: %s (%.2f volts). Charging: %t. On the charger: %t.",
+		level, resp.GetBatteryVolts(), resp.GetIsCharging(), resp.GetIsOnChargerPlatform())
+	if cube := resp.GetCubeBattery(); cube != nil {
+		info += fmt.Sprintf(" Cube battery: %.2f volts.", cube.GetBatteryVolts())
+	}
+	return info, nil
+}
+
+func queryState(robot *vector.Vector) (string, error) {
+	state, err := robotState(robot)
+	if err != nil {
+		return "", err
+	}
+	status := vectorpb.RobotStatus(state.GetStatus())
+	has := func(s vectorpb.RobotStatus) bool {
+		return status&s != 0
+	}
+	info := fmt.Sprintf("Head angle: %.0f degrees. Lift height: %.0f%%. Picked up: %t. On the charger: %t. Charging: %t. At a cliff: %t. Carrying the cube: %t.",
+		state.GetHeadAngleRad()*180/math.Pi,
+		(state.GetLiftHeightMm()-liftMinMm)/(liftMaxMm-liftMinMm)*100,
+		has(vectorpb.RobotStatus_ROBOT_STATUS_IS_PICKED_UP) || has(vectorpb.RobotStatus_ROBOT_STATUS_IS_BEING_HELD),
+		has(vectorpb.RobotStatus_ROBOT_STATUS_IS_ON_CHARGER),
+		has(vectorpb.RobotStatus_ROBOT_STATUS_IS_CHARGING),
+		has(vectorpb.RobotStatus_ROBOT_STATUS_CLIFF_DETECTED),
+		has(vectorpb.RobotStatus_ROBOT_STATUS_IS_CARRYING_BLOCK),
+	)
+	if prox := state.GetProxData(); prox != nil && prox.GetFoundObject() {
+		info += fmt.Sprintf(" Something is %d millimeters in front of it.", prox.GetDistanceMm())
+	}
+	return info, nil
+}
@@ -0,0 +1,248 @@
+package wirepod_ttr
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fforchino/vector-go-sdk/pkg/vector"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/llm"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/pluginhost"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
+)
+
+// the LLM commands as native tool calls. tool calls are validated against the command's schema.
+// actions are done right away, so the LLM gets what really happened. the ones which end the
+// response are turned into {{command||parameter}} so they go through the same GetActionsFromString
+// and PerformActions as commands written in the text by models without tool support
+
+// a response can go back and forth with the LLM this many times for tool results
+const maxToolRounds = 4
+
+var (
+	// providers which said they don't take tools, by name. these get the commands in the prompt
+	noToolProviders   = make(map[string]bool)
+	noToolProvidersMu sync.Mutex
+)
+
+func providerSupportsTools(p llm.Provider) bool {
+	noToolProvidersMu.Lock()
+	defer noToolProvidersMu.Unlock()
+	return !noToolProviders[p.Name()]
+}
+
+// toolsUnsupported is true for errors which say the model or API doesn't take tools, like ollama's
+// "does not support tools". timeouts, rate limits and server errors don't turn tools off
+func toolsUnsupported(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	if !strings.Contains(msg, "tool") && !strings.Contains(msg, "function") {
+		return false
+	}
+	for _, reason := range []string{"support", "not allowed", "unknown", "unrecognized", "unexpected", "invalid", "not available", "400", "bad request"} {
+		if strings.Contains(msg, reason) {
+			return true
+		}
+	}
+	return false
+}
+
+func setNoToolSupport(p llm.Provider) {
+	noToolProvidersMu.Lock()
+	noToolProviders[p.Name()] = true
+	noToolProvidersMu.Unlock()
+	logger.Println("LLM " + p.Name() + " doesn't seem to support tools, using {{command||parameter}} in the prompt from now on")
+}
+
+func enumParam(name, description, choices string) map[string]any {
+	var enum []string
+	for _, choice := range strings.Split(choices, ",") {
+		enum = append(enum, strings.TrimSpace(choice))
+	}
+	return objectParam(name, map[string]any{"type": "string", "description": description, "enum": enum})
+}
+
+func numberParam(name, description string, min, max float64) map[string]any {
+	return objectParam(name, map[string]any{"type": "number", "description": description, "minimum": min, "maximum": max})
+}
+
+func objectParam(name string, prop map[string]any) map[string]any {
+	return map[string]any{
+		"type":       "object",
+		"properties": map[string]any{name: prop},
+		"required":   []string{name},
+	}
+}
+
+func noParams() map[string]any {
+	return map[string]any{"type": "object", "properties": map[string]any{}}
+}
+
+// paramName is the name of a command's one argument, empty if it has none
+func paramName(cmd LLMCommand) (string, map[string]any) {
+	props, _ := cmd.Parameters["properties"].(map[string]any)
+	for name, prop := range props {
+		p, _ := prop.(map[string]any)
+		return name, p
+	}
+	return "", nil
+}
+
+// LLMTools are the commands a robot's LLM may use, and the functions of plugin programs, as tools
+func LLMTools(k vars.Knowledge, model string) []llm.Tool {
+	var tools []llm.Tool
+	for _, cmd := range ValidLLMCommands {
+		cmd, ok := withChoices(cmd)
+		if ok && ModelIsSupported(cmd, k, model) && k.CommandAllowed(cmd.Command) {
+			tools = append(tools, llm.Tool{Name: cmd.Command, Description: cmd.Description, Parameters: cmd.Parameters})
+		}
+	}
+	for _, f := range pluginhost.Functions() {
+		if _, isCommand := findCommand(f.Name); !isCommand && k.CommandAllowed(f.Name) {
+			tools = append(tools, llm.Tool{Name: f.Name, Description: f.Description, Parameters: f.Parameters})
+		}
+	}
+	return tools
+}
+
+// validateParam checks a {{command||parameter}} parameter against the command's schema
+func validateParam(cmd LLMCommand, param string) error {
+	name, prop := paramName(cmd)
+	if name == "" {
+		return nil
+	}
+	var value any = param
+	if t := prop["type"]; t == "number" || t == "integer" {
+		n, err := strconv.ParseFloat(param, 64)
+		if err != nil {
+			value = param
+		} else {
+			value = n
+		}
+	}
+	args, _ := json.Marshal(map[string]any{name: value})
+	_, err := llm.ValidateArgs(cmd.Parameters, string(args))
+	return err
+}
+
+var commandSyntax = regexp.MustCompile(`\{\{|\}\}|\|\|`)
+
+// toolCallsToCommands does the tool calls with run, or turns them into {{command||parameter}} for
+// the robot if they end the response (like getImage), and returns what goes back to the LLM.
+// queries are answered right away. more is false if a call ends the response
+func toolCallsToCommands(k vars.Knowledge, model string, calls []llm.ToolCall, robot *vector.Vector, run func(RobotAction) error) (cmds []string, results []llm.Message, more bool) {
+	more = true
+	for _, call := range calls {
+		command, result, err := toolCallToCommand(k, model, call, robot, run)
+		if err != nil {
+			logger.Println("LLM tool call " + call.Name + " " + call.Arguments + ": " + err.Error())
+			result = "error: " + err.Error()
+		}
+		if command != "" {
+			cmds = append(cmds, command)
+		}
+		if cmd, _ := findCommand(call.Name); err == nil && cmd.EndsResponse {
+			more = false
+		}
+		results = append(results, llm.Message{Role: llm.RoleTool, ToolCallID: call.ID, Name: call.Name, Content: result})
+	}
+	return cmds, results, more
+}
+
+func toolCallToCommand(k vars.Knowledge, model string, call llm.ToolCall, robot *vector.Vector, run func(RobotAction) error) (command string, result string, err error) {
+	cmd, ok := findCommand(call.Name)
+	if !ok && k.CommandAllowed(call.Name) {
+		if p, found := pluginhost.FindFunction(call.Name); found {
+			ctx, cancel := context.WithTimeout(context.Background(), pluginTimeout)
+			defer cancel()
+			result, err = p.Call(ctx, call.Name, call.Arguments)
+			return "", result, err
+		}
+	}
+	if !ok || !ModelIsSupported(cmd, k, model) || !k.CommandAllowed(cmd.Command) {
+		return "", "", errors.New("there is no tool called " + call.Name)
+	}
+	args, err := llm.ValidateArgs(cmd.Parameters, call.Arguments)
+	if err != nil {
+		return "", "", err
+	}
+	if cmd.Query != nil {
+		result, err = cmd.Query(robot)
+		return "", result, err
+	}
+	if cmd.Moves {
+		if reason := moveBlocked(robot); reason != "" {
+			return "", "", errors.New("not allowed to move, " + reason)
+		}
+	}
+	param := cmd.ParamChoices
+	if name, _ := paramName(cmd); name != "" {
+		switch v := args[name].(type) {
+		case float64:
+			param = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			param = commandSyntax.ReplaceAllString(strings.TrimSpace(toString(v)), "")
+		}
+	}
+	if !cmd.EndsResponse {
+		if err := run(RobotAction{Action: cmd.Action, Parameter: param}); err != nil {
+			return "", "", err
+		}
+		return "", "done", nil
+	}
+	result = "This happens once the robot is done talking."
+	if cmd.Action == ActionGetImage {
+		result = "The photo is in the next message."
+	}
+	return "{{" + cmd.Command + "||" + param + "}}", result, nil
+}
+
+func toString(v any) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case bool:
+		return strconv.FormatBool(s)
+	}
+	return ""
+}
+
+func findCommand(name string) (LLMCommand, bool) {
+	for _, cmd := range ValidLLMCommands {
+		if cmd.Command == name {
+			return withChoices(cmd)
+		}
+	}
+	return LLMCommand{}, false
+}
+
+// withChoices fills in the current choices of a command with Choices. ok is false if there
+// aren't any right now
+func withChoices(cmd LLMCommand) (LLMCommand, bool) {
+	if cmd.Choices == nil {
+		return cmd, true
+	}
+	choices := cmd.Choices()
+	if len(choices) == 0 {
+		return cmd, false
+	}
+	name, prop := paramName(cmd)
+	cmd.ParamChoices = strings.Join(choices, ", ")
+	cmd.Parameters = enumParam(name, toString(prop["description"]), cmd.ParamChoices)
+	return cmd, true
+}
+
+// stripCommands takes {{command||parameter}} out of text, for the chat history of robots using
+// tools, where the model shouldn't learn to write them
+func stripCommands(text string) string {
+	return strings.Join(strings.Fields(commandPattern.ReplaceAllString(text, "")), " ")
+}
+
+var commandPattern = regexp.MustCompile(`\{\{[^}]*\}\}`)
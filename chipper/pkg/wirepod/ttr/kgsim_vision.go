@@ -0,0 +1,152 @@
+package wirepod_ttr
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/fforchino/vector-go-sdk/pkg/vector"
+	"github.com/fforchino/vector-go-sdk/pkg/vectorpb"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/llm"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
+)
+
+// getImage works with models which can see, or with any model if there's a vision model to do the
+// looking for it. then the vision model describes the pictures, and the description is what the
+// robot's model gets
+
+const (
+	// between the pictures getImage takes
+	frameInterval = time.Second / 2
+	// how long the vision model gets to describe them
+	visionTimeout = time.Minute
+	// the head's highest angle, for lookingUp
+	headMaxDeg = 45
+)
+
+// parts of the names of models which take pictures. a vision model can be set for any other
+var visionModelNames = []string{
+	"gpt-4o", "gpt-4.1", "gpt-4-turbo", "gpt-4-vision", "gpt-5",
+	"claude-3", "claude-sonnet-4", "claude-opus-4",
+	"llava", "bakllava", "vision", "moondream", "minicpm-v", "qwen2-vl", "qwen2.5-vl", "qwen2.5vl",
+	"gemma3", "pixtral", "gemini", "llama-4", "llama4",
+}
+
+// modelCanSee is true for models which take pictures themselves
+func modelCanSee(model string) bool {
+	model = strings.ToLower(model)
+	for _, name := range visionModelNames {
+		if strings.Contains(model, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// canSee is true if a robot's LLM can use getImage, by itself or with the vision model
+func canSee(k vars.Knowledge, model string) bool {
+	return k.Vision.Model != "" || modelCanSee(model)
+}
+
+// withoutImages takes the pictures out of a conversation for a model which can't see. the
+// messages they came with say what was in them
+func withoutImages(msgs []llm.Message) []llm.Message {
+	out := make([]llm.Message, len(msgs))
+	for i, m := range msgs {
+		m.Images = nil
+		out[i] = m
+	}
+	return out
+}
+
+// lookUp tilts the robot's head all the way up, for getImage's lookingUp. the returned func puts
+// it back
+func lookUp(robot *vector.Vector) func() {
+	ctx := context.Background()
+	var headAngle float32
+	if state, err := robotState(robot); err == nil {
+		headAngle = state.GetHeadAngleRad()
+	}
+	robot.Conn.SetHeadAngle(ctx, &vectorpb.SetHeadAngleRequest{
+		AngleRad:          float32(headMaxDeg * math.Pi / 180),
+		MaxSpeedRadPerSec: 10,
+		AccelRadPerSec2:   10,
+	})
+	return func() {
+		robot.Conn.SetHeadAngle(ctx, &vectorpb.SetHeadAngleRequest{
+			AngleRad:          headAngle,
+			MaxSpeedRadPerSec: 10,
+			AccelRadPerSec2:   10,
+		})
+	}
+}
+
+// captureFrames takes pictures with the robot's camera, a bit apart
+func captureFrames(robot *vector.Vector, frames int, stopped func() bool) []llm.Image {
+	ctx := context.Background()
+	var images []llm.Image
+	for i := 0; i < frames; i++ {
+		if stopped() {
+			break
+		}
+		if i > 0 {
+			time.Sleep(frameInterval)
+		}
+		resp, err := robot.Conn.CaptureSingleImage(ctx, &vectorpb.CaptureSingleImageRequest{
+			EnableHighResolution: true,
+		})
+		if err != nil {
+			logger.Println("Error getting an image from " + robot.Cfg.SerialNo + ": " + err.Error())
+			continue
+		}
+		images = append(images, llm.Image{MediaType: "image/jpeg", Data: resp.Data})
+	}
+	return images
+}
+
+// describeImages has the vision model say what's in pictures, for a model which can't see them.
+// msgs is the conversation so far, so it knows what the user wants to know
+func describeImages(k vars.Knowledge, msgs []llm.Message, images []llm.Image) (string, error) {
+	provider, err := llm.New(llm.Config{Type: k.Vision.Provider, Key: k.Vision.Key, Endpoint: k.Vision.Endpoint, Model: k.Vision.Model})
+	if err != nil {
+		return "", err
+	}
+	var question string
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if msgs[i].Role == llm.RoleUser && strings.TrimSpace(msgs[i].Content) != "" {
+			question = msgs[i].Content
+			break
+		}
+	}
+	prompt := "You are the eyes of a small robot. Describe what is in the picture from its camera for another model, which can't see it and will answer the user. Be specific but brief, and focus on what the user wants to know. Read out any text you can see."
+	if len(images) > 1 {
+		prompt = "You are the eyes of a small robot. The pictures are from its camera, a moment apart. Describe what is in them and what changes for another model, which can't see them and will answer the user. Be specific but brief, and focus on what the user wants to know. Read out any text you can see."
+	}
+	content := "The user asked the robot to take a picture."
+	if question != "" {
+		content = "The user said: " + question
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), visionTimeout)
+	defer cancel()
+	logger.Println("Having " + provider.Name() + " look at " + fmt.Sprint(len(images)) + " picture(s)")
+	resp, err := llm.Chat(ctx, provider, llm.Request{
+		Messages: []llm.Message{
+			{Role: llm.RoleSystem, Content: prompt},
+			{Role: llm.RoleUser, Content: content, Images: images},
+		},
+		MaxTokens:   k.MaxTokens,
+		Temperature: 0.2,
+	})
+	if err != nil {
+		return "", err
+	}
+	description := strings.TrimSpace(resp.Content)
+	if description == "" {
+		return "", errors.New(provider.Name() + " didn't describe the picture")
+	}
+	return description, nil
+}
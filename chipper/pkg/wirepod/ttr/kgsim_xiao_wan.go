@@ -14,63 +14,14 @@ import (
 	"github.com/fforchino/vector-go-sdk/pkg/vector"
 	"github.com/fforchino/vector-go-sdk/pkg/vectorpb"
 	"github.com/sashabaranov/go-openai"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/llm"
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/history"
 	xiao_wan "github.com/wangergou2023/xiao_wan/chipper/plugins/xiao_wan"
 	xiao_wan_config "github.com/wangergou2023/xiao_wan/chipper/plugins/xiao_wan/config"
 )
 
-func getChat(esn string) vars.RememberedChat {
-	for _, chat := range vars.RememberedChats {
-		if chat.ESN == esn {
-			return chat
-		}
-	}
-	return vars.RememberedChat{
-		ESN: esn,
-	}
-}
-
-func placeChat(chat vars.RememberedChat) {
-	for i, achat := range vars.RememberedChats {
-		if achat.ESN == chat.ESN {
-			vars.RememberedChats[i] = chat
-			return
-		}
-	}
-	vars.RememberedChats = append(vars.RememberedChats, chat)
-	vars.SaveChats()
-}
-
-// remember last 16 lines of chat
-func remember(user, ai, esn string) {
-	chatAppend := []openai.ChatCompletionMessage{
-		{
-			Role:    openai.ChatMessageRoleUser,
-			Content: user,
-		},
-		{
-			Role:    openai.ChatMessageRoleAssistant,
-			Content: ai,
-		},
-	}
-	currentChat := getChat(esn)
-	if len(currentChat.Chats) == 16 {
-		var newChat vars.RememberedChat
-		newChat.ESN = currentChat.ESN
-		for i, chat := range currentChat.Chats {
-			if i < 2 {
-				continue
-			}
-			newChat.Chats = append(newChat.Chats, chat)
-		}
-		currentChat = newChat
-	}
-	currentChat.ESN = esn
-	currentChat.Chats = append(currentChat.Chats, chatAppend...)
-	placeChat(currentChat)
-}
-
 var cfg = xiao_wan_config.New()
 
 var xiao_wan_vector xiao_wan.Xiao_wan
@@ -99,6 +50,11 @@ func Xiao_wan_start(transcribedText string) (string, error) {
 	return "", nil
 }
 
+// ReloadXiaoWanPlugins loads the xiao_wan function-calling plugins again
+func ReloadXiaoWanPlugins() error {
+	return xiao_wan_vector.ReloadPlugins()
+}
+
 func StreamingKGSim_xiao_wan(req interface{}, esn string, transcribedText string) (string, error) {
 
 	sdk_wrapper.InitSDKForWirepod(esn)
@@ -221,85 +177,53 @@ func StreamingKGSim_test(req interface{}, esn string, transcribedText string) (s
 	var fullRespText string
 	var fullRespSlice []string
 	var isDone bool
-	var c *openai.Client
-	if vars.APIConfig.Knowledge.Provider == "together" {
-		if vars.APIConfig.Knowledge.Model == "" {
-			vars.APIConfig.Knowledge.Model = "meta-llama/Llama-2-70b-chat-hf"
-			vars.WriteConfigToDisk()
-		}
-		conf := openai.DefaultConfig(vars.APIConfig.Knowledge.Key)
-		conf.BaseURL = "https://api.together.xyz/v1"
-		c = openai.NewClientWithConfig(conf)
-	} else if vars.APIConfig.Knowledge.Provider == "openai" {
-		c = openai.NewClient(vars.APIConfig.Knowledge.Key)
-	}
+	k := vars.GetKnowledge(esn)
 	ctx := context.Background()
 	speakReady := make(chan string)
 
-	var robName string
-	if vars.APIConfig.Knowledge.RobotName != "" {
-		robName = vars.APIConfig.Knowledge.RobotName
-	} else {
-		robName = "Vector"
-	}
-	defaultPrompt := "You are a helpful robot called " + robName + ". The prompt may not be punctuated or spelled correctly as the STT model is small. The answer will be put through TTS, so it should be a speakable string. Keep the answer concise yet informative."
+	defaultPrompt := "You are a helpful robot called " + k.RobotName + ". The prompt may not be punctuated or spelled correctly as the STT model is small. The answer will be put through TTS, so it should be a speakable string. Keep the answer concise yet informative."
 
-	var nChat []openai.ChatCompletionMessage
+	var nChat []llm.Message
 
-	smsg := openai.ChatCompletionMessage{
-		Role: openai.ChatMessageRoleSystem,
+	smsg := llm.Message{
+		Role: llm.RoleSystem,
 	}
-	if strings.TrimSpace(vars.APIConfig.Knowledge.OpenAIPrompt) != "" {
-		smsg.Content = strings.TrimSpace(vars.APIConfig.Knowledge.OpenAIPrompt)
+	if k.Prompt != "" {
+		smsg.Content = k.Prompt
 	} else {
 		smsg.Content = defaultPrompt
 	}
 
 	nChat = append(nChat, smsg)
-	if vars.APIConfig.Knowledge.SaveChat {
-		rchat := getChat(esn)
-		logger.Println("Using remembered chats, length of " + fmt.Sprint(len(rchat.Chats)) + " messages")
-		nChat = append(nChat, rchat.Chats...)
+	if k.SaveChat {
+		rchat := history.Context(esn, transcribedText)
+		logger.Println("Using remembered chats, length of " + fmt.Sprint(len(rchat)) + " messages")
+		nChat = append(nChat, rchat...)
 	}
-	nChat = append(nChat, openai.ChatCompletionMessage{
-		Role:    openai.ChatMessageRoleUser,
+	nChat = append(nChat, llm.Message{
+		Role:    llm.RoleUser,
 		Content: transcribedText,
 	})
 
-	aireq := openai.ChatCompletionRequest{
-		MaxTokens: 2048,
-		Messages:  nChat,
-		Stream:    true,
+	aireq := llm.Request{
+		Messages:    nChat,
+		MaxTokens:   k.MaxTokens,
+		Temperature: k.Temperature,
 	}
-	if vars.APIConfig.Knowledge.Provider == "openai" {
-		aireq.Model = openai.GPT4Turbo1106
-		logger.Println("Using " + aireq.Model)
-	} else {
-		logger.Println("Using " + vars.APIConfig.Knowledge.Model)
-		aireq.Model = vars.APIConfig.Knowledge.Model
+	provider, err := newLLMProvider(k)
+	if err != nil {
+		return "", err
 	}
-	stream, err := c.CreateChatCompletionStream(ctx, aireq)
+	logger.Println("Using " + provider.Name())
+	stream, err := provider.ChatStream(ctx, aireq)
 	if err != nil {
-		if strings.Contains(err.Error(), "does not exist") && vars.APIConfig.Knowledge.Provider == "openai" {
-			logger.Println("GPT-4 model cannot be accessed with this API key. You likely need to add more than $5 dollars of funds to your OpenAI account.")
-			logger.LogUI("GPT-4 model cannot be accessed with this API key. You likely need to add more than $5 dollars of funds to your OpenAI account.")
-			aireq.Model = openai.GPT3Dot5Turbo
-			logger.Println("Falling back to " + aireq.Model)
-			logger.LogUI("Falling back to " + aireq.Model)
-			stream, err = c.CreateChatCompletionStream(ctx, aireq)
-			if err != nil {
-				logger.Println("OpenAI still not returning a response even after falling back. Erroring.")
-				return "", err
-			}
-		} else {
-			return "", err
-		}
+		return "", err
 	}
-	//defer stream.Close()
 
 	fmt.Println("LLM stream response: ")
 	// 启动一个新的goroutine来异步处理流数据。
 	go func() {
+		defer stream.Close()
 		// 无限循环，持续监听和处理从流中接收的数据。
 		for {
 			// 从流中接收数据。每次调用Recv()将等待并获取一个响应，或返回错误。
@@ -324,8 +248,8 @@ func StreamingKGSim_test(req interface{}, esn string, transcribedText string) (s
 					logger.Println("Warning: fullRespSlice is empty, no data to process.")
 				}
 				// 如果配置中启用了保存聊天功能，则保存转录文本和响应。
-				if vars.APIConfig.Knowledge.SaveChat {
-					remember(transcribedText, newStr, esn)
+				if k.SaveChat {
+					Remember(llm.Message{Role: llm.RoleUser, Content: transcribedText}, llm.Message{Role: llm.RoleAssistant, Content: newStr}, esn, llm.StreamModel(provider, stream))
 				}
 				// 向用户界面日志输出完整响应和ESN标识。
 				logger.LogUI("LLM response for " + esn + ": " + newStr)
@@ -339,9 +263,9 @@ func StreamingKGSim_test(req interface{}, esn string, transcribedText string) (s
 				return
 			}
 			// 日志打印接收到的内容
-			logger.Println("Received content: ", response.Choices[0].Delta.Content)
+			logger.Println("Received content: ", response)
 			// 将接收到的内容添加到完整响应文本中。
-			fullRespText = fullRespText + response.Choices[0].Delta.Content
+			fullRespText = fullRespText + response
 
 			// 检查完整响应文本中是否包含预定义的句末标点。
 			if strings.Contains(fullRespText, "...") || strings.Contains(fullRespText, ".'") || strings.Contains(fullRespText, ".\"") ||
@@ -1,10 +1,9 @@
 package wirepod_ttr
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"os/exec"
 	"strings"
 
 	pb "github.com/digital-dream-labs/api/go/chipperpb"
@@ -12,8 +11,14 @@ import (
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/scripting"
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/vtt"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/recorder"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/wirepod/sounds"
 )
 
+// DryRun is set by chipper replay. intents are still matched and sent to the request stream,
+// but custom intent scripts/executables aren't run and nothing is said on the robot
+var DryRun bool
+
 type systemIntentResponseStruct struct {
 	Status       string `json:"status"`
 	ReturnIntent string `json:"returnIntent"`
@@ -21,16 +26,19 @@ type systemIntentResponseStruct struct {
 
 func IntentPass(req interface{}, intentThing string, speechText string, intentParams map[string]string, isParam bool) (interface{}, error) {
 	var esn string
+	var session string
 	var req1 *vtt.IntentRequest
 	var req2 *vtt.IntentGraphRequest
 	var isIntentGraph bool
 	if str, ok := req.(*vtt.IntentRequest); ok {
 		req1 = str
 		esn = req1.Device
+		session = req1.Session
 		isIntentGraph = false
 	} else if str, ok := req.(*vtt.IntentGraphRequest); ok {
 		req2 = str
 		esn = req2.Device
+		session = req2.Session
 		isIntentGraph = true
 	}
 
@@ -53,6 +61,7 @@ func IntentPass(req interface{}, intentThing string, speechText string, intentPa
 		}
 	}
 	logger.LogUI("Intent matched: " + intentThing + ", transcribed text: '" + speechText + "', device: " + esn)
+	recorder.SetIntent(esn, session, intentThing, intentParams)
 	if isParam {
 		logger.LogUI("Parameters sent: " + fmt.Sprint(intentParams))
 	}
@@ -100,78 +109,14 @@ func IntentPass(req interface{}, intentThing string, speechText string, intentPa
 func customIntentHandler(req interface{}, voiceText string, botSerial string) bool {
 	var successMatched bool = false
 	if vars.CustomIntentsExist {
-		for _, c := range vars.CustomIntents {
+		for _, c := range vars.GetCustomIntents() {
 			for _, v := range c.Utterances {
 				//if strings.Contains(voiceText, strings.ToLower(strings.TrimSpace(v))) {
 				// Check whether the custom sentence is either at the end of the spoken text or space-separated...
 				var seekText = strings.ToLower(strings.TrimSpace(v))
 				// System intents can also match any utterances (*)
 				if (c.IsSystemIntent && strings.HasPrefix(seekText, "*")) || strings.Contains(voiceText, seekText) {
-					logger.Println("Bot " + botSerial + " Custom Intent Matched: " + c.Name + " - " + c.Description + " - " + c.Intent)
-					var intentParams map[string]string
-					var isParam bool = false
-					if c.Params.ParamValue != "" {
-						logger.Println("Bot " + botSerial + " Custom Intent Parameter: " + c.Params.ParamName + " - " + c.Params.ParamValue)
-						intentParams = map[string]string{c.Params.ParamName: c.Params.ParamValue}
-						isParam = true
-					}
-
-					go func() {
-						if c.LuaScript != "" {
-							err := scripting.RunLuaScript(botSerial, c.LuaScript)
-							if err != nil {
-								logger.Println("Error running Lua script: " + err.Error())
-							}
-						}
-					}()
-
-					var args []string
-					for _, arg := range c.ExecArgs {
-						if arg == "!botSerial" {
-							arg = botSerial
-						} else if arg == "!speechText" {
-							arg = "\"" + voiceText + "\""
-						} else if arg == "!intentName" {
-							arg = c.Name
-						} else if arg == "!locale" {
-							arg = vars.APIConfig.STT.Language
-						}
-						args = append(args, arg)
-					}
-					var customIntentExec *exec.Cmd
-					if len(args) == 0 {
-						logger.Println("Bot " + botSerial + " Executing: " + c.Exec)
-						customIntentExec = exec.Command(c.Exec)
-					} else {
-						logger.Println("Bot " + botSerial + " Executing: " + c.Exec + " " + strings.Join(args, " "))
-						customIntentExec = exec.Command(c.Exec, args...)
-					}
-					var out bytes.Buffer
-					var stderr bytes.Buffer
-					customIntentExec.Stdout = &out
-					customIntentExec.Stderr = &stderr
-					err := customIntentExec.Run()
-					if err != nil {
-						fmt.Println(fmt.Sprint(err) + ": " + stderr.String())
-					}
-					logger.Println("Bot " + botSerial + " Custom Intent Exec Output: " + strings.TrimSpace(string(out.String())))
-
-					if c.IsSystemIntent {
-						// A system intent returns its output in json format
-						var resp systemIntentResponseStruct
-						err := json.Unmarshal(out.Bytes(), &resp)
-						if err == nil && resp.Status == "ok" {
-							logger.Println("Bot " + botSerial + " System intent parsed and executed successfully")
-							IntentPass(req, resp.ReturnIntent, voiceText, intentParams, isParam)
-							successMatched = true
-						}
-					} else {
-						IntentPass(req, c.Intent, voiceText, intentParams, isParam)
-						successMatched = true
-					}
-					break
-				}
-				if successMatched {
+					successMatched = runCustomIntent(req, c, voiceText, botSerial)
 					break
 				}
 			}
@@ -183,59 +128,179 @@ func customIntentHandler(req interface{}, voiceText string, botSerial string) bo
 	return successMatched
 }
 
+// runs a custom intent's Lua script, webhook and executable, then sends its intent
+func runCustomIntent(req interface{}, c vars.CustomIntent, voiceText string, botSerial string) bool {
+	logger.Println("Bot " + botSerial + " Custom Intent Matched: " + c.Name + " - " + c.Description + " - " + c.Intent)
+	var intentParams map[string]string
+	var isParam bool = false
+	if c.Params.ParamValue != "" {
+		logger.Println("Bot " + botSerial + " Custom Intent Parameter: " + c.Params.ParamName + " - " + c.Params.ParamValue)
+		intentParams = map[string]string{c.Params.ParamName: c.Params.ParamValue}
+		isParam = true
+	}
+
+	if DryRun {
+		logger.Println("Bot " + botSerial + " Dry run, not executing custom intent")
+		IntentPass(req, c.Intent, voiceText, intentParams, isParam)
+		return true
+	}
+
+	go func() {
+		if c.LuaScript != "" {
+			err := scripting.RunLuaScript(botSerial, c.LuaScript)
+			if err != nil {
+				logger.Println("Error running Lua script: " + err.Error())
+			}
+		}
+	}()
+
+	if c.Sound != "" {
+		go playIntentSound(botSerial, c.Sound)
+	}
+
+	var hook webhookResult
+	var hookOK bool
+	if c.Webhook != nil && c.Webhook.URL != "" {
+		logger.Println("Bot " + botSerial + " Calling webhook: " + c.Webhook.URL)
+		var err error
+		hook, err = runWebhook(c.Webhook, webhookData{
+			SpeechText: voiceText,
+			ESN:        botSerial,
+			Locale:     vars.APIConfig.STT.Language,
+			Name:       c.Name,
+			Intent:     c.Intent,
+			Slots:      intentParams,
+		})
+		if err != nil {
+			logger.Println("Bot " + botSerial + " Webhook error: " + err.Error())
+		} else {
+			hookOK = true
+			logger.Println("Bot " + botSerial + " Webhook returned " + fmt.Sprint(hook.Status))
+		}
+	}
+
+	var out []byte
+	if c.Exec != "" {
+		if execOptions(c).Async && !c.IsSystemIntent {
+			go runCustomExec(c, botSerial, voiceText)
+		} else {
+			out = runCustomExec(c, botSerial, voiceText)
+		}
+	}
+
+	intent := c.Intent
+	if hook.Intent != "" {
+		intent = hook.Intent
+	}
+	if c.IsSystemIntent {
+		// A system intent returns its output in json format
+		var resp systemIntentResponseStruct
+		err := json.Unmarshal(out, &resp)
+		if err == nil && resp.Status == "ok" {
+			logger.Println("Bot " + botSerial + " System intent parsed and executed successfully")
+			IntentPass(req, resp.ReturnIntent, voiceText, intentParams, isParam)
+			sayWebhookReply(botSerial, hook)
+			return true
+		}
+		// a webhook system intent declines by failing, or by not returning an intent if one is mapped
+		if hookOK && (c.Webhook.Response.Intent == "" || hook.Intent != "") {
+			logger.Println("Bot " + botSerial + " System intent webhook executed successfully")
+			IntentPass(req, intent, voiceText, intentParams, isParam)
+			sayWebhookReply(botSerial, hook)
+			return true
+		}
+		return false
+	}
+	IntentPass(req, intent, voiceText, intentParams, isParam)
+	sayWebhookReply(botSerial, hook)
+	return true
+}
+
+// playIntentSound plays a custom intent's sound under behavior control, so the robot's own behaviors
+// (like the intent's) wait for it instead of playing over it
+func playIntentSound(botSerial string, sound string) {
+	robot, err := vars.GetRobot(botSerial)
+	if err != nil {
+		logger.Println("Bot " + botSerial + " Couldn't play sound " + sound + ": " + err.Error())
+		return
+	}
+	start := make(chan bool)
+	stop := make(chan bool)
+	BControl(robot, context.Background(), start, stop)
+	for range start {
+		err := sounds.Play(robot, sound)
+		stop <- true
+		if err != nil {
+			logger.Println("Bot " + botSerial + " Couldn't play sound " + sound + ": " + err.Error())
+		}
+		break
+	}
+}
+
+func sayWebhookReply(botSerial string, hook webhookResult) {
+	if hook.Say != "" {
+		logger.Println("Bot " + botSerial + " Webhook reply: " + hook.Say)
+		KGSim(botSerial, hook.Say)
+	}
+}
+
 func pluginFunctionHandler(req interface{}, voiceText string, botSerial string) bool {
-	matched := false
-	var intent string
+	ctx := context.Background()
 	var igr *vtt.IntentGraphRequest
+	var isKG bool
 	if str, ok := req.(*vtt.IntentGraphRequest); ok {
 		igr = str
+		if str.Stream != nil {
+			ctx = str.Stream.Context()
+		}
+	} else if str, ok := req.(*vtt.IntentRequest); ok && str.Stream != nil {
+		ctx = str.Stream.Context()
+	} else if str, ok := req.(*vtt.KnowledgeGraphRequest); ok {
+		isKG = true
+		if str.Stream != nil {
+			ctx = str.Stream.Context()
+		}
 	}
-	var pluginResponse string
-	for num, array := range PluginUtterances {
-		array := array
-		for _, str := range *array {
-			if strings.Contains(voiceText, str) || str == "*" {
-				logger.Println("Bot " + botSerial + " matched plugin " + PluginNames[num] + ", executing function")
-				var guid string
-				var target string
-				for _, bot := range vars.BotInfo.Robots {
-					if bot.Esn == botSerial {
-						guid = bot.GUID
-						target = bot.IPAddress + ":443"
-					}
-				}
-				intent, pluginResponse = PluginFunctions[num](voiceText, botSerial, guid, target)
-				if intent == "" && pluginResponse == "" {
-					break
-				}
-				if intent == "" {
-					intent = "intent_imperative_praise"
-				}
-				logger.Println("Bot " + botSerial + " plugin " + PluginNames[num] + ", response " + pluginResponse)
-				if pluginResponse != "" && igr != nil {
-					response := &pb.IntentGraphResponse{
-						Session:      igr.Session,
-						DeviceId:     igr.Device,
-						ResponseType: pb.IntentGraphMode_KNOWLEDGE_GRAPH,
-						SpokenText:   pluginResponse,
-						QueryText:    voiceText,
-						IsFinal:      true,
-					}
-					igr.Stream.Send(response)
-				} else if pluginResponse != "" {
-					KGSim(botSerial, pluginResponse)
-				} else {
-					IntentPass(req, intent, voiceText, make(map[string]string), false)
+	for _, m := range matchPlugins(voiceText) {
+		logger.Println("Bot " + botSerial + " matched plugin " + m.plugin.Name + ", executing function")
+		result, err := runPlugin(ctx, m, voiceText, botSerial)
+		if err != nil {
+			logger.Println("Bot " + botSerial + " plugin " + m.plugin.Name + " error: " + err.Error())
+			continue
+		}
+		if result.Empty() {
+			continue
+		}
+		logger.Println("Bot " + botSerial + " plugin " + m.plugin.Name + ", response " + result.SpokenText)
+		switch {
+		case result.LLMFollowUp != "":
+			if _, err := StreamingKGSim(req, botSerial, result.LLMFollowUp, isKG); err != nil {
+				logger.Println("LLM error: " + err.Error())
+				if !isKG {
+					IntentPass(req, "intent_system_unmatched", voiceText, map[string]string{"": ""}, false)
 				}
-				matched = true
-				break
 			}
+		case result.Intent != "":
+			IntentPass(req, result.Intent, voiceText, result.Params, len(result.Params) > 0)
+			if result.SpokenText != "" {
+				KGSim(botSerial, result.SpokenText)
+			}
+		case igr != nil:
+			response := &pb.IntentGraphResponse{
+				Session:      igr.Session,
+				DeviceId:     igr.Device,
+				ResponseType: pb.IntentGraphMode_KNOWLEDGE_GRAPH,
+				SpokenText:   result.SpokenText,
+				QueryText:    voiceText,
+				IsFinal:      true,
+			}
+			igr.Stream.Send(response)
+		default:
+			KGSim(botSerial, result.SpokenText)
 		}
-		if matched {
-			break
-		}
+		return true
 	}
-	return matched
+	return false
 }
 
 func ProcessTextAll(req interface{}, voiceText string, intents []vars.JsonIntent, isOpus bool) bool {
@@ -257,7 +322,24 @@ func ProcessTextAll(req interface{}, voiceText string, intents []vars.JsonIntent
 	var intentNum int = 0
 	var successMatched bool = false
 	voiceText = strings.ToLower(voiceText)
+	// the robot asked something and this is the answer
+	if isOpus && resumeDialog(req, botSerial, voiceText) {
+		return true
+	}
 	pluginMatched := pluginFunctionHandler(req, voiceText, botSerial)
+	if pluginMatched && (vars.APIConfig.IntentMatch.Classifier.Enable || vars.APIConfig.IntentMatch.Fuzzy) {
+		return true
+	}
+	if vars.APIConfig.IntentMatch.Classifier.Enable {
+		matched, err := classifierIntentHandler(req, voiceText, intents, isOpus, botSerial)
+		if err == nil {
+			return matched
+		}
+		logger.Println("Intent classifier error, falling back to keyphrase matching: " + err.Error())
+	}
+	if vars.APIConfig.IntentMatch.Fuzzy {
+		return scoredIntentHandler(req, voiceText, intents, isOpus, botSerial)
+	}
 	customIntentMatched := customIntentHandler(req, voiceText, botSerial)
 	if !customIntentMatched && !pluginMatched {
 		logger.Println("Not a custom intent")
@@ -313,3 +395,82 @@ func ProcessTextAll(req interface{}, voiceText string, intents []vars.JsonIntent
 	}
 	return successMatched
 }
+
+// partialIsAmbiguous returns true if the user could still be in the middle of saying something else,
+// or if the final transcript would go to a custom intent or plugin instead
+func partialIsAmbiguous(partialText string, intents []vars.JsonIntent) bool {
+	var utterances []string
+	for _, b := range intents {
+		utterances = append(utterances, b.Keyphrases...)
+	}
+	if vars.CustomIntentsExist {
+		for _, c := range vars.GetCustomIntents() {
+			utterances = append(utterances, c.Utterances...)
+		}
+	}
+	for _, p := range currentPlugins() {
+		for _, u := range p.utterances {
+			if u.regex == nil {
+				utterances = append(utterances, u.Text)
+			}
+		}
+	}
+	for _, u := range utterances {
+		u = strings.ToLower(strings.TrimSpace(u))
+		if strings.HasPrefix(u, "*") || strings.HasPrefix(u, partialText+" ") {
+			return true
+		}
+	}
+	if vars.CustomIntentsExist {
+		for _, c := range vars.GetCustomIntents() {
+			for _, v := range c.Utterances {
+				if strings.Contains(partialText, strings.ToLower(strings.TrimSpace(v))) {
+					return true
+				}
+			}
+		}
+	}
+	if len(matchPlugins(partialText)) > 0 {
+		return true
+	}
+	return false
+}
+
+// ProcessTextPartial sends an intent before the user has finished talking, but only if the partial
+// transcript is exactly one of its keyphrases and nothing longer could start with it.
+// intents which take parameters (_extend or slots) are left for the final transcript
+func ProcessTextPartial(req interface{}, partialText string, intents []vars.JsonIntent, isOpus bool) bool {
+	var botSerial string
+	if str, ok := req.(*vtt.IntentRequest); ok {
+		botSerial = str.Device
+	} else if str, ok := req.(*vtt.KnowledgeGraphRequest); ok {
+		botSerial = str.Device
+	} else if str, ok := req.(*vtt.IntentGraphRequest); ok {
+		botSerial = str.Device
+	}
+	// answers to a question wait for the final transcript
+	if DialogPending(botSerial) {
+		return false
+	}
+	partialText = strings.Trim(strings.ToLower(partialText), " .,!?")
+	if partialText == "" || partialIsAmbiguous(partialText, intents) {
+		return false
+	}
+	for _, b := range intents {
+		if strings.Contains(b.Name, "_extend") || len(b.Slots) > 0 {
+			continue
+		}
+		for _, c := range b.Keyphrases {
+			if partialText == strings.ToLower(c) {
+				logger.Println("Bot " + botSerial + " Perfect match for intent " + b.Name + " from partial transcript (" + partialText + ")")
+				if isOpus {
+					ParamChecker(req, b.Name, partialText, botSerial)
+				} else {
+					prehistoricParamChecker(req, b.Name, partialText)
+				}
+				return true
+			}
+		}
+	}
+	return false
+}
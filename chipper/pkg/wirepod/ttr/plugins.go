@@ -1,81 +1,431 @@
 package wirepod_ttr
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
 	"plugin"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/fforchino/vector-go-sdk/pkg/vector"
 	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/pluginapi"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/pluginhost"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
 )
 
+// how long a plugin gets to handle a request
+const pluginTimeout = time.Second * 30
+
+type pluginUtterance struct {
+	pluginapi.Utterance
+	regex *regexp.Regexp
+}
+
+type LoadedPlugin struct {
+	Name    string
+	File    string
+	Version int
+	Plugin  pluginapi.Plugin
+	// sorted by priority, highest first
+	utterances []pluginUtterance
+}
+
 var PluginList []*plugin.Plugin
-var PluginUtterances []*[]string
-var PluginFunctions []func(string, string, string, string) (string, string)
-var PluginNames []string
+
+// the active plugins. replaced whole on reload, never changed in place
+var Plugins []*LoadedPlugin
+
+// Plugins is put together from these
+var sharedList []*LoadedPlugin
+var programList []*LoadedPlugin
+var registeredPlugins []*LoadedPlugin
+var pluginsMu sync.RWMutex
+
+// one load or reload at a time
+var reloadMu sync.Mutex
+
+type sharedPlugin struct {
+	loaded  *LoadedPlugin
+	modTime time.Time
+}
+
+// .so plugins which have been opened, by file name
+var sharedPlugins = make(map[string]sharedPlugin)
+
+// legacyPlugin adapts a version 1 plugin (Utterances, Name, Action) to pluginapi.Plugin
+type legacyPlugin struct {
+	name       string
+	utterances *[]string
+	action     func(string, string, string, string) (string, string)
+}
+
+func (l legacyPlugin) Name() string {
+	return l.name
+}
+
+func (l legacyPlugin) Utterances() []pluginapi.Utterance {
+	var utterances []pluginapi.Utterance
+	for _, u := range *l.utterances {
+		utterances = append(utterances, pluginapi.Utterance{Text: u})
+	}
+	return utterances
+}
+
+func (l legacyPlugin) Handle(ctx context.Context, req pluginapi.Request) (pluginapi.Result, error) {
+	var guid string
+	var target string
+	for _, bot := range vars.BotInfo.Robots {
+		if bot.Esn == req.ESN {
+			guid = bot.GUID
+			target = bot.IPAddress + ":443"
+		}
+	}
+	intent, response := l.action(req.Text, req.ESN, guid, target)
+	// version 1 plugins which say something don't send their intent
+	if response != "" {
+		return pluginapi.Result{SpokenText: response}, nil
+	}
+	if intent == "" {
+		return pluginapi.Result{}, nil
+	}
+	return pluginapi.Result{Intent: intent}, nil
+}
+
+func loadLegacyPlugin(p *plugin.Plugin, fileName string) (pluginapi.Plugin, bool) {
+	u, err := p.Lookup("Utterances")
+	if err != nil {
+		logger.Println("Error loading Utterances []string from plugin file " + fileName)
+		logger.Println(err)
+		return nil, false
+	} else {
+		if _, ok := u.(*[]string); ok {
+			logger.Println("Utterances []string in plugin " + fileName + " are OK")
+		} else {
+			logger.Println("Error: Utterances in plugin " + fileName + " are not of type []string")
+			return nil, false
+		}
+	}
+	a, err := p.Lookup("Action")
+	if err != nil {
+		logger.Println("Error loading Action func from plugin file " + fileName)
+		return nil, false
+	} else {
+		if _, ok := a.(func(string, string, string, string) (string, string)); ok {
+			logger.Println("Action func in plugin " + fileName + " is OK")
+		} else {
+			logger.Println("Error: Action func in plugin " + fileName + " is not of type func(string, string, string, string) (string, string)")
+			return nil, false
+		}
+	}
+	n, err := p.Lookup("Name")
+	if err != nil {
+		logger.Println("Error loading Name string from plugin file " + fileName)
+		return nil, false
+	} else {
+		if _, ok := n.(*string); ok {
+			logger.Println("Name string in plugin " + *n.(*string) + " is OK")
+		} else {
+			logger.Println("Error: Name string in plugin " + fileName + " is not of type string")
+			return nil, false
+		}
+	}
+	return legacyPlugin{
+		name:       *n.(*string),
+		utterances: u.(*[]string),
+		action:     a.(func(string, string, string, string) (string, string)),
+	}, true
+}
+
+func loadV2Plugin(p *plugin.Plugin, fileName string) (pluginapi.Plugin, int, bool) {
+	v, err := p.Lookup("APIVersion")
+	if err != nil {
+		return nil, 1, false
+	}
+	version, ok := v.(*int)
+	if !ok {
+		logger.Println("Error: APIVersion in plugin " + fileName + " is not of type int")
+		return nil, 0, false
+	}
+	if *version != pluginapi.Version {
+		logger.Println("Error: plugin " + fileName + " is for plugin API version " + fmt.Sprint(*version) + ", this wire-pod has version " + fmt.Sprint(pluginapi.Version))
+		return nil, *version, false
+	}
+	pl, err := p.Lookup("Plugin")
+	if err != nil {
+		logger.Println("Error loading Plugin from plugin file " + fileName)
+		return nil, *version, false
+	}
+	impl, ok := pl.(*pluginapi.Plugin)
+	if !ok || *impl == nil {
+		logger.Println("Error: Plugin in plugin " + fileName + " is not a pluginapi.Plugin")
+		return nil, *version, false
+	}
+	return *impl, *version, true
+}
+
+// compilePlugin compiles a plugin's utterances
+func compilePlugin(p pluginapi.Plugin, fileName string, version int) (*LoadedPlugin, error) {
+	loaded := &LoadedPlugin{
+		Name:    p.Name(),
+		File:    fileName,
+		Version: version,
+		Plugin:  p,
+	}
+	for _, u := range p.Utterances() {
+		pu := pluginUtterance{Utterance: u}
+		if u.Regex != "" {
+			regex, err := regexp.Compile(u.Regex)
+			if err != nil {
+				return nil, fmt.Errorf("utterance regex %q: %w", u.Regex, err)
+			}
+			pu.regex = regex
+		} else if u.Text == "" {
+			continue
+		}
+		loaded.utterances = append(loaded.utterances, pu)
+	}
+	sort.SliceStable(loaded.utterances, func(i, j int) bool {
+		return loaded.utterances[i].Priority > loaded.utterances[j].Priority
+	})
+	return loaded, nil
+}
+
+// RegisterPlugin compiles a plugin's utterances and adds it to the list
+func RegisterPlugin(p pluginapi.Plugin, fileName string, version int) error {
+	loaded, err := compilePlugin(p, fileName, version)
+	if err != nil {
+		return err
+	}
+	pluginsMu.Lock()
+	registeredPlugins = append(registeredPlugins, loaded)
+	pluginsMu.Unlock()
+	swapPlugins()
+	return nil
+}
+
+// swapPlugins puts together the plugin list. requests which already have the old list keep it
+func swapPlugins() {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	var list []*LoadedPlugin
+	list = append(list, sharedList...)
+	list = append(list, programList...)
+	list = append(list, registeredPlugins...)
+	Plugins = list
+}
+
+func currentPlugins() []*LoadedPlugin {
+	pluginsMu.RLock()
+	defer pluginsMu.RUnlock()
+	return Plugins
+}
 
 func LoadPlugins() {
 	logger.Println("Loading plugins")
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	shared, _ := loadSharedPlugins(false)
+	// plugin programs in ./plugins/exec, see pluginhost
+	var programs []*LoadedPlugin
+	for _, p := range pluginhost.Start(pluginhost.DefaultDir) {
+		loaded, err := compilePlugin(p.Plugin(), filepath.Base(p.Path), pluginapi.Version)
+		if err != nil {
+			logger.Println("Error loading plugin program " + filepath.Base(p.Path) + ": " + err.Error())
+			continue
+		}
+		programs = append(programs, loaded)
+	}
+	pluginsMu.Lock()
+	sharedList = shared
+	programList = programs
+	pluginsMu.Unlock()
+	swapPlugins()
+}
+
+// ReloadPlugins loads the plugins again. nothing changes if a plugin fails to load.
+// plugin programs are only restarted if restartPrograms is set
+func ReloadPlugins(restartPrograms bool) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	shared, err := loadSharedPlugins(true)
+	if err != nil {
+		return err
+	}
+	pluginsMu.RLock()
+	programs := programList
+	pluginsMu.RUnlock()
+	if restartPrograms {
+		launched, err := pluginhost.Launch(pluginhost.DefaultDir)
+		if err != nil {
+			return err
+		}
+		programs = nil
+		for _, p := range launched {
+			loaded, err := compilePlugin(p.Plugin(), filepath.Base(p.Path), pluginapi.Version)
+			if err != nil {
+				pluginhost.Discard(launched)
+				return errors.New("plugin program " + filepath.Base(p.Path) + ": " + err.Error())
+			}
+			programs = append(programs, loaded)
+		}
+		pluginhost.Activate(launched)
+	}
+	pluginsMu.Lock()
+	sharedList = shared
+	programList = programs
+	pluginsMu.Unlock()
+	swapPlugins()
+	logger.Println("Reloaded plugins (" + fmt.Sprint(len(shared)) + " .so, " + fmt.Sprint(len(programs)) + " programs)")
+	return nil
+}
+
+// openSharedPlugin loads a .so plugin
+func openSharedPlugin(fileName string) (*LoadedPlugin, error) {
+	p, err := plugin.Open("./plugins/" + fileName)
+	if err != nil {
+		return nil, err
+	}
+	logger.Println("Loading plugin: " + fileName)
+	impl, version, ok := loadV2Plugin(p, fileName)
+	if !ok {
+		if version != 1 {
+			return nil, errors.New("not a usable plugin")
+		}
+		impl, ok = loadLegacyPlugin(p, fileName)
+		if !ok {
+			return nil, errors.New("not a usable plugin")
+		}
+	}
+	loaded, err := compilePlugin(impl, fileName, version)
+	if err != nil {
+		return nil, err
+	}
+	PluginList = append(PluginList, p)
+	logger.Println(fileName + " loaded successfully (plugin API version " + fmt.Sprint(version) + ")")
+	return loaded, nil
+}
+
+// loadSharedPlugins loads the .so plugins in ./plugins. Go can't unload or replace a .so,
+// so ones which were loaded before are reused. if strict, a plugin which fails to load is an error
+func loadSharedPlugins(strict bool) ([]*LoadedPlugin, error) {
 	entries, err := os.ReadDir("./plugins")
 	if err != nil {
 		logger.Println("Unable to load plugins:")
 		logger.Println(err)
-		return
+		return nil, nil
 	}
+	var list []*LoadedPlugin
 	for _, file := range entries {
-		if strings.Contains(file.Name(), ".so") {
-			plugin, err := plugin.Open("./plugins/" + file.Name())
-			if err != nil {
-				logger.Println("Error loading plugin: " + file.Name())
-				logger.Println(err)
-				continue
-			} else {
-				logger.Println("Loading plugin: " + file.Name())
+		if !strings.Contains(file.Name(), ".so") {
+			// logger.Println("Not loading " + file.Name() + ". Plugins must be built with 'go build -buildmode=plugin' and must end in '.so'.")
+			continue
+		}
+		var modTime time.Time
+		if info, err := file.Info(); err == nil {
+			modTime = info.ModTime()
+		}
+		if prev, ok := sharedPlugins[file.Name()]; ok {
+			if !modTime.Equal(prev.modTime) {
+				logger.Println(file.Name() + " changed, restart wire-pod to load the new version")
+				prev.modTime = modTime
+				sharedPlugins[file.Name()] = prev
 			}
-			u, err := plugin.Lookup("Utterances")
-			if err != nil {
-				logger.Println("Error loading Utterances []string from plugin file " + file.Name())
-				logger.Println(err)
-				continue
-			} else {
-				if _, ok := u.(*[]string); ok {
-					logger.Println("Utterances []string in plugin " + file.Name() + " are OK")
-				} else {
-					logger.Println("Error: Utterances in plugin " + file.Name() + " are not of type []string")
-					continue
-				}
+			list = append(list, prev.loaded)
+			continue
+		}
+		loaded, err := openSharedPlugin(file.Name())
+		if err != nil {
+			if strict {
+				return nil, errors.New("plugin " + file.Name() + ": " + err.Error())
 			}
-			a, err := plugin.Lookup("Action")
-			if err != nil {
-				logger.Println("Error loading Action func from plugin file " + file.Name())
-				continue
-			} else {
-				if _, ok := a.(func(string, string, string, string) (string, string)); ok {
-					logger.Println("Action func in plugin " + file.Name() + " is OK")
-				} else {
-					logger.Println("Error: Action func in plugin " + file.Name() + " is not of type func(string, string) string")
-					continue
-				}
+			logger.Println("Error loading plugin " + file.Name() + ": " + err.Error())
+			continue
+		}
+		sharedPlugins[file.Name()] = sharedPlugin{loaded: loaded, modTime: modTime}
+		list = append(list, loaded)
+	}
+	return list, nil
+}
+
+// match returns the slots if the utterance matches the transcript
+func (u pluginUtterance) match(voiceText string) (map[string]string, bool) {
+	if u.regex != nil {
+		groups := u.regex.FindStringSubmatch(voiceText)
+		if groups == nil {
+			return nil, false
+		}
+		slots := make(map[string]string)
+		for i, name := range u.regex.SubexpNames() {
+			if name != "" && groups[i] != "" {
+				slots[name] = groups[i]
 			}
-			n, err := plugin.Lookup("Name")
-			if err != nil {
-				logger.Println("Error loading Name string from plugin file " + file.Name())
-				continue
-			} else {
-				if _, ok := n.(*string); ok {
-					logger.Println("Name string in plugin " + *n.(*string) + " is OK")
-				} else {
-					logger.Println("Error: Name string in plugin " + file.Name() + " is not of type string")
-					continue
+		}
+		return slots, true
+	}
+	if strings.Contains(voiceText, u.Text) || u.Text == "*" {
+		return map[string]string{}, true
+	}
+	return nil, false
+}
+
+type pluginMatch struct {
+	plugin    *LoadedPlugin
+	utterance pluginUtterance
+	slots     map[string]string
+}
+
+// matchPlugins returns the plugins matching the transcript, by priority, then load order.
+// each plugin is there once, with its best utterance
+func matchPlugins(voiceText string) []pluginMatch {
+	var matches []pluginMatch
+	for _, p := range currentPlugins() {
+		for _, u := range p.utterances {
+			if slots, ok := u.match(voiceText); ok {
+				matches = append(matches, pluginMatch{plugin: p, utterance: u, slots: slots})
+				break
+			}
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].utterance.Priority > matches[j].utterance.Priority
+	})
+	return matches
+}
+
+// runPlugin gives a matched request to a plugin
+func runPlugin(ctx context.Context, m pluginMatch, voiceText string, botSerial string) (pluginapi.Result, error) {
+	var robot *vector.Vector
+	if _, isLegacy := m.plugin.Plugin.(legacyPlugin); !isLegacy && !DryRun {
+		for _, bot := range vars.BotInfo.Robots {
+			if bot.Esn == botSerial {
+				var err error
+				robot, err = vector.New(vector.WithSerialNo(botSerial), vector.WithToken(bot.GUID), vector.WithTarget(bot.IPAddress+":443"))
+				if err != nil {
+					logger.Println("Plugin " + m.plugin.Name + " can't connect to " + botSerial + ": " + err.Error())
+					robot = nil
 				}
+				break
 			}
-			PluginUtterances = append(PluginUtterances, u.(*[]string))
-			PluginFunctions = append(PluginFunctions, a.(func(string, string, string, string) (string, string)))
-			PluginNames = append(PluginNames, *n.(*string))
-			PluginList = append(PluginList, plugin)
-			logger.Println(file.Name() + " loaded successfully")
 		}
-		// else {
-		//	logger.Println("Not loading " + file.Name() + ". Plugins must be built with 'go build -buildmode=plugin' and must end in '.so'.")
-		//}
 	}
+	ctx, cancel := context.WithTimeout(ctx, pluginTimeout)
+	defer cancel()
+	prefix := "Plugin " + m.plugin.Name + ": "
+	return m.plugin.Plugin.Handle(ctx, pluginapi.Request{
+		Text:   voiceText,
+		ESN:    botSerial,
+		Locale: vars.APIConfig.STT.Language,
+		Robot:  robot,
+		Slots:  m.slots,
+		Log: func(a ...any) {
+			logger.Println(prefix + fmt.Sprint(a...))
+		},
+	})
 }
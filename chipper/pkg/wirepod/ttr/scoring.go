@@ -0,0 +1,352 @@
+package wirepod_ttr
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
+)
+
+// scored intent matching, used instead of first-match when vars.APIConfig.IntentMatch.Fuzzy is on.
+// every keyphrase of every intent and custom intent gets a 0-1 score against the transcript
+// and the best one wins if it is above the threshold
+
+const DefaultMatchThreshold = 0.7
+
+const (
+	// the whole transcript is the keyphrase
+	scoreExact = 1.0
+	// the keyphrase is in the transcript as whole words
+	scoreWords = 0.9
+	// the keyphrase is in the transcript, but not on word boundaries ("play" in "display").
+	// below DefaultMatchThreshold, so this alone doesn't match
+	scoreSubstring = 0.6
+	// words which sound the same count as this similar
+	phoneticSimilarity = 0.85
+	// words less similar than this don't count towards overlap at all
+	minWordSimilarity = 0.6
+	// token overlap and whole-string edit distance are scaled by this so they never beat a whole-word match
+	fuzzyWeight = 0.9
+)
+
+// phonetic encoders by language (first part of the locale)
+var phoneticEncoders = map[string]func(string) string{
+	"en": soundex,
+}
+
+type intentScore struct {
+	Intent string
+	Phrase string
+	Score  float64
+	// set if this is a custom intent
+	Custom *vars.CustomIntent
+}
+
+func (s intentScore) String() string {
+	return s.Intent + " (" + s.Phrase + ") " + fmt.Sprintf("%.2f", s.Score)
+}
+
+func matchThreshold() float64 {
+	if vars.APIConfig.IntentMatch.Threshold <= 0 {
+		return DefaultMatchThreshold
+	}
+	return vars.APIConfig.IntentMatch.Threshold
+}
+
+func phoneticEncoder() func(string) string {
+	if !vars.APIConfig.IntentMatch.Phonetic {
+		return nil
+	}
+	lang := strings.ToLower(strings.Split(vars.APIConfig.STT.Language, "-")[0])
+	if lang == "" {
+		lang = "en"
+	}
+	return phoneticEncoders[lang]
+}
+
+// splits text into lowercase words. han characters are a word each, since chinese has no spaces
+func tokenize(text string) []string {
+	var tokens []string
+	var word []rune
+	flush := func() {
+		if len(word) > 0 {
+			tokens = append(tokens, string(word))
+			word = nil
+		}
+	}
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			flush()
+			tokens = append(tokens, string(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == '\'':
+			word = append(word, r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
+
+func levenshtein(a, b []rune) int {
+	if len(a) == 0 {
+		return len(b)
+	}
+	if len(b) == 0 {
+		return len(a)
+	}
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j] + 1
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// 1 for the same string, 0 for nothing in common
+func similarity(a, b string) float64 {
+	ra, rb := []rune(a), []rune(b)
+	longest := len(ra)
+	if len(rb) > longest {
+		longest = len(rb)
+	}
+	if longest == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(ra, rb))/float64(longest)
+}
+
+func wordSimilarity(a, b string, phonetic func(string) string) float64 {
+	sim := similarity(a, b)
+	if phonetic != nil && sim < phoneticSimilarity && phonetic(a) != "" && phonetic(a) == phonetic(b) {
+		sim = phoneticSimilarity
+	}
+	return sim
+}
+
+// true if phrase appears in text as a run of whole words
+func containsWords(text []string, phrase []string) bool {
+	if len(phrase) == 0 || len(phrase) > len(text) {
+		return false
+	}
+	for i := 0; i+len(phrase) <= len(text); i++ {
+		matched := true
+		for j := range phrase {
+			if text[i+j] != phrase[j] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// how well the keyphrase's words are covered by the transcript's words, 0-1
+func tokenOverlap(text []string, phrase []string, phonetic func(string) string) float64 {
+	if len(phrase) == 0 || len(text) == 0 {
+		return 0
+	}
+	var total float64
+	for _, p := range phrase {
+		var best float64
+		for _, t := range text {
+			if sim := wordSimilarity(t, p, phonetic); sim > best {
+				best = sim
+			}
+		}
+		if best >= minWordSimilarity {
+			total += best
+		}
+	}
+	return total / float64(len(phrase))
+}
+
+func scorePhrase(text string, textTokens []string, phrase string, exactOnly bool, phonetic func(string) string) float64 {
+	phraseTokens := tokenize(phrase)
+	if len(phraseTokens) == 0 {
+		return 0
+	}
+	if strings.Join(textTokens, " ") == strings.Join(phraseTokens, " ") {
+		return scoreExact
+	}
+	if exactOnly {
+		return 0
+	}
+	if containsWords(textTokens, phraseTokens) {
+		return scoreWords
+	}
+	score := tokenOverlap(textTokens, phraseTokens, phonetic)
+	if whole := similarity(strings.Join(textTokens, " "), strings.Join(phraseTokens, " ")); whole > score {
+		score = whole
+	}
+	score *= fuzzyWeight
+	if score < scoreSubstring && strings.Contains(text, strings.ToLower(strings.TrimSpace(phrase))) {
+		return scoreSubstring
+	}
+	return score
+}
+
+// rankIntents scores the transcript against every intent and custom intent, best first.
+// each intent is in the list once, with its best keyphrase
+func rankIntents(voiceText string, intents []vars.JsonIntent) []intentScore {
+	text := strings.ToLower(voiceText)
+	textTokens := tokenize(text)
+	phonetic := phoneticEncoder()
+	var scores []intentScore
+	for _, b := range intents {
+		best := intentScore{Intent: b.Name}
+		for _, c := range b.Keyphrases {
+			score := scorePhrase(text, textTokens, c, b.RequireExactMatch, phonetic)
+			if score > best.Score || (score == best.Score && len(c) > len(best.Phrase)) {
+				best.Score = score
+				best.Phrase = c
+			}
+		}
+		if best.Score > 0 {
+			scores = append(scores, best)
+		}
+	}
+	if vars.CustomIntentsExist {
+		customIntents := vars.GetCustomIntents()
+		for i := range customIntents {
+			c := &customIntents[i]
+			best := intentScore{Intent: c.Name, Custom: c}
+			for _, v := range c.Utterances {
+				if strings.HasPrefix(strings.TrimSpace(v), "*") {
+					continue
+				}
+				score := scorePhrase(text, textTokens, v, false, phonetic)
+				if score > best.Score || (score == best.Score && len(v) > len(best.Phrase)) {
+					best.Score = score
+					best.Phrase = v
+				}
+			}
+			if best.Score > 0 {
+				scores = append(scores, best)
+			}
+		}
+	}
+	// ties go to the longer (more specific) keyphrase, then file order
+	sort.SliceStable(scores, func(i, j int) bool {
+		if scores[i].Score != scores[j].Score {
+			return scores[i].Score > scores[j].Score
+		}
+		return len(scores[i].Phrase) > len(scores[j].Phrase)
+	})
+	return scores
+}
+
+// scoredIntentHandler is the fuzzy version of the custom intent + keyphrase matching in ProcessTextAll
+func scoredIntentHandler(req interface{}, voiceText string, intents []vars.JsonIntent, isOpus bool, botSerial string) bool {
+	voiceText = strings.ToLower(voiceText)
+	// system intents with * get everything, like they do without scoring
+	if vars.CustomIntentsExist {
+		for _, c := range vars.GetCustomIntents() {
+			if !c.IsSystemIntent {
+				continue
+			}
+			for _, v := range c.Utterances {
+				if strings.HasPrefix(strings.TrimSpace(v), "*") {
+					if runCustomIntent(req, c, voiceText, botSerial) {
+						return true
+					}
+					break
+				}
+			}
+		}
+	}
+	scores := rankIntents(voiceText, intents)
+	if len(scores) > 3 {
+		logger.Println("Bot " + botSerial + " Intent scores: " + fmt.Sprint(scores[:3]))
+	} else {
+		logger.Println("Bot " + botSerial + " Intent scores: " + fmt.Sprint(scores))
+	}
+	threshold := matchThreshold()
+	for _, s := range scores {
+		if s.Score < threshold {
+			break
+		}
+		if s.Custom != nil {
+			// a system intent can decline, then the next best is tried
+			if runCustomIntent(req, *s.Custom, voiceText, botSerial) {
+				return true
+			}
+			continue
+		}
+		logger.Println("Bot " + botSerial + " Scored match for intent " + s.String())
+		if isOpus {
+			ParamChecker(req, s.Intent, voiceText, botSerial)
+		} else {
+			prehistoricParamChecker(req, s.Intent, voiceText)
+		}
+		return true
+	}
+	logger.Println("Bot " + botSerial + " No intent scored above " + fmt.Sprint(threshold))
+	return false
+}
+
+// american soundex. good enough to catch "whether"/"weather", "for"/"four"
+func soundex(word string) string {
+	codes := map[rune]byte{
+		'b': '1', 'f': '1', 'p': '1', 'v': '1',
+		'c': '2', 'g': '2', 'j': '2', 'k': '2', 'q': '2', 's': '2', 'x': '2', 'z': '2',
+		'd': '3', 't': '3',
+		'l': '4',
+		'm': '5', 'n': '5',
+		'r': '6',
+	}
+	var out []byte
+	var last byte
+	for i, r := range strings.ToLower(word) {
+		if r < 'a' || r > 'z' {
+			continue
+		}
+		code := codes[r]
+		if len(out) == 0 {
+			out = append(out, byte(unicode.ToUpper(r)))
+			last = code
+			continue
+		}
+		if code != 0 && code != last {
+			out = append(out, code)
+		}
+		// h and w don't separate letters with the same code, vowels do
+		if r != 'h' && r != 'w' || i == 0 {
+			last = code
+		}
+		if len(out) == 4 {
+			break
+		}
+	}
+	if len(out) == 0 {
+		return ""
+	}
+	for len(out) < 4 {
+		out = append(out, '0')
+	}
+	return string(out)
+}
@@ -0,0 +1,142 @@
+package wirepod_ttr
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/logger"
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
+)
+
+// fills intent parameters from the slots defined for an intent in intent-data/<lang>.json.
+// intents without slots still go through the code in intentparam.go
+
+var numberPattern = regexp.MustCompile(`\d+`)
+
+// slotIntent returns the intent from the loaded intent list if it has slots
+func slotIntent(intent string) (vars.JsonIntent, bool) {
+	for _, b := range vars.GetIntentList() {
+		if b.Name == intent && len(b.Slots) > 0 {
+			return b, true
+		}
+	}
+	return vars.JsonIntent{}, false
+}
+
+// words lowercases text and puts it between single spaces, without punctuation, so whole words
+// and phrases can be looked for with strings.Contains. han characters are words of their own,
+// since chinese isn't written with spaces
+func words(text string) string {
+	tokens := tokenize(text)
+	if len(tokens) == 0 {
+		return ""
+	}
+	return " " + strings.Join(tokens, " ") + " "
+}
+
+// findSlotValue returns the value whose longest synonym is in the text as whole words, so "medium low"
+// beats "low" and "loudness" isn't "loud"
+func findSlotValue(slot vars.JsonSlot, text string) (string, bool) {
+	var value string
+	var longest int
+	text = words(text)
+	for _, v := range slot.Values {
+		for _, synonym := range v.Synonyms {
+			synonym = words(synonym)
+			if synonym != "" && len(synonym) > longest && strings.Contains(text, synonym) {
+				value = v.Value
+				longest = len(synonym)
+			}
+		}
+	}
+	return value, longest > 0
+}
+
+// textAfter returns what comes after the first of the markers to appear in the text
+func textAfter(markers []string, text string) (string, bool) {
+	index := -1
+	var marker string
+	for _, m := range markers {
+		if m == "" {
+			continue
+		}
+		if i := strings.Index(text, m); i != -1 && (index == -1 || i < index) {
+			index = i
+			marker = m
+		}
+	}
+	if index == -1 {
+		return "", false
+	}
+	value := strings.Trim(text[index+len(marker):], " .,!?")
+	return value, value != ""
+}
+
+func extractSlot(slot vars.JsonSlot, text string) (string, bool) {
+	switch slot.Type {
+	case "enum", "color":
+		return findSlotValue(slot, text)
+	case "number":
+		if num := numberPattern.FindString(text); num != "" {
+			return num, true
+		}
+		for _, word := range strings.Fields(text) {
+			if num := mapTextToNumber(word); num != 0 {
+				return strconv.Itoa(num), true
+			}
+		}
+		return "", false
+	case "duration":
+		secs := words2num(text)
+		return secs, secs != "0"
+	case "location", "text":
+		return textAfter(slot.After, text)
+	}
+	logger.Println("Unknown slot type " + slot.Type + " for slot " + slot.Name)
+	return "", false
+}
+
+// extractSlots returns the intent to send and its parameters. isParam is false if a required slot wasn't found.
+// legacy is for 0.10 robots. answered has slots which were already filled by a follow-up question
+func extractSlots(intent vars.JsonIntent, speechText string, legacy bool, answered map[string]string) (newIntent string, intentParams map[string]string, isParam bool) {
+	speechText = strings.ToLower(speechText)
+	newIntent = intent.Name
+	if intent.SendAs != "" {
+		newIntent = intent.SendAs
+	}
+	if legacy && intent.LegacyName != "" {
+		newIntent = intent.LegacyName
+	}
+	intentParams = make(map[string]string)
+	for _, slot := range intent.Slots {
+		value, found := answered[slot.Name]
+		if !found {
+			value, found = extractSlot(slot, speechText)
+		}
+		if !found {
+			if slot.Required {
+				logger.Println("No " + slot.Name + " parsed from speech, sending " + intent.Name + " without parameters")
+				return intent.Name, map[string]string{"": ""}, false
+			}
+			value = slot.Default
+		}
+		logger.Println("Slot " + slot.Name + " parsed from speech: `" + value + "`")
+		intentParams[slot.Name] = value
+	}
+	return newIntent, intentParams, true
+}
+
+// resolveSlot looks up an already-extracted slot (rhino) in an intent's slot values
+func resolveSlot(intent string, slotName string, text string) (string, bool) {
+	b, ok := slotIntent(intent)
+	if !ok {
+		return "", false
+	}
+	for _, slot := range b.Slots {
+		if slot.Name == slotName {
+			return extractSlot(slot, strings.ToLower(text))
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,89 @@
+package wirepod_ttr
+
+import (
+	"os"
+	"testing"
+
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
+)
+
+func loadSlot(t *testing.T, lang, name string) vars.JsonSlot {
+	t.Helper()
+	jsonBytes, err := os.ReadFile("../../../intent-data/" + lang + ".json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	intents, err := vars.ParseIntents(jsonBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, intent := range intents {
+		for _, slot := range intent.Slots {
+			if slot.Name == name {
+				return slot
+			}
+		}
+	}
+	t.Fatal("no " + name + " slot in " + lang + ".json")
+	return vars.JsonSlot{}
+}
+
+type slotTest struct {
+	text  string
+	value string
+	found bool
+}
+
+func checkSlotValues(t *testing.T, slot vars.JsonSlot, tests []slotTest) {
+	t.Helper()
+	for _, test := range tests {
+		value, found := findSlotValue(slot, test.text)
+		if value != test.value || found != test.found {
+			t.Errorf("findSlotValue(%q) = %q, %v, want %q, %v", test.text, value, found, test.value, test.found)
+		}
+	}
+}
+
+func TestFindSlotValueVolume(t *testing.T) {
+	checkSlotValues(t, loadSlot(t, "en-US", "volume_level"), []slotTest{
+		{"set the volume to low", "VOLUME_1", true},
+		{"set loudness to low", "VOLUME_1", true},
+		{"volume quiet", "VOLUME_1", true},
+		{"turn the volume off", "VOLUME_1", true},
+		{"volume medium low", "VOLUME_2", true},
+		{"set volume to medium", "VOLUME_3", true},
+		{"volume normal please", "VOLUME_3", true},
+		{"volume medium high", "VOLUME_4", true},
+		{"Set the volume to HIGH.", "VOLUME_5", true},
+		{"make it loud", "VOLUME_5", true},
+		{"louder volume", "", false},
+		{"change the loudness", "", false},
+	})
+}
+
+func TestFindSlotValueChinese(t *testing.T) {
+	checkSlotValues(t, loadSlot(t, "zh-CN", "volume_level"), []slotTest{
+		{"音量调到高", "VOLUME_5", true},
+		{"音量调到中低", "VOLUME_2", true},
+		{"音量中高", "VOLUME_4", true},
+		{"把音量调成正常。", "VOLUME_3", true},
+		{"静音", "VOLUME_1", true},
+		{"音量", "", false},
+	})
+	checkSlotValues(t, loadSlot(t, "zh-CN", "eye_color"), []slotTest{
+		{"把眼睛变成紫色", "COLOR_PURPLE", true},
+		{"眼睛换成天蓝", "COLOR_BLUE", true},
+		{"眼睛颜色", "", false},
+	})
+	checkSlotValues(t, loadSlot(t, "zh-CN", "entity_photo_selfie"), []slotTest{
+		{"给我拍张照片", "photo_selfie", true},
+		{"拍张照片", "", false},
+	})
+}
+
+func TestFindSlotValueSynonymCase(t *testing.T) {
+	slot := vars.JsonSlot{Values: []vars.JsonSlotValue{{Value: "VOLUME_1", Synonyms: []string{"Niets"}}}}
+	if value, _ := findSlotValue(slot, "volume niets"); value != "VOLUME_1" {
+		t.Errorf("findSlotValue with an uppercase synonym = %q, want VOLUME_1", value)
+	}
+}
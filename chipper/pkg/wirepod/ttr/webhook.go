@@ -0,0 +1,195 @@
+package wirepod_ttr
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/vars"
+)
+
+// webhook custom intents. the body (and url/header values) are templates filled with webhookData
+
+const defaultWebhookTimeout = 5
+
+// responses bigger than this are cut off before being parsed
+const maxWebhookResponse = 1 << 20
+
+type webhookData struct {
+	SpeechText string
+	ESN        string
+	Locale     string
+	// the custom intent's name, and the intent it sends
+	Name   string
+	Intent string
+	// custom intent parameters
+	Slots map[string]string
+}
+
+type webhookResult struct {
+	Status int
+	Say    string
+	Intent string
+}
+
+var webhookFuncs = template.FuncMap{
+	// {{json .SpeechText}} gives a quoted and escaped JSON string
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	// for the url: {{urlquery .SpeechText}} in a query string, {{pathescape .ESN}} in the path.
+	// values put in without them can change what the url points to
+	"urlquery": func(v interface{}) string {
+		return url.QueryEscape(fmt.Sprint(v))
+	},
+	"pathescape": func(v interface{}) string {
+		return url.PathEscape(fmt.Sprint(v))
+	},
+}
+
+func executeWebhookTemplate(name string, text string, data webhookData) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+	tmpl, err := template.New(name).Funcs(webhookFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// ValidateWebhook checks a webhook before it is saved
+func ValidateWebhook(hook *vars.Webhook) error {
+	if hook == nil || hook.URL == "" {
+		return nil
+	}
+	if !strings.HasPrefix(hook.URL, "http://") && !strings.HasPrefix(hook.URL, "https://") {
+		return errors.New("webhook url must start with http:// or https://")
+	}
+	if hook.Timeout < 0 {
+		return errors.New("webhook timeout must be positive")
+	}
+	for name, text := range map[string]string{"url": hook.URL, "body": hook.Body} {
+		if _, err := template.New(name).Funcs(webhookFuncs).Parse(text); err != nil {
+			return errors.New("webhook " + name + " template: " + err.Error())
+		}
+	}
+	for key, value := range hook.Headers {
+		if _, err := template.New(key).Funcs(webhookFuncs).Parse(value); err != nil {
+			return errors.New("webhook header " + key + " template: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// jsonPath finds a dot-separated path ("data.items.0.text") in decoded JSON
+func jsonPath(v interface{}, path string) (string, bool) {
+	if path == "" {
+		return "", false
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			next, ok := node[key]
+			if !ok {
+				return "", false
+			}
+			v = next
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", false
+			}
+			v = node[i]
+		default:
+			return "", false
+		}
+	}
+	switch value := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return value, value != ""
+	case map[string]interface{}, []interface{}:
+		b, _ := json.Marshal(value)
+		return string(b), true
+	}
+	return fmt.Sprint(v), true
+}
+
+func runWebhook(hook *vars.Webhook, data webhookData) (webhookResult, error) {
+	var result webhookResult
+	url, err := executeWebhookTemplate("url", hook.URL, data)
+	if err != nil {
+		return result, err
+	}
+	body, err := executeWebhookTemplate("body", hook.Body, data)
+	if err != nil {
+		return result, err
+	}
+	method := strings.ToUpper(hook.Method)
+	if method == "" {
+		method = http.MethodPost
+	}
+	timeout := hook.Timeout
+	if timeout == 0 {
+		timeout = defaultWebhookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	var bodyReader io.Reader
+	if body != "" {
+		bodyReader = strings.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bodyReader)
+	if err != nil {
+		return result, err
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for key, value := range hook.Headers {
+		value, err := executeWebhookTemplate(key, value, data)
+		if err != nil {
+			return result, err
+		}
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	result.Status = resp.StatusCode
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, maxWebhookResponse))
+	if err != nil {
+		return result, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return result, errors.New("webhook returned " + resp.Status + ": " + strings.TrimSpace(string(respBody)))
+	}
+	if hook.Response.Say == "" && hook.Response.Intent == "" {
+		return result, nil
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(respBody, &decoded); err != nil {
+		return result, errors.New("webhook response isn't JSON: " + err.Error())
+	}
+	result.Say, _ = jsonPath(decoded, hook.Response.Say)
+	result.Intent, _ = jsonPath(decoded, hook.Response.Intent)
+	return result, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"strconv"
+
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/pluginapi"
+)
+
+// Example plugin for plugin API version 2. "roll a dice", "roll a 20 sided dice"
+
+var APIVersion = pluginapi.Version
+var Plugin pluginapi.Plugin = rollDice{}
+
+type rollDice struct{}
+
+func (rollDice) Name() string {
+	return "Roll Dice"
+}
+
+func (rollDice) Utterances() []pluginapi.Utterance {
+	return []pluginapi.Utterance{
+		{Regex: `roll (?:a |an )?(?P<sides>\d+)[ -]sided`, Priority: 1},
+		{Text: "roll a dice"},
+		{Text: "roll a die"},
+	}
+}
+
+func (rollDice) Handle(ctx context.Context, req pluginapi.Request) (pluginapi.Result, error) {
+	sides := 6
+	if s, err := strconv.Atoi(req.Slots["sides"]); err == nil && s > 1 {
+		sides = s
+	}
+	roll := rand.Intn(sides) + 1
+	req.Log("rolled " + strconv.Itoa(roll) + " on a " + strconv.Itoa(sides) + " sided dice")
+	return pluginapi.Result{SpokenText: "You rolled a " + strconv.Itoa(roll)}, nil
+}
@@ -2,9 +2,9 @@
 package config
 
 // 导入必要的包
-
-// 用于格式化输出
-// 用于操作系统相关的操作，如文件操作
+import (
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/llm" // 大模型接口
+)
 
 // 定义Milvus数据库配置的结构体
 type MalvusCfg struct {
@@ -18,6 +18,15 @@ type Cfg struct {
 	openAibaseURL        string // OpenAI 中转地址
 	openWeatherMapAPIKey string // OpenWeatherMap API的密钥
 	malvusCfg MalvusCfg // Milvus数据库的配置
+
+	// 对话用的大模型: openai, together, custom, ollama 或 anthropic
+	llmProvider string
+	llmModel    string
+	// 为空时使用上面的OpenAI密钥和中转地址
+	llmAPIKey  string
+	llmBaseURL string
+	// 大模型出错时依次尝试
+	llmFallbacks []llm.Config
 }
 
 // New函数用于创建并初始化Cfg配置实例
@@ -34,6 +43,8 @@ func New() Cfg {
 		openAibaseURL:        "your/v1",   //中转地址
 		openWeatherMapAPIKey: "your",      // OpenWeatherMap API的密钥
 		malvusCfg:            malvusCfg,   // 设置Milvus配置
+		llmProvider:          "openai",
+		llmModel:             "gpt-4-turbo",
 	}
 
 	return cfg // 返回配置实例
@@ -52,6 +63,23 @@ func (c Cfg) OpenWeatherMapAPIKey() string {
 	return c.openWeatherMapAPIKey
 }
 
+// LLMConfigs方法返回对话大模型的配置，后面是备用的
+func (c Cfg) LLMConfigs() []llm.Config {
+	primary := llm.Config{
+		Type:     c.llmProvider,
+		Key:      c.llmAPIKey,
+		Endpoint: c.llmBaseURL,
+		Model:    c.llmModel,
+	}
+	if primary.Key == "" {
+		primary.Key = c.openAiAPIKey
+	}
+	if primary.Endpoint == "" {
+		primary.Endpoint = c.openAibaseURL
+	}
+	return append([]llm.Config{primary}, c.llmFallbacks...)
+}
+
 // MalvusApiEndpoint方法返回Milvus API终端的地址
 func (c Cfg) MalvusApiEndpoint() string {
 	return c.malvusCfg.apiEndpoint
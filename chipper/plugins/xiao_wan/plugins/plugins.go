@@ -2,20 +2,27 @@ package plugins
 
 // 导入必要的包
 import (
+	"context"       // 用于插件程序调用超时
 	"encoding/json" // 用于JSON处理
 	"fmt"           // 用于格式化输出
 	"os"            // 提供操作系统函数，用于文件路径操作等
 	"path/filepath" // 用于文件路径操作
 	"plugin"        // 支持从共享库动态加载代码
 	"runtime"
+	"sync"
+	"time"
 
 	"github.com/sashabaranov/go-openai"                                        // OpenAI GPT库
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/pluginhost"                 // 独立进程插件
 	config "github.com/wangergou2023/xiao_wan/chipper/plugins/xiao_wan/config" // 配置包
 )
 
 // 已加载插件的映射，键为插件ID，值为插件实例
 var loadedPlugins = make(map[string]Plugin)
 
+// 保护loadedPlugins，重新加载时整体替换
+var loadedPluginsMu sync.RWMutex
+
 // Plugin接口定义了所有插件必须实现的方法
 type Plugin interface {
 	Init(cfg config.Cfg, openaiClient *openai.Client) error // 初始化插件
@@ -25,70 +32,98 @@ type Plugin interface {
 	Execute(string) (string, error)                         // 执行插件逻辑
 }
 
+// 插件程序执行函数的超时时间
+const pluginProgramTimeout = 30 * time.Second
+
 // PluginResponse结构体用于封装插件执行的响应
 type PluginResponse struct {
 	Error  string `json:"error,omitempty"`  // 错误信息，如果有的话
 	Result string `json:"result,omitempty"` // 成功执行的结果
 }
 
-// LoadPlugins函数加载指定目录下的所有插件
-func LoadPlugins(cfg config.Cfg, openaiClient *openai.Client) error {
-	loadedPlugins = make(map[string]Plugin) // 重新初始化插件映射
-
+// CompiledDir函数返回存放编译后插件的目录
+func CompiledDir() (string, error) {
 	// 获取当前函数的执行文件路径
 	_, filename, _, ok := runtime.Caller(0)
 	if !ok {
 		fmt.Println("Error: Cannot get current file path")
-		return fmt.Errorf("cannot get current file path")
+		return "", fmt.Errorf("cannot get current file path")
 	}
 
 	// 打印当前文件所在目录
 	fmt.Println("Current file path:", filename)
 	fmt.Println("Current directory:", filepath.Dir(filename))
 
+	return filepath.Dir(filename) + "/compiled", nil
+}
+
+// loadPluginDir函数加载目录下的所有插件，返回新的插件映射
+func loadPluginDir(cfg config.Cfg, openaiClient *openai.Client) (map[string]Plugin, error) {
+	dir, err := CompiledDir()
+	if err != nil {
+		return nil, err
+	}
+
 	// 从"compiled"目录读取插件文件
-	files, err := os.ReadDir(filepath.Dir(filename) + "/compiled")
+	files, err := os.ReadDir(dir)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// 遍历文件，加载.so文件作为插件
+	newPlugins := make(map[string]Plugin)
 	for _, file := range files {
 		if filepath.Ext(file.Name()) == ".so" {
 			fmt.Println("Loading plugin: ", file.Name())
-			err := loadSinglePlugin(filepath.Dir(filename)+"/compiled/"+file.Name(), cfg, openaiClient)
+			p, err := loadSinglePlugin(dir+"/"+file.Name(), cfg, openaiClient)
 			if err != nil {
-				return err
+				return nil, err
 			}
+			newPlugins[p.ID()] = p // 将插件加入映射
 		}
 	}
 
+	return newPlugins, nil
+}
+
+// LoadPlugins函数加载指定目录下的所有插件
+// 任何插件加载失败时，保留原来的插件
+func LoadPlugins(cfg config.Cfg, openaiClient *openai.Client) error {
+	newPlugins, err := loadPluginDir(cfg, openaiClient)
+	if err != nil {
+		return err
+	}
+
+	// 一次性替换，正在执行的请求继续使用旧的插件
+	loadedPluginsMu.Lock()
+	loadedPlugins = newPlugins
+	loadedPluginsMu.Unlock()
 	return nil
 }
 
 // loadSinglePlugin函数加载单个插件
-func loadSinglePlugin(path string, cfg config.Cfg, openaiClient *openai.Client) error {
+// 注意：Go不能卸载.so插件，再次打开同一路径会得到已加载的版本
+func loadSinglePlugin(path string, cfg config.Cfg, openaiClient *openai.Client) (Plugin, error) {
 	plugin, err := plugin.Open(path) // 打开插件文件
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	symbol, err := plugin.Lookup("Plugin") // 查找插件中的"Plugin"符号
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// 类型断言确认找到的符号类型正确
 	p, ok := symbol.(*Plugin)
 	if !ok {
-		return fmt.Errorf("unexpected type from module symbol: %s", path)
+		return nil, fmt.Errorf("unexpected type from module symbol: %s", path)
 	}
 	err = (*p).Init(cfg, openaiClient) // 初始化插件
 	if err != nil {
-		return err
+		return nil, err
 	}
-	loadedPlugins[(*p).ID()] = *p // 将插件加入映射
-	return nil
+	return *p, nil
 }
 
 // CallPlugin函数通过ID查找插件并执行
@@ -99,6 +134,19 @@ func CallPlugin(id string, jsonInput string) (string, error) {
 
 	plugin, exists := GetPluginByID(id) // 查找插件
 	if !exists {
+		// 不是.so插件时，查找提供该函数的插件程序
+		if p, ok := pluginhost.FindFunction(id); ok {
+			ctx, cancel := context.WithTimeout(context.Background(), pluginProgramTimeout)
+			defer cancel()
+			result, err := p.Call(ctx, id, jsonInput)
+			if err != nil {
+				response.Error = err.Error()
+			} else {
+				response.Result = result
+			}
+			jsonResponse, err := json.Marshal(response)
+			return string(jsonResponse), err
+		}
 		response.Error = fmt.Sprintf("plugin with ID %s not found", id)
 		jsonResponse, err := json.Marshal(response)
 		return string(jsonResponse), err
@@ -123,18 +171,25 @@ func CallPlugin(id string, jsonInput string) (string, error) {
 
 // IsPluginLoaded函数检查指定ID的插件是否已加载
 func IsPluginLoaded(id string) bool {
-	_, exists := loadedPlugins[id]
+	if _, exists := GetPluginByID(id); exists {
+		return true
+	}
+	_, exists := pluginhost.FindFunction(id) // 插件程序提供的函数
 	return exists
 }
 
 // GetPluginByID函数通过ID获取插件
 func GetPluginByID(id string) (Plugin, bool) {
+	loadedPluginsMu.RLock()
+	defer loadedPluginsMu.RUnlock()
 	p, exists := loadedPlugins[id]
 	return p, exists
 }
 
 // GetAllPlugins函数返回所有已加载的插件
 func GetAllPlugins() map[string]Plugin {
+	loadedPluginsMu.RLock()
+	defer loadedPluginsMu.RUnlock()
 	return loadedPlugins
 }
 
@@ -143,10 +198,13 @@ func GenerateOpenAIFunctionsDefinition() []openai.FunctionDefinition {
 	var definitions []openai.FunctionDefinition
 
 	// 遍历已加载的插件，收集它们的函数定义
-	for _, plugin := range loadedPlugins {
+	for _, plugin := range GetAllPlugins() {
 		def := plugin.FunctionDefinition()
 		definitions = append(definitions, def)
 	}
 
+	// 加上插件程序提供的函数
+	definitions = append(definitions, pluginhost.Functions()...)
+
 	return definitions
 }
@@ -9,17 +9,19 @@ import (
 	"strconv" // 用于字符串和其他类型的转换
 
 	// 用于控制屏幕输出
-	openai "github.com/sashabaranov/go-openai" // OpenAI GPT的Go客户端
+	openai "github.com/sashabaranov/go-openai" // OpenAI GPT的Go客户端，插件还在用
 	// 聊天界面
+	"github.com/wangergou2023/xiao_wan/chipper/pkg/llm"                          // 大模型接口
 	config "github.com/wangergou2023/xiao_wan/chipper/plugins/xiao_wan/config"   // 配置
 	plugins "github.com/wangergou2023/xiao_wan/chipper/plugins/xiao_wan/plugins" // 插件系统
 )
 
-// 定义助手结构体，包括配置、OpenAI客户端、函数定义和聊天界面
+// 定义助手结构体，包括配置、OpenAI客户端和对话用的大模型
+// 函数定义在每次请求时生成，重新加载的插件立即生效
 type Xiao_wan struct {
-	cfg                 config.Cfg
-	Client              *openai.Client
-	functionDefinitions []openai.FunctionDefinition
+	cfg    config.Cfg
+	Client *openai.Client
+	LLM    llm.Provider
 }
 
 // 定义系统提示信息，指导如何使用AI助手
@@ -39,11 +41,11 @@ var SystemPrompt = `
 `
 
 // 定义全局变量conversation，用于存储对话历史
-var conversation []openai.ChatCompletionMessage
+var conversation []llm.Message
 
 // appendMessage函数用于向对话中添加消息
 func appendMessage(role string, message string, name string) {
-	conversation = append(conversation, openai.ChatCompletionMessage{
+	conversation = append(conversation, llm.Message{
 		Role:    role,
 		Content: message,
 		Name:    name,
@@ -52,14 +54,14 @@ func appendMessage(role string, message string, name string) {
 
 // resetConversation函数用于清空对话历史
 func resetConversation() {
-	conversation = []openai.ChatCompletionMessage{}
+	conversation = []llm.Message{}
 }
 
 // restartConversation函数用于重置并重新开始对话
 func (xiao_wan Xiao_wan) restartConversation() {
 	resetConversation() // 重置对话
 
-	appendMessage(openai.ChatMessageRoleSystem, SystemPrompt, "") // 添加系统提示到对话
+	appendMessage(llm.RoleSystem, SystemPrompt, "") // 添加系统提示到对话
 
 	response, err := xiao_wan.sendMessage() // 发送系统提示到OpenAI并获取回复
 
@@ -67,13 +69,13 @@ func (xiao_wan Xiao_wan) restartConversation() {
 		fmt.Printf("Error sending system prompt to OpenAI: %v\n", err)
 	}
 
-	appendMessage(openai.ChatMessageRoleAssistant, response, "") // 添加助手回复到对话
+	appendMessage(llm.RoleAssistant, response, "") // 添加助手回复到对话
 }
 
 // Message函数用于处理用户消息
 func (xiao_wan Xiao_wan) Message(message string) (string, error) {
 
-	appendMessage(openai.ChatMessageRoleUser, message, "") // 添加用户消息到对话
+	appendMessage(llm.RoleUser, message, "") // 添加用户消息到对话
 
 	response, err := xiao_wan.sendMessage() // 发送消息到OpenAI并获取回复
 
@@ -81,71 +83,100 @@ func (xiao_wan Xiao_wan) Message(message string) (string, error) {
 		return "", err
 	}
 
-	appendMessage(openai.ChatMessageRoleAssistant, response, "") // 添加助手回复到对话
+	appendMessage(llm.RoleAssistant, response, "") // 添加助手回复到对话
 	fmt.Printf("xiao wan:%s\r\n", response)
 
 	return response, nil
 }
 
-// sendMessage函数用于向OpenAI发送请求并获取回复
+// sendMessage函数用于向大模型发送请求并获取回复
 func (xiao_wan Xiao_wan) sendMessage() (string, error) {
-	resp, err := xiao_wan.sendRequestToOpenAI() // 发送请求到OpenAI
+	resp, err := xiao_wan.sendRequest() // 发送请求到大模型
 
 	if err != nil {
 		return "", err
 	}
 
-	if resp.Choices[0].FinishReason == openai.FinishReasonFunctionCall {
-		responseContent, err := xiao_wan.handleFunctionCall(resp) // 处理函数调用
+	if len(resp.ToolCalls) > 0 {
+		responseContent, err := xiao_wan.handleToolCalls(resp) // 处理工具调用
 		if err != nil {
 			return "", err
 		}
 		return responseContent, nil
 	}
 
-	return resp.Choices[0].Message.Content, nil
+	return resp.Content, nil
 }
 
-// handleFunctionCall函数用于处理OpenAI回复中的函数调用
-func (xiao_wan Xiao_wan) handleFunctionCall(resp *openai.ChatCompletionResponse) (string, error) {
-
-	funcName := resp.Choices[0].Message.FunctionCall.Name // 获取函数名称
-	fmt.Println("获取函数名称", funcName)
-	ok := plugins.IsPluginLoaded(funcName) // 检查是否加载了相应插件
-	fmt.Println("检查是否加载了相应插件", ok)
-	if !ok {
-		return "", fmt.Errorf("no plugin loaded with name %v", funcName)
+// handleToolCalls函数用于处理大模型回复中的工具调用
+func (xiao_wan Xiao_wan) handleToolCalls(resp llm.Response) (string, error) {
+	// 工具调用要和结果一起加进对话，每个调用都要有结果，不然之后的请求会被拒绝
+	messages := []llm.Message{{
+		Role:      llm.RoleAssistant,
+		Content:   resp.Content,
+		ToolCalls: resp.ToolCalls,
+	}}
+
+	for _, call := range resp.ToolCalls {
+		funcName := call.Name // 获取函数名称
+		fmt.Println("获取函数名称", funcName)
+		ok := plugins.IsPluginLoaded(funcName) // 检查是否加载了相应插件
+		fmt.Println("检查是否加载了相应插件", ok)
+
+		var jsonResponse string
+		if !ok {
+			jsonResponse = fmt.Sprintf("error: no plugin loaded with name %v", funcName)
+		} else if result, err := plugins.CallPlugin(funcName, call.Arguments); err != nil { // 调用插件
+			fmt.Println("Error calling plugin: ", err)
+			jsonResponse = "error: " + err.Error() // 把错误告诉大模型
+		} else {
+			jsonResponse = result
+		}
+		messages = append(messages, llm.Message{
+			Role:       llm.RoleTool,
+			Content:    jsonResponse,
+			Name:       funcName,
+			ToolCallID: call.ID,
+		})
 	}
+	conversation = append(conversation, messages...)
 
-	jsonResponse, err := plugins.CallPlugin(resp.Choices[0].Message.FunctionCall.Name, resp.Choices[0].Message.FunctionCall.Arguments) // 调用插件
-
+	resp, err := xiao_wan.sendRequest() // 发送请求到大模型
 	if err != nil {
 		return "", err
 	}
-	appendMessage(openai.ChatMessageRoleFunction, resp.Choices[0].Message.Content, funcName)
-	appendMessage(openai.ChatMessageRoleFunction, jsonResponse, "functionName")
 
-	resp, err = xiao_wan.sendRequestToOpenAI() // 发送请求到OpenAI
-	if err != nil {
-		return "", err
+	if len(resp.ToolCalls) > 0 {
+		return xiao_wan.handleToolCalls(resp) // 递归处理工具调用
 	}
 
-	if resp.Choices[0].FinishReason == openai.FinishReasonFunctionCall {
-		return xiao_wan.handleFunctionCall(resp) // 递归处理函数调用
-	}
+	return resp.Content, nil
+}
 
-	return resp.Choices[0].Message.Content, nil
+// tools函数把插件的函数定义转换成大模型的工具
+func tools() []llm.Tool {
+	var tools []llm.Tool
+	for _, def := range plugins.GenerateOpenAIFunctionsDefinition() {
+		tools = append(tools, llm.Tool{
+			Name:        def.Name,
+			Description: def.Description,
+			Parameters:  def.Parameters,
+		})
+	}
+	return tools
 }
 
-// sendRequestToOpenAI函数用于向OpenAI发送请求
-func (xiao_wan Xiao_wan) sendRequestToOpenAI() (*openai.ChatCompletionResponse, error) {
-	resp, err := xiao_wan.Client.CreateChatCompletion(
+// sendRequest函数用于向大模型发送请求
+func (xiao_wan Xiao_wan) sendRequest() (llm.Response, error) {
+	if xiao_wan.LLM == nil {
+		return llm.Response{}, fmt.Errorf("no LLM configured")
+	}
+	resp, err := llm.Chat(
 		context.Background(),
-		openai.ChatCompletionRequest{
-			Model:        openai.GPT4Turbo,
-			Messages:     conversation,
-			Functions:    xiao_wan.functionDefinitions,
-			FunctionCall: "auto",
+		xiao_wan.LLM,
+		llm.Request{
+			Messages: conversation,
+			Tools:    tools(),
 		},
 	)
 
@@ -153,7 +184,7 @@ func (xiao_wan Xiao_wan) sendRequestToOpenAI() (*openai.ChatCompletionResponse,
 		xiao_wan.openaiError(err) // 处理OpenAI错误
 		fmt.Println("Error: ", err)
 	}
-	return &resp, err
+	return resp, err
 }
 
 // Start函数用于启动助手
@@ -162,10 +193,16 @@ func Start(cfg config.Cfg, openaiClient *openai.Client) Xiao_wan {
 		fmt.Printf("Error loading plugins: %v", err)
 	}
 	fmt.Println("Plugins loaded successfully")
+	provider, err := llm.NewChain(cfg.LLMConfigs()...)
+	if err != nil {
+		fmt.Printf("Error setting up the LLM: %v\n", err)
+	} else {
+		fmt.Println("Using LLM " + provider.Name())
+	}
 	xiao_wan := Xiao_wan{
-		cfg:                 cfg,
-		Client:              openaiClient,
-		functionDefinitions: plugins.GenerateOpenAIFunctionsDefinition(),
+		cfg:    cfg,
+		Client: openaiClient,
+		LLM:    provider,
 	}
 
 	xiao_wan.restartConversation()
@@ -175,6 +212,14 @@ func Start(cfg config.Cfg, openaiClient *openai.Client) Xiao_wan {
 
 }
 
+// ReloadPlugins函数重新加载插件，失败时保留原来的插件
+func (xiao_wan Xiao_wan) ReloadPlugins() error {
+	if xiao_wan.Client == nil {
+		return fmt.Errorf("xiao wan isn't started")
+	}
+	return plugins.LoadPlugins(xiao_wan.cfg, xiao_wan.Client)
+}
+
 // OpenAIError结构体用于封装OpenAI错误
 type OpenAIError struct {
 	StatusCode int
@@ -81,6 +81,11 @@ function editFormCreate() {
     .then((intents) => {
       const intent = intents[intentNumber];
       if (intent) {
+        const execOpts = intent.execoptions || { timeout: 10, dir: "", env: [], maxoutput: 65536, user: "", async: false };
+        if (!execOpts.env) {
+          execOpts.env = [];
+        }
+        const hook = intent.webhook || { url: "", method: "POST", headers: {}, body: "", timeout: 5, response: { say: "", intent: "" } };
         const form = document.createElement("form");
         form.id = "editIntentForm";
         form.name = "editIntentForm";
@@ -99,7 +104,28 @@ function editFormCreate() {
           <label for="paramvalue">Param Value:<br><input type="text" id="paramvalue" value="${intent.params.paramvalue}"></label><br>
           <label for="exec">Exec:<br><input type="text" id="exec" value="${intent.exec}"></label><br>
           <label for="execargs">Exec Args:<br><input type="text" id="execargs" value="${intent.execargs.join(",")}"></label><br>
-          <label for="luascript">Lua code to run:</label><br><textarea id="luascript">${intent.luascript}</textarea>
+          <label for="execTimeout">Exec timeout in seconds:<br><input type="number" id="execTimeout" value="${execOpts.timeout}"></label><br>
+          <label for="execDir">Exec working directory:<br><input type="text" id="execDir" value="${execOpts.dir}"></label><br>
+          <label for="execEnv">Exec environment variables:<br><input type="text" id="execEnv" value="${execOpts.env.join(",")}"></label><br>
+          <label for="execMaxOutput">Exec max output in bytes:<br><input type="number" id="execMaxOutput" value="${execOpts.maxoutput}"></label><br>
+          <label for="execUser">Run exec as user:<br><input type="text" id="execUser" value="${execOpts.user}"></label><br>
+          <label for="execAsync"><input type="checkbox" id="execAsync" ${execOpts.async ? "checked" : ""}> Don't wait for exec before sending the intent</label><br>
+          <label for="luascript">Lua code to run:</label><br><textarea id="luascript">${intent.luascript}</textarea><br>
+          <label for="sound">Sound to play:<br><select id="sound">${["none"]
+            .concat(soundNames)
+            .map(
+              (name) =>
+                `<option value="${name}" ${name === (intent.sound || "none") ? "selected" : ""
+                }>${name}</option>`
+            )
+            .join("")}</select></label><br>
+          <label for="webhookUrl">Webhook URL ({{urlquery .SpeechText}}, {{pathescape .ESN}}):<br><input type="text" id="webhookUrl" value="${hook.url}"></label><br>
+          <label for="webhookMethod">Webhook method:<br><input type="text" id="webhookMethod" value="${hook.method}"></label><br>
+          <label for="webhookHeaders">Webhook headers (JSON):<br><input type="text" id="webhookHeaders" value='${JSON.stringify(hook.headers || {})}'></label><br>
+          <label for="webhookBody">Webhook body template:</label><br><textarea id="webhookBody">${hook.body}</textarea><br>
+          <label for="webhookTimeout">Webhook timeout in seconds:<br><input type="number" id="webhookTimeout" value="${hook.timeout}"></label><br>
+          <label for="webhookSay">Response field to say:<br><input type="text" id="webhookSay" value="${hook.response.say}"></label><br>
+          <label for="webhookIntent">Response field with the intent to send:<br><input type="text" id="webhookIntent" value="${hook.response.intent}"></label><br>
           <button onclick="editIntent(${intentNumber})">Submit</button>
         `;
         //form.querySelector("#submit").onclick = () => editIntent(intentNumber);
@@ -125,8 +151,14 @@ function editIntent(intentNumber) {
     },
     exec: getE("exec").value,
     execargs: getE("execargs").value.split(","),
+    execoptions: execOptionsFromForm("execTimeout", "execDir", "execEnv", "execMaxOutput", "execUser", "execAsync"),
     luascript: getE("luascript").value,
+    sound: getE("sound").value,
+    webhook: webhookFromForm("webhookUrl", "webhookMethod", "webhookHeaders", "webhookBody", "webhookTimeout", "webhookSay", "webhookIntent"),
   };
+  if (data.webhook === null) {
+    return;
+  }
 
   fetch("/api/edit_custom_intent", {
     method: "POST",
@@ -163,6 +195,42 @@ function deleteSelectedIntent() {
     });
 }
 
+function execOptionsFromForm(timeoutId, dirId, envId, maxOutputId, userId, asyncId) {
+  return {
+    timeout: parseInt(getE(timeoutId).value) || 0,
+    dir: getE(dirId).value.trim(),
+    env: getE(envId).value.split(",").map((name) => name.trim()).filter((name) => name !== ""),
+    maxoutput: parseInt(getE(maxOutputId).value) || 0,
+    user: getE(userId).value.trim(),
+    async: getE(asyncId).checked,
+  };
+}
+
+// null if the headers aren't valid JSON
+function webhookFromForm(urlId, methodId, headersId, bodyId, timeoutId, sayId, intentId) {
+  let headers = {};
+  const headersText = getE(headersId).value.trim();
+  if (headersText) {
+    try {
+      headers = JSON.parse(headersText);
+    } catch (e) {
+      alert("Webhook headers must be a JSON object, like {\"Authorization\": \"Bearer abc\"}");
+      return null;
+    }
+  }
+  return {
+    url: getE(urlId).value.trim(),
+    method: getE(methodId).value,
+    headers: headers,
+    body: getE(bodyId).value,
+    timeout: parseInt(getE(timeoutId).value) || 0,
+    response: {
+      say: getE(sayId).value.trim(),
+      intent: getE(intentId).value.trim(),
+    },
+  };
+}
+
 function sendIntentAdd() {
   const form = getE("intentAddForm");
   const data = {
@@ -176,8 +244,14 @@ function sendIntentAdd() {
     },
     exec: form.elements["execAdd"].value,
     execargs: form.elements["execAddArgs"].value.split(","),
+    execoptions: execOptionsFromForm("execTimeoutAdd", "execDirAdd", "execEnvAdd", "execMaxOutputAdd", "execUserAdd", "execAsyncAdd"),
     luascript: form.elements["luaAdd"].value,
+    sound: form.elements["soundAdd"].value,
+    webhook: webhookFromForm("webhookUrlAdd", "webhookMethodAdd", "webhookHeadersAdd", "webhookBodyAdd", "webhookTimeoutAdd", "webhookSayAdd", "webhookIntentAdd"),
   };
+  if (data.webhook === null) {
+    return;
+  }
   if (!data.name || !data.description || !data.utterances) {
     displayMessage("addIntentStatus", "A required input is missing. You need a name, description, and utterances.");
     alert("A required input is missing. You need a name, description, and utterances.")
@@ -202,6 +276,74 @@ function sendIntentAdd() {
     });
 }
 
+var soundNames = [];
+
+function updateSounds() {
+  fetch("/api/get_sounds")
+    .then((response) => response.json())
+    .then((sounds) => {
+      soundNames = sounds.map((sound) => sound.name);
+      const select = getE("soundAdd");
+      select.innerHTML = "";
+      ["", ...soundNames].forEach((name) => {
+        const option = document.createElement("option");
+        option.value = name;
+        option.text = name || "none";
+        select.appendChild(option);
+      });
+      const list = getE("soundList");
+      list.innerHTML = "";
+      if (sounds.length === 0) {
+        list.innerHTML = "<p>The sound library is empty.</p>";
+        return;
+      }
+      sounds.forEach((sound) => {
+        const row = document.createElement("div");
+        const label = document.createElement("span");
+        label.textContent = `${sound.name} (${sound.file}, ${Math.ceil(sound.size / 1024)} KB) `;
+        const button = document.createElement("button");
+        button.textContent = "Delete";
+        button.onclick = () => deleteSound(sound.name);
+        row.appendChild(label);
+        row.appendChild(button);
+        list.appendChild(row);
+      });
+    });
+}
+
+function uploadSound() {
+  const file = getE("soundFile").files[0];
+  if (!file) {
+    displayMessage("soundStatus", "Choose a file first.");
+    return;
+  }
+  const data = new FormData();
+  data.append("sound", file);
+  displayMessage("soundStatus", "Uploading...");
+  fetch("/api/upload_sound", {
+    method: "POST",
+    body: data,
+  })
+    .then((response) => response.text())
+    .then((response) => {
+      displayMessage("soundStatus", response);
+      getE("soundFile").value = "";
+      updateSounds();
+    });
+}
+
+function deleteSound(name) {
+  if (!confirm(`Delete the sound ${name}?`)) {
+    return;
+  }
+  fetch("/api/delete_sound?name=" + encodeURIComponent(name))
+    .then((response) => response.text())
+    .then((response) => {
+      displayMessage("soundStatus", response);
+      updateSounds();
+    });
+}
+
 function checkWeather() {
   getE("apiKeySpan").style.display = getE("weatherProvider").value ? "block" : "none";
 }
@@ -266,7 +408,7 @@ function checkKG() {
       getE("togetherInput").style.display = "block";
       getE("saveChatInput").style.display = "block";
       getE("llmCommandInput").style.display = "block";
-    } else if (provider === "custom") {
+    } else if (provider === "custom" || provider === "ollama" || provider === "anthropic") {
       getE("intentGraphInput").style.display = "block";
       getE("customAIInput").style.display = "block";
       getE("saveChatInput").style.display = "block";
@@ -300,7 +442,7 @@ function sendKGAPIKey() {
     data.commands_enable = getE("commandYes").checked
     data.openai_voice = getE("openaiVoice").value
     data.openai_voice_with_english = getE("voiceEnglishYes").checked
-  } else if (provider === "custom") {
+  } else if (provider === "custom" || provider === "ollama" || provider === "anthropic") {
     data.key = getE("customKey").value;
     data.model = getE("customModel").value;
     data.openai_prompt = getE("customAIPrompt").value;
@@ -334,6 +476,77 @@ function sendKGAPIKey() {
       displayMessage("addKGProviderAPIStatus", response);
       alert(response);
     });
+  if (data.save_chat) {
+    sendHistorySettings();
+  }
+}
+
+function sendHistorySettings() {
+  fetch("/api/set_history_settings", {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/json",
+    },
+    body: JSON.stringify({
+      retention_days: parseInt(getE("historyRetention").value) || 0,
+      context_tokens: parseInt(getE("historyContextTokens").value) || 0,
+      summarize: getE("historySummarize").checked,
+    }),
+  });
+}
+
+function updateHistorySettings() {
+  fetch("/api/get_history_settings")
+    .then((response) => response.json())
+    .then((data) => {
+      getE("historyRetention").value = data.retention_days;
+      getE("historyContextTokens").value = data.context_tokens;
+      getE("historySummarize").checked = data.summarize;
+    });
+}
+
+function checkTTS() {
+  const engine = getE("ttsEngine").value;
+  getE("ttsSettings").style.display = engine ? "block" : "none";
+  getE("ttsPathInput").style.display = engine === "piper" || engine === "espeak" ? "block" : "none";
+  getE("ttsAPIInput").style.display = engine === "openai" || engine === "custom" ? "block" : "none";
+}
+
+function sendTTSSettings() {
+  fetch("/api/set_tts", {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/json",
+    },
+    body: JSON.stringify({
+      engine: getE("ttsEngine").value,
+      path: getE("ttsPath").value.trim(),
+      key: getE("ttsKey").value.trim(),
+      endpoint: getE("ttsEndpoint").value.trim(),
+      model: getE("ttsModel").value.trim(),
+      voice: getE("ttsVoice").value.trim(),
+      with_english: getE("ttsWithEnglish").checked,
+    }),
+  })
+    .then((response) => response.text())
+    .then((response) => {
+      displayMessage("ttsStatus", response);
+    });
+}
+
+function updateTTSSettings() {
+  fetch("/api/get_tts")
+    .then((response) => response.json())
+    .then((data) => {
+      getE("ttsEngine").value = data.engine;
+      getE("ttsPath").value = data.path;
+      getE("ttsKey").value = data.key;
+      getE("ttsEndpoint").value = data.endpoint;
+      getE("ttsModel").value = data.model;
+      getE("ttsVoice").value = data.voice;
+      getE("ttsWithEnglish").checked = data.with_english;
+      checkTTS();
+    });
 }
 
 function deleteSavedChats() {
@@ -366,7 +579,7 @@ function updateKGAPI() {
         getE("commandYes").checked = data.commands_enable
         getE("intentyes").checked = data.intentgraph
         getE("saveChatYes").checked = data.save_chat
-      } else if (data.provider === "custom") {
+      } else if (data.provider === "custom" || data.provider === "ollama" || data.provider === "anthropic") {
         getE("customKey").value = data.key;
         getE("customModel").value = data.model;
         getE("customAIPrompt").value = data.openai_prompt;
@@ -380,6 +593,7 @@ function updateKGAPI() {
       }
       checkKG();
     });
+  updateHistorySettings();
 }
 
 function setSTTLanguage() {
@@ -406,6 +620,41 @@ function setSTTLanguage() {
     });
 }
 
+function updateSTTEngines() {
+  fetch("/api/get_stt_engines")
+    .then((response) => response.json())
+    .then((parsed) => {
+      const select = getE("sttEngineSelection");
+      select.innerHTML = "";
+      parsed.engines.forEach((engine) => {
+        const option = document.createElement("option");
+        option.value = engine.name;
+        option.text = engine.name;
+        select.appendChild(option);
+      });
+      select.value = parsed.current;
+    });
+}
+
+function setSTTService() {
+  const data = { provider: getE("sttEngineSelection").value };
+
+  displayMessage("sttEngineStatus", "Switching...");
+
+  fetch("/api/set_stt_service", {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/json",
+    },
+    body: JSON.stringify(data),
+  })
+    .then((response) => response.text())
+    .then((response) => {
+      displayMessage("sttEngineStatus", response);
+      showLanguage();
+    });
+}
+
 function updateSTTLanguageDownload() {
 
   const interval = setInterval(() => {
@@ -566,13 +815,15 @@ function checkUpdate() {
 
 function showLanguage() {
   toggleVisibility(["section-weather", "section-restart", "section-kg", "section-language"], "section-language", "icon-Language");
+  updateSTTEngines();
   fetch("/api/get_stt_info")
     .then((response) => response.json())
     .then((parsed) => {
       if (parsed.provider !== "vosk" && parsed.provider !== "whisper.cpp") {
-        displayError("languageStatus", `To set the STT language, the provider must be Vosk or Whisper. The current one is '${parsed.sttProvider}'.`);
+        displayError("languageStatus", `To set the STT language, the provider must be Vosk or Whisper. The current one is '${parsed.provider}'.`);
         getE("languageSelectionDiv").style.display = "none";
       } else {
+        getE("languageStatus").innerHTML = "";
         getE("languageSelectionDiv").style.display = "block";
         getE("languageSelection").value = parsed.language;
       }
@@ -210,6 +210,175 @@ function sendTimeZone() {
   };
 }
 
+function getVADSettings() {
+  fetch("/api/get_vad_settings?esn=" + esn)
+    .then((response) => response.json())
+    .then((vad) => {
+      document.getElementById("vadCustom").checked = vad.custom;
+      document.getElementById("vadAdaptive").checked = vad.adaptive;
+      document.getElementById("vadMode").value = vad.mode;
+      document.getElementById("vadSilence").value = vad.silence_ms;
+      document.getElementById("vadMinSpeech").value = vad.min_speech_ms;
+      document.getElementById("vadMaxUtterance").value = vad.max_utterance_ms;
+      document.getElementById("vadGain").value = vad.gain;
+      document.getElementById("vadPostGain").value = vad.post_gain;
+    });
+}
+
+function sendVADSettings() {
+  const vad = {
+    custom: document.getElementById("vadCustom").checked,
+    adaptive: document.getElementById("vadAdaptive").checked,
+    mode: parseInt(document.getElementById("vadMode").value),
+    silence_ms: parseInt(document.getElementById("vadSilence").value),
+    min_speech_ms: parseInt(document.getElementById("vadMinSpeech").value),
+    max_utterance_ms: parseInt(document.getElementById("vadMaxUtterance").value),
+    gain: parseFloat(document.getElementById("vadGain").value),
+    post_gain: parseFloat(document.getElementById("vadPostGain").value),
+  };
+  fetch("/api/set_vad_settings?esn=" + esn, {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/json",
+    },
+    body: JSON.stringify(vad),
+  })
+    .then((response) => response.text())
+    .then((response) => {
+      document.getElementById("vadStatus").innerHTML = "";
+      const p = document.createElement("p");
+      p.textContent = response;
+      document.getElementById("vadStatus").appendChild(p);
+    });
+}
+
+function getPersona() {
+  fetch("/api/get_persona?esn=" + esn)
+    .then((response) => response.json())
+    .then((persona) => {
+      document.getElementById("personaRobotName").value = persona.robot_name;
+      document.getElementById("personaPrompt").value = persona.prompt;
+      document.getElementById("personaProvider").value = persona.provider;
+      document.getElementById("personaKey").value = persona.key;
+      document.getElementById("personaEndpoint").value = persona.endpoint;
+      document.getElementById("personaModel").value = persona.model;
+      document.getElementById("personaTemperature").value = persona.temperature;
+      document.getElementById("personaMaxTokens").value = persona.max_tokens;
+      document.getElementById("personaLanguage").value = persona.language;
+      document.getElementById("personaVoice").value = persona.voice;
+      document.getElementById("personaDisableCommands").checked = persona.disable_commands;
+      document.getElementById("personaCommands").value = (persona.commands || []).join(", ");
+    });
+}
+
+function sendPersona() {
+  const persona = {
+    robot_name: document.getElementById("personaRobotName").value.trim(),
+    prompt: document.getElementById("personaPrompt").value.trim(),
+    provider: document.getElementById("personaProvider").value,
+    key: document.getElementById("personaKey").value.trim(),
+    endpoint: document.getElementById("personaEndpoint").value.trim(),
+    model: document.getElementById("personaModel").value.trim(),
+    temperature: parseFloat(document.getElementById("personaTemperature").value) || 0,
+    max_tokens: parseInt(document.getElementById("personaMaxTokens").value) || 0,
+    language: document.getElementById("personaLanguage").value.trim(),
+    voice: document.getElementById("personaVoice").value.trim(),
+    disable_commands: document.getElementById("personaDisableCommands").checked,
+    commands: document
+      .getElementById("personaCommands")
+      .value.split(",")
+      .map((c) => c.trim())
+      .filter((c) => c !== ""),
+  };
+  fetch("/api/set_persona?esn=" + esn, {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/json",
+    },
+    body: JSON.stringify(persona),
+  })
+    .then((response) => response.text())
+    .then((response) => {
+      document.getElementById("personaStatus").innerHTML = "";
+      const p = document.createElement("p");
+      p.textContent = response;
+      document.getElementById("personaStatus").appendChild(p);
+    });
+}
+
+function getChatHistory() {
+  const search = document.getElementById("historySearch").value.trim();
+  fetch("/api/get_chat_history?esn=" + esn + "&limit=200&search=" + encodeURIComponent(search))
+    .then((response) => response.json())
+    .then((messages) => {
+      const historyList = document.getElementById("historyList");
+      historyList.innerHTML = "";
+      if (!messages || messages.length === 0) {
+        const p = document.createElement("p");
+        p.textContent = search ? "Nothing found." : "No saved chats.";
+        historyList.appendChild(p);
+        return;
+      }
+      let session = 0;
+      for (const m of messages) {
+        if (m.session !== session) {
+          session = m.session;
+          const h = document.createElement("h3");
+          h.textContent = new Date(m.time).toLocaleString();
+          historyList.appendChild(h);
+        }
+        const p = document.createElement("p");
+        const who = document.createElement("b");
+        who.textContent = (m.role === "user" ? "You" : "Vector") + ": ";
+        p.appendChild(who);
+        p.appendChild(document.createTextNode(m.content));
+        historyList.appendChild(p);
+      }
+    });
+}
+
+function getChatSummary() {
+  fetch("/api/get_chat_summary?esn=" + esn)
+    .then((response) => response.json())
+    .then((summary) => {
+      document.getElementById("chatSummary").value = summary.summary;
+      document.getElementById("chatSummaryTime").textContent = summary.summary
+        ? "Last updated " + new Date(summary.time).toLocaleString()
+        : "";
+    });
+}
+
+function sendChatSummary() {
+  fetch("/api/set_chat_summary?esn=" + esn, {
+    method: "POST",
+    headers: {
+      "Content-Type": "application/json",
+    },
+    body: JSON.stringify({ summary: document.getElementById("chatSummary").value }),
+  })
+    .then((response) => response.text())
+    .then((response) => {
+      document.getElementById("summaryStatus").innerHTML = "";
+      const p = document.createElement("p");
+      p.textContent = response;
+      document.getElementById("summaryStatus").appendChild(p);
+      getChatSummary();
+    });
+}
+
+function exportChatHistory(format) {
+  window.location.href = "/api/export_chats?esn=" + esn + (format === "text" ? "&format=text" : "");
+}
+
+function deleteChatHistory() {
+  if (confirm("Delete all saved chats for this robot?")) {
+    fetch("/api/delete_chats?esn=" + esn).then(() => {
+      getChatHistory();
+      getChatSummary();
+    });
+  }
+}
+
 function sendCustomColor() {
   var pickerHue = colorPicker.color.hue;
   var pickerSat = colorPicker.color.saturation;